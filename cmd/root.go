@@ -1,21 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	cnabdriver "github.com/cnabio/cnab-go/driver"
 	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	"github.com/deislabs/cnab-azure-driver/pkg"
 	"github.com/deislabs/cnab-azure-driver/pkg/driver"
@@ -38,6 +44,85 @@ var versionCmd = &cobra.Command{
 	},
 }
 
+var planCmd = &cobra.Command{
+	Use:          "plan",
+	Short:        "Print the container group that would be created to run an operation",
+	Long:         `Reads an operation from stdin and prints the Azure container group that would be created to run it as JSON with secret values redacted, Azure is not called and no resources are created`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return PlanOperation(os.Stdout)
+	},
+}
+
+var gcOlderThan time.Duration
+var gcDryRun bool
+var gcForce bool
+var gcCmd = &cobra.Command{
+	Use:          "gc",
+	Short:        "Delete Azure resources left behind by the driver",
+	Long:         `Finds the resource groups, container groups and system MSI role assignments created by the driver in the subscription, reports their age and state and deletes those older than --older-than`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return CollectGarbage(os.Stdout, gcOlderThan, gcDryRun, gcForce)
+	},
+}
+
+var attachName string
+var attachResourceGroup string
+var attachCmd = &cobra.Command{
+	Use:          "attach",
+	Short:        "Resume an operation after the driver exited before it completed",
+	Long:         `Writes the logs of a container group that is still running an operation from where the driver left off, waits for it to complete, writes the outputs to CNAB_OUTPUT_DIR and cleans up the Azure resources as the driver would have`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return AttachOperation(attachName, attachResourceGroup)
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:          "status <id>",
+	Short:        "Print the state of a detached operation",
+	Long:         `Prints the state of the container group running an operation that was detached by setting CNAB_AZURE_DETACH`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return OperationStatus(os.Stdout, args[0])
+	},
+}
+
+var collectCmd = &cobra.Command{
+	Use:          "collect <id>",
+	Short:        "Get the outputs of a detached operation and clean up",
+	Long:         `Once the container group running a detached operation has completed, writes its logs, writes the outputs to CNAB_OUTPUT_DIR and cleans up the Azure resources as the driver would have. Fails without waiting if the container group is still running`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return CollectOperation(args[0])
+	},
+}
+
+var execName string
+var execResourceGroup string
+var execCmd = &cobra.Command{
+	Use:   "exec --name <container group> [--resource-group <resource group>] [-- <command>]",
+	Short: "Run a command in the invocation image container",
+	Long:  `Runs a command in the invocation image container of a running container group with an interactive terminal, use CNAB_AZURE_DEBUG_CONTAINER to keep the container running for debugging. The command defaults to /bin/sh, ACI does not support passing arguments to the command. If --resource-group is not set it is found from the record of an operation started on this machine`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("ACI does not support passing arguments to the command, got %d arguments: run %s and pass the arguments to it", len(args), driver.DefaultExecCommand)
+		}
+		return nil
+	},
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		command := driver.DefaultExecCommand
+		if len(args) > 0 {
+			command = args[0]
+		}
+		return ExecCommand(execName, execResourceGroup, command)
+	},
+}
+
 func runRootCmd(cmd *cobra.Command, args []string) error {
 	if handles {
 		HandlesImageTypes()
@@ -50,63 +135,262 @@ func runRootCmd(cmd *cobra.Command, args []string) error {
 
 // RunOperation a bundle operation using ACI Driver
 func RunOperation() error {
-	log.SetReportCaller(true)
-	fileName, err := getLogFileName()
+	writer, err := setUpLogging()
 	if err != nil {
-		return fmt.Errorf("Failed to get log filename: %v", err)
+		return err
 	}
 
-	writer, err := os.Create(fileName)
+	defer writer.Close()
+	op, err := GetOperation()
 	if err != nil {
-		return fmt.Errorf("Failed to create log filename:%s error: %v", fileName, err)
+		return logError(err)
 	}
 
-	defer writer.Close()
-	verboseSetting := os.Getenv("CNAB_AZURE_VERBOSE")
-	if len(verboseSetting) > 0 && strings.ToLower(verboseSetting) == "true" {
-		multiWriter := io.MultiWriter(os.Stdout, writer)
-		log.SetOutput(multiWriter)
-	} else {
-		log.SetOutput(writer)
+	outputDirName := os.Getenv("CNAB_OUTPUT_DIR")
+	if err := checkOutputDir(outputDirName, len(op.Outputs)); err != nil {
+		return logError(err)
 	}
 
-	log.SetLevel(log.DebugLevel)
+	acidriver, err := driver.NewACIDriver(Version())
+	if err != nil {
+		return logError(fmt.Errorf("Error creating ACI Driver: %v", err))
+	}
 
-	op, err := GetOperation()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopHandlingSignals := handleSignals(cancel)
+	defer stopHandlingSignals()
+
+	fmt.Printf("Running %s action on %s\n", op.Action, op.Installation)
+	opResult, err := acidriver.RunWithContext(ctx, op)
+	if err != nil {
+		return logError(fmt.Errorf("Running %s action on %s Error:%w", op.Action, op.Installation, err))
+	}
+
+	return logError(WriteOutputs(outputDirName, opResult))
+}
+
+// AttachOperation resumes an operation whose driver process exited before the container group completed and writes its outputs
+func AttachOperation(name string, resourceGroup string) error {
+	return resumeOperation("Attaching to", func(attacher driver.OperationAttacher) (*driver.OperationRecord, error) {
+		return attacher.GetOperationRecord(resourceGroup, name)
+	}, driver.OperationAttacher.Attach)
+}
+
+// CollectOperation writes the outputs of a detached operation once its container group has completed and cleans up
+func CollectOperation(id string) error {
+	return resumeOperation("Collecting", func(attacher driver.OperationAttacher) (*driver.OperationRecord, error) {
+		return attacher.GetOperationRecordByID(id)
+	}, driver.OperationAttacher.Collect)
+}
+
+// OperationStatus writes the state of the container group running a detached operation
+func OperationStatus(w io.Writer, id string) error {
+	logWriter, err := setUpLogging()
+	if err != nil {
+		return err
+	}
+
+	defer logWriter.Close()
+	attacher, err := driver.NewOperationAttacher(Version())
+	if err != nil {
+		return logError(fmt.Errorf("Error creating ACI Driver: %v", err))
+	}
+
+	record, err := attacher.GetOperationRecordByID(id)
+	if err != nil {
+		return logError(err)
+	}
+
+	state, err := attacher.GetOperationState(context.Background(), record)
+	if err != nil {
+		return logError(err)
+	}
+
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "ID:\t%s\n", record.ID)
+	fmt.Fprintf(writer, "Action:\t%s\n", record.Action)
+	fmt.Fprintf(writer, "Installation:\t%s\n", record.Installation)
+	fmt.Fprintf(writer, "Container Group:\t%s\n", record.ContainerGroupName)
+	fmt.Fprintf(writer, "Resource Group:\t%s\n", record.ResourceGroup)
+	fmt.Fprintf(writer, "State:\t%s\n", state)
+	fmt.Fprintf(writer, "Age:\t%s\n", time.Since(record.CreatedAt).Round(time.Second))
+	return logError(writer.Flush())
+}
+
+// resumeOperation resumes the operation in the record returned by getRecord and writes its outputs
+func resumeOperation(verb string, getRecord func(driver.OperationAttacher) (*driver.OperationRecord, error), resume func(driver.OperationAttacher, context.Context, *driver.OperationRecord) (cnabdriver.OperationResult, error)) error {
+	writer, err := setUpLogging()
+	if err != nil {
+		return err
+	}
+
+	defer writer.Close()
+	attacher, err := driver.NewOperationAttacher(Version())
+	if err != nil {
+		return logError(fmt.Errorf("Error creating ACI Driver: %v", err))
+	}
+
+	record, err := getRecord(attacher)
 	if err != nil {
 		return logError(err)
 	}
 
 	outputDirName := os.Getenv("CNAB_OUTPUT_DIR")
-	if len(op.Outputs) > 0 {
-		if len(outputDirName) == 0 {
-			return logError(fmt.Errorf("Bundle has %d outputs but CNAB_OUTPUT_DIR is not set", len(op.Outputs)))
-		}
+	if err := checkOutputDir(outputDirName, len(record.Outputs)); err != nil {
+		return logError(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopHandlingSignals := handleSignals(cancel)
+	defer stopHandlingSignals()
+
+	fmt.Printf("%s %s action on %s\n", verb, record.Action, record.Installation)
+	opResult, err := resume(attacher, ctx, record)
+	if err != nil {
+		return logError(fmt.Errorf("Running %s action on %s Error:%w", record.Action, record.Installation, err))
+	}
+
+	return logError(WriteOutputs(outputDirName, opResult))
+}
 
-		// The output directory should exist and be a directory
-		info, err := os.Stat(outputDirName)
+// ExecCommand runs a command in the invocation image container of a running container group, if stdin is a terminal it is put in raw mode so that the command controls it
+func ExecCommand(name string, resourceGroup string, command string) error {
+	writer, err := setUpLogging()
+	if err != nil {
+		return err
+	}
+
+	defer writer.Close()
+	executor, err := driver.NewContainerExecutor(Version())
+	if err != nil {
+		return logError(fmt.Errorf("Error creating ACI Driver: %v", err))
+	}
+
+	var terminal *driver.TerminalSize
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		if cols, rows, err := term.GetSize(stdin); err == nil {
+			terminal = &driver.TerminalSize{Rows: int32(rows), Cols: int32(cols)}
+		}
+		state, err := term.MakeRaw(stdin)
 		if err != nil {
-			return logError(fmt.Errorf("CNAB_OUTPUT_DIR: %s does not exist", outputDirName))
+			return logError(fmt.Errorf("Error setting terminal to raw mode: %v", err))
 		}
+		defer func() {
+			_ = term.Restore(stdin, state)
+		}()
+	}
 
-		if !info.IsDir() {
-			return logError(fmt.Errorf("CNAB_OUTPUT_DIR: %s is not a directory", outputDirName))
-		}
+	return logError(executor.Exec(context.Background(), resourceGroup, name, command, terminal, os.Stdin, os.Stdout))
+}
+
+// checkOutputDir checks that CNAB_OUTPUT_DIR is an existing directory if the operation has outputs
+func checkOutputDir(outputDirName string, outputCount int) error {
+	if outputCount == 0 {
+		return nil
+	}
 
+	if len(outputDirName) == 0 {
+		return fmt.Errorf("Bundle has %d outputs but CNAB_OUTPUT_DIR is not set", outputCount)
+	}
+
+	// The output directory should exist and be a directory
+	info, err := os.Stat(outputDirName)
+	if err != nil {
+		return fmt.Errorf("CNAB_OUTPUT_DIR: %s does not exist", outputDirName)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("CNAB_OUTPUT_DIR: %s is not a directory", outputDirName)
+	}
+
+	return nil
+}
+
+// PlanOperation writes the plan for a bundle operation using ACI Driver without creating any Azure resources
+func PlanOperation(w io.Writer) error {
+	op, err := GetOperation()
+	if err != nil {
+		return err
 	}
 
 	acidriver, err := driver.NewACIDriver(Version())
 	if err != nil {
-		return logError(fmt.Errorf("Error creating ACI Driver: %v", err))
+		return fmt.Errorf("Error creating ACI Driver: %v", err)
 	}
 
-	fmt.Printf("Running %s action on %s\n", op.Action, op.Installation)
-	opResult, err := acidriver.Run(op)
+	plan, err := acidriver.Plan(op)
 	if err != nil {
-		return logError(fmt.Errorf("Running %s action on %s Error:%v", op.Action, op.Installation, err))
+		return fmt.Errorf("Planning %s action on %s Error:%v", op.Action, op.Installation, err)
 	}
 
-	return logError(WriteOutputs(outputDirName, opResult))
+	return plan.Write(w)
+}
+
+// CollectGarbage deletes Azure resources created by the ACI Driver that are older than olderThan and writes a report of the resources found,
+// the resources of running container groups are only deleted if force is true
+func CollectGarbage(w io.Writer, olderThan time.Duration, dryRun bool, force bool) error {
+	logWriter, err := setUpLogging()
+	if err != nil {
+		return err
+	}
+
+	defer logWriter.Close()
+	collector, err := driver.NewGarbageCollector(Version())
+	if err != nil {
+		return logError(fmt.Errorf("Error creating garbage collector: %v", err))
+	}
+
+	garbage, err := collector.CollectGarbage(context.Background(), olderThan, dryRun, force)
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TYPE\tNAME\tRESOURCE GROUP\tSTATE\tAGE\tACTION")
+	for _, item := range garbage {
+		age := "unknown"
+		if !item.CreatedAt.IsZero() {
+			age = time.Since(item.CreatedAt).Round(time.Minute).String()
+		}
+		action := string(item.Action)
+		if item.Error != nil {
+			action = fmt.Sprintf("%s: %v", action, item.Error)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", item.Type, item.Name, item.ResourceGroup, item.State, age, action)
+	}
+	if flushErr := writer.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+
+	return logError(err)
+}
+
+// handleSignals cancels the operation when an interrupt or termination signal is received so that the driver can stop the container group and clean up,
+// a second signal exits immediately. The returned function stops signal handling.
+func handleSignals(cancel context.CancelFunc) func() {
+	signals := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Debug("Received signal: ", sig)
+			fmt.Fprintln(os.Stderr, "Cancelling operation, stopping the Container Group and cleaning up Azure resources. Interrupt again to exit immediately.")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			log.Debug("Received second signal exiting: ", sig)
+			fmt.Fprintln(os.Stderr, "Exiting without cleaning up Azure resources")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
 }
 
 // Version returns the version string
@@ -177,13 +461,66 @@ func GetOperation() (*cnabdriver.Operation, error) {
 func init() {
 	rootCmd.Flags().BoolVarP(&handles, "handles", "", false, "Checks if driver supports Invocation Image type being executed")
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(planCmd)
+	gcCmd.Flags().DurationVarP(&gcOlderThan, "older-than", "", 24*time.Hour, "Only delete resources created longer ago than this")
+	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "", false, "List the resources that would be deleted without deleting them")
+	gcCmd.Flags().BoolVarP(&gcForce, "force", "", false, "Delete the resources of container groups that are still running and resources kept by the never retention policy")
+	rootCmd.AddCommand(gcCmd)
+	attachCmd.Flags().StringVarP(&attachName, "name", "", "", "The name of the container group running the operation")
+	attachCmd.Flags().StringVarP(&attachResourceGroup, "resource-group", "", "", "The resource group of the container group running the operation")
+	_ = attachCmd.MarkFlagRequired("name")
+	_ = attachCmd.MarkFlagRequired("resource-group")
+	rootCmd.AddCommand(attachCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(collectCmd)
+	execCmd.Flags().StringVarP(&execName, "name", "", "", "The name of the container group to run the command in")
+	execCmd.Flags().StringVarP(&execResourceGroup, "resource-group", "", "", "The resource group of the container group, only needed if the operation was not started on this machine")
+	_ = execCmd.MarkFlagRequired("name")
+	rootCmd.AddCommand(execCmd)
 }
 
 // Execute runs the aci command driver
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the exit code of the invocation image if it failed so that the caller sees the same exit status as it would running the image locally
+func exitCode(err error) int {
+	var containerFailed *driver.ContainerFailedError
+	if errors.As(err, &containerFailed) && containerFailed.ExitCode != nil {
+		if code := int(*containerFailed.ExitCode); code > 0 && code < 256 {
+			return code
+		}
 	}
+
+	return 1
+}
+
+// setUpLogging sends log output to a new log file and to stdout if CNAB_AZURE_VERBOSE is true, the returned file should be closed when the command completes
+func setUpLogging() (io.Closer, error) {
+	log.SetReportCaller(true)
+	fileName, err := getLogFileName()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get log filename: %v", err)
+	}
+
+	writer, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create log filename:%s error: %v", fileName, err)
+	}
+
+	verboseSetting := os.Getenv("CNAB_AZURE_VERBOSE")
+	if len(verboseSetting) > 0 && strings.ToLower(verboseSetting) == "true" {
+		multiWriter := io.MultiWriter(os.Stdout, writer)
+		log.SetOutput(multiWriter)
+	} else {
+		log.SetOutput(writer)
+	}
+
+	log.SetLevel(log.DebugLevel)
+	return writer, nil
 }
 
 func getLogFileName() (string, error) {
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/cnabio/cnab-go/bundle"
 	cnabdriver "github.com/cnabio/cnab-go/driver"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/deislabs/cnab-azure-driver/pkg"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/pkg/driver"
+	"github.com/deislabs/cnab-azure-driver/test"
+	"github.com/deislabs/cnab-azure-driver/test/fakeazure"
 )
 
 func TestHandlesImageTypes(t *testing.T) {
@@ -103,6 +117,24 @@ func TestOutputHandling(t *testing.T) {
 	assert.EqualError(t, err, "Error creating ACI Driver: ACI Driver requires CNAB_AZURE_LOCATION environment variable or an existing Resource Group in CNAB_AZURE_RESOURCE_GROUP")
 }
 
+func TestHandleSignalsCancelsOperation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Sending interrupt signals is not supported on Windows")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopHandlingSignals := handleSignals(cancel)
+	defer stopHandlingSignals()
+	process, err := os.FindProcess(os.Getpid())
+	assert.NoError(t, err, "Error getting current process")
+	assert.NoError(t, process.Signal(os.Interrupt), "Error sending interrupt signal")
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected context to be cancelled after interrupt signal")
+	}
+}
+
 func getOutput(t *testing.T, f func()) string {
 	stdout := os.Stdout
 	defer func() { os.Stdout = stdout }()
@@ -168,3 +200,398 @@ func writeToStdInAndTest(content []byte, fn interface{}) (interface{}, error) {
 		return nil, errors.New("Unknown function type to test")
 	}
 }
+
+func TestRunOperationWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	testcases := []struct {
+		name     string
+		file     string
+		settings map[string]string
+		outputs  map[string]string
+	}{
+		{name: "operation", file: "operation-test.json"},
+		{name: "operation without outputs", file: "no-output-test.json"},
+		{name: "helloworld operation", file: "helloworld-aci-test.json", settings: map[string]string{"CNAB_AZURE_MSI_TYPE": "system"}},
+		{name: "dry run", file: "helloworld-aci-test.json", settings: map[string]string{"CNAB_AZURE_MSI_TYPE": "system", "CNAB_AZURE_DRY_RUN": "true"}},
+		{
+			name: "operation with outputs",
+			file: "output-test.json",
+			settings: map[string]string{
+				"CNAB_AZURE_STATE_FILESHARE":            "share",
+				"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+				"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  base64.StdEncoding.EncodeToString([]byte("key")),
+			},
+			outputs: map[string]string{
+				"test/test/outputs/output1": "OUTPUT_1",
+				"test/test/outputs/output2": "OUTPUT_2",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := fake.NewBackend(subscriptionID, "westeurope")
+			share := fake.NewFileShare()
+			backend.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				for k, v := range tc.outputs {
+					share.WriteFile(k, v)
+				}
+				return fake.ContainerRun{{State: "Succeeded", Logs: []string{"Hello World"}}}
+			}
+			server := fakeazure.NewServer(backend, share)
+			defer server.Close()
+			defer server.RedirectStorageRequests()()
+
+			test.UnSetDriverEnvironmentVars(t)
+			defer test.UnSetDriverEnvironmentVars(t)
+			settings := map[string]string{
+				"CNAB_AZURE_CLIENT_ID":       "client",
+				"CNAB_AZURE_CLIENT_SECRET":   "secret",
+				"CNAB_AZURE_TENANT_ID":       "tenant",
+				"CNAB_AZURE_SUBSCRIPTION_ID": subscriptionID,
+				"CNAB_AZURE_LOCATION":        "westeurope",
+			}
+			for k, v := range server.Environment() {
+				settings[k] = v
+			}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			for k, v := range settings {
+				os.Setenv(k, v)
+			}
+
+			outputDir, err := ioutil.TempDir("", "outputtest")
+			assert.NoError(t, err, "Error creating output directory")
+			defer os.RemoveAll(outputDir)
+			os.Setenv("CNAB_OUTPUT_DIR", outputDir)
+			defer os.Unsetenv("CNAB_OUTPUT_DIR")
+
+			bytes, err := ioutil.ReadFile(filepath.Join("testdata", tc.file))
+			assert.NoErrorf(t, err, "Error reading from testdata/%s", tc.file)
+			_, err = writeToStdInAndTest(bytes, RunOperation)
+			assert.NoErrorf(t, err, "Expected no error running testdata/%s. Got: %v", tc.file, err)
+
+			assert.Empty(t, backend.ContainerGroups, "Expected container groups to be deleted")
+			assert.Empty(t, backend.ResourceGroups, "Expected resource groups to be deleted")
+			assert.Empty(t, share.Files(), "Expected outputs to be deleted from the file share")
+			if tc.settings["CNAB_AZURE_DRY_RUN"] == "true" {
+				assert.Empty(t, backend.DeletedContainerGroups, "Expected no container groups to be created")
+				assert.Empty(t, backend.RoleAssignments, "Expected no role assignments to be created")
+			} else if tc.settings["CNAB_AZURE_MSI_TYPE"] == "system" {
+				assert.Len(t, backend.RoleAssignments, 1)
+			}
+			for k, v := range tc.outputs {
+				name := strings.TrimPrefix(k, "test/test/outputs/")
+				content, err := ioutil.ReadFile(filepath.Join(outputDir, "cnab", "app", "outputs", name))
+				assert.NoErrorf(t, err, "Error reading output %s", name)
+				assert.Equal(t, v, string(content))
+			}
+		})
+	}
+}
+
+func TestRunOperationFailureWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	backend.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{
+			State:        "Failed",
+			Logs:         []string{"Install failed"},
+			ExitCode:     to.Int32Ptr(2),
+			DetailStatus: "Error",
+			Events: []containerinstance.Event{
+				{Type: to.StringPtr("Warning"), Name: to.StringPtr("BackOff"), Message: to.StringPtr("Back-off restarting failed container")},
+			},
+		}}
+	}
+	server := fakeazure.NewServer(backend, fake.NewFileShare())
+	defer server.Close()
+
+	test.UnSetDriverEnvironmentVars(t)
+	defer test.UnSetDriverEnvironmentVars(t)
+	settings := map[string]string{
+		"CNAB_AZURE_CLIENT_ID":       "client",
+		"CNAB_AZURE_CLIENT_SECRET":   "secret",
+		"CNAB_AZURE_TENANT_ID":       "tenant",
+		"CNAB_AZURE_SUBSCRIPTION_ID": subscriptionID,
+		"CNAB_AZURE_LOCATION":        "westeurope",
+	}
+	for k, v := range server.Environment() {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		os.Setenv(k, v)
+	}
+
+	bytes, err := ioutil.ReadFile(filepath.Join("testdata", "no-output-test.json"))
+	assert.NoError(t, err, "Error reading from testdata/no-output-test.json")
+	_, err = writeToStdInAndTest(bytes, RunOperation)
+	assert.EqualError(t, err, "Running install action on test Error:running invocation instance using ACI failed: Unexpected Container Status:Failed exit code:2 detail status:Error events:BackOff: Back-off restarting failed container")
+	assert.Equal(t, 2, exitCode(err))
+	assert.Empty(t, backend.ContainerGroups, "Expected container groups to be deleted")
+}
+
+func TestExitCode(t *testing.T) {
+	testcases := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "an error that is not a container failure", err: errors.New("failed"), expected: 1},
+		{name: "a container failure with an exit code", err: fmt.Errorf("wrapped: %w", &driver.ContainerFailedError{State: "Failed", ExitCode: to.Int32Ptr(42)}), expected: 42},
+		{name: "a container failure without an exit code", err: &driver.ContainerFailedError{State: "Failed"}, expected: 1},
+		{name: "a container failure with an exit code of zero", err: &driver.ContainerFailedError{State: "Stopped", ExitCode: to.Int32Ptr(0)}, expected: 1},
+		{name: "a container failure with an exit code out of range", err: &driver.ContainerFailedError{State: "Failed", ExitCode: to.Int32Ptr(-1)}, expected: 1},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, exitCode(tc.err))
+		})
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	assert.NoError(t, execCmd.Args(execCmd, []string{}))
+	assert.NoError(t, execCmd.Args(execCmd, []string{"/bin/bash"}))
+	assert.EqualError(t, execCmd.Args(execCmd, []string{"ls", "-l"}), "ACI does not support passing arguments to the command, got 2 arguments: run /bin/sh and pass the arguments to it")
+}
+
+func TestPlanOperation(t *testing.T) {
+	test.UnSetDriverEnvironmentVars(t)
+	defer test.UnSetDriverEnvironmentVars(t)
+	settings := map[string]string{
+		"CNAB_AZURE_LOCATION":                   "westeurope",
+		"CNAB_AZURE_RESOURCE_GROUP":             "rg",
+		"CNAB_AZURE_NAME":                       "plan-test",
+		"CNAB_AZURE_STATE_FILESHARE":            "share",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "accountkey",
+	}
+	for k, v := range settings {
+		os.Setenv(k, v)
+	}
+
+	bytes, err := ioutil.ReadFile(filepath.Join("testdata", "output-test.json"))
+	assert.NoError(t, err, "Error reading from testdata/output-test.json")
+	var buffer strings.Builder
+	_, err = writeToStdInAndTest(bytes, func() error {
+		return PlanOperation(&buffer)
+	})
+	if !assert.NoErrorf(t, err, "Expected no error planning testdata/output-test.json. Got: %v", err) {
+		return
+	}
+
+	var plan driver.Plan
+	err = json.Unmarshal([]byte(buffer.String()), &plan)
+	assert.NoErrorf(t, err, "Expected plan to be JSON. Got: %s", buffer.String())
+	assert.Equal(t, "rg", plan.ResourceGroup)
+	assert.Equal(t, "plan-test", plan.ContainerGroupName)
+	assert.False(t, plan.CreateResourceGroup)
+	assert.NotNil(t, plan.ContainerGroup.ContainerGroupProperties)
+	assert.NotContains(t, buffer.String(), "accountkey")
+}
+
+func TestCollectGarbageWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	server := fakeazure.NewServer(backend, fake.NewFileShare())
+	defer server.Close()
+
+	test.UnSetDriverEnvironmentVars(t)
+	defer test.UnSetDriverEnvironmentVars(t)
+	settings := map[string]string{
+		"CNAB_AZURE_CLIENT_ID":        "client",
+		"CNAB_AZURE_CLIENT_SECRET":    "secret",
+		"CNAB_AZURE_TENANT_ID":        "tenant",
+		"CNAB_AZURE_SUBSCRIPTION_ID":  subscriptionID,
+		"CNAB_AZURE_LOCATION":         "westeurope",
+		"CNAB_AZURE_MSI_TYPE":         "system",
+		"CNAB_AZURE_DELETE_RESOURCES": "false",
+	}
+	for k, v := range server.Environment() {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		os.Setenv(k, v)
+	}
+
+	// Leave the resources for an operation behind
+	bytes, err := ioutil.ReadFile(filepath.Join("testdata", "helloworld-aci-test.json"))
+	assert.NoError(t, err, "Error reading from testdata/helloworld-aci-test.json")
+	_, err = writeToStdInAndTest(bytes, RunOperation)
+	if !assert.NoErrorf(t, err, "Expected no error running testdata/helloworld-aci-test.json. Got: %v", err) {
+		return
+	}
+	assert.Len(t, backend.ResourceGroups, 1)
+	assert.Len(t, backend.ContainerGroups, 1)
+	assert.Len(t, backend.RoleAssignments, 1)
+
+	var report strings.Builder
+	err = CollectGarbage(&report, time.Hour, true, false)
+	assert.NoErrorf(t, err, "Expected no error listing garbage. Got: %v", err)
+	assert.Equal(t, 4, strings.Count(report.String(), "\n"), "Expected a header and 3 resources. Got: %s", report.String())
+	assert.Equal(t, 3, strings.Count(report.String(), "kept"), "Expected resources newer than an hour to be kept. Got: %s", report.String())
+
+	// The resources were created with CNAB_AZURE_DELETE_RESOURCES set to false so they are only deleted when forced
+	report.Reset()
+	err = CollectGarbage(&report, 0, false, false)
+	assert.NoErrorf(t, err, "Expected no error collecting garbage. Got: %v", err)
+	assert.Equal(t, 3, strings.Count(report.String(), "kept by retention policy"), "Expected resources to be kept by their retention policy. Got: %s", report.String())
+	assert.Len(t, backend.ResourceGroups, 1)
+
+	report.Reset()
+	err = CollectGarbage(&report, 0, false, true)
+	assert.NoErrorf(t, err, "Expected no error collecting garbage. Got: %v", err)
+	assert.Contains(t, report.String(), "deleted with resource group", report.String())
+	assert.Empty(t, backend.ResourceGroups, "Expected resource groups to be deleted")
+	assert.Empty(t, backend.ContainerGroups, "Expected container groups to be deleted")
+	assert.Empty(t, backend.RoleAssignments, "Expected role assignments to be deleted")
+}
+
+func TestAttachOperationWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	share := fake.NewFileShare()
+	backend.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		share.WriteFile("test/test/outputs/output1", "OUTPUT_1")
+		return fake.ContainerRun{{State: "Succeeded", Logs: []string{"Hello", "World"}}}
+	}
+	server := fakeazure.NewServer(backend, share)
+	defer server.Close()
+	defer server.RedirectStorageRequests()()
+
+	test.UnSetDriverEnvironmentVars(t)
+	defer test.UnSetDriverEnvironmentVars(t)
+	home, err := ioutil.TempDir("", "home")
+	assert.NoError(t, err, "Error creating home directory")
+	defer os.RemoveAll(home)
+	outputDir, err := ioutil.TempDir("", "outputtest")
+	assert.NoError(t, err, "Error creating output directory")
+	defer os.RemoveAll(outputDir)
+	settings := map[string]string{
+		"HOME":                                  home,
+		"CNAB_OUTPUT_DIR":                       outputDir,
+		"CNAB_AZURE_CLIENT_ID":                  "client",
+		"CNAB_AZURE_CLIENT_SECRET":              "secret",
+		"CNAB_AZURE_TENANT_ID":                  "tenant",
+		"CNAB_AZURE_STATE_FILESHARE":            "share",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  base64.StdEncoding.EncodeToString([]byte("key")),
+	}
+	for k, v := range server.Environment() {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	// Leave a running container group and its operation record behind as the driver does when it exits before the operation completes
+	ctx := context.Background()
+	_, err = backend.CreateResourceGroup(ctx, subscriptionID, "rg", resources.Group{Location: to.StringPtr("westeurope")})
+	assert.NoError(t, err)
+	_, err = backend.CreateContainerGroup(ctx, subscriptionID, "rg", "aci", containerinstance.ContainerGroup{ContainerGroupProperties: &containerinstance.ContainerGroupProperties{}})
+	assert.NoError(t, err)
+	record := driver.OperationRecord{
+		SubscriptionID:          subscriptionID,
+		ResourceGroup:           "rg",
+		ContainerGroupName:      "aci",
+		DeleteResources:         true,
+		Installation:            "test",
+		Action:                  "install",
+		Outputs:                 map[string]string{"/cnab/app/outputs/output1": "output1"},
+		StateFileShare:          "share",
+		StateStorageAccountName: "account",
+		StatePath:               "test/test",
+		DeleteOutputs:           true,
+		LinesOutput:             1,
+	}
+	data, err := json.Marshal(record)
+	assert.NoError(t, err)
+	recordDir := filepath.Join(home, ".cnab-azure-driver", "operations")
+	assert.NoError(t, os.MkdirAll(recordDir, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(recordDir, "rg_aci.json"), data, 0600))
+
+	var attachErr error
+	output := getOutput(t, func() { attachErr = AttachOperation("aci", "rg") })
+	if !assert.NoErrorf(t, attachErr, "Expected no error attaching to operation. Got: %v", attachErr) {
+		return
+	}
+	assert.Contains(t, output, "World")
+	assert.NotContains(t, output, "Hello", "Expected the logs written before the driver exited not to be written again")
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, "cnab", "app", "outputs", "output1"))
+	assert.NoError(t, err, "Error reading output output1")
+	assert.Equal(t, "OUTPUT_1", string(content))
+	assert.Empty(t, backend.ContainerGroups, "Expected container groups to be deleted")
+	assert.Empty(t, share.Files(), "Expected outputs to be deleted from the file share")
+
+	err = AttachOperation("aci", "rg")
+	assert.EqualError(t, err, "No operation record found for container group aci in resource group rg, only operations started on this machine that did not complete can be attached to")
+}
+
+func TestDetachedOperationWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	backend.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{State: "Running", Logs: []string{"Hello"}}, {State: "Succeeded", Logs: []string{"World"}}}
+	}
+	server := fakeazure.NewServer(backend, fake.NewFileShare())
+	defer server.Close()
+
+	test.UnSetDriverEnvironmentVars(t)
+	defer test.UnSetDriverEnvironmentVars(t)
+	home, err := ioutil.TempDir("", "home")
+	assert.NoError(t, err, "Error creating home directory")
+	defer os.RemoveAll(home)
+	settings := map[string]string{
+		"HOME":                       home,
+		"CNAB_AZURE_CLIENT_ID":       "client",
+		"CNAB_AZURE_CLIENT_SECRET":   "secret",
+		"CNAB_AZURE_TENANT_ID":       "tenant",
+		"CNAB_AZURE_SUBSCRIPTION_ID": subscriptionID,
+		"CNAB_AZURE_LOCATION":        "westeurope",
+		"CNAB_AZURE_DETACH":          "true",
+	}
+	for k, v := range server.Environment() {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	bytes, err := ioutil.ReadFile(filepath.Join("testdata", "helloworld-aci-test.json"))
+	assert.NoError(t, err, "Error reading from testdata/helloworld-aci-test.json")
+	_, err = writeToStdInAndTest(bytes, RunOperation)
+	if !assert.NoErrorf(t, err, "Expected no error running testdata/helloworld-aci-test.json. Got: %v", err) {
+		return
+	}
+	assert.Len(t, backend.ContainerGroups, 1, "Expected the container group to be kept until the operation is collected")
+
+	records, err := ioutil.ReadDir(filepath.Join(home, ".cnab-azure-driver", "operations"))
+	if !assert.NoError(t, err) || !assert.Len(t, records, 1) {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(home, ".cnab-azure-driver", "operations", records[0].Name()))
+	assert.NoError(t, err)
+	var record driver.OperationRecord
+	assert.NoError(t, json.Unmarshal(data, &record))
+
+	var status strings.Builder
+	err = OperationStatus(&status, record.ID)
+	assert.NoErrorf(t, err, "Expected no error getting operation status. Got: %v", err)
+	assert.Contains(t, status.String(), record.ContainerGroupName)
+	assert.Regexp(t, "State: +(Running|Succeeded)", status.String())
+
+	var collectErr error
+	output := getOutput(t, func() { collectErr = CollectOperation(record.ID) })
+	assert.NoErrorf(t, collectErr, "Expected no error collecting operation. Got: %v", collectErr)
+	assert.Contains(t, output, "World")
+	assert.Empty(t, backend.ContainerGroups, "Expected container groups to be deleted")
+	assert.Empty(t, backend.ResourceGroups, "Expected resource groups to be deleted")
+
+	err = CollectOperation(record.ID)
+	assert.EqualError(t, err, fmt.Sprintf("No operation record found with ID %s", record.ID))
+}
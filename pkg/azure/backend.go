@@ -0,0 +1,416 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2022-07-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-11-01/subscriptions"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// Backend contains the Azure Resource Manager operations used by the driver
+type Backend interface {
+	// GetSubscription gets the details of a subscription
+	GetSubscription(ctx context.Context, subscriptionID string) (subscriptions.Subscription, error)
+	// ListSubscriptions lists the subscriptions available to the logged in account
+	ListSubscriptions(ctx context.Context) ([]subscriptions.Subscription, error)
+	// ListResourceGroups lists the resource groups in a subscription
+	ListResourceGroups(ctx context.Context, subscriptionID string) ([]resources.Group, error)
+	// GetResourceGroup gets a resource group
+	GetResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string) (resources.Group, error)
+	// CreateResourceGroup creates or updates a resource group
+	CreateResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string, group resources.Group) (resources.Group, error)
+	// UpdateResourceGroupTags replaces the tags of a resource group
+	UpdateResourceGroupTags(ctx context.Context, subscriptionID string, resourceGroupName string, tags map[string]*string) (resources.Group, error)
+	// DeleteResourceGroup deletes a resource group and waits for the deletion to complete
+	DeleteResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string) error
+	// GetProvider gets the details of a resource provider
+	GetProvider(ctx context.Context, subscriptionID string, resourceProviderNamespace string) (resources.Provider, error)
+	// ListContainerInstanceCapabilities lists the resource capabilities of ACI in a location
+	ListContainerInstanceCapabilities(ctx context.Context, subscriptionID string, location string) ([]containerinstance.Capabilities, error)
+	// CreateContainerGroup creates or updates a container group and waits for the operation to complete
+	CreateContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerGroup containerinstance.ContainerGroup) (containerinstance.ContainerGroup, error)
+	// ListContainerGroups lists the container groups in a subscription, the instance view of the container groups is not included
+	ListContainerGroups(ctx context.Context, subscriptionID string) ([]containerinstance.ContainerGroup, error)
+	// GetContainerGroup gets a container group
+	GetContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) (containerinstance.ContainerGroup, error)
+	// UpdateContainerGroupTags replaces the tags of a container group without restarting it
+	UpdateContainerGroupTags(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, tags map[string]*string) (containerinstance.ContainerGroup, error)
+	// StopContainerGroup stops all the containers in a container group
+	StopContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) error
+	// DeleteContainerGroup deletes a container group and waits for the deletion to complete
+	DeleteContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) error
+	// GetContainerLogs gets the logs of a container in a container group
+	GetContainerLogs(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string) (string, error)
+	// AttachContainer opens a stream of the output written by a running container from the time it is attached, the stream ends when the container terminates
+	AttachContainer(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string) (io.ReadCloser, error)
+	// ExecuteCommand runs a command in a running container, writes to the returned stream are the input of the command and reads are its output
+	ExecuteCommand(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string, command string, rows int32, cols int32) (io.ReadWriteCloser, error)
+	// ListRoleDefinitions lists the role definitions available at a scope
+	ListRoleDefinitions(ctx context.Context, subscriptionID string, scope string) ([]authorization.RoleDefinition, error)
+	// CreateRoleAssignment creates a role assignment at a scope
+	CreateRoleAssignment(ctx context.Context, subscriptionID string, scope string, roleAssignmentName string, parameters authorization.RoleAssignmentCreateParameters) (authorization.RoleAssignment, error)
+	// ListRoleAssignmentsForPrincipal lists the role assignments for a principal in a subscription
+	ListRoleAssignmentsForPrincipal(ctx context.Context, subscriptionID string, principalID string) ([]authorization.RoleAssignment, error)
+	// DeleteRoleAssignment deletes a role assignment
+	DeleteRoleAssignment(ctx context.Context, subscriptionID string, roleAssignmentID string) error
+	// GetUserAssignedIdentity gets a user assigned managed identity
+	GetUserAssignedIdentity(ctx context.Context, subscriptionID string, resourceGroupName string, resourceName string) (msi.Identity, error)
+	// GetSubnet gets a subnet of a virtual network
+	GetSubnet(ctx context.Context, subscriptionID string, resourceGroupName string, virtualNetworkName string, subnetName string) (network.Subnet, error)
+}
+
+// IsNotFound checks if an error returned by a Backend is the result of a resource not being found
+func IsNotFound(err error) bool {
+	var detailedError autorest.DetailedError
+	if errors.As(err, &detailedError) {
+		return detailedError.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+type armBackend struct {
+	authorizer autorest.Authorizer
+	userAgent  string
+}
+
+// NewBackend creates a Backend that uses the Azure Resource Manager APIs
+func NewBackend(authorizer autorest.Authorizer, userAgent string) Backend {
+	return &armBackend{
+		authorizer: authorizer,
+		userAgent:  userAgent,
+	}
+}
+
+func (b *armBackend) GetSubscription(ctx context.Context, subscriptionID string) (subscriptions.Subscription, error) {
+	subscriptionsClient, err := GetSubscriptionsClient(b.authorizer, b.userAgent)
+	if err != nil {
+		return subscriptions.Subscription{}, err
+	}
+
+	return subscriptionsClient.Get(ctx, subscriptionID)
+}
+
+func (b *armBackend) ListSubscriptions(ctx context.Context) ([]subscriptions.Subscription, error) {
+	subscriptionsClient, err := GetSubscriptionsClient(b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []subscriptions.Subscription
+	iterator, err := subscriptionsClient.ListComplete(ctx)
+	for ; err == nil && iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		result = append(result, iterator.Value())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *armBackend) ListResourceGroups(ctx context.Context, subscriptionID string) ([]resources.Group, error) {
+	groupsClient, err := GetGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []resources.Group
+	iterator, err := groupsClient.ListComplete(ctx, "", nil)
+	for ; err == nil && iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		result = append(result, iterator.Value())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *armBackend) GetResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string) (resources.Group, error) {
+	groupsClient, err := GetGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return resources.Group{}, err
+	}
+
+	return groupsClient.Get(ctx, resourceGroupName)
+}
+
+func (b *armBackend) CreateResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string, group resources.Group) (resources.Group, error) {
+	groupsClient, err := GetGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return resources.Group{}, err
+	}
+
+	return groupsClient.CreateOrUpdate(ctx, resourceGroupName, group)
+}
+
+func (b *armBackend) UpdateResourceGroupTags(ctx context.Context, subscriptionID string, resourceGroupName string, tags map[string]*string) (resources.Group, error) {
+	groupsClient, err := GetGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return resources.Group{}, err
+	}
+
+	return groupsClient.Update(ctx, resourceGroupName, resources.GroupPatchable{Tags: tags})
+}
+
+func (b *armBackend) DeleteResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string) error {
+	groupsClient, err := GetGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return err
+	}
+
+	future, err := groupsClient.Delete(ctx, resourceGroupName)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletionRef(ctx, groupsClient.Client)
+}
+
+func (b *armBackend) GetProvider(ctx context.Context, subscriptionID string, resourceProviderNamespace string) (resources.Provider, error) {
+	providersClient, err := GetProvidersClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return resources.Provider{}, err
+	}
+
+	return providersClient.Get(ctx, resourceProviderNamespace, "")
+}
+
+func (b *armBackend) ListContainerInstanceCapabilities(ctx context.Context, subscriptionID string, location string) ([]containerinstance.Capabilities, error) {
+	locationClient, err := GetContainerInstanceLocationClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []containerinstance.Capabilities
+	for iterator, err := locationClient.ListCapabilitiesComplete(ctx, location); iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, iterator.Value())
+	}
+
+	return result, nil
+}
+
+func (b *armBackend) CreateContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerGroup containerinstance.ContainerGroup) (containerinstance.ContainerGroup, error) {
+	containerGroupsClient, err := GetContainerGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	future, err := containerGroupsClient.CreateOrUpdate(ctx, resourceGroupName, containerGroupName, containerGroup)
+	if err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	err = future.WaitForCompletionRef(ctx, containerGroupsClient.Client)
+	if err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	return future.Result(*containerGroupsClient)
+}
+
+func (b *armBackend) UpdateContainerGroupTags(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, tags map[string]*string) (containerinstance.ContainerGroup, error) {
+	containerGroupsClient, err := GetContainerGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	return containerGroupsClient.Update(ctx, resourceGroupName, containerGroupName, containerinstance.Resource{Tags: tags})
+}
+
+func (b *armBackend) ListContainerGroups(ctx context.Context, subscriptionID string) ([]containerinstance.ContainerGroup, error) {
+	containerGroupsClient, err := GetContainerGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []containerinstance.ContainerGroup
+	iterator, err := containerGroupsClient.ListComplete(ctx)
+	for ; err == nil && iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		result = append(result, iterator.Value())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *armBackend) GetContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) (containerinstance.ContainerGroup, error) {
+	containerGroupsClient, err := GetContainerGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	return containerGroupsClient.Get(ctx, resourceGroupName, containerGroupName)
+}
+
+func (b *armBackend) StopContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) error {
+	containerGroupsClient, err := GetContainerGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return err
+	}
+
+	_, err = containerGroupsClient.Stop(ctx, resourceGroupName, containerGroupName)
+	return err
+}
+
+func (b *armBackend) DeleteContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) error {
+	containerGroupsClient, err := GetContainerGroupsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return err
+	}
+
+	future, err := containerGroupsClient.Delete(ctx, resourceGroupName, containerGroupName)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletionRef(ctx, containerGroupsClient.Client)
+}
+
+func (b *armBackend) GetContainerLogs(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string) (string, error) {
+	containerClient, err := GetContainerClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return "", err
+	}
+
+	logs, err := containerClient.ListLogs(ctx, resourceGroupName, containerGroupName, containerName, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if logs.Content == nil {
+		return "", nil
+	}
+
+	return *logs.Content, nil
+}
+
+func (b *armBackend) AttachContainer(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string) (io.ReadCloser, error) {
+	containerClient, err := GetContainerClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	attach, err := containerClient.Attach(ctx, resourceGroupName, containerGroupName, containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if attach.WebSocketURI == nil || attach.Password == nil {
+		return nil, fmt.Errorf("No output stream returned attaching to container %s", containerName)
+	}
+
+	return OpenAttachStream(ctx, *attach.WebSocketURI, *attach.Password)
+}
+
+func (b *armBackend) ExecuteCommand(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string, command string, rows int32, cols int32) (io.ReadWriteCloser, error) {
+	containerClient, err := GetContainerClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	request := containerinstance.ContainerExecRequest{
+		Command: &command,
+		TerminalSize: &containerinstance.ContainerExecRequestTerminalSize{
+			Rows: &rows,
+			Cols: &cols,
+		},
+	}
+	exec, err := containerClient.ExecuteCommand(ctx, resourceGroupName, containerGroupName, containerName, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if exec.WebSocketURI == nil || exec.Password == nil {
+		return nil, fmt.Errorf("No stream returned executing command in container %s", containerName)
+	}
+
+	return OpenExecStream(ctx, *exec.WebSocketURI, *exec.Password)
+}
+
+func (b *armBackend) ListRoleDefinitions(ctx context.Context, subscriptionID string, scope string) ([]authorization.RoleDefinition, error) {
+	roleDefinitionsClient, err := GetRoleDefinitionsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []authorization.RoleDefinition
+	iterator, err := roleDefinitionsClient.ListComplete(ctx, scope, "")
+	for ; err == nil && iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		result = append(result, iterator.Value())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *armBackend) CreateRoleAssignment(ctx context.Context, subscriptionID string, scope string, roleAssignmentName string, parameters authorization.RoleAssignmentCreateParameters) (authorization.RoleAssignment, error) {
+	roleAssignmentsClient, err := GetRoleAssignmentClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return authorization.RoleAssignment{}, err
+	}
+
+	return roleAssignmentsClient.Create(ctx, scope, roleAssignmentName, parameters)
+}
+
+func (b *armBackend) ListRoleAssignmentsForPrincipal(ctx context.Context, subscriptionID string, principalID string) ([]authorization.RoleAssignment, error) {
+	roleAssignmentsClient, err := GetRoleAssignmentClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []authorization.RoleAssignment
+	iterator, err := roleAssignmentsClient.ListComplete(ctx, fmt.Sprintf("principalId eq '%s'", principalID))
+	for ; err == nil && iterator.NotDone(); err = iterator.NextWithContext(ctx) {
+		result = append(result, iterator.Value())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *armBackend) DeleteRoleAssignment(ctx context.Context, subscriptionID string, roleAssignmentID string) error {
+	roleAssignmentsClient, err := GetRoleAssignmentClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return err
+	}
+
+	_, err = roleAssignmentsClient.DeleteByID(ctx, roleAssignmentID)
+	return err
+}
+
+func (b *armBackend) GetUserAssignedIdentity(ctx context.Context, subscriptionID string, resourceGroupName string, resourceName string) (msi.Identity, error) {
+	userAssignedIdentitiesClient, err := GetUserAssignedIdentitiesClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return msi.Identity{}, err
+	}
+
+	return userAssignedIdentitiesClient.Get(ctx, resourceGroupName, resourceName)
+}
+
+func (b *armBackend) GetSubnet(ctx context.Context, subscriptionID string, resourceGroupName string, virtualNetworkName string, subnetName string) (network.Subnet, error) {
+	subnetsClient, err := GetSubnetsClient(subscriptionID, b.authorizer, b.userAgent)
+	if err != nil {
+		return network.Subnet{}, err
+	}
+
+	return subnetsClient.Get(ctx, resourceGroupName, virtualNetworkName, subnetName, "")
+}
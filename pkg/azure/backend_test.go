@@ -0,0 +1,57 @@
+package azure_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/test/fakeazure"
+)
+
+func TestListErrorsWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	ctx := context.Background()
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	server := fakeazure.NewServer(backend, fake.NewFileShare())
+	defer server.Close()
+	os.Setenv("CNAB_AZURE_ARM_ENDPOINT", server.URL+"/")
+	defer os.Unsetenv("CNAB_AZURE_ARM_ENDPOINT")
+	arm := az.NewBackend(autorest.NullAuthorizer{}, "test")
+
+	testcases := map[string]func() (interface{}, error){
+		"ListSubscriptions": func() (interface{}, error) {
+			return arm.ListSubscriptions(ctx)
+		},
+		"ListResourceGroups": func() (interface{}, error) {
+			return arm.ListResourceGroups(ctx, subscriptionID)
+		},
+		"ListContainerGroups": func() (interface{}, error) {
+			return arm.ListContainerGroups(ctx, subscriptionID)
+		},
+		"ListRoleDefinitions": func() (interface{}, error) {
+			return arm.ListRoleDefinitions(ctx, subscriptionID, "/subscriptions/"+subscriptionID)
+		},
+		"ListRoleAssignmentsForPrincipal": func() (interface{}, error) {
+			return arm.ListRoleAssignmentsForPrincipal(ctx, subscriptionID, "22222222-2222-2222-2222-222222222222")
+		},
+	}
+
+	for method, list := range testcases {
+		t.Run(method, func(t *testing.T) {
+			backend.Errors = map[string]error{method: errors.New("list failed")}
+			defer func() { backend.Errors = nil }()
+
+			result, err := list()
+			if assert.Error(t, err, "Expected the error from the first page of results to be returned") {
+				assert.Contains(t, err.Error(), "list failed")
+			}
+			assert.Empty(t, result)
+		})
+	}
+}
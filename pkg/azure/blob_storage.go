@@ -0,0 +1,142 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// BlobContainer is a container in an Azure Storage Account that can be used for state instead of an Azure File Share
+type BlobContainer struct {
+	container *storage.Container
+}
+
+// NewBlobContainer creates a new BlobContainer client, the container must exist
+func NewBlobContainer(accountName string, accountKey string, containerName string) (*BlobContainer, error) {
+	baseclient, err := storage.NewClient(accountName, accountKey, StorageEndpointSuffix(), storage.DefaultAPIVersion, true)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting Storage Client when creating BlobContainerClient: %v", err)
+	}
+
+	client := baseclient.GetBlobService()
+	bc := BlobContainer{
+		container: client.GetContainerReference(containerName),
+	}
+	if exists, err := bc.container.Exists(); err != nil || !exists {
+		if err != nil {
+			return nil, fmt.Errorf("Error checking if container %s exists in Storage Account %s: %v", containerName, accountName, err)
+		}
+		return nil, fmt.Errorf("Azure Blob Container %s does not exist in Storage Account %s", containerName, accountName)
+	}
+
+	return &bc, nil
+}
+
+func cleanBlobName(blobName string) string {
+	return strings.TrimPrefix(path.Clean(blobName), "/")
+}
+
+// UploadBlob writes the content to a block blob, an existing blob is overwritten
+func (bc *BlobContainer) UploadBlob(blobName string, content []byte) error {
+	log.Debugf("Uploading blob %s to container %s", blobName, bc.container.Name)
+	blob := bc.container.GetBlobReference(cleanBlobName(blobName))
+	if err := blob.CreateBlockBlobFromReader(bytes.NewReader(content), nil); err != nil {
+		return fmt.Errorf("Error uploading blob %s to container %s Error: %v", blobName, bc.container.Name, err)
+	}
+	return nil
+}
+
+// DownloadBlob reads the content of a blob
+func (bc *BlobContainer) DownloadBlob(blobName string) (string, error) {
+	if exists, err := bc.BlobExists(blobName); err != nil || !exists {
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("Blob %s not found in container %s", blobName, bc.container.Name)
+	}
+	stream, err := bc.container.GetBlobReference(cleanBlobName(blobName)).Get(nil)
+	if err != nil {
+		return "", fmt.Errorf("Error downloading blob %s from container %s Error: %v", blobName, bc.container.Name, err)
+	}
+
+	defer stream.Close()
+	content, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return "", fmt.Errorf("Error reading blob %s from container %s Error: %v", blobName, bc.container.Name, err)
+	}
+
+	return string(content), nil
+}
+
+// BlobExists checks if a blob exists in the container
+func (bc *BlobContainer) BlobExists(blobName string) (bool, error) {
+	log.Debugf("Checking if blob %s exists in container %s", blobName, bc.container.Name)
+	exists, err := bc.container.GetBlobReference(cleanBlobName(blobName)).Exists()
+	if err != nil {
+		return false, fmt.Errorf("Error checking if blob %s exists in container %s: %v", blobName, bc.container.Name, err)
+	}
+	return exists, nil
+}
+
+// DeleteBlob deletes a blob, it returns false if the blob does not exist
+func (bc *BlobContainer) DeleteBlob(blobName string) (bool, error) {
+	return bc.container.GetBlobReference(cleanBlobName(blobName)).DeleteIfExists(nil)
+}
+
+// ListBlobs gets the names of the blobs whose names start with the prefix
+func (bc *BlobContainer) ListBlobs(prefix string) ([]string, error) {
+	var names []string
+	params := storage.ListBlobsParameters{Prefix: strings.TrimPrefix(prefix, "/")}
+	for {
+		list, err := bc.container.ListBlobs(params)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing blobs with prefix %s in container %s: %v", prefix, bc.container.Name, err)
+		}
+		for _, blob := range list.Blobs {
+			names = append(names, blob.Name)
+		}
+		if len(list.NextMarker) == 0 {
+			return names, nil
+		}
+		params.Marker = list.NextMarker
+	}
+}
+
+// URL gets the URL of the container
+func (bc *BlobContainer) URL() string {
+	return bc.container.GetURL()
+}
+
+// GetUploadSASToken gets a SAS token that allows blobs to be created and written in the container until the expiry time, the token is returned
+// without the leading ? so that it can be appended to the URL of a blob
+func (bc *BlobContainer) GetUploadSASToken(expiry time.Time) (string, error) {
+	options := storage.ContainerSASOptions{
+		ContainerSASPermissions: storage.ContainerSASPermissions{
+			BlobServiceSASPermissions: storage.BlobServiceSASPermissions{
+				Create: true,
+				Write:  true,
+			},
+		},
+		SASOptions: storage.SASOptions{
+			Expiry:   expiry.UTC(),
+			UseHTTPS: true,
+		},
+	}
+	uri, err := bc.container.GetSASURI(options)
+	if err != nil {
+		return "", fmt.Errorf("Error getting SAS token for container %s: %v", bc.container.Name, err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing SAS URI for container %s: %v", bc.container.Name, err)
+	}
+	return parsed.RawQuery, nil
+}
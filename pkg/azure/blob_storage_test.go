@@ -0,0 +1,52 @@
+package azure
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureBlobContainer(t *testing.T) {
+	testcases := []struct {
+		name    string
+		key     string
+		message string
+	}{
+		{"", "", "Expected Error when account name and key are not set"},
+		{"badname", "badkey", "Expected Error when account name and key are invalid"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewBlobContainer(tc.name, tc.key, "")
+			assert.Error(t, err, tc.message)
+		})
+	}
+}
+
+func TestBlobContainerGetUploadSASToken(t *testing.T) {
+	client, err := storage.NewClient("account", "a2V5", storage.DefaultBaseURL, storage.DefaultAPIVersion, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	blobService := client.GetBlobService()
+	bc := BlobContainer{container: blobService.GetContainerReference("outputs")}
+	assert.Equal(t, "https://account.blob.core.windows.net/outputs", bc.URL())
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	token, err := bc.GetUploadSASToken(expiry)
+	if !assert.NoError(t, err) {
+		return
+	}
+	values, err := url.ParseQuery(token)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "cw", values.Get("sp"), "Expected the token to only allow blobs to be created and written")
+	assert.Equal(t, "c", values.Get("sr"))
+	assert.Equal(t, "https", values.Get("spr"))
+	assert.Equal(t, "2030-01-02T03:04:05Z", values.Get("se"))
+	assert.NotEmpty(t, values.Get("sig"))
+}
@@ -1,18 +1,47 @@
 package azure
 
 import (
+	"os"
+
 	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
-	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2018-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
 	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2022-07-01/network"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-11-01/subscriptions"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
-	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-04-01/storage"
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-04-01/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 )
 
+// ResourceManagerEndpoint gets the Azure Resource Manager endpoint used by the management clients, this is the Azure public cloud endpoint unless CNAB_AZURE_ARM_ENDPOINT is set
+func ResourceManagerEndpoint() string {
+	if endpoint := os.Getenv("CNAB_AZURE_ARM_ENDPOINT"); len(endpoint) > 0 {
+		return endpoint
+	}
+	return azure.PublicCloud.ResourceManagerEndpoint
+}
+
+// ActiveDirectoryEndpoint gets the Azure Active Directory endpoint used to login, this is the Azure public cloud endpoint unless CNAB_AZURE_AAD_ENDPOINT is set
+func ActiveDirectoryEndpoint() string {
+	if endpoint := os.Getenv("CNAB_AZURE_AAD_ENDPOINT"); len(endpoint) > 0 {
+		return endpoint
+	}
+	return azure.PublicCloud.ActiveDirectoryEndpoint
+}
+
+// StorageEndpointSuffix gets the suffix of Azure Storage service endpoints, this is the Azure public cloud suffix unless CNAB_AZURE_STORAGE_ENDPOINT_SUFFIX is set
+func StorageEndpointSuffix() string {
+	if suffix := os.Getenv("CNAB_AZURE_STORAGE_ENDPOINT_SUFFIX"); len(suffix) > 0 {
+		return suffix
+	}
+	return storage.DefaultBaseURL
+}
+
 // GetSubscriptionsClient gets a Subscriptions Management Client
 func GetSubscriptionsClient(authorizer autorest.Authorizer, userAgent string) (*subscriptions.Client, error) {
-	subscriptionClient := subscriptions.NewClient()
+	subscriptionClient := subscriptions.NewClientWithBaseURI(ResourceManagerEndpoint())
 	if err := setupClient(&subscriptionClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -22,7 +51,7 @@ func GetSubscriptionsClient(authorizer autorest.Authorizer, userAgent string) (*
 
 // GetRoleDefinitionsClient gets a RoleDefinitions Management Client
 func GetRoleDefinitionsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*authorization.RoleDefinitionsClient, error) {
-	roleDefinitionsClient := authorization.NewRoleDefinitionsClient(subscriptionID)
+	roleDefinitionsClient := authorization.NewRoleDefinitionsClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&roleDefinitionsClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -32,7 +61,7 @@ func GetRoleDefinitionsClient(subscriptionID string, authorizer autorest.Authori
 
 // GetRoleAssignmentClient gets a RoleAssignment Management Client
 func GetRoleAssignmentClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*authorization.RoleAssignmentsClient, error) {
-	roleAssignmentsClient := authorization.NewRoleAssignmentsClient(subscriptionID)
+	roleAssignmentsClient := authorization.NewRoleAssignmentsClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&roleAssignmentsClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -42,7 +71,7 @@ func GetRoleAssignmentClient(subscriptionID string, authorizer autorest.Authoriz
 
 // GetUserAssignedIdentitiesClient gets a UserAssignedIdentities Management Client
 func GetUserAssignedIdentitiesClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*msi.UserAssignedIdentitiesClient, error) {
-	userAssignedIdentitiesClient := msi.NewUserAssignedIdentitiesClient(subscriptionID)
+	userAssignedIdentitiesClient := msi.NewUserAssignedIdentitiesClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&userAssignedIdentitiesClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -52,7 +81,7 @@ func GetUserAssignedIdentitiesClient(subscriptionID string, authorizer autorest.
 
 // GetContainerGroupsClient gets a ContainerGroups Management Client
 func GetContainerGroupsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*containerinstance.ContainerGroupsClient, error) {
-	containerGroupsClient := containerinstance.NewContainerGroupsClient(subscriptionID)
+	containerGroupsClient := containerinstance.NewContainerGroupsClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&containerGroupsClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -61,8 +90,8 @@ func GetContainerGroupsClient(subscriptionID string, authorizer autorest.Authori
 }
 
 // GetContainerClient gets a Container Management Client
-func GetContainerClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*containerinstance.ContainerClient, error) {
-	containerClient := containerinstance.NewContainerClient(subscriptionID)
+func GetContainerClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*containerinstance.ContainersClient, error) {
+	containerClient := containerinstance.NewContainersClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&containerClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -70,9 +99,19 @@ func GetContainerClient(subscriptionID string, authorizer autorest.Authorizer, u
 	return &containerClient, nil
 }
 
+// GetContainerInstanceLocationClient gets a Container Instance Location Management Client
+func GetContainerInstanceLocationClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*containerinstance.LocationClient, error) {
+	locationClient := containerinstance.NewLocationClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
+	if err := setupClient(&locationClient.BaseClient.Client, userAgent, authorizer); err != nil {
+		return nil, err
+	}
+
+	return &locationClient, nil
+}
+
 // GetGroupsClient gets a Resource Group Management Client
 func GetGroupsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*resources.GroupsClient, error) {
-	groupsClient := resources.NewGroupsClient(subscriptionID)
+	groupsClient := resources.NewGroupsClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&groupsClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -82,7 +121,7 @@ func GetGroupsClient(subscriptionID string, authorizer autorest.Authorizer, user
 
 // GetProvidersClient gets a Providers Management Client
 func GetProvidersClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*resources.ProvidersClient, error) {
-	providersClient := resources.NewProvidersClient(subscriptionID)
+	providersClient := resources.NewProvidersClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&providersClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -90,9 +129,19 @@ func GetProvidersClient(subscriptionID string, authorizer autorest.Authorizer, u
 	return &providersClient, nil
 }
 
+// GetSubnetsClient gets a Subnets Management Client
+func GetSubnetsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*network.SubnetsClient, error) {
+	subnetsClient := network.NewSubnetsClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
+	if err := setupClient(&subnetsClient.BaseClient.Client, userAgent, authorizer); err != nil {
+		return nil, err
+	}
+
+	return &subnetsClient, nil
+}
+
 // GetStorageAccountsClient gets a Providers Management Client
-func GetStorageAccountsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*storage.AccountsClient, error) {
-	accountsClient := storage.NewAccountsClient(subscriptionID)
+func GetStorageAccountsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) (*storagemgmt.AccountsClient, error) {
+	accountsClient := storagemgmt.NewAccountsClientWithBaseURI(ResourceManagerEndpoint(), subscriptionID)
 	if err := setupClient(&accountsClient.BaseClient.Client, userAgent, authorizer); err != nil {
 		return nil, err
 	}
@@ -302,11 +302,12 @@ func CheckCanAccessResource(actionID string, scope string) (bool, error) {
 	return makeCheckAccessRequest(payload, scope)
 }
 func getFromToken(accessToken string, parameter string) (string, error) {
-	bearerToken := strings.Split(accessToken, ".")[1]
-	if len(bearerToken) == 0 {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) < 2 || len(parts[1]) == 0 {
 		return "", errors.New("Failed to get bearer token from CloudShell Token")
 	}
-	token, err := base64.RawStdEncoding.DecodeString(bearerToken)
+	// JWT segments are base64url encoded without padding
+	token, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
 		return "", fmt.Errorf("Failed to decode Bearer Token: %v ", err)
 	}
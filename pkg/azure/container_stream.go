@@ -0,0 +1,101 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// containerStream reads the output of a container from a websocket returned by the ACI attach or exec APIs, each message holds some of the output.
+// Writes are sent to the container as the input of an executed command.
+type containerStream struct {
+	conn    *websocket.Conn
+	message io.Reader
+	writeMu sync.Mutex
+}
+
+// OpenAttachStream connects to the websocket returned by the ACI attach API, the password is sent as the Authorization header
+func OpenAttachStream(ctx context.Context, webSocketURI string, password string) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Authorization", password)
+	conn, err := dialContainerStream(ctx, webSocketURI, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &containerStream{conn: conn}, nil
+}
+
+// OpenExecStream connects to the websocket returned by the ACI exec API, the password is sent as the first message
+func OpenExecStream(ctx context.Context, webSocketURI string, password string) (io.ReadWriteCloser, error) {
+	conn, err := dialContainerStream(ctx, webSocketURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(password)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to authenticate to container stream: %v", err)
+	}
+
+	return &containerStream{conn: conn}, nil
+}
+
+func dialContainerStream(ctx context.Context, webSocketURI string, header http.Header) (*websocket.Conn, error) {
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, webSocketURI, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Failed to connect to container stream, status: %s: %v", resp.Status, err)
+		}
+		return nil, fmt.Errorf("Failed to connect to container stream: %v", err)
+	}
+
+	return conn, nil
+}
+
+func (s *containerStream) Read(p []byte) (int, error) {
+	for {
+		if s.message == nil {
+			_, message, err := s.conn.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			s.message = message
+		}
+
+		n, err := s.message.Read(p)
+		if err == io.EOF {
+			s.message = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends p to the container as a text message, gorilla/websocket allows one concurrent writer
+func (s *containerStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close tells the server the stream is being closed and closes the connection
+func (s *containerStream) Close() error {
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return s.conn.Close()
+}
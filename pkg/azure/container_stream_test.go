@@ -0,0 +1,108 @@
+package azure_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/test/fakeazure"
+)
+
+func TestAttachContainerWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	ctx := context.Background()
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	backend.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{
+			{State: "Running", Logs: []string{"written before attaching"}},
+			{State: "Running", Logs: []string{"Installing"}},
+			{State: "Succeeded", Logs: []string{"Done"}},
+		}
+	}
+	server := fakeazure.NewServer(backend, fake.NewFileShare())
+	defer server.Close()
+	os.Setenv("CNAB_AZURE_ARM_ENDPOINT", server.URL+"/")
+	defer os.Unsetenv("CNAB_AZURE_ARM_ENDPOINT")
+
+	_, err := backend.CreateResourceGroup(ctx, subscriptionID, "rg", resources.Group{Location: to.StringPtr("westeurope")})
+	assert.NoError(t, err)
+	_, err = backend.CreateContainerGroup(ctx, subscriptionID, "rg", "aci", containerinstance.ContainerGroup{ContainerGroupProperties: &containerinstance.ContainerGroupProperties{}})
+	assert.NoError(t, err)
+	_, err = backend.GetContainerGroup(ctx, subscriptionID, "rg", "aci")
+	assert.NoError(t, err)
+
+	arm := az.NewBackend(autorest.NullAuthorizer{}, "test")
+	_, err = arm.AttachContainer(ctx, subscriptionID, "rg", "missing", "missing")
+	assert.True(t, az.IsNotFound(err), "Expected attaching to a missing container group to fail with not found. Got: %v", err)
+
+	stream, err := arm.AttachContainer(ctx, subscriptionID, "rg", "aci", "aci")
+	if !assert.NoErrorf(t, err, "Expected no error attaching to container. Got: %v", err) {
+		return
+	}
+	defer stream.Close()
+
+	// The stream gets the output written once the container has moved on to its next steps
+	for i := 0; i < 2; i++ {
+		_, err = backend.GetContainerGroup(ctx, subscriptionID, "rg", "aci")
+		assert.NoError(t, err)
+	}
+	output, err := ioutil.ReadAll(stream)
+	assert.NoErrorf(t, err, "Expected no error reading container output. Got: %v", err)
+	assert.Equal(t, "Installing\nDone\n", string(output))
+}
+
+func TestExecuteCommandWithFakeAzure(t *testing.T) {
+	const subscriptionID = "11111111-1111-1111-1111-111111111111"
+	ctx := context.Background()
+	backend := fake.NewBackend(subscriptionID, "westeurope")
+	backend.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{State: "Running"}, {State: "Succeeded"}}
+	}
+	backend.Exec = func(command string, stdin io.Reader, stdout io.Writer) {
+		line, _ := bufio.NewReader(stdin).ReadString('\n')
+		fmt.Fprintf(stdout, "%s got %s", command, line)
+	}
+	server := fakeazure.NewServer(backend, fake.NewFileShare())
+	defer server.Close()
+	os.Setenv("CNAB_AZURE_ARM_ENDPOINT", server.URL+"/")
+	defer os.Unsetenv("CNAB_AZURE_ARM_ENDPOINT")
+
+	_, err := backend.CreateResourceGroup(ctx, subscriptionID, "rg", resources.Group{Location: to.StringPtr("westeurope")})
+	assert.NoError(t, err)
+	_, err = backend.CreateContainerGroup(ctx, subscriptionID, "rg", "aci", containerinstance.ContainerGroup{ContainerGroupProperties: &containerinstance.ContainerGroupProperties{}})
+	assert.NoError(t, err)
+	_, err = backend.GetContainerGroup(ctx, subscriptionID, "rg", "aci")
+	assert.NoError(t, err)
+
+	arm := az.NewBackend(autorest.NullAuthorizer{}, "test")
+	stream, err := arm.ExecuteCommand(ctx, subscriptionID, "rg", "aci", "aci", "/bin/sh", 40, 120)
+	if !assert.NoErrorf(t, err, "Expected no error executing command. Got: %v", err) {
+		return
+	}
+	defer stream.Close()
+
+	_, err = stream.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+	output, err := ioutil.ReadAll(stream)
+	assert.NoErrorf(t, err, "Expected no error reading command output. Got: %v", err)
+	assert.Equal(t, "/bin/sh got hello\n", string(output))
+	assert.Equal(t, []fake.ExecutedCommand{{Key: fake.Key("rg", "aci"), ContainerName: "aci", Command: "/bin/sh", Rows: 40, Cols: 120}}, backend.ExecutedCommands)
+
+	// Commands cannot be executed once the container has terminated
+	_, err = backend.GetContainerGroup(ctx, subscriptionID, "rg", "aci")
+	assert.NoError(t, err)
+	_, err = arm.ExecuteCommand(ctx, subscriptionID, "rg", "aci", "aci", "/bin/sh", 40, 120)
+	assert.Error(t, err, "Expected executing a command in a terminated container to fail")
+}
@@ -0,0 +1,732 @@
+// Package fake provides in-memory implementations of the Azure services used by the driver so that it can be tested without an Azure subscription
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2022-07-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-11-01/subscriptions"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/google/uuid"
+)
+
+// ContainerStep is one step in the execution of a container group, each time the container group is read it moves to the next step
+type ContainerStep struct {
+	// State is the state reported for the container group e.g. Running, Succeeded or Failed
+	State string
+	// Logs are the lines written by the container during the step
+	Logs []string
+	// StoppedLogs are the lines written by the container if it is stopped during the step e.g. by a handler for SIGTERM
+	StoppedLogs []string
+	// ExitCode is the exit code reported for the containers once they have terminated
+	ExitCode *int32
+	// DetailStatus is the detail status reported for the containers e.g. Completed or Error
+	DetailStatus string
+	// Events are the events reported for the containers
+	Events []containerinstance.Event
+	// StreamEnded ends the attached streams before the logs of the step are sent, as happens if the connection to the stream drops
+	StreamEnded bool
+}
+
+// ContainerRun is the sequence of steps a container group goes through once it has been created, the last step is repeated once it is reached
+type ContainerRun []ContainerStep
+
+// Backend is an in-memory implementation of azure.Backend
+type Backend struct {
+	// SubscriptionIDs are the subscriptions available to the logged in account
+	SubscriptionIDs []string
+	// Locations are the locations where ACI is available
+	Locations []string
+	// Capabilities are the ACI capabilities returned for every location
+	Capabilities []containerinstance.Capabilities
+	// RoleDefinitions are the role definitions available at any scope
+	RoleDefinitions []authorization.RoleDefinition
+	// ResourceGroups are the existing resource groups keyed by name
+	ResourceGroups map[string]resources.Group
+	// UserAssignedIdentities are the existing user assigned identities keyed by resource ID
+	UserAssignedIdentities map[string]msi.Identity
+	// Subnets are the existing virtual network subnets keyed by resource ID
+	Subnets map[string]network.Subnet
+	// ContainerGroups are the container groups that have been created keyed by resource group and name
+	ContainerGroups map[string]containerinstance.ContainerGroup
+	// RoleAssignments are the role assignments that have been created
+	RoleAssignments []authorization.RoleAssignment
+	// DeletedRoleAssignments are the IDs of the role assignments that have been deleted
+	DeletedRoleAssignments []string
+	// StoppedContainerGroups are the keys of the container groups that have been stopped
+	StoppedContainerGroups []string
+	// AttachedContainerGroups are the keys of the container groups that have had a stream attached to their output
+	AttachedContainerGroups []string
+	// DeletedContainerGroups are the keys of the container groups that have been deleted
+	DeletedContainerGroups []string
+	// DeletedResourceGroups are the names of the resource groups that have been deleted
+	DeletedResourceGroups []string
+	// Run is called when a container group is created to get the steps it goes through, if it is nil the container group succeeds without writing any logs
+	Run func(containerGroup containerinstance.ContainerGroup) ContainerRun
+	// ExecutedCommands are the commands that have been executed in containers
+	ExecutedCommands []ExecutedCommand
+	// Exec runs a command executed in a container reading its input from stdin and writing its output to stdout, if it is nil commands exit without any output
+	Exec func(command string, stdin io.Reader, stdout io.Writer)
+	// LogTailLines limits the logs returned by GetContainerLogs to the last lines written if it is not zero, as ACI does once the logs are large
+	LogTailLines int
+	// Errors are returned by the method with the same name instead of calling it
+	Errors map[string]error
+
+	mu   sync.Mutex
+	runs map[string]*containerRun
+	// changed is signalled when a run moves on to its next step, is stopped or deleted, or a stream is closed
+	changed *sync.Cond
+}
+
+// ExecutedCommand is a command that has been executed in a container
+type ExecutedCommand struct {
+	// Key is the key of the container group
+	Key           string
+	ContainerName string
+	Command       string
+	Rows          int32
+	Cols          int32
+}
+
+type containerRun struct {
+	steps   ContainerRun
+	step    int
+	stopped bool
+	deleted bool
+}
+
+// NewBackend creates a fake Backend with a single subscription and ACI available in one location
+func NewBackend(subscriptionID string, location string) *Backend {
+	b := &Backend{
+		SubscriptionIDs: []string{subscriptionID},
+		Locations:       []string{location},
+		RoleDefinitions: []authorization.RoleDefinition{
+			{
+				ID: to.StringPtr(fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/b24988ac-6180-42a0-ab88-20f7382dd24c", subscriptionID)),
+				RoleDefinitionProperties: &authorization.RoleDefinitionProperties{
+					RoleName: to.StringPtr("Contributor"),
+				},
+			},
+		},
+		ResourceGroups:         map[string]resources.Group{},
+		UserAssignedIdentities: map[string]msi.Identity{},
+		Subnets:                map[string]network.Subnet{},
+		ContainerGroups:        map[string]containerinstance.ContainerGroup{},
+		Errors:                 map[string]error{},
+		runs:                   map[string]*containerRun{},
+	}
+	b.changed = sync.NewCond(&b.mu)
+	return b
+}
+
+// Key gets the key used for a container group in ContainerGroups, StoppedContainerGroups and DeletedContainerGroups
+func Key(resourceGroupName string, containerGroupName string) string {
+	return strings.ToLower(resourceGroupName + "/" + containerGroupName)
+}
+
+func notFound(format string, a ...interface{}) error {
+	return autorest.DetailedError{
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf(format, a...),
+	}
+}
+
+// GetSubscription gets a subscription
+func (b *Backend) GetSubscription(ctx context.Context, subscriptionID string) (subscriptions.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetSubscription"]; err != nil {
+		return subscriptions.Subscription{}, err
+	}
+
+	for _, s := range b.SubscriptionIDs {
+		if strings.EqualFold(s, subscriptionID) {
+			return subscriptions.Subscription{SubscriptionID: to.StringPtr(s)}, nil
+		}
+	}
+
+	return subscriptions.Subscription{}, notFound("subscription %s not found", subscriptionID)
+}
+
+// ListSubscriptions lists the subscriptions
+func (b *Backend) ListSubscriptions(ctx context.Context) ([]subscriptions.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ListSubscriptions"]; err != nil {
+		return nil, err
+	}
+
+	var result []subscriptions.Subscription
+	for _, s := range b.SubscriptionIDs {
+		result = append(result, subscriptions.Subscription{SubscriptionID: to.StringPtr(s)})
+	}
+
+	return result, nil
+}
+
+// ListResourceGroups lists the resource groups
+func (b *Backend) ListResourceGroups(ctx context.Context, subscriptionID string) ([]resources.Group, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ListResourceGroups"]; err != nil {
+		return nil, err
+	}
+
+	var result []resources.Group
+	for name, group := range b.ResourceGroups {
+		group.Name = to.StringPtr(name)
+		result = append(result, group)
+	}
+
+	return result, nil
+}
+
+// GetResourceGroup gets a resource group
+func (b *Backend) GetResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string) (resources.Group, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetResourceGroup"]; err != nil {
+		return resources.Group{}, err
+	}
+
+	group, ok := b.ResourceGroups[resourceGroupName]
+	if !ok {
+		return resources.Group{}, notFound("resource group %s not found", resourceGroupName)
+	}
+
+	return group, nil
+}
+
+// CreateResourceGroup creates or updates a resource group
+func (b *Backend) CreateResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string, group resources.Group) (resources.Group, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["CreateResourceGroup"]; err != nil {
+		return resources.Group{}, err
+	}
+
+	group.ID = to.StringPtr(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionID, resourceGroupName))
+	group.Name = to.StringPtr(resourceGroupName)
+	b.ResourceGroups[resourceGroupName] = group
+	return group, nil
+}
+
+// UpdateResourceGroupTags replaces the tags of a resource group
+func (b *Backend) UpdateResourceGroupTags(ctx context.Context, subscriptionID string, resourceGroupName string, tags map[string]*string) (resources.Group, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["UpdateResourceGroupTags"]; err != nil {
+		return resources.Group{}, err
+	}
+
+	group, ok := b.ResourceGroups[resourceGroupName]
+	if !ok {
+		return resources.Group{}, notFound("resource group %s not found", resourceGroupName)
+	}
+
+	group.Tags = tags
+	b.ResourceGroups[resourceGroupName] = group
+	return group, nil
+}
+
+// DeleteResourceGroup deletes a resource group and any container groups in it
+func (b *Backend) DeleteResourceGroup(ctx context.Context, subscriptionID string, resourceGroupName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["DeleteResourceGroup"]; err != nil {
+		return err
+	}
+
+	if _, ok := b.ResourceGroups[resourceGroupName]; !ok {
+		return notFound("resource group %s not found", resourceGroupName)
+	}
+
+	delete(b.ResourceGroups, resourceGroupName)
+	prefix := Key(resourceGroupName, "")
+	for key := range b.ContainerGroups {
+		if strings.HasPrefix(key, prefix) {
+			delete(b.ContainerGroups, key)
+			delete(b.runs, key)
+		}
+	}
+
+	b.DeletedResourceGroups = append(b.DeletedResourceGroups, resourceGroupName)
+	return nil
+}
+
+// GetProvider gets a resource provider, ContainerGroups are available in Locations
+func (b *Backend) GetProvider(ctx context.Context, subscriptionID string, resourceProviderNamespace string) (resources.Provider, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetProvider"]; err != nil {
+		return resources.Provider{}, err
+	}
+
+	locations := append([]string{}, b.Locations...)
+	return resources.Provider{
+		Namespace: to.StringPtr(resourceProviderNamespace),
+		ResourceTypes: &[]resources.ProviderResourceType{
+			{
+				ResourceType: to.StringPtr("ContainerGroups"),
+				Locations:    &locations,
+			},
+		},
+	}, nil
+}
+
+// ListContainerInstanceCapabilities lists the ACI capabilities
+func (b *Backend) ListContainerInstanceCapabilities(ctx context.Context, subscriptionID string, location string) ([]containerinstance.Capabilities, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ListContainerInstanceCapabilities"]; err != nil {
+		return nil, err
+	}
+
+	return b.Capabilities, nil
+}
+
+// CreateContainerGroup creates or updates a container group and starts running it
+func (b *Backend) CreateContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerGroup containerinstance.ContainerGroup) (containerinstance.ContainerGroup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["CreateContainerGroup"]; err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	if _, ok := b.ResourceGroups[resourceGroupName]; !ok {
+		return containerinstance.ContainerGroup{}, notFound("resource group %s not found", resourceGroupName)
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	containerGroup.ID = to.StringPtr(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ContainerInstance/containerGroups/%s", subscriptionID, resourceGroupName, containerGroupName))
+	containerGroup.Name = to.StringPtr(containerGroupName)
+
+	// A system assigned identity keeps its principal when the container group is updated
+	if containerGroup.Identity != nil && containerGroup.Identity.Type == containerinstance.ResourceIdentityTypeSystemAssigned {
+		identity := *containerGroup.Identity
+		identity.PrincipalID = to.StringPtr(uuid.New().String())
+		if existing, ok := b.ContainerGroups[key]; ok && existing.Identity != nil && existing.Identity.PrincipalID != nil {
+			identity.PrincipalID = existing.Identity.PrincipalID
+		}
+		containerGroup.Identity = &identity
+	}
+
+	steps := ContainerRun{{State: "Succeeded"}}
+	if b.Run != nil {
+		if run := b.Run(containerGroup); len(run) > 0 {
+			steps = run
+		}
+	}
+
+	b.runs[key] = &containerRun{steps: steps, step: -1}
+	b.ContainerGroups[key] = containerGroup
+	return b.withInstanceView(key, containerGroup), nil
+}
+
+// ListContainerGroups lists the container groups without their instance views and without moving them on to the next step in their runs
+func (b *Backend) ListContainerGroups(ctx context.Context, subscriptionID string) ([]containerinstance.ContainerGroup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ListContainerGroups"]; err != nil {
+		return nil, err
+	}
+
+	var result []containerinstance.ContainerGroup
+	for _, containerGroup := range b.ContainerGroups {
+		result = append(result, containerGroup)
+	}
+
+	return result, nil
+}
+
+// GetContainerGroup gets a container group, each call moves the container group on to the next step in its run
+func (b *Backend) GetContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) (containerinstance.ContainerGroup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetContainerGroup"]; err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	containerGroup, ok := b.ContainerGroups[key]
+	if !ok {
+		return containerinstance.ContainerGroup{}, notFound("container group %s not found", containerGroupName)
+	}
+
+	run := b.runs[key]
+	if !run.stopped && run.step < len(run.steps)-1 {
+		run.step++
+		b.changed.Broadcast()
+	}
+
+	return b.withInstanceView(key, containerGroup), nil
+}
+
+// UpdateContainerGroupTags replaces the tags of a container group without moving it on to the next step in its run
+func (b *Backend) UpdateContainerGroupTags(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, tags map[string]*string) (containerinstance.ContainerGroup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["UpdateContainerGroupTags"]; err != nil {
+		return containerinstance.ContainerGroup{}, err
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	containerGroup, ok := b.ContainerGroups[key]
+	if !ok {
+		return containerinstance.ContainerGroup{}, notFound("container group %s not found", containerGroupName)
+	}
+
+	containerGroup.Tags = tags
+	b.ContainerGroups[key] = containerGroup
+	return b.withInstanceView(key, containerGroup), nil
+}
+
+// StopContainerGroup stops a container group
+func (b *Backend) StopContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["StopContainerGroup"]; err != nil {
+		return err
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	if _, ok := b.ContainerGroups[key]; !ok {
+		return notFound("container group %s not found", containerGroupName)
+	}
+
+	b.runs[key].stopped = true
+	b.changed.Broadcast()
+	b.StoppedContainerGroups = append(b.StoppedContainerGroups, key)
+	return nil
+}
+
+// DeleteContainerGroup deletes a container group
+func (b *Backend) DeleteContainerGroup(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["DeleteContainerGroup"]; err != nil {
+		return err
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	if _, ok := b.ContainerGroups[key]; !ok {
+		return notFound("container group %s not found", containerGroupName)
+	}
+
+	delete(b.ContainerGroups, key)
+	b.runs[key].deleted = true
+	delete(b.runs, key)
+	b.changed.Broadcast()
+	b.DeletedContainerGroups = append(b.DeletedContainerGroups, key)
+	return nil
+}
+
+// GetContainerLogs gets the logs written by the container group up to its current step
+func (b *Backend) GetContainerLogs(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetContainerLogs"]; err != nil {
+		return "", err
+	}
+
+	run, ok := b.runs[Key(resourceGroupName, containerGroupName)]
+	if !ok {
+		return "", notFound("container group %s not found", containerGroupName)
+	}
+
+	var lines []string
+	for i := 0; i <= run.step; i++ {
+		lines = append(lines, run.steps[i].Logs...)
+	}
+	if run.stopped && run.step >= 0 {
+		lines = append(lines, run.steps[run.step].StoppedLogs...)
+	}
+	if b.LogTailLines > 0 && len(lines) > b.LogTailLines {
+		lines = lines[len(lines)-b.LogTailLines:]
+	}
+
+	var logs strings.Builder
+	for _, line := range lines {
+		logs.WriteString(line)
+		logs.WriteString("\n")
+	}
+
+	return logs.String(), nil
+}
+
+// AttachContainer streams the logs of the steps that the container group moves on to after it is attached, the stream ends once a step that is not Running has been sent
+func (b *Backend) AttachContainer(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["AttachContainer"]; err != nil {
+		return nil, err
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	run, ok := b.runs[key]
+	if !ok {
+		return nil, notFound("container group %s not found", containerGroupName)
+	}
+
+	b.AttachedContainerGroups = append(b.AttachedContainerGroups, key)
+	reader, writer := io.Pipe()
+	stream := &attachStream{PipeReader: reader, backend: b}
+	go b.stream(run, run.step+1, stream, writer)
+	return stream, nil
+}
+
+// ExecuteCommand runs a command in a container using Exec, the container group must be at a Running step
+func (b *Backend) ExecuteCommand(ctx context.Context, subscriptionID string, resourceGroupName string, containerGroupName string, containerName string, command string, rows int32, cols int32) (io.ReadWriteCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ExecuteCommand"]; err != nil {
+		return nil, err
+	}
+
+	key := Key(resourceGroupName, containerGroupName)
+	run, ok := b.runs[key]
+	if !ok {
+		return nil, notFound("container group %s not found", containerGroupName)
+	}
+	if run.stopped || run.step < 0 || run.steps[run.step].State != "Running" {
+		return nil, autorest.DetailedError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("container %s is not running", containerName),
+		}
+	}
+
+	b.ExecutedCommands = append(b.ExecutedCommands, ExecutedCommand{Key: key, ContainerName: containerName, Command: command, Rows: rows, Cols: cols})
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	exec := b.Exec
+	go func() {
+		if exec != nil {
+			exec(command, stdinReader, stdoutWriter)
+		}
+		stdoutWriter.Close()
+		stdinReader.Close()
+	}()
+
+	return &execStream{PipeReader: stdoutReader, stdin: stdinWriter}, nil
+}
+
+type execStream struct {
+	*io.PipeReader
+	stdin *io.PipeWriter
+}
+
+func (s *execStream) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+func (s *execStream) Close() error {
+	s.stdin.Close()
+	return s.PipeReader.Close()
+}
+
+type attachStream struct {
+	*io.PipeReader
+	backend *Backend
+	closed  bool
+}
+
+func (s *attachStream) Close() error {
+	s.backend.mu.Lock()
+	s.closed = true
+	s.backend.changed.Broadcast()
+	s.backend.mu.Unlock()
+	return s.PipeReader.Close()
+}
+
+// stream writes the logs of each step of the run from next onwards as the run reaches it
+func (b *Backend) stream(run *containerRun, next int, stream *attachStream, writer *io.PipeWriter) {
+	defer writer.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for next < len(run.steps) {
+		for run.step < next && !stream.closed && !run.stopped && !run.deleted {
+			b.changed.Wait()
+		}
+		if stream.closed || run.stopped || run.deleted || run.steps[next].StreamEnded {
+			return
+		}
+
+		step := run.steps[next]
+		b.mu.Unlock()
+		var err error
+		for _, line := range step.Logs {
+			if _, err = io.WriteString(writer, line+"\n"); err != nil {
+				break
+			}
+		}
+		b.mu.Lock()
+		if err != nil || step.State != "Running" {
+			return
+		}
+		next++
+	}
+
+	// The last step is repeated so the stream stays open until the container group is stopped or deleted
+	for !stream.closed && !run.stopped && !run.deleted {
+		b.changed.Wait()
+	}
+}
+
+// ListRoleDefinitions lists the role definitions
+func (b *Backend) ListRoleDefinitions(ctx context.Context, subscriptionID string, scope string) ([]authorization.RoleDefinition, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ListRoleDefinitions"]; err != nil {
+		return nil, err
+	}
+
+	return b.RoleDefinitions, nil
+}
+
+// CreateRoleAssignment creates a role assignment
+func (b *Backend) CreateRoleAssignment(ctx context.Context, subscriptionID string, scope string, roleAssignmentName string, parameters authorization.RoleAssignmentCreateParameters) (authorization.RoleAssignment, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["CreateRoleAssignment"]; err != nil {
+		return authorization.RoleAssignment{}, err
+	}
+
+	roleAssignment := authorization.RoleAssignment{
+		ID:   to.StringPtr(fmt.Sprintf("%s/providers/Microsoft.Authorization/roleAssignments/%s", scope, roleAssignmentName)),
+		Name: to.StringPtr(roleAssignmentName),
+		Properties: &authorization.RoleAssignmentPropertiesWithScope{
+			Scope: to.StringPtr(scope),
+		},
+	}
+	if parameters.Properties != nil {
+		roleAssignment.Properties.RoleDefinitionID = parameters.Properties.RoleDefinitionID
+		roleAssignment.Properties.PrincipalID = parameters.Properties.PrincipalID
+	}
+
+	b.RoleAssignments = append(b.RoleAssignments, roleAssignment)
+	return roleAssignment, nil
+}
+
+// ListRoleAssignmentsForPrincipal lists the role assignments for a principal
+func (b *Backend) ListRoleAssignmentsForPrincipal(ctx context.Context, subscriptionID string, principalID string) ([]authorization.RoleAssignment, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["ListRoleAssignmentsForPrincipal"]; err != nil {
+		return nil, err
+	}
+
+	var result []authorization.RoleAssignment
+	for _, roleAssignment := range b.RoleAssignments {
+		if roleAssignment.Properties != nil && strings.EqualFold(to.String(roleAssignment.Properties.PrincipalID), principalID) {
+			result = append(result, roleAssignment)
+		}
+	}
+
+	return result, nil
+}
+
+// DeleteRoleAssignment deletes a role assignment
+func (b *Backend) DeleteRoleAssignment(ctx context.Context, subscriptionID string, roleAssignmentID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["DeleteRoleAssignment"]; err != nil {
+		return err
+	}
+
+	for i, roleAssignment := range b.RoleAssignments {
+		if strings.EqualFold(to.String(roleAssignment.ID), roleAssignmentID) {
+			b.RoleAssignments = append(b.RoleAssignments[:i], b.RoleAssignments[i+1:]...)
+			b.DeletedRoleAssignments = append(b.DeletedRoleAssignments, roleAssignmentID)
+			return nil
+		}
+	}
+
+	return notFound("role assignment %s not found", roleAssignmentID)
+}
+
+// GetUserAssignedIdentity gets a user assigned identity
+func (b *Backend) GetUserAssignedIdentity(ctx context.Context, subscriptionID string, resourceGroupName string, resourceName string) (msi.Identity, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetUserAssignedIdentity"]; err != nil {
+		return msi.Identity{}, err
+	}
+
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ManagedIdentity/userAssignedIdentities/%s", subscriptionID, resourceGroupName, resourceName)
+	for k, identity := range b.UserAssignedIdentities {
+		if strings.EqualFold(k, id) {
+			return identity, nil
+		}
+	}
+
+	return msi.Identity{}, notFound("user assigned identity %s not found", id)
+}
+
+// GetSubnet gets a subnet of a virtual network
+func (b *Backend) GetSubnet(ctx context.Context, subscriptionID string, resourceGroupName string, virtualNetworkName string, subnetName string) (network.Subnet, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Errors["GetSubnet"]; err != nil {
+		return network.Subnet{}, err
+	}
+
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/virtualNetworks/%s/subnets/%s", subscriptionID, resourceGroupName, virtualNetworkName, subnetName)
+	for k, subnet := range b.Subnets {
+		if strings.EqualFold(k, id) {
+			return subnet, nil
+		}
+	}
+
+	return network.Subnet{}, notFound("subnet %s not found", id)
+}
+
+// withInstanceView returns a copy of the container group with the instance view set from the current step of its run
+func (b *Backend) withInstanceView(key string, containerGroup containerinstance.ContainerGroup) containerinstance.ContainerGroup {
+	run := b.runs[key]
+	step := ContainerStep{State: "Pending"}
+	if run.stopped {
+		step = ContainerStep{State: "Stopped"}
+	} else if run.step >= 0 {
+		step = run.steps[run.step]
+	}
+
+	properties := containerinstance.ContainerGroupProperties{}
+	if containerGroup.ContainerGroupProperties != nil {
+		properties = *containerGroup.ContainerGroupProperties
+	}
+	properties.InstanceView = &containerinstance.ContainerGroupPropertiesInstanceView{
+		State: to.StringPtr(step.State),
+	}
+	if properties.Containers != nil {
+		containers := make([]containerinstance.Container, len(*properties.Containers))
+		for i, container := range *properties.Containers {
+			containerProperties := containerinstance.ContainerProperties{}
+			if container.ContainerProperties != nil {
+				containerProperties = *container.ContainerProperties
+			}
+			containerProperties.InstanceView = &containerinstance.ContainerPropertiesInstanceView{
+				CurrentState: &containerinstance.ContainerState{
+					State:        to.StringPtr(step.State),
+					ExitCode:     step.ExitCode,
+					DetailStatus: to.StringPtr(step.DetailStatus),
+				},
+				Events: &step.Events,
+			}
+			container.ContainerProperties = &containerProperties
+			containers[i] = container
+		}
+		properties.Containers = &containers
+	}
+	containerGroup.ContainerGroupProperties = &properties
+	return containerGroup
+}
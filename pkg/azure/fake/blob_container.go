@@ -0,0 +1,96 @@
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobContainer is an in-memory Azure Blob Container
+type BlobContainer struct {
+	mu    sync.Mutex
+	name  string
+	blobs map[string]string
+}
+
+// NewBlobContainer creates an empty BlobContainer
+func NewBlobContainer(name string) *BlobContainer {
+	return &BlobContainer{
+		name:  name,
+		blobs: map[string]string{},
+	}
+}
+
+// Blobs returns a copy of the blobs in the container keyed by blob name
+func (c *BlobContainer) Blobs() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blobs := make(map[string]string, len(c.blobs))
+	for k, v := range c.blobs {
+		blobs[k] = v
+	}
+	return blobs
+}
+
+// UploadBlob writes a blob to the container, this is also used to simulate outputs uploaded by the invocation image
+func (c *BlobContainer) UploadBlob(blobName string, content []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[cleanFileName(blobName)] = string(content)
+	return nil
+}
+
+// DownloadBlob reads a blob from the container
+func (c *BlobContainer) DownloadBlob(blobName string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	content, ok := c.blobs[cleanFileName(blobName)]
+	if !ok {
+		return "", fmt.Errorf("Blob %s not found in container %s", blobName, c.name)
+	}
+	return content, nil
+}
+
+// BlobExists checks if a blob exists in the container
+func (c *BlobContainer) BlobExists(blobName string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.blobs[cleanFileName(blobName)]
+	return ok, nil
+}
+
+// DeleteBlob deletes a blob from the container
+func (c *BlobContainer) DeleteBlob(blobName string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := cleanFileName(blobName)
+	_, ok := c.blobs[name]
+	delete(c.blobs, name)
+	return ok, nil
+}
+
+// ListBlobs gets the sorted names of the blobs whose names start with the prefix
+func (c *BlobContainer) ListBlobs(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.blobs {
+		if strings.HasPrefix(name, strings.TrimPrefix(prefix, "/")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// URL gets the URL the container would have in a storage account named fake
+func (c *BlobContainer) URL() string {
+	return "https://fake.blob.core.windows.net/" + c.name
+}
+
+// GetUploadSASToken gets a token that is not signed
+func (c *BlobContainer) GetUploadSASToken(expiry time.Time) (string, error) {
+	return fmt.Sprintf("se=%s&sp=cw&sig=fake", expiry.UTC().Format(time.RFC3339)), nil
+}
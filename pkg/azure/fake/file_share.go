@@ -0,0 +1,99 @@
+package fake
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// FileShare is an in-memory Azure File Share
+type FileShare struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// NewFileShare creates an empty FileShare
+func NewFileShare() *FileShare {
+	return &FileShare{
+		files: map[string]string{},
+	}
+}
+
+func cleanFileName(fileName string) string {
+	return strings.TrimPrefix(path.Clean(fileName), "/")
+}
+
+// WriteFile writes a file to the share, this is used to simulate files written by the invocation image
+func (f *FileShare) WriteFile(fileName string, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[cleanFileName(fileName)] = content
+}
+
+// Files returns a copy of the files in the share keyed by file name
+func (f *FileShare) Files() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files := make(map[string]string, len(f.files))
+	for k, v := range f.files {
+		files[k] = v
+	}
+	return files
+}
+
+// CheckIfFileExists checks if a file exists in the share
+func (f *FileShare) CheckIfFileExists(fileName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.files[cleanFileName(fileName)]
+	return ok, nil
+}
+
+// ReadFileFromShare reads a file from the share
+func (f *FileShare) ReadFileFromShare(fileName string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.files[cleanFileName(fileName)]
+	if !ok {
+		return "", fmt.Errorf("File %s not found in FileShare", fileName)
+	}
+	return content, nil
+}
+
+// WriteFileToShare writes a file to the share, it fails if the file exists and overwrite is false
+func (f *FileShare) WriteFileToShare(fileName string, content []byte, overwrite bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := cleanFileName(fileName)
+	if _, ok := f.files[name]; ok && !overwrite {
+		return fmt.Errorf("File %s already exists in FileShare", fileName)
+	}
+	f.files[name] = string(content)
+	return nil
+}
+
+// DeleteDirectoryFromShare deletes the files in a directory of the share
+func (f *FileShare) DeleteDirectoryFromShare(dirName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := cleanFileName(dirName) + "/"
+	deleted := false
+	for name := range f.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(f.files, name)
+			deleted = true
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteFileFromShare deletes a file from the share
+func (f *FileShare) DeleteFileFromShare(fileName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := cleanFileName(fileName)
+	_, ok := f.files[name]
+	delete(f.files, name)
+	return ok, nil
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/Azure/azure-sdk-for-go/storage"
 )
 
+// maxWriteRangeSize is the largest range that can be written to a file in a single request
+const maxWriteRangeSize = 4 * 1024 * 1024
+
 type FileShare struct {
 	share *storage.Share
 }
@@ -70,22 +73,74 @@ func (afs *FileShare) WriteFileToShare(fileName string, content []byte, overwrit
 		return fmt.Errorf("File %s already exists in FileShare %s", fileName, afs.share.Name)
 	}
 
-	size := uint64(len(content))
 	err := file.Create(uint64(len(content)), nil)
 	if err != nil {
 		return fmt.Errorf("Error creating file %s in FileShare %s Error:%v", fileName, afs.share.Name, err)
 	}
 
-	writeRangeOptions := storage.WriteRangeOptions{
-		ContentMD5: getMD5HashAsBase64(content),
-	}
-	err = file.WriteRange(bytes.NewReader(content), storage.FileRange{Start: 0, End: size - 1}, &writeRangeOptions)
-	if err != nil {
-		return fmt.Errorf("Error writing file %s in FileShare %s Error:%v", fileName, afs.share.Name, err)
+	// Files larger than the maximum range size are written in chunks
+	for start := 0; start < len(content); start += maxWriteRangeSize {
+		end := start + maxWriteRangeSize
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := content[start:end]
+		writeRangeOptions := storage.WriteRangeOptions{
+			ContentMD5: getMD5HashAsBase64(chunk),
+		}
+		err = file.WriteRange(bytes.NewReader(chunk), storage.FileRange{Start: uint64(start), End: uint64(end - 1)}, &writeRangeOptions)
+		if err != nil {
+			return fmt.Errorf("Error writing file %s in FileShare %s Error:%v", fileName, afs.share.Name, err)
+		}
 	}
 
 	return nil
 }
+
+// DeleteDirectoryFromShare deletes a directory and everything in it, it returns false if the directory does not exist
+func (afs *FileShare) DeleteDirectoryFromShare(dirName string) (bool, error) {
+	cleanDirName := strings.Trim(path.Clean(dirName), "/")
+	if len(cleanDirName) == 0 || cleanDirName == "." {
+		return false, fmt.Errorf("No directory name in path: %s", dirName)
+	}
+	if exists, err := afs.checkIfDirExists(cleanDirName); err != nil || !exists {
+		return false, err
+	}
+
+	if err := afs.deleteDirectoryContents(afs.share.GetRootDirectoryReference().GetDirectoryReference(cleanDirName)); err != nil {
+		return false, fmt.Errorf("Error deleting directory %s from FileShare %s: %v", dirName, afs.share.Name, err)
+	}
+	return afs.share.GetRootDirectoryReference().GetDirectoryReference(cleanDirName).DeleteIfExists(nil)
+}
+
+// deleteDirectoryContents deletes the files and directories in a directory as only empty directories can be deleted
+func (afs *FileShare) deleteDirectoryContents(dir *storage.Directory) error {
+	params := storage.ListDirsAndFilesParameters{}
+	for {
+		list, err := dir.ListDirsAndFiles(params)
+		if err != nil {
+			return err
+		}
+		for _, file := range list.Files {
+			if _, err := dir.GetFileReference(file.Name).DeleteIfExists(nil); err != nil {
+				return err
+			}
+		}
+		for _, child := range list.Directories {
+			childDir := dir.GetDirectoryReference(child.Name)
+			if err := afs.deleteDirectoryContents(childDir); err != nil {
+				return err
+			}
+			if _, err := childDir.DeleteIfExists(nil); err != nil {
+				return err
+			}
+		}
+		if len(list.NextMarker) == 0 {
+			return nil
+		}
+		params.Marker = list.NextMarker
+	}
+}
 func getMD5HashAsBase64(content []byte) string {
 	hash := md5.Sum(content)
 	return base64.StdEncoding.EncodeToString(hash[:])
@@ -96,7 +151,7 @@ func NewFileShare(accountName string, accountKey string, shareName string) (*Fil
 	afs := FileShare{
 		share: nil,
 	}
-	baseclient, err := storage.NewBasicClient(accountName, accountKey)
+	baseclient, err := storage.NewClient(accountName, accountKey, StorageEndpointSuffix(), storage.DefaultAPIVersion, true)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting Storage Client when creating FileShareClient: %v", err)
 	}
@@ -12,6 +12,7 @@ import (
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/azure/cli"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,10 +41,25 @@ type LoginInfo struct {
 	Authorizer         autorest.Authorizer
 	LoginType          LoginType
 	OAuthTokenProvider adal.OAuthTokenProvider
+	// ObjectID is the Azure AD object ID of the logged in user or service principal, it is empty if it could not be read from the access token
+	ObjectID string
 }
 
 // LoginToAzure attempts to login to azure
 func LoginToAzure(clientID string, clientSecret string, tenantID string, applicationID string) (LoginInfo, error) {
+	loginInfo, err := login(clientID, clientSecret, tenantID, applicationID)
+	if err != nil {
+		return loginInfo, err
+	}
+
+	loginInfo.ObjectID, err = getObjectID(loginInfo)
+	if err != nil {
+		log.Debug("Failed to get object ID of logged in identity: ", err)
+	}
+	return loginInfo, nil
+}
+
+func login(clientID string, clientSecret string, tenantID string, applicationID string) (LoginInfo, error) {
 
 	var loginInfo LoginInfo
 	var err error
@@ -51,10 +67,13 @@ func LoginToAzure(clientID string, clientSecret string, tenantID string, applica
 	if len(clientID) != 0 && len(clientSecret) != 0 && len(tenantID) != 0 {
 		log.Debug("Attempting to Login with Service Principal")
 		clientCredentailsConfig := auth.NewClientCredentialsConfig(clientID, clientSecret, tenantID)
-		loginInfo.Authorizer, err = clientCredentailsConfig.Authorizer()
+		clientCredentailsConfig.AADEndpoint = ActiveDirectoryEndpoint()
+		clientCredentailsConfig.Resource = ResourceManagerEndpoint()
+		loginInfo.OAuthTokenProvider, err = clientCredentailsConfig.ServicePrincipalToken()
 		if err != nil {
 			return loginInfo, fmt.Errorf("Attempt to set Authorizer with Service Principal failed: %v", err)
 		}
+		loginInfo.Authorizer = autorest.NewBearerAuthorizer(loginInfo.OAuthTokenProvider)
 
 		log.Debug("Logged in with Service Principal")
 		loginInfo.LoginType = ServicePrincipal
@@ -65,6 +84,8 @@ func LoginToAzure(clientID string, clientSecret string, tenantID string, applica
 	if len(applicationID) != 0 && len(tenantID) != 0 {
 		log.Debug("Attempting to Login with Device Code")
 		deviceFlowConfig := auth.NewDeviceFlowConfig(applicationID, tenantID)
+		deviceFlowConfig.AADEndpoint = ActiveDirectoryEndpoint()
+		deviceFlowConfig.Resource = ResourceManagerEndpoint()
 		loginInfo.OAuthTokenProvider, err = deviceFlowConfig.ServicePrincipalToken()
 		if err != nil {
 			return loginInfo, fmt.Errorf("failed to get oauth token from device flow: %v", err)
@@ -94,10 +115,11 @@ func LoginToAzure(clientID string, clientSecret string, tenantID string, applica
 	if checkForMSIEndpoint() {
 		log.Debug("Attempting to Login with MSI")
 		msiConfig := auth.NewMSIConfig()
-		loginInfo.Authorizer, err = msiConfig.Authorizer()
+		loginInfo.OAuthTokenProvider, err = msiConfig.ServicePrincipalToken()
 		if err != nil {
 			return loginInfo, fmt.Errorf("Attempt to set Authorizer with MSI failed: %v", err)
 		}
+		loginInfo.Authorizer = autorest.NewBearerAuthorizer(loginInfo.OAuthTokenProvider)
 		loginInfo.LoginType = MSI
 		log.Debug("Logged in with MSI")
 		return loginInfo, nil
@@ -167,6 +189,42 @@ func GetCloudShellToken() (*adal.Token, error) {
 
 	return &token, nil
 }
+
+// AccessToken gets an Azure Resource Manager access token for the logged in identity
+func (loginInfo LoginInfo) AccessToken() (string, error) {
+	var accessToken string
+	switch {
+	case loginInfo.LoginType == CLI:
+		token, err := cli.GetTokenFromCLI(ResourceManagerEndpoint())
+		if err != nil {
+			return "", fmt.Errorf("Failed to get token from cli: %v", err)
+		}
+		accessToken = token.AccessToken
+	case loginInfo.OAuthTokenProvider != nil:
+		// Service Principal and MSI tokens are not acquired until they are first used
+		if refresher, ok := loginInfo.OAuthTokenProvider.(adal.Refresher); ok {
+			if err := refresher.EnsureFresh(); err != nil {
+				return "", fmt.Errorf("Failed to refresh token: %v", err)
+			}
+		}
+		accessToken = loginInfo.OAuthTokenProvider.OAuthToken()
+	}
+
+	if len(accessToken) == 0 {
+		return "", errors.New("No access token available")
+	}
+	return accessToken, nil
+}
+
+// getObjectID reads the oid claim from the access token for the logged in identity
+func getObjectID(loginInfo LoginInfo) (string, error) {
+	accessToken, err := loginInfo.AccessToken()
+	if err != nil {
+		return "", err
+	}
+	return getFromToken(accessToken, "oid")
+}
+
 func checkForMSIEndpoint() bool {
 	var err error
 	for i := 1; i < 4; i++ {
@@ -1,11 +1,13 @@
 package azure
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strconv"
 	"testing"
 
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,3 +69,30 @@ func shouldRunTest(envVarName string) bool {
 	}
 	return false
 }
+
+func TestGetObjectID(t *testing.T) {
+	// The claims are chosen so that the encoded payload contains characters that differ between base64 and base64url
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"oid":"22222222-2222-2222-2222-222222222222","name":"???>>>"}`))
+	testcases := []struct {
+		name        string
+		loginInfo   LoginInfo
+		expected    string
+		expectError string
+	}{
+		{"reads the oid claim from the token", LoginInfo{LoginType: CloudShell, OAuthTokenProvider: &adal.Token{AccessToken: "header." + claims + ".signature"}}, "22222222-2222-2222-2222-222222222222", ""},
+		{"fails if there is no token", LoginInfo{LoginType: MSI}, "", "No access token available"},
+		{"fails if the token is not a JWT", LoginInfo{LoginType: DeviceCode, OAuthTokenProvider: &adal.Token{AccessToken: "token"}}, "", "Failed to get bearer token from CloudShell Token"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			objectID, err := getObjectID(tc.loginInfo)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, objectID)
+		})
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"path"
 	"reflect"
 	"regexp"
+	"strconv"
 
 	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
-	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2018-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/cli"
 	"github.com/Azure/go-autorest/autorest/to"
@@ -22,20 +25,26 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
 
 	"os"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const (
 	userAgentPrefix      = "azure-cnab-driver"
+	generatedNamePrefix  = "cnab-azure-"
 	fileMountPoint       = "/mnt/BundleFiles"
 	fileMountName        = "bundlefilevolume"
 	stateMountName       = "state"
 	stateMountPoint      = "/cnab/state"
 	cnabOutputDirName    = "outputs"
 	cnabOutputMountPoint = "/cnab/app/"
+	defaultCPU           = 1.5
+	defaultMemoryInGB    = 1
+	maxGPUCount          = 4
 
 	// We could have a more complex regex for the subscription ID but
 	// we parse that anyway to ensure validity so we can keep the regex here simple.
@@ -47,41 +56,136 @@ const (
 	// validate that separatley too.
 	azureSubscriptionScopeRegexPattern  = "^/subscriptions/[a-z0-9-]{36}$"
 	azureResourceGroupScopeRegexPattern = "^/subscriptions/[a-z0-9-]{36}/resourceGroups/[-\\w\\._\\(\\)]+$"
+	// A subnet is a child resource of a virtual network so the resource ID has to be parsed here rather than using azure.ParseResourceID
+	azureSubnetIDRegexPattern = "(?i)^/subscriptions/([a-z0-9-]{36})/resourceGroups/([-\\w\\._\\(\\)]+)/providers/Microsoft\\.Network/virtualNetworks/([-\\w\\.]+)/subnets/([-\\w\\.]+)$"
+
+	// A container group can only be attached to a subnet that is delegated to ACI
+	aciSubnetDelegation = "Microsoft.ContainerInstance/containerGroups"
+
+	// Tags added by the driver to every resource that it creates, tag names starting with the prefix cannot be set in CNAB_AZURE_TAGS.
+	// The retained tags are only added to resources that are kept after a failure by the retention policy.
+	reservedTagPrefix    = "cnab-"
+	tagBundleName        = "cnab-bundle-name"
+	tagBundleVersion     = "cnab-bundle-version"
+	tagInstallation      = "cnab-installation"
+	tagAction            = "cnab-action"
+	tagDriverVersion     = "cnab-driver-version"
+	tagCreatedAt         = "cnab-created-at"
+	tagCreatedBy         = "cnab-created-by"
+	tagRetentionPolicy   = "cnab-retention-policy"
+	tagRetainedAt        = "cnab-retained-at"
+	tagRetainUntil       = "cnab-retain-until"
+	driverTagCount       = 10
+	maxTagCount          = 50
+	maxTagNameLength     = 512
+	maxTagValueLength    = 256
+	invalidTagCharacters = "<>%&\\?/"
 )
 
+// ErrOperationTimedOut is returned when an operation does not complete within the time set in CNAB_AZURE_TIMEOUT
+var ErrOperationTimedOut = errors.New("operation timed out")
+
 // aciDriver runs Docker and OCI invocation images in ACI
 type aciDriver struct {
-	deleteACIResources      bool
-	subscriptionID          string
-	clientID                string
-	clientSecret            string
-	tenantID                string
-	applicationID           string
-	aciRG                   string
-	createRG                bool
-	aciLocation             string
-	aciName                 string
-	msiType                 string
-	msiResource             azure.Resource
-	systemMSIScope          string
-	systemMSIRole           string
-	propagateCredentials    bool
-	userMSIResourceID       string
-	useSPForACR             bool
-	imageRegistryUser       string
-	imageRegistryPassword   string
+	deleteACIResources    bool
+	keepOnFailure         bool
+	retentionTTL          time.Duration
+	retained              bool
+	subscriptionID        string
+	clientID              string
+	clientSecret          string
+	tenantID              string
+	applicationID         string
+	aciRG                 string
+	createRG              bool
+	aciLocation           string
+	aciName               string
+	msiType               string
+	msiResource           azure.Resource
+	systemMSIScope        string
+	systemMSIRole         string
+	propagateCredentials  bool
+	userMSIResourceID     string
+	useSPForACR           bool
+	imageRegistryUser     string
+	imageRegistryPassword string
+	// acrTokenExchange is true if the login token is exchanged for credentials when the invocation image is in an Azure Container Registry
+	acrTokenExchange bool
+	// dockerConfigDir is the directory of the Docker config.json that registry credentials are read from if none are configured
+	dockerConfigDir         string
 	hasStateVolumeInfo      bool
 	mountStateVolume        bool
 	stateFileShare          string
 	stateStorageAccountName string
 	stateStorageAccountKey  string
+	stateBlobContainer      string
 	statePath               string
 	stateMountPoint         string
 	userAgent               string
+	version                 string
 	loginInfo               az.LoginInfo
 	hasOutputs              bool
-	deleteOutputs           bool
-	debugContainer          bool
+	outputTransport         string
+	// outputsInLogs is true if the outputs are read from the container logs, logOutputs are the encoded outputs that were read
+	outputsInLogs bool
+	logOutputs    map[string]string
+	// outputsInBlob is true if the invocation image uploads the outputs to the state blob container using the container URL and SAS token
+	outputsInBlob       bool
+	outputsContainerURL string
+	outputsSASToken     string
+	deleteOutputs       bool
+	debugContainer      bool
+	fileInjection       string
+	// stagedFilesPath is the directory in the state file share that file inputs too large for a secret volume are staged in
+	stagedFilesPath       string
+	fileInjectionFallback string
+	// systemMSIPrincipalID is the principal of the system assigned identity of the container group once it has been created
+	systemMSIPrincipalID string
+	// runCommand is the command declared in the bundle extension, imageCommand is the entrypoint and cmd read from the registry
+	runCommand        []string
+	imageCommand      []string
+	getImageConfig    func(ctx context.Context, image string, domain string) (*registry.ImageConfig, error)
+	exchangeACRToken  func(ctx context.Context, domain string) (string, error)
+	dockerCredentials func(ctx context.Context, domain string) (registry.Credentials, bool, error)
+	relocationMapping relocationMapping
+	registryMirrors   registryMirrors
+	// bootstrapImage and initContainerImage are the images used by the driver, registry mirrors have been applied to them
+	bootstrapImage     string
+	initContainerImage string
+	dryRun             bool
+	detach             bool
+	detached           bool
+	streamLogs         bool
+	cpu                float64
+	memoryInGB         float64
+	gpuSKU             string
+	gpuCount           int
+	timeout            time.Duration
+	subnet             subnetDetails
+	dnsNameServers     []string
+	dnsSearchDomains   []string
+	tags               map[string]string
+	pollInterval       time.Duration
+	operationRecordDir string
+	operationRecord    *OperationRecord
+	backend            az.Backend
+	newBackend         func(authorizer autorest.Authorizer, userAgent string) az.Backend
+	login              func(clientID string, clientSecret string, tenantID string, applicationID string) (az.LoginInfo, error)
+	newFileShare       func(accountName string, accountKey string, shareName string) (fileShare, error)
+	newBlobContainer   func(accountName string, accountKey string, containerName string) (blobContainer, error)
+}
+
+// fileShare is used to read and delete outputs written to the state file share by the invocation image and to stage large file inputs
+type fileShare interface {
+	CheckIfFileExists(fileName string) (bool, error)
+	ReadFileFromShare(fileName string) (string, error)
+	DeleteFileFromShare(fileName string) (bool, error)
+	WriteFileToShare(fileName string, content []byte, overwrite bool) error
+	DeleteDirectoryFromShare(dirName string) (bool, error)
+}
+
+func newAzureFileShare(accountName string, accountKey string, shareName string) (fileShare, error) {
+	return az.NewFileShare(accountName, accountKey, shareName)
 }
 
 // Config returns the ACI driver configuration options
@@ -97,6 +201,7 @@ func (d *aciDriver) Config() map[string]string {
 		"CNAB_AZURE_LOCATION":                           "The location to create the ACI Instance in",
 		"CNAB_AZURE_NAME":                               "The name of the ACI instance to create - if not specified a name will be generated",
 		"CNAB_AZURE_DELETE_RESOURCES":                   "Delete RG and ACI instance created - default is true useful to set to false for debugging - only deletes RG if it was created by the driver",
+		"CNAB_AZURE_RETENTION_POLICY":                   "Controls which resources created by the driver are deleted when the operation completes: always, never, on-success or on-success:<duration> to keep them after a failure for the duration - default is always, cannot be set with CNAB_AZURE_DELETE_RESOURCES",
 		"CNAB_AZURE_MSI_TYPE":                           "This can be set to user or system",
 		"CNAB_AZURE_SYSTEM_MSI_ROLE":                    "The role to be asssigned to System MSI User - used if CNAB_AZURE_ACI_MSI_TYPE == system, if this is null or empty then the role defaults to contributor",
 		"CNAB_AZURE_SYSTEM_MSI_SCOPE":                   "The scope to apply the role to System MSI User - will attempt to set scope to the  Resource Group that the ACI Instance is being created in if not set",
@@ -105,21 +210,61 @@ func (d *aciDriver) Config() map[string]string {
 		"CNAB_AZURE_USE_CLIENT_CREDS_FOR_REGISTRY_AUTH": "If this is set to true the CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET are also used for authentication to ACR",
 		"CNAB_AZURE_REGISTRY_USERNAME":                  "The username for authenticating to the container registry",
 		"CNAB_AZURE_REGISTRY_PASSWORD":                  "The password for authenticating to the container registry",
+		"CNAB_AZURE_DOCKER_CONFIG":                      "The directory of the Docker config.json that registry credentials are read from if none are set - default is DOCKER_CONFIG or ~/.docker",
+		"CNAB_AZURE_REGISTRY_TOKEN_EXCHANGE":            "If no registry credentials are set the Azure AD token of the driver is exchanged for credentials for ACR registries, set to false to disable - default is true",
 		"CNAB_AZURE_STATE_FILESHARE":                    "The File Share for Azure State volume",
 		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME":         "The Storage Account for the Azure State File Share",
 		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":          "The Storage Key for the Azure State File Share",
 		"CNAB_AZURE_STATE_MOUNT_POINT":                  "The mount point location for state volume",
+		"CNAB_AZURE_RELOCATION_MAPPING":                 "Path to a CNAB relocation mapping file, if the invocation image is in the mapping it is pulled from the relocated reference",
+		"CNAB_AZURE_REGISTRY_MIRRORS":                   "A comma separated list of registry=mirror rules e.g. docker.io=myregistry.azurecr.io/dockerhub, images in the registry are pulled from the mirror instead",
+		"CNAB_AZURE_BOOTSTRAP_IMAGE":                    "The image used to create the Container Group that sets up a system assigned identity - default is alpine:latest",
+		"CNAB_AZURE_INIT_CONTAINER_IMAGE":               "The image of the init container used by init-container file injection, it must have a statically linked busybox at /bin/busybox - default is busybox:1.36-musl",
+		"CNAB_AZURE_STATE_BLOB_CONTAINER":               "The Blob Container in the State Storage Account that outputs are uploaded to, this can be set instead of CNAB_AZURE_STATE_FILESHARE",
 		"CNAB_AZURE_DELETE_OUTPUTS_FROM_FILESHARE":      "Any Outputs Created in the fileshare are deleted on completion",
-		"CNAB_AZURE_DEBUG_CONTAINER":                    "Replaces /cnab/app/run with tail -f /dev/null so that container can be connected to and debugged",
+		"CNAB_AZURE_DEBUG_CONTAINER":                    "Replaces the command of the invocation image with tail -f /dev/null so that container can be connected to and debugged",
+		"CNAB_AZURE_CPU":                                "The number of CPU cores to allocate to the container instance - default is 1.5",
+		"CNAB_AZURE_MEMORY_GB":                          "The memory in GB to allocate to the container instance - default is 1",
+		"CNAB_AZURE_GPU_SKU":                            "The SKU of GPU to allocate to the container instance (K80, P100 or V100) - if not set no GPU is allocated",
+		"CNAB_AZURE_GPU_COUNT":                          "The number of GPUs to allocate to the container instance - default is 1 if CNAB_AZURE_GPU_SKU is set",
+		"CNAB_AZURE_TIMEOUT":                            "The maximum duration of the operation (e.g. 30m or 2h) after which the container instance is stopped - default is no timeout",
+		"CNAB_AZURE_SUBNET_ID":                          "The resource ID of a virtual network subnet delegated to Microsoft.ContainerInstance/containerGroups that the container instance is attached to - if not set the container instance is not attached to a virtual network",
+		"CNAB_AZURE_DNS_NAME_SERVERS":                   "A comma separated list of DNS servers for the container instance - requires CNAB_AZURE_SUBNET_ID",
+		"CNAB_AZURE_DNS_SEARCH_DOMAINS":                 "A comma separated list of DNS search domains for the container instance - requires CNAB_AZURE_DNS_NAME_SERVERS",
+		"CNAB_AZURE_TAGS":                               "A comma separated list of name=value tags to apply to the resource group and container instance in addition to the tags added by the driver, names starting with cnab- are reserved",
+		"CNAB_AZURE_DETACH":                             "If this is set to true the driver returns as soon as the container group has been created, use cnab-azure status to check the operation and cnab-azure collect to get the outputs and clean up once it has completed, default is false",
+		"CNAB_AZURE_DRY_RUN":                            "If this is set to true the container group that would be created is printed as JSON with secret values redacted and no Azure resources are created, default is false",
+		"CNAB_AZURE_FILE_INJECTION":                     "How files and outputs are set up in the invocation image: bash, sh, init-container to run the set up with a shell copied into the container by an init container, or auto to use bash and fall back to sh and then init-container if the image does not have the shell - default is auto",
+		"CNAB_AZURE_OUTPUT_TRANSPORT":                   "How outputs are retrieved: fileshare to read them from the state file share, blob to read them from the state blob container, logs to read them from the container logs, or auto to use the state file share if it is configured or available in Cloud Shell, the state blob container if it is configured and the container logs otherwise - default is auto",
+		"CNAB_AZURE_STREAM_LOGS":                        "If this is set to false the logs of the invocation image are polled rather than streamed through the ACI attach API, default is true",
 	}
 }
 
+// ACIDriver is a driver.Driver that can also run an operation using a context that can be cancelled
+type ACIDriver interface {
+	driver.Driver
+	// RunWithContext executes the operation, if the context is cancelled the container group is stopped and any resources created are cleaned up
+	RunWithContext(ctx context.Context, op *driver.Operation) (driver.OperationResult, error)
+	// Plan builds the container group that would be created to run the operation without calling Azure
+	Plan(op *driver.Operation) (*Plan, error)
+}
+
 // NewACIDriver creates a new ACI Driver instance
-func NewACIDriver(version string) (driver.Driver, error) {
+func NewACIDriver(version string) (ACIDriver, error) {
 	d := &aciDriver{
-		msiResource: azure.Resource{},
-	}
+		msiResource:        azure.Resource{},
+		pollInterval:       5 * time.Second,
+		operationRecordDir: defaultOperationRecordDir(),
+		newBackend:         az.NewBackend,
+		login:              az.LoginToAzure,
+		newFileShare:       newAzureFileShare,
+		newBlobContainer:   newAzureBlobContainer,
+	}
+	d.getImageConfig = d.getImageConfigFromRegistry
+	d.exchangeACRToken = d.exchangeACRTokenFromLogin
+	d.dockerCredentials = d.getDockerConfigCredentials
 	d.userAgent = fmt.Sprintf("%s-%s", userAgentPrefix, version)
+	d.version = version
 	config := make(map[string]string)
 	for env := range d.Config() {
 		config[env] = os.Getenv(env)
@@ -141,55 +286,25 @@ func (d *aciDriver) processConfiguration(config map[string]string) error {
 	}
 	log.Debug("Delete Resources: ", d.deleteACIResources)
 
-	// Azure AAD Client Id for authenticating to Azure
-	d.clientID = config["CNAB_AZURE_CLIENT_ID"]
-	log.Debug("Client ID: ", d.clientID)
-
-	// Azure AAD Client Secret for authenticating to Azure
-	d.clientSecret = config["CNAB_AZURE_CLIENT_SECRET"]
-	log.Debug("Client Secret Set: ", len(d.clientSecret) > 0)
-
-	//Validate that both of Client Id and Client Secret are set
-	clientCreds, err := checkAllOrNoneSet(config, []string{"CNAB_AZURE_CLIENT_ID", "CNAB_AZURE_CLIENT_SECRET"})
-	if err != nil {
-		return err
-	}
-
-	// Azure Tenant Id for authenticating to Azure
-	d.tenantID = config["CNAB_AZURE_TENANT_ID"]
-	log.Debug("Tenant ID: ", d.tenantID)
-
-	// Azure Application Id to be used with device code auth flow
-	d.applicationID = config["CNAB_AZURE_APP_ID"]
-	log.Debug("Application ID: ", d.applicationID)
-	appID := len(d.applicationID) > 0
-
-	// SPN and appId are mutually exclusive
-	if clientCreds && appID {
-		return errors.New("either CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET or CNAB_AZURE_APP_ID should be set not both")
-	}
-
-	// TenantId is required when client credentials or CNAB_AZURE_APP_ID is set
-	if (clientCreds || appID) && len(d.tenantID) == 0 {
-		if az.IsInCloudShell() {
-			d.tenantID = az.GetTenantIDFromCliProfile()
+	// The retention policy replaces CNAB_AZURE_DELETE_RESOURCES so that failed operations can be kept for debugging
+	d.keepOnFailure = false
+	d.retentionTTL = 0
+	if len(config["CNAB_AZURE_RETENTION_POLICY"]) > 0 {
+		if len(config["CNAB_AZURE_DELETE_RESOURCES"]) > 0 {
+			return errors.New("CNAB_AZURE_DELETE_RESOURCES should not be set when CNAB_AZURE_RETENTION_POLICY is set")
 		}
-		if len(d.tenantID) == 0 {
-			return errors.New("CNAB_AZURE_TENANT_ID should be set when CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET or CNAB_AZURE_APP_ID are set")
+		policy, err := parseRetentionPolicy(config["CNAB_AZURE_RETENTION_POLICY"])
+		if err != nil {
+			return err
 		}
+		d.setRetentionPolicy(policy)
 	}
+	log.Debug("Retention Policy: ", d.retention())
 
-	// TenantId should not be set if client creds or app id not set
-	if !clientCreds && !appID && len(d.tenantID) > 0 {
-		return errors.New("CNAB_AZURE_TENANT_ID should not be set when CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET or CNAB_AZURE_APP_ID are not set")
-	}
-
-	// Azure Subscription Id to create resources to run invocation image in - if this is not set then the first subscription found will be used
-	d.subscriptionID = config["CNAB_AZURE_SUBSCRIPTION_ID"]
-	if len(d.subscriptionID) == 0 {
-		d.subscriptionID = az.GetSubscriptionIDFromCliProfile()
+	err := d.processLoginConfiguration(config)
+	if err != nil {
+		return err
 	}
-	log.Debug("Subscription ID: ", d.subscriptionID)
 
 	// Check to see if an resource group name has been set, if not then a location must be set , if an resource group name is set and no location is used then the resource group must already exist and the location of he resource group will be used for the resources
 	d.aciRG = config["CNAB_AZURE_RESOURCE_GROUP"]
@@ -207,14 +322,14 @@ func (d *aciDriver) processConfiguration(config map[string]string) error {
 	// If Resource group name is not set generate a unique name
 	d.createRG = len(d.aciRG) == 0
 	if d.createRG {
-		d.aciRG = fmt.Sprintf("cnab-azure-%s", uuid.New().String())
+		d.aciRG = generatedNamePrefix + uuid.New().String()
 		log.Debug("New Resource Group : ", d.aciRG)
 	}
 
 	// If aci driver name is not set generate a unique aci name
 	d.aciName = config["CNAB_AZURE_NAME"]
 	if len(d.aciName) == 0 {
-		d.aciName = fmt.Sprintf("cnab-azure-%s", uuid.New().String())
+		d.aciName = generatedNamePrefix + uuid.New().String()
 	}
 
 	log.Debug("Generated ACI Name: ", d.aciName)
@@ -293,18 +408,191 @@ func (d *aciDriver) processConfiguration(config map[string]string) error {
 		d.imageRegistryPassword = d.clientSecret
 		d.imageRegistryUser = d.clientID
 	}
+
+	// CNAB_AZURE_REGISTRY_TOKEN_EXCHANGE disables the exchange of the login token for ACR credentials
+	d.acrTokenExchange = strings.ToLower(config["CNAB_AZURE_REGISTRY_TOKEN_EXCHANGE"]) != "false"
+	log.Debug("Registry Token Exchange: ", d.acrTokenExchange)
+
+	d.dockerConfigDir = config["CNAB_AZURE_DOCKER_CONFIG"]
+	if len(d.dockerConfigDir) == 0 {
+		d.dockerConfigDir = registry.DefaultDockerConfigDir()
+	}
+	log.Debug("Docker Config Directory: ", d.dockerConfigDir)
+	err = d.processStateConfiguration(config)
+	if err != nil {
+		return err
+	}
+
+	d.deleteOutputs = !(len(config["CNAB_AZURE_DELETE_OUTPUTS_FROM_FILESHARE"]) > 0 && strings.ToLower(config["CNAB_AZURE_DELETE_OUTPUTS_FROM_FILESHARE"]) == "false")
+	d.debugContainer = len(config["CNAB_AZURE_DEBUG_CONTAINER"]) > 0 && strings.ToLower(config["CNAB_AZURE_DEBUG_CONTAINER"]) == "true"
+	d.dryRun = len(config["CNAB_AZURE_DRY_RUN"]) > 0 && strings.ToLower(config["CNAB_AZURE_DRY_RUN"]) == "true"
+	d.streamLogs = !(len(config["CNAB_AZURE_STREAM_LOGS"]) > 0 && strings.ToLower(config["CNAB_AZURE_STREAM_LOGS"]) == "false")
+	d.fileInjection, err = parseFileInjection(config["CNAB_AZURE_FILE_INJECTION"])
+	if err != nil {
+		return err
+	}
+	log.Debug("File Injection: ", d.fileInjection)
+	d.outputTransport, err = parseOutputTransport(config["CNAB_AZURE_OUTPUT_TRANSPORT"])
+	if err != nil {
+		return err
+	}
+	log.Debug("Output Transport: ", d.outputTransport)
+	d.relocationMapping = nil
+	if len(config["CNAB_AZURE_RELOCATION_MAPPING"]) > 0 {
+		d.relocationMapping, err = readRelocationMapping(config["CNAB_AZURE_RELOCATION_MAPPING"])
+		if err != nil {
+			return err
+		}
+		log.Debug("Relocation Mapping: ", config["CNAB_AZURE_RELOCATION_MAPPING"])
+	}
+	if err := d.processImageConfiguration(config); err != nil {
+		return err
+	}
+
+	// CNAB_AZURE_CPU, CNAB_AZURE_MEMORY_GB and CNAB_AZURE_GPU_* control the resources allocated to the container instance, these can be overridden by the bundle
+	d.cpu = defaultCPU
+	if len(config["CNAB_AZURE_CPU"]) > 0 {
+		d.cpu, err = strconv.ParseFloat(config["CNAB_AZURE_CPU"], 64)
+		if err != nil {
+			return fmt.Errorf("CNAB_AZURE_CPU environment variable parsing error: %v", err)
+		}
+	}
+	log.Debug("CPU: ", d.cpu)
+
+	d.memoryInGB = defaultMemoryInGB
+	if len(config["CNAB_AZURE_MEMORY_GB"]) > 0 {
+		d.memoryInGB, err = strconv.ParseFloat(config["CNAB_AZURE_MEMORY_GB"], 64)
+		if err != nil {
+			return fmt.Errorf("CNAB_AZURE_MEMORY_GB environment variable parsing error: %v", err)
+		}
+	}
+	log.Debug("Memory in GB: ", d.memoryInGB)
+
+	d.gpuSKU = strings.ToUpper(config["CNAB_AZURE_GPU_SKU"])
+	d.gpuCount = 0
+	if len(config["CNAB_AZURE_GPU_COUNT"]) > 0 {
+		if len(d.gpuSKU) == 0 {
+			return errors.New("CNAB_AZURE_GPU_SKU should be set when CNAB_AZURE_GPU_COUNT is set")
+		}
+		d.gpuCount, err = strconv.Atoi(config["CNAB_AZURE_GPU_COUNT"])
+		if err != nil {
+			return fmt.Errorf("CNAB_AZURE_GPU_COUNT environment variable parsing error: %v", err)
+		}
+	} else if len(d.gpuSKU) > 0 {
+		d.gpuCount = 1
+	}
+	log.Debugf("GPU SKU: %s GPU Count: %d", d.gpuSKU, d.gpuCount)
+
+	// CNAB_AZURE_TIMEOUT sets an upper bound on how long the operation can run for
+	d.timeout = 0
+	if len(config["CNAB_AZURE_TIMEOUT"]) > 0 {
+		d.timeout, err = time.ParseDuration(config["CNAB_AZURE_TIMEOUT"])
+		if err != nil {
+			return fmt.Errorf("CNAB_AZURE_TIMEOUT environment variable parsing error: %v", err)
+		}
+		if d.timeout < 0 {
+			return fmt.Errorf("value (%s) of CNAB_AZURE_TIMEOUT should not be negative", config["CNAB_AZURE_TIMEOUT"])
+		}
+	}
+	log.Debug("Timeout: ", d.timeout)
+
+	// A detached operation is not watched by the driver so the timeout cannot be enforced
+	d.detach = len(config["CNAB_AZURE_DETACH"]) > 0 && strings.ToLower(config["CNAB_AZURE_DETACH"]) == "true"
+	if d.detach && d.timeout > 0 {
+		return errors.New("CNAB_AZURE_TIMEOUT should not be set when CNAB_AZURE_DETACH is true")
+	}
+	log.Debug("Detach: ", d.detach)
+
+	// The container group is only attached to a virtual network if a subnet is set, DNS settings only apply to container groups in a virtual network
+	d.subnet = subnetDetails{}
+	if len(config["CNAB_AZURE_SUBNET_ID"]) > 0 {
+		d.subnet, err = parseSubnetID(config["CNAB_AZURE_SUBNET_ID"])
+		if err != nil {
+			return fmt.Errorf("CNAB_AZURE_SUBNET_ID environment variable parsing error: %v", err)
+		}
+	}
+	log.Debug("Subnet ID: ", d.subnet.ID)
+
+	d.dnsNameServers = splitList(config["CNAB_AZURE_DNS_NAME_SERVERS"])
+	for _, nameServer := range d.dnsNameServers {
+		if net.ParseIP(nameServer) == nil {
+			return fmt.Errorf("CNAB_AZURE_DNS_NAME_SERVERS environment variable parsing error: %s is not an IP address", nameServer)
+		}
+	}
+
+	d.dnsSearchDomains = splitList(config["CNAB_AZURE_DNS_SEARCH_DOMAINS"])
+	if len(d.dnsNameServers) > 0 && len(d.subnet.ID) == 0 {
+		return errors.New("CNAB_AZURE_SUBNET_ID should be set when CNAB_AZURE_DNS_NAME_SERVERS is set")
+	}
+	if len(d.dnsSearchDomains) > 0 && len(d.dnsNameServers) == 0 {
+		return errors.New("CNAB_AZURE_DNS_NAME_SERVERS should be set when CNAB_AZURE_DNS_SEARCH_DOMAINS is set")
+	}
+	log.Debugf("DNS Name Servers: %v DNS Search Domains: %v", d.dnsNameServers, d.dnsSearchDomains)
+
+	d.tags, err = parseTags(config["CNAB_AZURE_TAGS"])
+	if err != nil {
+		return fmt.Errorf("CNAB_AZURE_TAGS environment variable parsing error: %v", err)
+	}
+	log.Debug("Tags: ", d.tags)
+
+	return validateResources(d.cpu, d.memoryInGB, d.gpuSKU, d.gpuCount)
+}
+
+// Processes the configuration of the registry mirrors and the images used by the driver, the mirrors are applied to the images here
+func (d *aciDriver) processImageConfiguration(config map[string]string) error {
+	var err error
+	d.registryMirrors, err = parseRegistryMirrors(config["CNAB_AZURE_REGISTRY_MIRRORS"])
+	if err != nil {
+		return err
+	}
+	log.Debug("Registry Mirrors: ", config["CNAB_AZURE_REGISTRY_MIRRORS"])
+
+	images := map[string]*string{
+		"CNAB_AZURE_BOOTSTRAP_IMAGE":      &d.bootstrapImage,
+		"CNAB_AZURE_INIT_CONTAINER_IMAGE": &d.initContainerImage,
+	}
+	defaults := map[string]string{
+		"CNAB_AZURE_BOOTSTRAP_IMAGE":      defaultBootstrapImage,
+		"CNAB_AZURE_INIT_CONTAINER_IMAGE": defaultInitContainerImage,
+	}
+	for name, image := range images {
+		value := strings.TrimSpace(config[name])
+		if len(value) == 0 {
+			value = defaults[name]
+		}
+		*image, err = d.registryMirrors.apply(value)
+		if err != nil {
+			return fmt.Errorf("value (%s) of %s is not valid: %v", value, name, err)
+		}
+		log.Debugf("%s: %s", name, *image)
+	}
+	return nil
+}
+
+// Processes the configuration of the file share used for state, this is shared with the operation attacher
+func (d *aciDriver) processStateConfiguration(config map[string]string) error {
+	var err error
 	d.mountStateVolume = false
 	// CNAB_AZURE_STATE_* allows an Azure File Share to be mounted to the invocation image sto be used for instance state
 	// TODO Allow empty storage account key and do runtime lookup
-	d.hasStateVolumeInfo, err = checkAllOrNoneSet(config, []string{"CNAB_AZURE_STATE_FILESHARE", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY"})
+	// CNAB_AZURE_STATE_BLOB_CONTAINER can be used with the storage account instead of the file share when there is no state to mount
+	stateItems := []string{"CNAB_AZURE_STATE_FILESHARE", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY"}
+	d.stateBlobContainer = config["CNAB_AZURE_STATE_BLOB_CONTAINER"]
+	if len(d.stateBlobContainer) > 0 && len(config["CNAB_AZURE_STATE_FILESHARE"]) == 0 {
+		stateItems[0] = "CNAB_AZURE_STATE_BLOB_CONTAINER"
+	}
+	hasStorageAccount, err := checkAllOrNoneSet(config, stateItems)
 	if err != nil {
 		return err
 	}
 
-	if d.hasStateVolumeInfo {
-		d.stateFileShare = config["CNAB_AZURE_STATE_FILESHARE"]
+	if hasStorageAccount {
 		d.stateStorageAccountName = config["CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME"]
 		d.stateStorageAccountKey = config["CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY"]
+	}
+	d.hasStateVolumeInfo = hasStorageAccount && len(config["CNAB_AZURE_STATE_FILESHARE"]) > 0
+	if d.hasStateVolumeInfo {
+		d.stateFileShare = config["CNAB_AZURE_STATE_FILESHARE"]
 		d.mountStateVolume = true
 	}
 
@@ -322,8 +610,96 @@ func (d *aciDriver) processConfiguration(config map[string]string) error {
 		d.stateMountPoint = stateMountPoint
 	}
 
-	d.deleteOutputs = !(len(config["CNAB_AZURE_DELETE_OUTPUTS_FROM_FILESHARE"]) > 0 && strings.ToLower(config["CNAB_AZURE_DELETE_OUTPUTS_FROM_FILESHARE"]) == "false")
-	d.debugContainer = len(config["CNAB_AZURE_DEBUG_CONTAINER"]) > 0 && strings.ToLower(config["CNAB_AZURE_DEBUG_CONTAINER"]) == "true"
+	return nil
+}
+
+// Processes the configuration used to login to Azure and choose the subscription, this is shared with the garbage collector
+func (d *aciDriver) processLoginConfiguration(config map[string]string) error {
+	// Azure AAD Client Id for authenticating to Azure
+	d.clientID = config["CNAB_AZURE_CLIENT_ID"]
+	log.Debug("Client ID: ", d.clientID)
+
+	// Azure AAD Client Secret for authenticating to Azure
+	d.clientSecret = config["CNAB_AZURE_CLIENT_SECRET"]
+	log.Debug("Client Secret Set: ", len(d.clientSecret) > 0)
+
+	//Validate that both of Client Id and Client Secret are set
+	clientCreds, err := checkAllOrNoneSet(config, []string{"CNAB_AZURE_CLIENT_ID", "CNAB_AZURE_CLIENT_SECRET"})
+	if err != nil {
+		return err
+	}
+
+	// Azure Tenant Id for authenticating to Azure
+	d.tenantID = config["CNAB_AZURE_TENANT_ID"]
+	log.Debug("Tenant ID: ", d.tenantID)
+
+	// Azure Application Id to be used with device code auth flow
+	d.applicationID = config["CNAB_AZURE_APP_ID"]
+	log.Debug("Application ID: ", d.applicationID)
+	appID := len(d.applicationID) > 0
+
+	// SPN and appId are mutually exclusive
+	if clientCreds && appID {
+		return errors.New("either CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET or CNAB_AZURE_APP_ID should be set not both")
+	}
+
+	// TenantId is required when client credentials or CNAB_AZURE_APP_ID is set
+	if (clientCreds || appID) && len(d.tenantID) == 0 {
+		if az.IsInCloudShell() {
+			d.tenantID = az.GetTenantIDFromCliProfile()
+		}
+		if len(d.tenantID) == 0 {
+			return errors.New("CNAB_AZURE_TENANT_ID should be set when CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET or CNAB_AZURE_APP_ID are set")
+		}
+	}
+
+	// TenantId should not be set if client creds or app id not set
+	if !clientCreds && !appID && len(d.tenantID) > 0 {
+		return errors.New("CNAB_AZURE_TENANT_ID should not be set when CNAB_AZURE_CLIENT_ID and CNAB_AZURE_CLIENT_SECRET or CNAB_AZURE_APP_ID are not set")
+	}
+
+	// Azure Subscription Id to create resources to run invocation image in - if this is not set then the first subscription found will be used
+	d.subscriptionID = config["CNAB_AZURE_SUBSCRIPTION_ID"]
+	if len(d.subscriptionID) == 0 {
+		d.subscriptionID = az.GetSubscriptionIDFromCliProfile()
+	}
+	log.Debug("Subscription ID: ", d.subscriptionID)
+
+	return nil
+}
+
+// Validates the resources requested for the container instance, limits that vary by region are checked once the location is known
+func validateResources(cpu float64, memoryInGB float64, gpuSKU string, gpuCount int) error {
+	if cpu <= 0 {
+		return fmt.Errorf("invalid CPU value %v, CPU must be greater than 0", cpu)
+	}
+
+	if memoryInGB <= 0 {
+		return fmt.Errorf("invalid memory value %v, memory in GB must be greater than 0", memoryInGB)
+	}
+
+	if len(gpuSKU) == 0 {
+		if gpuCount > 0 {
+			return errors.New("a GPU SKU must be specified when requesting GPUs")
+		}
+		return nil
+	}
+
+	validSKU := false
+	for _, sku := range containerinstance.PossibleGpuSkuValues() {
+		if string(sku) == gpuSKU {
+			validSKU = true
+			break
+		}
+	}
+
+	if !validSKU {
+		return fmt.Errorf("invalid GPU SKU %s, supported values are %v", gpuSKU, containerinstance.PossibleGpuSkuValues())
+	}
+
+	if gpuCount < 1 || gpuCount > maxGPUCount {
+		return fmt.Errorf("invalid GPU count %d, GPU count must be between 1 and %d", gpuCount, maxGPUCount)
+	}
 
 	return nil
 }
@@ -367,6 +743,76 @@ func validateMSIScope(scope string) error {
 	return nil
 }
 
+// Parses the resource ID of a virtual network subnet
+func parseSubnetID(id string) (subnetDetails, error) {
+	matches := regexp.MustCompile(azureSubnetIDRegexPattern).FindStringSubmatch(id)
+	if matches == nil {
+		return subnetDetails{}, fmt.Errorf("invalid subnet ID %s, expected /subscriptions/<subscriptionID>/resourceGroups/<resourceGroupName>/providers/Microsoft.Network/virtualNetworks/<virtualNetworkName>/subnets/<subnetName>", id)
+	}
+
+	if _, err := uuid.Parse(matches[1]); err != nil {
+		return subnetDetails{}, fmt.Errorf("invalid subnet ID %s, %w", id, err)
+	}
+
+	return subnetDetails{
+		ID:             id,
+		SubscriptionID: matches[1],
+		ResourceGroup:  matches[2],
+		VirtualNetwork: matches[3],
+		Name:           matches[4],
+	}, nil
+}
+
+// Parses a comma separated list of name=value tags, the limits are the same as those applied by Azure
+func parseTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		if len(strings.TrimSpace(item)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("tag %s should be in the format name=value", item)
+		}
+		name := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if len(name) == 0 {
+			return nil, fmt.Errorf("tag %s has no name", item)
+		}
+		if len(name) > maxTagNameLength {
+			return nil, fmt.Errorf("tag name %s is longer than %d characters", name, maxTagNameLength)
+		}
+		if strings.ContainsAny(name, invalidTagCharacters) {
+			return nil, fmt.Errorf("tag name %s should not contain any of the characters %s", name, invalidTagCharacters)
+		}
+		if strings.HasPrefix(strings.ToLower(name), reservedTagPrefix) {
+			return nil, fmt.Errorf("tag name %s is reserved, tag names starting with %s are set by the driver", name, reservedTagPrefix)
+		}
+		if len(value) > maxTagValueLength {
+			return nil, fmt.Errorf("value of tag %s is longer than %d characters", name, maxTagValueLength)
+		}
+		// Tag names are case insensitive in Azure
+		for existing := range tags {
+			if strings.EqualFold(existing, name) {
+				return nil, fmt.Errorf("tag %s is set more than once", name)
+			}
+		}
+		tags[name] = value
+	}
+
+	if len(tags)+driverTagCount > maxTagCount {
+		return nil, fmt.Errorf("%d tags are set, at most %d tags can be set as %d tags are added by the driver", len(tags), maxTagCount-driverTagCount, driverTagCount)
+	}
+	return tags, nil
+}
+
+// Splits a comma or space separated list ignoring empty items
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
 // Checks that all or none of a set of configuration values are set
 func checkAllOrNoneSet(config map[string]string, items []string) (bool, error) {
 	var length = 0
@@ -390,7 +836,24 @@ func checkAllOrNoneSet(config map[string]string, items []string) (bool, error) {
 
 // Run executes the ACI driver
 func (d *aciDriver) Run(op *driver.Operation) (driver.OperationResult, error) {
-	return d.exec(op)
+	return d.RunWithContext(context.Background(), op)
+}
+
+// RunWithContext executes the ACI driver using the provided context
+func (d *aciDriver) RunWithContext(ctx context.Context, op *driver.Operation) (driver.OperationResult, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	result, err := d.exec(ctx, op)
+	// The timeout may have expired during an Azure API call rather than while waiting for the container
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, ErrOperationTimedOut) {
+		err = fmt.Errorf("%w after %v: %v", ErrOperationTimedOut, d.timeout, err)
+	}
+
+	return result, err
 }
 
 // Handles indicates that the ACI driver supports "docker" and "oci"
@@ -398,80 +861,145 @@ func (d *aciDriver) Handles(dt string) bool {
 	return dt == driver.ImageTypeDocker || dt == driver.ImageTypeOCI
 }
 
-func (d *aciDriver) exec(op *driver.Operation) (driver.OperationResult, error) {
+func (d *aciDriver) exec(ctx context.Context, op *driver.Operation) (driver.OperationResult, error) {
 
 	var err error
 	operationResult := driver.OperationResult{
 		Outputs: map[string]string{},
 	}
 
-	// Check that there is a state volume if needed
-	d.hasOutputs = len(op.Outputs) > 0
-	if d.hasOutputs && !d.hasStateVolumeInfo && az.IsInCloudShell() {
-		log.Debug("Getting File share info from CloudShell")
-		fileshare, err := az.GetCloudDriveDetails(d.userAgent)
-		if err != nil {
-			return operationResult, fmt.Errorf("Bundle has outputs and no volume mounted for state, failed to get clouddrive details ,set CNAB_AZURE_STATE_* variables so that state can be retrieved: %v", err)
-		}
-		log.Debug("State File Share: ", fileshare.Name)
-		log.Debug("State Storage Account Name: ", fileshare.StorageAccountName)
-		d.stateFileShare = fileshare.Name
-		d.stateStorageAccountName = fileshare.StorageAccountName
-		d.stateStorageAccountKey = fileshare.StorageAccountKey
-		d.mountStateVolume = true
-		d.hasStateVolumeInfo = true
+	if err := d.prepareOperation(op); err != nil {
+		return operationResult, err
 	}
 
-	if d.hasOutputs && !d.hasStateVolumeInfo {
-		return operationResult, errors.New("Bundle has outputs no volume mounted for state, set CNAB_AZURE_STATE_* variables so that state can be retrieved")
+	if d.dryRun {
+		plan, err := d.plan(op)
+		if err != nil {
+			return operationResult, err
+		}
+		return operationResult, plan.Write(os.Stdout)
 	}
 
-	if d.hasOutputs && d.deleteOutputs {
-		defer d.deleteOutputsFromFileShare(op, &operationResult)
+	if d.hasOutputs && d.deleteOutputs && !d.outputsInLogs {
+		defer func() {
+			if !d.detached {
+				d.deleteOutputsFromFileShare(op, &operationResult)
+			}
+		}()
 	}
 
-	d.loginInfo, err = az.LoginToAzure(d.clientID, d.clientSecret, d.tenantID, d.applicationID)
-	if err != nil {
-		return operationResult, fmt.Errorf("cannot Login To Azure: %v", err)
+	if err := d.connect(ctx); err != nil {
+		return operationResult, err
 	}
 
-	err = d.setAzureSubscriptionID()
+	err = d.runInvocationImageUsingACI(ctx, op)
 	if err != nil {
-		return operationResult, fmt.Errorf("cannot set Azure subscription: %v", err)
+		return operationResult, fmt.Errorf("running invocation instance using ACI failed: %w", err)
 	}
 
-	err = d.runInvocationImageUsingACI(op)
-	if err != nil {
-		return operationResult, fmt.Errorf("running invocation instance using ACI failed: %v", err)
+	// The outputs of a detached operation are retrieved by cnab-azure collect
+	if d.detached {
+		return operationResult, nil
 	}
 
 	// Get any outputs
 	return d.getOutputs(op, &operationResult)
 }
-func (d *aciDriver) deleteOutputsFromFileShare(op *driver.Operation, operationResult *driver.OperationResult) {
-	fmt.Println("Deleting Outputs from Azure FileShare")
-	afs, err := az.NewFileShare(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateFileShare)
+
+// prepareOperation applies the bundle extension and checks that there is a state volume if the bundle has outputs
+func (d *aciDriver) prepareOperation(op *driver.Operation) error {
+	if err := d.applyBundleExtension(op.Bundle); err != nil {
+		return fmt.Errorf("Invalid %s bundle extension: %v", bundleExtensionKey, err)
+	}
+
+	d.hasOutputs = len(op.Outputs) > 0
+	d.prepareFiles(op)
+	// Outputs are only read from the state blob container or the container logs in auto if there is no state file share to read them from
+	d.outputsInBlob = d.hasOutputs && (d.outputTransport == outputTransportBlob || (d.outputTransport == outputTransportAuto && !d.hasStateVolumeInfo && len(d.stateBlobContainer) > 0))
+	d.outputsInLogs = d.hasOutputs && !d.outputsInBlob && (d.outputTransport == outputTransportLogs || (d.outputTransport == outputTransportAuto && !d.hasStateVolumeInfo && !az.IsInCloudShell()))
+	needsState := (d.hasOutputs && !d.outputsInLogs && !d.outputsInBlob) || len(d.stagedFilesPath) > 0
+	if needsState && !d.hasStateVolumeInfo && az.IsInCloudShell() {
+		log.Debug("Getting File share info from CloudShell")
+		fileshare, err := az.GetCloudDriveDetails(d.userAgent)
+		if err != nil {
+			return fmt.Errorf("Bundle has outputs and no volume mounted for state, failed to get clouddrive details ,set CNAB_AZURE_STATE_* variables so that state can be retrieved: %v", err)
+		}
+		log.Debug("State File Share: ", fileshare.Name)
+		log.Debug("State Storage Account Name: ", fileshare.StorageAccountName)
+		d.stateFileShare = fileshare.Name
+		d.stateStorageAccountName = fileshare.StorageAccountName
+		d.stateStorageAccountKey = fileshare.StorageAccountKey
+		d.mountStateVolume = true
+		d.hasStateVolumeInfo = true
+	}
+
+	if d.outputsInBlob && len(d.stateBlobContainer) == 0 {
+		return errors.New("Bundle has outputs and CNAB_AZURE_OUTPUT_TRANSPORT is blob, set CNAB_AZURE_STATE_BLOB_CONTAINER and CNAB_AZURE_STATE_STORAGE_ACCOUNT_* variables so that outputs can be uploaded")
+	}
+	if d.hasOutputs && !d.outputsInLogs && !d.outputsInBlob && !d.hasStateVolumeInfo {
+		return errors.New("Bundle has outputs no volume mounted for state, set CNAB_AZURE_STATE_* variables so that state can be retrieved")
+	}
+	if len(d.stagedFilesPath) > 0 && !d.hasStateVolumeInfo {
+		return fmt.Errorf("File inputs are %d bytes encoded which is more than the %d bytes that can be passed in a secret volume, set CNAB_AZURE_STATE_* variables so that they can be staged on the state file share", secretVolumeSize(op.Files), maxSecretVolumeSize)
+	}
+
+	return nil
+}
+
+func (d *aciDriver) deleteOutputsFromFileShare(op *driver.Operation, operationResult *driver.OperationResult) {
+	store, err := d.newOutputStore()
 	if err != nil {
-		fmt.Printf("Error creating AzureFileShare object to delete outputs: %v\n", err)
+		fmt.Printf("Error deleting outputs: %v\n", err)
 		return
 	}
+	fmt.Printf("Deleting Outputs from %s\n", store)
 	cnabOutputPrefix := cnabOutputMountPoint + cnabOutputDirName
 	for _, fullOutputName := range op.Outputs {
-		log.Debugf("Deleting output %s from fileshare", fullOutputName)
+		log.Debugf("Deleting output %s from %s", fullOutputName, store)
 		outputName := strings.TrimPrefix(fullOutputName, cnabOutputPrefix+"/")
 		fileName := fmt.Sprintf("%s/%s/%s", d.statePath, cnabOutputDirName, outputName)
-		_, err := afs.DeleteFileFromShare(fileName)
+		_, err := store.Delete(fileName)
 		if err != nil {
-			fmt.Printf("Error deleting output %s from fileshare:%v\n", fullOutputName, err)
+			fmt.Printf("Error deleting output %s from %s:%v\n", fullOutputName, store, err)
 		}
 	}
 }
+
+// getOutputsFromLogs decodes the outputs that the script wrote to the container logs
+func (d *aciDriver) getOutputsFromLogs(op *driver.Operation, operationResult *driver.OperationResult) (driver.OperationResult, error) {
+	cnabOutputPrefix := cnabOutputMountPoint + cnabOutputDirName
+	for outputPath, fullOutputName := range op.Outputs {
+		if output := op.Bundle.Outputs[fullOutputName]; output.AppliesTo(op.Action) {
+			outputName := strings.TrimPrefix(fullOutputName, cnabOutputPrefix+"/")
+			encoded, ok := d.logOutputs[outputName]
+			if !ok {
+				// Outputs with a default do not have to be written, the default is applied by the caller
+				if definition, ok := op.Bundle.Definitions[output.Definition]; !ok || definition.Default == nil {
+					fmt.Fprintf(os.Stderr, "Output %s was not found in the container logs, the logs may have been truncated by ACI\n", outputName)
+				}
+				log.Debugf("Output %s was not written to the container logs", outputName)
+				continue
+			}
+			content, err := decodeLogOutput(outputName, encoded)
+			if err != nil {
+				return *operationResult, err
+			}
+			operationResult.Outputs[outputPath] = content
+		}
+	}
+
+	return *operationResult, nil
+}
+
 func (d *aciDriver) getOutputs(op *driver.Operation, operationResult *driver.OperationResult) (driver.OperationResult, error) {
+	if d.hasOutputs && d.outputsInLogs {
+		return d.getOutputsFromLogs(op, operationResult)
+	}
 	if d.hasOutputs {
 		fmt.Println("Retreiving Outputs")
-		afs, err := az.NewFileShare(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateFileShare)
+		store, err := d.newOutputStore()
 		if err != nil {
-			return *operationResult, fmt.Errorf("Error creating AzureFileShare structure: %v", err)
+			return *operationResult, err
 		}
 		cnabOutputPrefix := cnabOutputMountPoint + cnabOutputDirName
 		for outputPath, fullOutputName := range op.Outputs {
@@ -481,9 +1009,9 @@ func (d *aciDriver) getOutputs(op *driver.Operation, operationResult *driver.Ope
 				log.Debugf("Checking for output for: %s", fullOutputName)
 				outputName := strings.TrimPrefix(fullOutputName, cnabOutputPrefix+"/")
 				fileName := fmt.Sprintf("%s/%s/%s", d.statePath, cnabOutputDirName, outputName)
-				exists, err := afs.CheckIfFileExists(fileName)
+				exists, err := store.Exists(fileName)
 				if err != nil {
-					return *operationResult, fmt.Errorf("Error checking file exists %s from AzureFileShare: %v", fileName, err)
+					return *operationResult, fmt.Errorf("Error checking file exists %s from %s: %v", fileName, store, err)
 				}
 				if !exists {
 					log.Debugf("Output File: %s does not exist", fileName)
@@ -491,9 +1019,9 @@ func (d *aciDriver) getOutputs(op *driver.Operation, operationResult *driver.Ope
 					continue
 				}
 				log.Debugf("Reading output for file: %s", fileName)
-				content, err := afs.ReadFileFromShare(fileName)
+				content, err := store.Read(fileName)
 				if err != nil {
-					return *operationResult, fmt.Errorf("Error reading output %s from AzureFileShare: %v", fileName, err)
+					return *operationResult, fmt.Errorf("Error reading output %s from %s: %v", fileName, store, err)
 				}
 				operationResult.Outputs[outputPath] = content
 			}
@@ -503,19 +1031,30 @@ func (d *aciDriver) getOutputs(op *driver.Operation, operationResult *driver.Ope
 	return *operationResult, nil
 }
 
-func (d *aciDriver) setAzureSubscriptionID() error {
-	subscriptionsClient, err := az.GetSubscriptionsClient(d.loginInfo.Authorizer, d.userAgent)
+// connect logs in to Azure and chooses the subscription to use
+func (d *aciDriver) connect(ctx context.Context) error {
+	var err error
+	d.loginInfo, err = d.login(d.clientID, d.clientSecret, d.tenantID, d.applicationID)
 	if err != nil {
-		return fmt.Errorf("Error getting Subscription Client: %v", err)
+		return fmt.Errorf("cannot Login To Azure: %v", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	d.backend = d.newBackend(d.loginInfo.Authorizer, d.userAgent)
+
+	err = d.setAzureSubscriptionID(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot set Azure subscription: %v", err)
+	}
+
+	return nil
+}
+
+func (d *aciDriver) setAzureSubscriptionID(ctx context.Context) error {
 	if len(d.subscriptionID) != 0 {
 		log.Debugf("Checking if Subscription ID: %s exists", d.subscriptionID)
-		result, err := subscriptionsClient.Get(ctx, d.subscriptionID)
+		_, err := d.backend.GetSubscription(ctx, d.subscriptionID)
 		if err != nil {
-			if result.StatusCode == 404 {
+			if az.IsNotFound(err) {
 				return fmt.Errorf("Subscription ID: %s not found", d.subscriptionID)
 			}
 
@@ -524,19 +1063,14 @@ func (d *aciDriver) setAzureSubscriptionID() error {
 
 	} else {
 		log.Debug("No Subscription ID set choosing first one available")
-		result, err := subscriptionsClient.ListComplete(ctx)
+		result, err := d.backend.ListSubscriptions(ctx)
 		if err != nil {
 			return fmt.Errorf("Attempt to List Subscriptions Failed: %v", err)
 		}
 
-		err = result.NextWithContext(ctx)
-		if err != nil {
-			return fmt.Errorf("Attempt to Get Subscription Failed: %v", err)
-		}
-
 		// Just choose the first subscription
-		if result.NotDone() {
-			subscriptionID := *result.Value().SubscriptionID
+		if len(result) > 0 && result[0].SubscriptionID != nil {
+			subscriptionID := *result[0].SubscriptionID
 			log.Debug("Setting Subscription ID to: ", subscriptionID)
 			d.subscriptionID = subscriptionID
 		} else {
@@ -548,36 +1082,19 @@ func (d *aciDriver) setAzureSubscriptionID() error {
 	return nil
 }
 
-func (d *aciDriver) runInvocationImageUsingACI(op *driver.Operation) error {
+func (d *aciDriver) runInvocationImageUsingACI(ctx context.Context, op *driver.Operation) (err error) {
 
 	// TODO Check that image is a type and platform that can be executed by ACI
 	fmt.Println("Creating Azure Container Instance To Execute Bundle")
 	// GET ACI Config
-	image := imageWithDigest(op.Image)
-	ref, err := reference.ParseAnyReference(image)
-	if err != nil {
-		return fmt.Errorf("Failed to parse image reference: %s error: %v", image, err)
-	}
-
-	var domain string
-	if named, ok := ref.(reference.Named); ok {
-		domain = reference.Domain(named)
-	}
-
-	// SPN details are for Azure registry only
-	if d.useSPForACR && !strings.HasSuffix(domain, "azurecr.io") {
-		return fmt.Errorf("Cannot use Service Principal as credentials for non Azure registry : %s", domain)
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	groupsClient, err := az.GetGroupsClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
+	image, domain, err := d.getImage(op)
 	if err != nil {
-		return fmt.Errorf("Error getting Groups Client Client: %v", err)
+		return err
 	}
+	d.setRegistryCredentials(ctx, domain)
 
 	if !d.createRG {
-		rg, err := groupsClient.Get(ctx, d.aciRG)
+		rg, err := d.backend.GetResourceGroup(ctx, d.subscriptionID, d.aciRG)
 		if err != nil {
 			return fmt.Errorf("Checking for existing resource group %s failed with error: %v", d.aciRG, err)
 		}
@@ -592,12 +1109,7 @@ func (d *aciDriver) runInvocationImageUsingACI(op *driver.Operation) error {
 
 	// Check that location supports ACI
 
-	providersClient, err := az.GetProvidersClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
-	if err != nil {
-		return fmt.Errorf("Error getting Providers Accounts Client: %v", err)
-	}
-
-	provider, err := providersClient.Get(ctx, "Microsoft.ContainerInstance", "")
+	provider, err := d.backend.GetProvider(ctx, d.subscriptionID, "Microsoft.ContainerInstance")
 	if err != nil {
 		return fmt.Errorf("Error getting provider details for ACI: %v", err)
 	}
@@ -612,6 +1124,18 @@ func (d *aciDriver) runInvocationImageUsingACI(op *driver.Operation) error {
 
 	}
 
+	err = d.checkResourcesAvailableInLocation(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(d.subnet.ID) > 0 {
+		if err := d.checkSubnet(ctx); err != nil {
+			return err
+		}
+	}
+
+	tags := d.getTags(op, time.Now())
 	if d.createRG {
 		// If in cloudshell check that RG can be created
 		// TODO update so that this check works outside cloudshell
@@ -630,34 +1154,25 @@ func (d *aciDriver) runInvocationImageUsingACI(op *driver.Operation) error {
 		}
 
 		log.Debug("Creating Resource Group: ", d.aciRG)
-		_, err := groupsClient.CreateOrUpdate(
+		_, err := d.backend.CreateResourceGroup(
 			ctx,
+			d.subscriptionID,
 			d.aciRG,
 			resources.Group{
 				Location: &d.aciLocation,
+				Tags:     tags,
 			})
 		if err != nil {
 			return fmt.Errorf("Failed to create resource group: %v", err)
 		}
 
-		defer func() {
-			if d.deleteACIResources {
-				log.Debug("Deleting Resource Group: ", d.aciRG)
-				future, err := groupsClient.Delete(ctx, d.aciRG)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to execute delete resource group %s error: %v\n", d.aciRG, err)
+		if d.deleteACIResources {
+			defer func() {
+				if !d.detached {
+					d.deleteResourceGroup()
 				}
-
-				err = future.WaitForCompletionRef(ctx, groupsClient.Client)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to delete resource group %s error: %v\n", d.aciRG, err)
-				} else {
-					log.Debug("Deleted Resource Group ", d.aciRG)
-				}
-
-			}
-
-		}()
+			}()
+		}
 	}
 
 	// Check if permission to create ACI and permission
@@ -675,183 +1190,316 @@ func (d *aciDriver) runInvocationImageUsingACI(op *driver.Operation) error {
 		}
 	}
 
-	var mounts []containerinstance.VolumeMount
-	var volumes []containerinstance.Volume
-
-	// ACI does not support file copy
-	// files are mounted into the container in a secrets volume and invocationImage Entry point is modified to process the files before run cmd is invoked
-
-	hasFiles := false
-	log.Debug("Bundle Has File Inputs:", hasFiles)
-	if len(op.Files) > 0 {
-
-		// TODO Check that the run cmd is "/cnab/app/run"
+	identity, err := d.getContainerIdentity(ctx, d.aciRG)
+	if err != nil {
+		return fmt.Errorf("Failed to get container Identity:%v", err)
+	}
 
-		hasFiles = true
-		secretMount := containerinstance.VolumeMount{
-			MountPath: to.StringPtr(fileMountPoint),
-			Name:      to.StringPtr(fileMountName),
-		}
-		mounts = append(mounts, secretMount)
-		secrets := make(map[string]*string)
-		secretVolume := containerinstance.Volume{
-			Name:   to.StringPtr(fileMountName),
-			Secret: secrets,
-		}
-		volumes = append(volumes, secretVolume)
-		i := 0
-		for k, v := range op.Files {
-			log.Debug("Processing File Input: ", k)
-			secrets[fmt.Sprintf("path%d", i)] = to.StringPtr(base64.StdEncoding.EncodeToString([]byte(k)))
-			secrets[fmt.Sprintf("value%d", i)] = to.StringPtr(base64.StdEncoding.EncodeToString([]byte(v)))
-			i++
+	if len(d.stagedFilesPath) > 0 {
+		defer func() {
+			if !d.detached {
+				d.deleteStagedFiles()
+			}
+		}()
+		if err := d.stageFiles(op); err != nil {
+			return err
 		}
 	}
 
-	// Create ACI Instance
-
-	var env []containerinstance.EnvironmentVariable
-	env = d.createMSIEnvVars(env)
-	if d.propagateCredentials {
-		env = d.createAzureEnvironmentEnvVars(env)
-		// Only propagate credentials if not using MSI
-		if len(d.msiType) == 0 {
-			env, err = d.createCredentialEnvVars(env)
+	if d.outputsInBlob {
+		if err := d.prepareBlobOutputs(); err != nil {
+			return err
 		}
+	}
 
-		if err != nil {
-			return fmt.Errorf("Failed to create environment variables for Credentials:%v", err)
-		}
+	// The command of the image is only needed when the driver runs a script before it
+	if (len(op.Files) > 0 || d.hasOutputs) && !d.debugContainer {
+		d.resolveImageCommand(ctx, image, domain)
+	}
 
+	containerGroup, err := d.buildContainerGroup(op, image, domain, identity, tags)
+	if err != nil {
+		return err
 	}
 
-	for k, v := range op.Environment {
-		// Need to check if any of the env variables already exist in case any propagated credentials are being overridden
-		for _, ev := range env {
-			if k == *ev.Name {
-				ev.SecureValue = to.StringPtr(strings.Replace(v, "'", "''", -1))
-				log.Debug("Updating Container Group Environment Variable: Name: ", k)
-				continue
+	// The container group may have been created even if creation fails or is cancelled so set up deletion first
+	if d.deleteACIResources {
+		defer func() {
+			if !d.detached {
+				d.deleteContainerGroup()
 			}
+		}()
+		// This runs before the resources are deleted so that they can be kept if the operation failed
+		defer func() {
+			d.retainFailedResources(err)
+		}()
+	}
 
-		}
-		env = append(env, containerinstance.EnvironmentVariable{
-			Name:        to.StringPtr(k),
-			SecureValue: to.StringPtr(strings.Replace(v, "'", "''", -1)),
-		})
-		log.Debug("Setting Container Group Environment Variable: Name: ", k)
+	_, err = d.createInstance(ctx, d.aciName, d.aciRG, containerGroup, *identity)
+	if err != nil {
+		return fmt.Errorf("Error creating ACI Instance:%v", err)
 	}
-	var volume = containerinstance.Volume{}
-	var volumeMount = containerinstance.VolumeMount{}
-	if d.mountStateVolume {
-		d.statePath = fmt.Sprintf("%s/%s", strings.ToLower(op.Bundle.Name), strings.ToLower(op.Installation))
-		statePath := fmt.Sprintf("%s/%s", d.stateMountPoint, d.statePath)
-		log.Debug("State Path: ", statePath)
-		env = append(env, containerinstance.EnvironmentVariable{
-			Name:  to.StringPtr("STATE_PATH"),
-			Value: to.StringPtr(statePath),
-		})
-		volume.Name = to.StringPtr(stateMountName)
-		volume.AzureFile = d.getAzureFileVolume()
-		volumeMount.Name = to.StringPtr(stateMountName)
-		volumeMount.ReadOnly = to.BoolPtr(false)
-		volumeMount.MountPath = to.StringPtr(d.stateMountPoint)
-		mounts = append(mounts, volumeMount)
-		volumes = append(volumes, volume)
+
+	if d.debugContainer {
+		fmt.Println(execInstructions(d.aciRG, d.aciName))
 	}
 
-	identity, err := d.getContainerIdentity(ctx, d.aciRG)
+	// If this process exits before the container group completes the record is left behind so that the operation can be attached to
+	err = d.writeOperationRecord(op)
+	if d.detach {
+		if err != nil {
+			return fmt.Errorf("Failed to write operation record for detached operation: %v", err)
+		}
+		// The resources are cleaned up and the outputs retrieved by cnab-azure collect
+		d.detached = true
+		fmt.Printf("Detached from operation %s, Container Group %s is running in Resource Group %s\n", d.operationRecord.ID, d.aciName, d.aciRG)
+		fmt.Printf("Run cnab-azure status %s to check the operation and cnab-azure collect %s to get the outputs and clean up once it has completed\n", d.operationRecord.ID, d.operationRecord.ID)
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to get container Identity:%v", err)
+		fmt.Fprintf(os.Stderr, "Failed to write operation record, the operation cannot be attached to if the driver exits before it completes: %v\n", err)
 	}
+	defer d.removeOperationRecord()
 
-	_, err = d.createInstance(d.aciName, d.aciLocation, d.aciRG, image, env, *identity, &mounts, &volumes, hasFiles, domain)
+	fmt.Println("Running Bundle Instance in Azure Container Instance")
+	// Check if the container is running
+	status, err := d.waitForContainerGroupStart(ctx)
 	if err != nil {
-		return fmt.Errorf("Error creating ACI Instance:%v", err)
+		return err
 	}
 
-	// TODO: Check if ACR under ACI supports MSI
-	// TODO: Login to ACR if the registry is azurecr.io
-	// TODO: Add support for private registry
+	// If the container failed to start because the invocation image does not have the shell used for the script try the next file injection strategy
+	for strings.Compare(status.State, "Failed") == 0 {
+		next, ok := d.nextFileInjection(status, to.StringSlice((*containerGroup.Containers)[0].Command))
+		if !ok {
+			break
+		}
+		fmt.Printf("Invocation image does not have %s, retrying with %s file injection\n", d.scriptCommand("")[0], next)
+		if status, containerGroup, err = d.restartWithFileInjection(ctx, op, next, image, domain, identity, tags); err != nil {
+			return err
+		}
+	}
 
-	if d.deleteACIResources {
-		defer func() {
-			fmt.Println("Cleaning up Azure Resources created to execute Bundle")
-			log.Debug("Deleting Container Instance ", d.aciName)
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
-			containerGroupsClient, err := az.GetContainerGroupsClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error getting Container Groups Client: %v\n", err)
-			}
+	// Get the logs if the container failed immediately
+	if strings.Compare(status.State, "Failed") == 0 {
+		if err := d.writeContainerLogs(ctx, newContainerLogs(0), true); err != nil {
+			return err
+		}
 
-			_, err = containerGroupsClient.Delete(ctx, d.aciRG, d.aciName)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to delete container error: %v\n", err)
-			}
+		return status.failedError()
+	}
 
-			log.Debug("Deleted Container ", d.aciName)
-		}()
+	return d.waitForContainerGroup(ctx, 0)
+}
+
+// restartWithFileInjection deletes the container group and creates it again using the file injection strategy
+func (d *aciDriver) restartWithFileInjection(ctx context.Context, op *driver.Operation, strategy string, image string, domain string, identity *identityDetails, tags map[string]*string) (*containerGroupStatus, containerinstance.ContainerGroup, error) {
+	d.fileInjectionFallback = strategy
+	containerGroup, err := d.buildContainerGroup(op, image, domain, identity, tags)
+	if err != nil {
+		return nil, containerGroup, err
+	}
+	if err := d.backend.DeleteContainerGroup(ctx, d.subscriptionID, d.aciRG, d.aciName); err != nil {
+		return nil, containerGroup, fmt.Errorf("Failed to delete container group to retry with %s file injection: %v", strategy, err)
 	}
+	// The system assigned identity is deleted with the container group and a new one is created with it so its role assignments are deleted
+	d.deleteSystemMSIRoleAssignments(ctx)
+	if _, err := d.createInstance(ctx, d.aciName, d.aciRG, containerGroup, *identity); err != nil {
+		return nil, containerGroup, fmt.Errorf("Error creating ACI Instance:%v", err)
+	}
+	status, err := d.waitForContainerGroupStart(ctx)
+	if err != nil {
+		return nil, containerGroup, err
+	}
+	return status, containerGroup, nil
+}
 
-	fmt.Println("Running Bundle Instance in Azure Container Instance")
-	// Check if the container is running
-	state, err := d.getContainerState(d.aciRG, d.aciName)
+// deleteSystemMSIRoleAssignments deletes the role assignments created for the system assigned identity of a container group that has been deleted
+func (d *aciDriver) deleteSystemMSIRoleAssignments(ctx context.Context) {
+	if len(d.systemMSIPrincipalID) == 0 {
+		return
+	}
+	assignments, err := d.backend.ListRoleAssignmentsForPrincipal(ctx, d.subscriptionID, d.systemMSIPrincipalID)
 	if err != nil {
-		return fmt.Errorf("Error getting container state :%v", err)
+		fmt.Fprintf(os.Stderr, "Failed to list role assignments for System MSI %s error: %v\n", d.systemMSIPrincipalID, err)
+		return
 	}
+	for _, assignment := range assignments {
+		if err := d.backend.DeleteRoleAssignment(ctx, d.subscriptionID, to.String(assignment.ID)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete role assignment %s error: %v\n", to.String(assignment.ID), err)
+		} else {
+			log.Debug("Deleted Role Assignment ", to.String(assignment.ID))
+		}
+	}
+	d.systemMSIPrincipalID = ""
+}
 
-	// Get the logs if the container failed immediately
-	if strings.Compare(state, "Failed") == 0 {
-		_, err := d.getContainerLogs(ctx, d.aciRG, d.aciName, 0)
+// waitForContainerGroupStart polls the container group until it is running or has terminated, a container group that fails to start because the
+// invocation image does not have the shell can be pending when it is first created
+func (d *aciDriver) waitForContainerGroupStart(ctx context.Context) (*containerGroupStatus, error) {
+	for {
+		status, err := d.getContainerGroupStatus(ctx, d.aciRG, d.aciName)
 		if err != nil {
-			return fmt.Errorf("Error getting container logs :%v", err)
+			if ctx.Err() != nil {
+				return nil, d.stopContainerGroup(ctx.Err(), newContainerLogs(0))
+			}
+			return nil, fmt.Errorf("Error getting container state :%v", err)
+		}
+
+		switch status.State {
+		case "Running", "Succeeded", "Failed", "Stopped":
+			return status, nil
 		}
 
-		return errors.New("Container execution failed")
+		log.Debugf("Container Group state is %s, waiting for it to start", status.State)
+		select {
+		case <-ctx.Done():
+			return nil, d.stopContainerGroup(ctx.Err(), newContainerLogs(0))
+		case <-time.After(d.pollInterval):
+		}
 	}
+}
 
-	containerRunning := true
-	linesOutput := 0
-	for containerRunning {
+// waitForContainerGroup writes the container logs after the first linesOutput lines until the container group completes, the logs are streamed
+// through the attach API unless it is disabled or fails, in which case they are polled
+func (d *aciDriver) waitForContainerGroup(ctx context.Context, linesOutput int) error {
+	logs := newContainerLogs(linesOutput)
+	// Outputs written to the logs before an operation was resumed are read again from the whole of the logs
+	logs.replayOutputs = d.outputsInLogs && linesOutput > 0
+	streamLogs := d.streamLogs
+	var stream *logStream
+	defer func() { stream.close() }()
+	for {
 		log.Debug("Getting ACI State")
-		state, err := d.getContainerState(d.aciRG, d.aciName)
+		status, err := d.getContainerGroupStatus(ctx, d.aciRG, d.aciName)
 		if err != nil {
+			if ctx.Err() != nil {
+				stream.close()
+				return d.stopContainerGroup(ctx.Err(), logs)
+			}
 			return fmt.Errorf("Error getting container state :%v", err)
 		}
 
-		if strings.Compare(state, "Running") == 0 {
-			linesOutput, err = d.getContainerLogs(ctx, d.aciRG, d.aciName, linesOutput)
+		if strings.Compare(status.State, "Running") != 0 {
+			stream.close()
+			// The container logs are written once the container has terminated to get any lines that were not streamed
+			err := d.writeContainerLogs(ctx, logs, true)
+			d.logOutputs = logs.outputs()
+			if strings.Compare(status.State, "Succeeded") != 0 {
+				// Log any error getting container logs
+				if err != nil {
+					log.Debugf("Error getting Container Logs: %v", err)
+				}
+				return status.failedError()
+			}
 			if err != nil {
-				return fmt.Errorf("Error getting container logs :%v", err)
+				return err
 			}
+			break
+		}
 
-			log.Debug("Sleeping waiting for Container to complete")
-			fmt.Print("\033[1C\033[1D")
-			time.Sleep(5 * time.Second)
-		} else {
-			if strings.Compare(state, "Succeeded") != 0 {
-				// Log any error getting container logs
-				if _, err = d.getContainerLogs(ctx, d.aciRG, d.aciName, linesOutput); err != nil {
-					log.Debugf("Error getting Container Logs: %v", err)
+		if !stream.open() {
+			if err := d.writeContainerLogs(ctx, logs, false); err != nil {
+				if ctx.Err() != nil {
+					return d.stopContainerGroup(ctx.Err(), logs)
 				}
-				return fmt.Errorf("Unexpected Container Status:%s", state)
+				return err
 			}
 
-			containerRunning = false
+			if streamLogs {
+				if stream != nil {
+					log.Debugf("Container output stream ended, polling container logs: %v", stream.err)
+					streamLogs = false
+				} else if stream, err = d.attachLogStream(ctx, logs); err != nil {
+					log.Debugf("Failed to attach to container, polling container logs: %v", err)
+					streamLogs = false
+				}
+			}
 		}
 
-	}
+		if lines := logs.linesOutput(); lines != linesOutput {
+			linesOutput = lines
+			d.saveOperationProgress(linesOutput)
+		}
 
-	_, err = d.getContainerLogs(ctx, d.aciRG, d.aciName, linesOutput)
-	if err != nil {
-		return fmt.Errorf("Error getting container logs :%v", err)
+		log.Debug("Sleeping waiting for Container to complete")
+		fmt.Print("\033[1C\033[1D")
+		select {
+		case <-ctx.Done():
+			stream.close()
+			return d.stopContainerGroup(ctx.Err(), logs)
+		case <-time.After(d.pollInterval):
+		}
 	}
 
 	log.Debug("Container terminated successfully")
 	return nil
 }
 
+// deleteContainerGroup deletes the container group once the operation is complete unless it was kept after a failure by the retention policy
+func (d *aciDriver) deleteContainerGroup() {
+	if d.retained {
+		return
+	}
+	fmt.Println("Cleaning up Azure Resources created to execute Bundle")
+	log.Debug("Deleting Container Instance ", d.aciName)
+	// The operation context may have been cancelled so clean up using a new context
+	err := d.backend.DeleteContainerGroup(context.Background(), d.subscriptionID, d.aciRG, d.aciName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to delete container error: %v\n", err)
+	}
+
+	log.Debug("Deleted Container ", d.aciName)
+}
+
+// deleteResourceGroup deletes the resource group created by the driver once the operation is complete unless it was kept after a failure by the retention policy
+func (d *aciDriver) deleteResourceGroup() {
+	if d.retained {
+		return
+	}
+	log.Debug("Deleting Resource Group: ", d.aciRG)
+	// The operation context may have been cancelled so clean up using a new context
+	err := d.backend.DeleteResourceGroup(context.Background(), d.subscriptionID, d.aciRG)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to delete resource group %s error: %v\n", d.aciRG, err)
+	} else {
+		log.Debug("Deleted Resource Group ", d.aciRG)
+	}
+}
+
+// stopContainerGroup stops a running container group when the operation is cancelled or times out and outputs any remaining logs,
+// the returned error wraps the reason the operation was cancelled
+func (d *aciDriver) stopContainerGroup(reason error, logs *containerLogs) error {
+	if errors.Is(reason, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "Operation timed out after %v, stopping Container Group %s\n", d.timeout, d.aciName)
+	} else {
+		fmt.Fprintf(os.Stderr, "Operation cancelled, stopping Container Group %s\n", d.aciName)
+	}
+	// The operation context has been cancelled so use a new context
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := d.backend.StopContainerGroup(ctx, d.subscriptionID, d.aciRG, d.aciName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop container group %s error: %v\n", d.aciName, err)
+	} else {
+		log.Debug("Stopped Container Group ", d.aciName)
+	}
+
+	if err := d.writeContainerLogs(ctx, logs, true); err != nil {
+		log.Debugf("Error getting Container Logs: %v", err)
+	}
+
+	return d.cancellationError(reason)
+}
+
+// cancellationError returns the error to report when the operation context is done, timeouts are reported using ErrOperationTimedOut
+func (d *aciDriver) cancellationError(reason error) error {
+	if errors.Is(reason, context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %v", ErrOperationTimedOut, d.timeout)
+	}
+
+	return fmt.Errorf("operation cancelled: %w", reason)
+}
+
 // This function creates an AzureFileVolume to be used by the bundle for state storage
 func (d *aciDriver) getAzureFileVolume() *containerinstance.AzureFileVolume {
 
@@ -866,31 +1514,6 @@ func (d *aciDriver) getAzureFileVolume() *containerinstance.AzureFileVolume {
 }
 
 // This will only work if the logs don't get truncated because of size.
-func (d *aciDriver) getContainerLogs(ctx context.Context, aciRG string, aciName string, linesOutput int) (int, error) {
-	log.Debug("Getting Logs from Invocation Image")
-	containerClient, err := az.GetContainerClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
-	if err != nil {
-		return 0, fmt.Errorf("Error getting Container Client: %v", err)
-	}
-
-	logs, err := containerClient.ListLogs(ctx, aciRG, aciName, aciName, nil)
-	if err != nil {
-		return 0, fmt.Errorf("Error getting container logs :%v", err)
-	}
-
-	lines := strings.Split(strings.TrimSuffix(*logs.Content, "\n"), "\n")
-	noOfLines := len(lines)
-	for currentLine := linesOutput; currentLine < noOfLines; currentLine++ {
-		_, err := fmt.Println(lines[currentLine])
-		if err != nil {
-			return 0, fmt.Errorf("Error writing container logs :%v", err)
-		}
-
-	}
-
-	return noOfLines, nil
-}
-
 func (d *aciDriver) getContainerIdentity(ctx context.Context, aciRG string) (*identityDetails, error) {
 
 	// System MSI
@@ -904,24 +1527,12 @@ func (d *aciDriver) getContainerIdentity(ctx context.Context, aciRG string) (*id
 			log.Debugf("Set system MSI Scope to %s", d.systemMSIScope)
 		}
 
-		return &identityDetails{
-			MSIType: "system",
-			Identity: &containerinstance.ContainerGroupIdentity{
-				Type: containerinstance.SystemAssigned,
-			},
-			Scope: &d.systemMSIScope,
-			Role:  &d.systemMSIRole,
-		}, nil
+		return systemAssignedIdentity(d.systemMSIScope, d.systemMSIRole), nil
 	}
 
 	// User MSI
 	if d.msiType == "user" {
-		userAssignedIdentitiesClient, err := az.GetUserAssignedIdentitiesClient(d.msiResource.SubscriptionID, d.loginInfo.Authorizer, d.userAgent)
-		if err != nil {
-			return nil, fmt.Errorf("Error getting User Assigned Identities Client: %v", err)
-		}
-
-		identity, err := userAssignedIdentitiesClient.Get(ctx, d.msiResource.ResourceGroup, d.msiResource.ResourceName)
+		identity, err := d.backend.GetUserAssignedIdentity(ctx, d.msiResource.SubscriptionID, d.msiResource.ResourceGroup, d.msiResource.ResourceName)
 		if err != nil {
 			return nil, fmt.Errorf("Error getting User Assigned Identity:%v  Error: %v", d.msiResource, err)
 		}
@@ -942,15 +1553,7 @@ func (d *aciDriver) getContainerIdentity(ctx context.Context, aciRG string) (*id
 			}
 		}
 
-		return &identityDetails{
-			MSIType: "user",
-			Identity: &containerinstance.ContainerGroupIdentity{
-				Type: containerinstance.UserAssigned,
-				UserAssignedIdentities: map[string]*containerinstance.ContainerGroupIdentityUserAssignedIdentitiesValue{
-					*identity.ID: {},
-				},
-			},
-		}, nil
+		return userAssignedIdentity(*identity.ID), nil
 	}
 
 	return &identityDetails{
@@ -959,20 +1562,141 @@ func (d *aciDriver) getContainerIdentity(ctx context.Context, aciRG string) (*id
 
 }
 
-func (d *aciDriver) getContainerState(aciRG string, aciName string) (string, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	containerGroupsClient, err := az.GetContainerGroupsClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
+func systemAssignedIdentity(scope string, role string) *identityDetails {
+	return &identityDetails{
+		MSIType: "system",
+		Identity: &containerinstance.ContainerGroupIdentity{
+			Type: containerinstance.ResourceIdentityTypeSystemAssigned,
+		},
+		Scope: &scope,
+		Role:  &role,
+	}
+}
+
+func userAssignedIdentity(resourceID string) *identityDetails {
+	return &identityDetails{
+		MSIType: "user",
+		Identity: &containerinstance.ContainerGroupIdentity{
+			Type: containerinstance.ResourceIdentityTypeUserAssigned,
+			UserAssignedIdentities: map[string]*containerinstance.UserAssignedIdentities{
+				resourceID: {},
+			},
+		},
+	}
+}
+
+// ContainerEvent is an event reported by ACI for the invocation image container or its container group e.g. an image pull failure
+type ContainerEvent struct {
+	Type    string
+	Name    string
+	Message string
+	Count   int32
+}
+
+// ContainerFailedError is returned when the invocation image container does not complete successfully
+type ContainerFailedError struct {
+	// State is the state of the container group e.g. Failed or Stopped
+	State string
+	// ExitCode is the exit code of the invocation image, it is nil if the container did not terminate or the image did not run
+	ExitCode *int32
+	// DetailStatus is the detail status of the container e.g. Error or OOMKilled
+	DetailStatus string
+	// Events are the events of the container group and the invocation image container
+	Events []ContainerEvent
+}
+
+func (e *ContainerFailedError) Error() string {
+	message := fmt.Sprintf("Unexpected Container Status:%s", e.State)
+	if e.ExitCode != nil {
+		message += fmt.Sprintf(" exit code:%d", *e.ExitCode)
+	}
+	if len(e.DetailStatus) > 0 {
+		message += fmt.Sprintf(" detail status:%s", e.DetailStatus)
+	}
+
+	// Normal events such as Pulling and Started are left out as they do not explain the failure
+	var warnings []string
+	for _, event := range e.Events {
+		if strings.EqualFold(event.Type, "Warning") {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", event.Name, event.Message))
+		}
+	}
+	if len(warnings) > 0 {
+		message += fmt.Sprintf(" events:%s", strings.Join(warnings, "; "))
+	}
+
+	return message
+}
+
+// containerGroupStatus is the state of a container group along with the state of the invocation image container
+type containerGroupStatus struct {
+	State        string
+	ExitCode     *int32
+	DetailStatus string
+	Events       []ContainerEvent
+}
+
+func (s *containerGroupStatus) failedError() *ContainerFailedError {
+	return &ContainerFailedError{
+		State:        s.State,
+		ExitCode:     s.ExitCode,
+		DetailStatus: s.DetailStatus,
+		Events:       s.Events,
+	}
+}
+
+func (d *aciDriver) getContainerGroupStatus(ctx context.Context, aciRG string, aciName string) (*containerGroupStatus, error) {
+	resp, err := d.backend.GetContainerGroup(ctx, d.subscriptionID, aciRG, aciName)
 	if err != nil {
-		return "", fmt.Errorf("Error getting Container Groups Client: %v", err)
+		return nil, err
 	}
 
-	resp, err := containerGroupsClient.Get(ctx, aciRG, aciName)
-	if err != nil {
-		return "", err
+	if resp.ContainerGroupProperties == nil || resp.InstanceView == nil || resp.InstanceView.State == nil {
+		return nil, fmt.Errorf("Container Group %s has no state", aciName)
+	}
+
+	status := &containerGroupStatus{
+		State: *resp.InstanceView.State,
+	}
+	if resp.InstanceView.Events != nil {
+		status.Events = append(status.Events, containerEvents(*resp.InstanceView.Events)...)
+	}
+
+	// The invocation image container has the same name as the container group
+	var container *containerinstance.Container
+	if resp.Containers != nil {
+		for i, c := range *resp.Containers {
+			if container == nil || strings.EqualFold(to.String(c.Name), aciName) {
+				container = &(*resp.Containers)[i]
+			}
+		}
+	}
+	if container == nil || container.ContainerProperties == nil || container.InstanceView == nil {
+		return status, nil
+	}
+
+	if container.InstanceView.CurrentState != nil {
+		status.ExitCode = container.InstanceView.CurrentState.ExitCode
+		status.DetailStatus = to.String(container.InstanceView.CurrentState.DetailStatus)
+	}
+	if container.InstanceView.Events != nil {
+		status.Events = append(status.Events, containerEvents(*container.InstanceView.Events)...)
 	}
 
-	return *resp.InstanceView.State, nil
+	return status, nil
+}
+
+func containerEvents(events []containerinstance.Event) []ContainerEvent {
+	result := make([]ContainerEvent, 0, len(events))
+	for _, event := range events {
+		result = append(result, ContainerEvent{
+			Type:    to.String(event.Type),
+			Name:    to.String(event.Name),
+			Message: to.String(event.Message),
+			Count:   to.Int32(event.Count),
+		})
+	}
+	return result
 }
 
 func locationIsAvailable(location string, locations []string) bool {
@@ -986,98 +1710,164 @@ func locationIsAvailable(location string, locations []string) bool {
 	return false
 }
 
-func (d *aciDriver) createContainerGroup(aciName string, aciRG string, containerGroup containerinstance.ContainerGroup) (containerinstance.ContainerGroup, error) {
-	containerGroupsClient, err := az.GetContainerGroupsClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
+func (d *aciDriver) createContainerGroup(ctx context.Context, aciName string, aciRG string, containerGroup containerinstance.ContainerGroup) (containerinstance.ContainerGroup, error) {
+	result, err := d.backend.CreateContainerGroup(ctx, d.subscriptionID, aciRG, aciName, containerGroup)
 	if err != nil {
-		return containerinstance.ContainerGroup{}, fmt.Errorf("Error getting Container Groups Client: %v", err)
+		return containerinstance.ContainerGroup{}, fmt.Errorf("Error Creating Container Group: %v", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	future, err := containerGroupsClient.CreateOrUpdate(ctx, aciRG, aciName, containerGroup)
+	return result, nil
+}
+
+// getImage gets the invocation image to run and the domain of the registry that it is pulled from, if the image has been relocated
+// the domain is the registry it was relocated to so that the registry credentials are for that registry
+func (d *aciDriver) getImage(op *driver.Operation) (string, string, error) {
+	img, err := d.relocateImage(op)
 	if err != nil {
-		return containerinstance.ContainerGroup{}, fmt.Errorf("Error Creating Container Group: %v", err)
+		return "", "", err
 	}
-
-	err = future.WaitForCompletionRef(ctx, containerGroupsClient.Client)
+	image, err := imageWithDigest(img)
+	if err != nil {
+		return "", "", err
+	}
+	if image, err = d.registryMirrors.apply(image); err != nil {
+		return "", "", err
+	}
+	named, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
-		return containerinstance.ContainerGroup{}, fmt.Errorf("Error Waiting for Container Group creation: %v", err)
+		return "", "", fmt.Errorf("Failed to parse image reference: %s error: %v", image, err)
+	}
+	domain := reference.Domain(named)
+
+	// SPN details are for Azure registry only
+	if d.useSPForACR && !registry.IsAzureContainerRegistry(domain) {
+		return "", "", fmt.Errorf("Cannot use Service Principal as credentials for non Azure registry : %s", domain)
 	}
 
-	return future.Result(*containerGroupsClient)
+	return image, domain, nil
 }
 
-func (d *aciDriver) createInstance(aciName string, aciLocation string, aciRG string, image string, env []containerinstance.EnvironmentVariable, identity identityDetails, mounts *[]containerinstance.VolumeMount, volumes *[]containerinstance.Volume, hasFiles bool, domain string) (*containerinstance.ContainerGroup, error) {
+// buildContainerGroup builds the container group that executes the operation, this does not call Azure so that the same container group can be used for a plan
+func (d *aciDriver) buildContainerGroup(op *driver.Operation, image string, domain string, identity *identityDetails, tags map[string]*string) (containerinstance.ContainerGroup, error) {
+	var err error
+	var mounts []containerinstance.VolumeMount
+	var volumes []containerinstance.Volume
 
-	// TODO Windows Container support
+	// ACI does not support file copy
+	// files are mounted into the container in a secrets volume and invocationImage Entry point is modified to process the files before run cmd is invoked,
+	// files that are too large for a secret volume are staged on the state file share which is mounted read-only in place of the secrets volume
 
-	// ARM does not yet support the ability to create a System MSI and assign role and scope on creation
-	// so if the MSI type is system assigned then need to create the ACI Instance first with an alpine instance in order to create the identity and then assign permissions
-	// The created ACI is then updated to execute the Invocation Image
+	hasFiles := len(op.Files) > 0
+	log.Debug("Bundle Has File Inputs:", hasFiles)
+	if hasFiles && len(d.stagedFilesPath) > 0 {
+		stagedVolume, stagedMount := d.getStagedFilesVolume()
+		volumes = append(volumes, stagedVolume)
+		mounts = append(mounts, stagedMount)
+	} else if hasFiles {
+		secretMount := containerinstance.VolumeMount{
+			MountPath: to.StringPtr(fileMountPoint),
+			Name:      to.StringPtr(fileMountName),
+		}
+		mounts = append(mounts, secretMount)
+		secrets := make(map[string]*string)
+		secretVolume := containerinstance.Volume{
+			Name:   to.StringPtr(fileMountName),
+			Secret: secrets,
+		}
+		volumes = append(volumes, secretVolume)
+		i := 0
+		for k, v := range op.Files {
+			log.Debug("Processing File Input: ", k)
+			secrets[fmt.Sprintf("path%d", i)] = to.StringPtr(base64.StdEncoding.EncodeToString([]byte(k)))
+			secrets[fmt.Sprintf("value%d", i)] = to.StringPtr(base64.StdEncoding.EncodeToString([]byte(v)))
+			i++
+		}
+	}
 
-	if identity.MSIType == "system" {
-		log.Debug("Creating ACI to create System Identity")
-		alpine := "alpine:latest"
-		containerGroup, err := d.createContainerGroup(
-			aciName,
-			aciRG,
-			containerinstance.ContainerGroup{
-				Name:     &aciName,
-				Location: &aciLocation,
-				Identity: identity.Identity,
-				ContainerGroupProperties: &containerinstance.ContainerGroupProperties{
-					OsType:        containerinstance.Linux,
-					RestartPolicy: containerinstance.Never,
-					Containers: &[]containerinstance.Container{
-						{
-							Name: &aciName,
-							ContainerProperties: &containerinstance.ContainerProperties{
-								Image: &alpine,
-								Resources: &containerinstance.ResourceRequirements{
-									Requests: &containerinstance.ResourceRequests{
-										MemoryInGB: to.Float64Ptr(1),
-										CPU:        to.Float64Ptr(1.5),
-									},
-									Limits: &containerinstance.ResourceLimits{
-										MemoryInGB: to.Float64Ptr(1),
-										CPU:        to.Float64Ptr(1.5),
-									},
-								},
-							},
-						},
-					},
-				},
-			})
-		if err != nil {
-			return nil, fmt.Errorf("Error Creating Container Group for System MSI creation: %v", err)
+	var env []containerinstance.EnvironmentVariable
+	env = d.createMSIEnvVars(env)
+	if d.propagateCredentials {
+		env = d.createAzureEnvironmentEnvVars(env)
+		// Only propagate credentials if not using MSI
+		if len(d.msiType) == 0 {
+			env, err = d.createCredentialEnvVars(env)
 		}
 
-		err = d.setUpSystemMSIRBAC(containerGroup.Identity.PrincipalID, *identity.Scope, *identity.Role)
 		if err != nil {
-			return nil, fmt.Errorf("Error setting up RBAC for System MSI : %v", err)
+			return containerinstance.ContainerGroup{}, fmt.Errorf("Failed to create environment variables for Credentials:%v", err)
 		}
 
 	}
 
-	log.Debug("Creating ACI for CNAB action")
+	for k, v := range op.Environment {
+		// Need to check if any of the env variables already exist in case any propagated credentials are being overridden
+		for _, ev := range env {
+			if k == *ev.Name {
+				ev.SecureValue = to.StringPtr(strings.Replace(v, "'", "''", -1))
+				log.Debug("Updating Container Group Environment Variable: Name: ", k)
+				continue
+			}
+
+		}
+		env = append(env, containerinstance.EnvironmentVariable{
+			Name:        to.StringPtr(k),
+			SecureValue: to.StringPtr(strings.Replace(v, "'", "''", -1)),
+		})
+		log.Debug("Setting Container Group Environment Variable: Name: ", k)
+	}
+	var volume = containerinstance.Volume{}
+	var volumeMount = containerinstance.VolumeMount{}
+	if d.mountStateVolume || d.outputsInBlob {
+		d.statePath = fmt.Sprintf("%s/%s", strings.ToLower(op.Bundle.Name), strings.ToLower(op.Installation))
+	}
+	if d.outputsInBlob {
+		log.Debug("Outputs URL: ", d.outputsURL())
+		env = append(env, containerinstance.EnvironmentVariable{
+			Name:  to.StringPtr(outputsURLEnvVarName),
+			Value: to.StringPtr(d.outputsURL()),
+		}, containerinstance.EnvironmentVariable{
+			Name:        to.StringPtr(outputsSASEnvVarName),
+			SecureValue: to.StringPtr(d.outputsSASToken),
+		})
+	}
+	if d.mountStateVolume {
+		statePath := fmt.Sprintf("%s/%s", d.stateMountPoint, d.statePath)
+		log.Debug("State Path: ", statePath)
+		env = append(env, containerinstance.EnvironmentVariable{
+			Name:  to.StringPtr("STATE_PATH"),
+			Value: to.StringPtr(statePath),
+		})
+		volume.Name = to.StringPtr(stateMountName)
+		volume.AzureFile = d.getAzureFileVolume()
+		volumeMount.Name = to.StringPtr(stateMountName)
+		volumeMount.ReadOnly = to.BoolPtr(false)
+		volumeMount.MountPath = to.StringPtr(d.stateMountPoint)
+		mounts = append(mounts, volumeMount)
+		volumes = append(volumes, volume)
+	}
+
+	// TODO Windows Container support
 
 	// Because ACI does not have a way to mount or copy files any file input to the invocation image is set as a pair of secrets in a secret volume, path{n} contains the file target file path and
 	// value{n} contains the file content, the script below is injected into the container so that the expected files are created before the run tool is executed
 	var scriptBuilder strings.Builder
 	var command []string
+	var initContainers *[]containerinstance.InitContainerDefinition
 
 	if hasFiles || d.hasOutputs || d.debugContainer {
 		if hasFiles {
 			// Get the filenames and data  from the secret volume and place them where they are expected by the bundle
-			scriptBuilder.WriteString(fmt.Sprintf("cd %s;for f in $(ls path*);do file=$(cat ${f});mkdir -p $(dirname ${file});cp value${f#path} ${file};done;cd -;", fileMountPoint))
+			scriptBuilder.WriteString(fmt.Sprintf("cd %s;for f in $(ls path*);do file=$(cat ${f});mkdir -p $(dirname ${file});cp value${f#path} ${file};done;cd -;", path.Join(fileMountPoint, d.stagedFilesPath)))
 		}
 
-		if len(d.statePath) > 0 {
+		if d.mountStateVolume {
 			statePathCmd := "mkdir -p ${STATE_PATH};"
 			scriptBuilder.WriteString(statePathCmd)
 		}
 
-		if d.hasOutputs {
+		if d.outputsInLogs || d.outputsInBlob {
+			scriptBuilder.WriteString(fmt.Sprintf("mkdir -p %s%s;", cnabOutputMountPoint, cnabOutputDirName))
+		} else if d.hasOutputs {
 			outputsCmd := fmt.Sprintf("mkdir -p ${STATE_PATH}/%[2]s;ln -s ${STATE_PATH}/%[2]s %[1]s%[2]s;", cnabOutputMountPoint, cnabOutputDirName)
 			scriptBuilder.WriteString(outputsCmd)
 		}
@@ -1085,10 +1875,19 @@ func (d *aciDriver) createInstance(aciName string, aciLocation string, aciRG str
 		if d.debugContainer {
 			scriptBuilder.WriteString("tail -f /dev/null")
 		} else {
-			scriptBuilder.WriteString("/cnab/app/run")
+			if d.outputsInLogs {
+				scriptBuilder.WriteString(writeOutputsCommand(shellCommand(d.getRunCommand())))
+			} else if d.outputsInBlob {
+				scriptBuilder.WriteString(uploadOutputsCommand(shellCommand(d.getRunCommand())))
+			} else {
+				scriptBuilder.WriteString(shellCommand(d.getRunCommand()))
+			}
 		}
 
-		command = []string{"/bin/bash", "-e", "-c", scriptBuilder.String()}
+		command = d.scriptCommand(scriptBuilder.String())
+		initContainers = d.getInitContainers(&volumes, &mounts)
+	} else if len(d.runCommand) > 0 {
+		command = d.runCommand
 	}
 
 	var registrycredentials []containerinstance.ImageRegistryCredential
@@ -1102,64 +1901,266 @@ func (d *aciDriver) createInstance(aciName string, aciLocation string, aciRG str
 		registrycredentials = append(registrycredentials, credentials)
 	}
 
-	containerGroup, err := d.createContainerGroup(
-		aciName,
-		aciRG,
-		containerinstance.ContainerGroup{
-			Name:     &aciName,
-			Location: &aciLocation,
-			Identity: identity.Identity,
-			ContainerGroupProperties: &containerinstance.ContainerGroupProperties{
-				OsType:        containerinstance.Linux,
-				RestartPolicy: containerinstance.Never,
-				Containers: &[]containerinstance.Container{
-					{
-						Name: &aciName,
-						ContainerProperties: &containerinstance.ContainerProperties{
-							Image: &image,
-							Resources: &containerinstance.ResourceRequirements{
-								Requests: &containerinstance.ResourceRequests{
-									MemoryInGB: to.Float64Ptr(1),
-									CPU:        to.Float64Ptr(1.5),
-								},
-								Limits: &containerinstance.ResourceLimits{
-									MemoryInGB: to.Float64Ptr(1),
-									CPU:        to.Float64Ptr(1.5),
-								},
+	return containerinstance.ContainerGroup{
+		Name:     &d.aciName,
+		Location: &d.aciLocation,
+		Tags:     tags,
+		Identity: identity.Identity,
+		ContainerGroupProperties: &containerinstance.ContainerGroupProperties{
+			OsType:        containerinstance.OperatingSystemTypesLinux,
+			RestartPolicy: containerinstance.ContainerGroupRestartPolicyNever,
+			Containers: &[]containerinstance.Container{
+				{
+					Name: &d.aciName,
+					ContainerProperties: &containerinstance.ContainerProperties{
+						Image:                &image,
+						Resources:            d.getResourceRequirements(),
+						EnvironmentVariables: &env,
+						Command:              to.StringSlicePtr(command),
+						VolumeMounts:         &mounts,
+					},
+				},
+			},
+			InitContainers:           initContainers,
+			Volumes:                  &volumes,
+			ImageRegistryCredentials: &registrycredentials,
+			SubnetIds:                d.getSubnetIDs(),
+			DNSConfig:                d.getDNSConfiguration(),
+		},
+	}, nil
+}
+
+func (d *aciDriver) createInstance(ctx context.Context, aciName string, aciRG string, containerGroup containerinstance.ContainerGroup, identity identityDetails) (*containerinstance.ContainerGroup, error) {
+
+	// ARM does not yet support the ability to create a System MSI and assign role and scope on creation
+	// so if the MSI type is system assigned then need to create the ACI Instance first with the bootstrap image (alpine by default) in order to create the identity and then assign permissions
+	// The created ACI is then updated to execute the Invocation Image
+
+	// The resources and network of a container group cannot be changed once it has been created so the bootstrap instance uses the same resources and subnet as the invocation image
+	if identity.MSIType == "system" {
+		log.Debug("Creating ACI to create System Identity")
+		systemMSIContainerGroup, err := d.createContainerGroup(
+			ctx,
+			aciName,
+			aciRG,
+			containerinstance.ContainerGroup{
+				Name:     &aciName,
+				Location: containerGroup.Location,
+				Tags:     containerGroup.Tags,
+				Identity: identity.Identity,
+				ContainerGroupProperties: &containerinstance.ContainerGroupProperties{
+					OsType:        containerinstance.OperatingSystemTypesLinux,
+					RestartPolicy: containerinstance.ContainerGroupRestartPolicyNever,
+					Containers: &[]containerinstance.Container{
+						{
+							Name: &aciName,
+							ContainerProperties: &containerinstance.ContainerProperties{
+								Image:     to.StringPtr(d.bootstrapImage),
+								Resources: d.getResourceRequirements(),
 							},
-							EnvironmentVariables: &env,
-							Command:              to.StringSlicePtr(command),
-							VolumeMounts:         mounts,
 						},
 					},
+					// The bootstrap image may be in the same private registry as the invocation image
+					ImageRegistryCredentials: containerGroup.ImageRegistryCredentials,
+					SubnetIds:                containerGroup.SubnetIds,
+					DNSConfig:                containerGroup.DNSConfig,
 				},
-				Volumes:                  volumes,
-				ImageRegistryCredentials: &registrycredentials,
-			},
-		})
+			})
+		if err != nil {
+			return nil, fmt.Errorf("Error Creating Container Group for System MSI creation: %v", err)
+		}
+
+		d.systemMSIPrincipalID = to.String(systemMSIContainerGroup.Identity.PrincipalID)
+		err = d.setUpSystemMSIRBAC(ctx, systemMSIContainerGroup.Identity.PrincipalID, *identity.Scope, *identity.Role)
+		if err != nil {
+			return nil, fmt.Errorf("Error setting up RBAC for System MSI : %v", err)
+		}
+
+	}
+
+	log.Debug("Creating ACI for CNAB action")
+	result, err := d.createContainerGroup(ctx, aciName, aciRG, containerGroup)
 	if err != nil {
 		return nil, fmt.Errorf("Error Creating Container Group: %v", err)
 	}
 
-	return &containerGroup, nil
+	return &result, nil
 }
 
-func (d *aciDriver) setUpSystemMSIRBAC(principalID *string, scope string, role string) error {
-	log.Debug("Setting up System MSI Scope ", scope, "Role ", role)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	roleDefinitionsClient, err := az.GetRoleDefinitionsClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
+// Returns the tags applied to the resources created to run the operation, the object ID of the logged in identity is only known after login
+func (d *aciDriver) getTags(op *driver.Operation, createdAt time.Time) map[string]*string {
+	tags := make(map[string]*string)
+	for name, value := range d.tags {
+		tags[name] = to.StringPtr(value)
+	}
+
+	driverTags := map[string]string{
+		tagInstallation:    op.Installation,
+		tagAction:          op.Action,
+		tagDriverVersion:   d.version,
+		tagCreatedAt:       createdAt.UTC().Format(time.RFC3339),
+		tagCreatedBy:       d.loginInfo.ObjectID,
+		tagRetentionPolicy: d.retention().String(),
+	}
+	if op.Bundle != nil {
+		driverTags[tagBundleName] = op.Bundle.Name
+		driverTags[tagBundleVersion] = op.Bundle.Version
+	}
+	for name, value := range driverTags {
+		if len(value) > 0 {
+			tags[name] = to.StringPtr(truncate(value, maxTagValueLength))
+		}
+	}
+
+	return tags
+}
+
+func truncate(value string, length int) string {
+	if len(value) > length {
+		return value[:length]
+	}
+	return value
+}
+
+// This function creates the resource requests and limits for the container instance
+func (d *aciDriver) getResourceRequirements() *containerinstance.ResourceRequirements {
+	requests := containerinstance.ResourceRequests{
+		MemoryInGB: to.Float64Ptr(d.memoryInGB),
+		CPU:        to.Float64Ptr(d.cpu),
+	}
+	limits := containerinstance.ResourceLimits{
+		MemoryInGB: to.Float64Ptr(d.memoryInGB),
+		CPU:        to.Float64Ptr(d.cpu),
+	}
+	if d.gpuCount > 0 {
+		gpu := containerinstance.GpuResource{
+			Count: to.Int32Ptr(int32(d.gpuCount)),
+			Sku:   containerinstance.GpuSku(d.gpuSKU),
+		}
+		requests.Gpu = &gpu
+		limits.Gpu = &gpu
+	}
+	return &containerinstance.ResourceRequirements{
+		Requests: &requests,
+		Limits:   &limits,
+	}
+}
+
+// This function gets the subnet the container group is attached to, if any
+func (d *aciDriver) getSubnetIDs() *[]containerinstance.ContainerGroupSubnetID {
+	if len(d.subnet.ID) == 0 {
+		return nil
+	}
+	return &[]containerinstance.ContainerGroupSubnetID{
+		{
+			ID: to.StringPtr(d.subnet.ID),
+		},
+	}
+}
+
+// This function gets the DNS configuration for a container group in a virtual network
+func (d *aciDriver) getDNSConfiguration() *containerinstance.DNSConfiguration {
+	if len(d.dnsNameServers) == 0 {
+		return nil
+	}
+	dnsConfig := containerinstance.DNSConfiguration{
+		NameServers: to.StringSlicePtr(d.dnsNameServers),
+	}
+	if len(d.dnsSearchDomains) > 0 {
+		dnsConfig.SearchDomains = to.StringPtr(strings.Join(d.dnsSearchDomains, " "))
+	}
+	return &dnsConfig
+}
+
+// Checks that the subnet exists and is delegated to ACI
+func (d *aciDriver) checkSubnet(ctx context.Context) error {
+	subnet, err := d.backend.GetSubnet(ctx, d.subnet.SubscriptionID, d.subnet.ResourceGroup, d.subnet.VirtualNetwork, d.subnet.Name)
 	if err != nil {
-		return fmt.Errorf("Error getting RoleDefinitions Client: %v", err)
+		if az.IsNotFound(err) {
+			return fmt.Errorf("Subnet %s not found", d.subnet.ID)
+		}
+		return fmt.Errorf("Error getting Subnet %s: %v", d.subnet.ID, err)
 	}
-	roleDefinitionID := ""
-	for roleDefinitions, err := roleDefinitionsClient.ListComplete(ctx, scope, ""); roleDefinitions.NotDone(); err = roleDefinitions.NextWithContext(ctx) {
-		if err != nil {
-			return fmt.Errorf("Error getting RoleDefinitions for Scope:%s Error: %v", scope, err)
+
+	if subnet.SubnetPropertiesFormat != nil && subnet.Delegations != nil {
+		for _, delegation := range *subnet.Delegations {
+			if delegation.ServiceDelegationPropertiesFormat != nil && strings.EqualFold(to.String(delegation.ServiceName), aciSubnetDelegation) {
+				log.Debugf("Subnet %s is delegated to %s", d.subnet.ID, aciSubnetDelegation)
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("Subnet %s is not delegated to %s", d.subnet.ID, aciSubnetDelegation)
+}
+
+// Checks that the requested resources are within the limits ACI supports in the location
+func (d *aciDriver) checkResourcesAvailableInLocation(ctx context.Context) error {
+	capabilities, err := d.backend.ListContainerInstanceCapabilities(ctx, d.subscriptionID, d.aciLocation)
+	if err != nil {
+		return fmt.Errorf("Error getting ACI capabilities for location %s: %v", d.aciLocation, err)
+	}
+
+	gpu := "None"
+	if d.gpuCount > 0 {
+		gpu = d.gpuSKU
+	}
+
+	found := false
+	var maxCPU, maxMemoryInGB, maxGPUCount float64
+	for _, c := range capabilities {
+		if c.ResourceType == nil || !strings.EqualFold(*c.ResourceType, "containerGroups") || c.OsType == nil || !strings.EqualFold(*c.OsType, string(containerinstance.OperatingSystemTypesLinux)) || c.Gpu == nil || !strings.EqualFold(*c.Gpu, gpu) || c.Capabilities == nil {
+			continue
+		}
+
+		found = true
+		maxCPU = maxFloat64(maxCPU, c.Capabilities.MaxCPU)
+		maxMemoryInGB = maxFloat64(maxMemoryInGB, c.Capabilities.MaxMemoryInGB)
+		maxGPUCount = maxFloat64(maxGPUCount, c.Capabilities.MaxGpuCount)
+	}
+
+	if !found {
+		if d.gpuCount > 0 {
+			return fmt.Errorf("GPU SKU %s is not available for ACI in location %s", d.gpuSKU, d.aciLocation)
 		}
+		log.Debug("No ACI capabilities found for location: ", d.aciLocation)
+		return nil
+	}
+
+	log.Debugf("ACI Capabilities for location %s GPU %s: Max CPU: %v Max Memory in GB: %v Max GPU Count: %v", d.aciLocation, gpu, maxCPU, maxMemoryInGB, maxGPUCount)
+	if d.cpu > maxCPU {
+		return fmt.Errorf("requested CPU %v exceeds the maximum of %v for ACI in location %s", d.cpu, maxCPU, d.aciLocation)
+	}
+
+	if d.memoryInGB > maxMemoryInGB {
+		return fmt.Errorf("requested memory %vGB exceeds the maximum of %vGB for ACI in location %s", d.memoryInGB, maxMemoryInGB, d.aciLocation)
+	}
+
+	if float64(d.gpuCount) > maxGPUCount {
+		return fmt.Errorf("requested GPU count %d exceeds the maximum of %v for ACI in location %s", d.gpuCount, maxGPUCount, d.aciLocation)
+	}
+
+	return nil
+}
+
+func maxFloat64(current float64, value *float64) float64 {
+	if value != nil && *value > current {
+		return *value
+	}
+	return current
+}
+
+func (d *aciDriver) setUpSystemMSIRBAC(ctx context.Context, principalID *string, scope string, role string) error {
+	log.Debug("Setting up System MSI Scope ", scope, "Role ", role)
+	roleDefinitions, err := d.backend.ListRoleDefinitions(ctx, d.subscriptionID, scope)
+	if err != nil {
+		return fmt.Errorf("Error getting RoleDefinitions for Scope:%s Error: %v", scope, err)
+	}
 
-		if *roleDefinitions.Value().RoleDefinitionProperties.RoleName == role {
-			roleDefinitionID = *roleDefinitions.Value().ID
+	roleDefinitionID := ""
+	for _, roleDefinition := range roleDefinitions {
+		if roleDefinition.RoleDefinitionProperties != nil && roleDefinition.RoleName != nil && *roleDefinition.RoleName == role {
+			roleDefinitionID = *roleDefinition.ID
 			break
 		}
 
@@ -1174,12 +2175,7 @@ func (d *aciDriver) setUpSystemMSIRBAC(principalID *string, scope string, role s
 	attempts := 5
 	for i := 0; i < attempts; i++ {
 		log.Debug("Creating RoleAssignment Attempt: ", i)
-		roleAssignmentsClient, raerror := az.GetRoleAssignmentClient(d.subscriptionID, d.loginInfo.Authorizer, d.userAgent)
-		if raerror != nil {
-			log.Debug("Failed to Get Role Assignment Client Error: ", err)
-		}
-
-		_, raerror = roleAssignmentsClient.Create(ctx, scope, uuid.New().String(), authorization.RoleAssignmentCreateParameters{
+		_, raerror := d.backend.CreateRoleAssignment(ctx, d.subscriptionID, scope, uuid.New().String(), authorization.RoleAssignmentCreateParameters{
 			Properties: &authorization.RoleAssignmentProperties{
 				RoleDefinitionID: &roleDefinitionID,
 				PrincipalID:      principalID,
@@ -1188,7 +2184,11 @@ func (d *aciDriver) setUpSystemMSIRBAC(principalID *string, scope string, role s
 		if raerror != nil {
 			err = fmt.Errorf("Error creating RoleAssignment Role:%s for Scope:%s Error: %v", role, scope, raerror)
 			log.Debug("Creating RoleAssignment Attempt: ", i, "Error: ", err)
-			time.Sleep(20 * time.Second)
+			select {
+			case <-ctx.Done():
+				return d.cancellationError(ctx.Err())
+			case <-time.After(20 * time.Second):
+			}
 			continue
 		}
 
@@ -1199,6 +2199,15 @@ func (d *aciDriver) setUpSystemMSIRBAC(principalID *string, scope string, role s
 	return err
 }
 
+// subnetDetails identifies the virtual network subnet that the container group is attached to
+type subnetDetails struct {
+	ID             string
+	SubscriptionID string
+	ResourceGroup  string
+	VirtualNetwork string
+	Name           string
+}
+
 type identityDetails struct {
 	MSIType  string
 	Identity *containerinstance.ContainerGroupIdentity
@@ -1308,20 +2317,45 @@ func (d *aciDriver) getFieldValue(field string) string {
 	return reflect.Indirect(r).FieldByName(field).String()
 }
 
-func imageWithDigest(img bundle.InvocationImage) string {
-	// its not clear what should be in img.Image and img.Digest this tries to cover multiple scenarios
-	// see https://github.com/deislabs/cnab-go/issues/145 and https://github.com/deislabs/cnab-spec/issues/287
+// imageWithDigest gets the reference that ACI pulls the invocation image with. Its not clear what should be in img.Image and img.Digest
+// (see https://github.com/deislabs/cnab-go/issues/145 and https://github.com/deislabs/cnab-spec/issues/287) so img.Image may have a tag, a digest or both
+// and img.Digest is used if it is set. ACI does not accept a reference with both a tag and a digest so the tag is dropped when there is a digest.
+func imageWithDigest(img bundle.InvocationImage) (string, error) {
 	log.Debug("Image: ", img.Image)
-	// Hack in case image contains digest and/or digest and tag
-	if img.Digest == "" || strings.Contains(img.Image, "@sha256") {
-		imageParts := strings.Split(img.Image, ":")
-		// Image contains a tag and a digest
-		if len(imageParts) == 3 {
-			return imageParts[0] + ":" + imageParts[2]
+	if len(strings.TrimSpace(img.Image)) == 0 {
+		return "", errors.New("Invocation image does not have an image reference")
+	}
+	named, err := reference.ParseNormalizedNamed(img.Image)
+	if err != nil {
+		return "", fmt.Errorf("Invocation image reference %s is not valid: %v", img.Image, err)
+	}
+
+	if len(img.Digest) > 0 {
+		ref, err := reference.ParseNormalizedNamed(named.Name() + "@" + img.Digest)
+		if err != nil {
+			return "", fmt.Errorf("Invocation image digest %s is not valid: %v", img.Digest, err)
+		}
+		withDigest := ref.(reference.Canonical)
+		if canonical, ok := named.(reference.Canonical); ok && canonical.Digest() != withDigest.Digest() {
+			return "", fmt.Errorf("Invocation image reference %s does not match the invocation image digest %s", img.Image, img.Digest)
+		}
+		named = withDigest
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		if named, err = reference.WithDigest(reference.TrimNamed(named), canonical.Digest()); err != nil {
+			return "", fmt.Errorf("Invocation image reference %s is not valid: %v", img.Image, err)
 		}
-		return img.Image
 	}
 
-	//Workaround for issue in ACI Image Reference Parsing where it doesn't allow both a tag and a digest
-	return strings.Split(img.Image, ":")[0] + "@" + img.Digest
+	// ACI pulls images from outside the container group so cannot use a registry on the local machine
+	host := reference.Domain(named)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" || net.ParseIP(host).IsLoopback() {
+		return "", fmt.Errorf("Invocation image %s is in a registry on the local machine which ACI cannot pull from", img.Image)
+	}
+
+	return reference.FamiliarString(reference.TagNameOnly(named)), nil
 }
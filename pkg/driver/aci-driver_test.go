@@ -1,12 +1,24 @@
 package driver
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2022-07-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/cnabio/cnab-go/bundle"
 	"github.com/cnabio/cnab-go/bundle/definition"
 	cnabdriver "github.com/cnabio/cnab-go/driver"
@@ -15,6 +27,7 @@ import (
 	"github.com/google/uuid"
 
 	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
 	"github.com/deislabs/cnab-azure-driver/test"
 )
 
@@ -67,6 +80,29 @@ func TestNewACIDriver(t *testing.T) {
 		{"CNAB_AZURE_STATE_MOUNT_POINT_should_be_an_absolute_path", true, "value (test) of CNAB_AZURE_STATE_MOUNT_POINT is not an absolute path", map[string]string{"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY": "test", "CNAB_AZURE_STATE_MOUNT_POINT": "test"}, []string{}, map[string]interface{}{}},
 		{"CNAB_AZURE_STATE_MOUNT_POINT_should_not be root path", true, "CNAB_AZURE_STATE_MOUNT_POINT should not be root path", map[string]string{"CNAB_AZURE_STATE_MOUNT_POINT": "/../"}, []string{}, map[string]interface{}{}},
 		{"No error when setting CNAB_AZURE_MOUNT_POINT", false, "", map[string]string{"CNAB_AZURE_STATE_MOUNT_POINT": "/mnt/path"}, []string{}, map[string]interface{}{"mountStateVolume": true, "stateMountPoint": "/mnt/path"}},
+		{"CNAB_AZURE_CPU should be a number", true, "CNAB_AZURE_CPU environment variable parsing error: strconv.ParseFloat: parsing \"invalid\": invalid syntax", map[string]string{"CNAB_AZURE_CPU": "invalid"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_CPU should be greater than 0", true, "invalid CPU value 0, CPU must be greater than 0", map[string]string{"CNAB_AZURE_CPU": "0"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_MEMORY_GB should be a number", true, "CNAB_AZURE_MEMORY_GB environment variable parsing error: strconv.ParseFloat: parsing \"invalid\": invalid syntax", map[string]string{"CNAB_AZURE_CPU": "2", "CNAB_AZURE_MEMORY_GB": "invalid"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_MEMORY_GB should be greater than 0", true, "invalid memory value -1, memory in GB must be greater than 0", map[string]string{"CNAB_AZURE_MEMORY_GB": "-1"}, []string{}, map[string]interface{}{}},
+		{"No error when setting CNAB_AZURE_CPU and CNAB_AZURE_MEMORY_GB", false, "", map[string]string{"CNAB_AZURE_MEMORY_GB": "4"}, []string{}, map[string]interface{}{"cpu": 2.0, "memoryInGB": 4.0, "gpuCount": int64(0)}},
+		{"CNAB_AZURE_GPU_SKU should be set if CNAB_AZURE_GPU_COUNT is set", true, "CNAB_AZURE_GPU_SKU should be set when CNAB_AZURE_GPU_COUNT is set", map[string]string{"CNAB_AZURE_GPU_COUNT": "2"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_GPU_SKU should be a valid SKU", true, "invalid GPU SKU X100, supported values are [K80 P100 V100]", map[string]string{"CNAB_AZURE_GPU_SKU": "x100"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_GPU_COUNT should not exceed the maximum", true, "invalid GPU count 5, GPU count must be between 1 and 4", map[string]string{"CNAB_AZURE_GPU_SKU": "k80", "CNAB_AZURE_GPU_COUNT": "5"}, []string{}, map[string]interface{}{}},
+		{"No error when setting CNAB_AZURE_GPU_SKU and CNAB_AZURE_GPU_COUNT", false, "", map[string]string{"CNAB_AZURE_GPU_COUNT": "2"}, []string{}, map[string]interface{}{"gpuSKU": "K80", "gpuCount": int64(2)}},
+		{"CNAB_AZURE_GPU_COUNT defaults to 1 when CNAB_AZURE_GPU_SKU is set", false, "", map[string]string{}, []string{"CNAB_AZURE_GPU_COUNT"}, map[string]interface{}{"gpuSKU": "K80", "gpuCount": int64(1)}},
+		{"CNAB_AZURE_TIMEOUT should be a duration", true, "CNAB_AZURE_TIMEOUT environment variable parsing error: time: invalid duration \"invalid\"", map[string]string{"CNAB_AZURE_TIMEOUT": "invalid"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_TIMEOUT should not be negative", true, "value (-1m) of CNAB_AZURE_TIMEOUT should not be negative", map[string]string{"CNAB_AZURE_TIMEOUT": "-1m"}, []string{}, map[string]interface{}{}},
+		{"No error when setting CNAB_AZURE_TIMEOUT", false, "", map[string]string{"CNAB_AZURE_TIMEOUT": "90m"}, []string{}, map[string]interface{}{"timeout": int64(90 * time.Minute)}},
+		{"CNAB_AZURE_TIMEOUT should not be set when CNAB_AZURE_DETACH is true", true, "CNAB_AZURE_TIMEOUT should not be set when CNAB_AZURE_DETACH is true", map[string]string{"CNAB_AZURE_DETACH": "true"}, []string{}, map[string]interface{}{}},
+		{"No error when setting CNAB_AZURE_DETACH", false, "", map[string]string{}, []string{"CNAB_AZURE_TIMEOUT"}, map[string]interface{}{"detach": true}},
+		{"CNAB_AZURE_SUBNET_ID should be a subnet resource ID", true, "CNAB_AZURE_SUBNET_ID environment variable parsing error: invalid subnet ID /subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet, expected /subscriptions/<subscriptionID>/resourceGroups/<resourceGroupName>/providers/Microsoft.Network/virtualNetworks/<virtualNetworkName>/subnets/<subnetName>", map[string]string{"CNAB_AZURE_SUBNET_ID": "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_SUBNET_ID should be set if CNAB_AZURE_DNS_NAME_SERVERS is set", true, "CNAB_AZURE_SUBNET_ID should be set when CNAB_AZURE_DNS_NAME_SERVERS is set", map[string]string{"CNAB_AZURE_DNS_NAME_SERVERS": "10.0.0.4"}, []string{"CNAB_AZURE_SUBNET_ID"}, map[string]interface{}{}},
+		{"CNAB_AZURE_DNS_NAME_SERVERS should be IP addresses", true, "CNAB_AZURE_DNS_NAME_SERVERS environment variable parsing error: dns.contoso.com is not an IP address", map[string]string{"CNAB_AZURE_SUBNET_ID": "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci", "CNAB_AZURE_DNS_NAME_SERVERS": "10.0.0.4,dns.contoso.com"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_DNS_NAME_SERVERS should be set if CNAB_AZURE_DNS_SEARCH_DOMAINS is set", true, "CNAB_AZURE_DNS_NAME_SERVERS should be set when CNAB_AZURE_DNS_SEARCH_DOMAINS is set", map[string]string{"CNAB_AZURE_DNS_SEARCH_DOMAINS": "contoso.com"}, []string{"CNAB_AZURE_DNS_NAME_SERVERS"}, map[string]interface{}{}},
+		{"No error when setting CNAB_AZURE_SUBNET_ID and DNS configuration", false, "", map[string]string{"CNAB_AZURE_DNS_NAME_SERVERS": "10.0.0.4, 10.0.0.5"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_TAGS should be name=value pairs", true, "CNAB_AZURE_TAGS environment variable parsing error: tag owner should be in the format name=value", map[string]string{"CNAB_AZURE_TAGS": "costcenter=1234,owner"}, []string{}, map[string]interface{}{}},
+		{"CNAB_AZURE_TAGS should not set tags added by the driver", true, "CNAB_AZURE_TAGS environment variable parsing error: tag name CNAB-Action is reserved, tag names starting with cnab- are set by the driver", map[string]string{"CNAB_AZURE_TAGS": "CNAB-Action=upgrade"}, []string{}, map[string]interface{}{}},
+		{"No error when setting CNAB_AZURE_TAGS", false, "", map[string]string{"CNAB_AZURE_TAGS": "costcenter=1234, owner=team a"}, []string{}, map[string]interface{}{}},
 		//{"No error when setting CNAB_AZURE_STATE_PATH", false, "", map[string]string{"CNAB_AZURE_STATE_PATH": "/statepath"}, []string{}, map[string]interface{}{"mountStateVolume": true, "statePath": "/statepath"}},
 	}
 	// Unset any CNAB_AZURE environment variables as these will make the tests fail
@@ -151,12 +187,23 @@ func TestCanWriteOutputs(t *testing.T) {
 		},
 	}
 
+	// The fileshare transport needs a state volume, the auto transport reads the outputs from the container logs instead
+	os.Setenv("CNAB_AZURE_OUTPUT_TRANSPORT", "fileshare")
 	d, err := NewACIDriver("test-version")
 	assert.NoErrorf(t, err, "Expected no error when creating Driver to run operation. Got: %v", err)
 	assert.NotNil(t, d)
 	_, err = d.Run(&op)
-	assert.Error(t, err, "Bundle has outputs no volume mounted for state, set CNAB_AZURE_STATE_* variables so that state can be retrieved")
+	assert.EqualError(t, err, "Bundle has outputs no volume mounted for state, set CNAB_AZURE_STATE_* variables so that state can be retrieved")
 
+	os.Setenv("CNAB_AZURE_OUTPUT_TRANSPORT", "auto")
+	d, err = NewACIDriver("test-version")
+	assert.NoErrorf(t, err, "Expected no error when creating Driver to run operation. Got: %v", err)
+	if assert.NotNil(t, d) {
+		aci := d.(*aciDriver)
+		err = aci.prepareOperation(&op)
+		assert.NoErrorf(t, err, "Expected no error preparing operation with auto output transport. Got: %v", err)
+		assert.True(t, aci.outputsInLogs, "Expected outputs to be read from the container logs")
+	}
 }
 func TestRunAzureTest(t *testing.T) {
 
@@ -400,6 +447,148 @@ func TestRunAzureTest(t *testing.T) {
 	}
 }
 
+func TestParseTags(t *testing.T) {
+	tooMany := make([]string, maxTagCount-driverTagCount+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("tag%d=value", i)
+	}
+	testcases := []struct {
+		name        string
+		tags        string
+		expected    map[string]string
+		expectError string
+	}{
+		{"no tags", "", map[string]string{}, ""},
+		{"names and values are trimmed", " costcenter = 1234 ,owner=team a,, ", map[string]string{"costcenter": "1234", "owner": "team a"}, ""},
+		{"values can be empty or contain =", "empty=,query=a=b", map[string]string{"empty": "", "query": "a=b"}, ""},
+		{"names are required", "=value", nil, "tag =value has no name"},
+		{"names cannot contain invalid characters", "cost/center=1234", nil, "tag name cost/center should not contain any of the characters <>%&\\?/"},
+		{"names are case insensitive", "Owner=a,owner=b", nil, "tag owner is set more than once"},
+		{"names are limited to 512 characters", strings.Repeat("n", maxTagNameLength+1) + "=value", nil, fmt.Sprintf("tag name %s is longer than 512 characters", strings.Repeat("n", maxTagNameLength+1))},
+		{"values are limited to 256 characters", "name=" + strings.Repeat("v", maxTagValueLength+1), nil, "value of tag name is longer than 256 characters"},
+		{"the driver tags count towards the limit", strings.Join(tooMany, ","), nil, "41 tags are set, at most 40 tags can be set as 10 tags are added by the driver"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tags, err := parseTags(tc.tags)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tags)
+		})
+	}
+}
+
+func TestParseSubnetID(t *testing.T) {
+	testcases := []struct {
+		name        string
+		id          string
+		expectError bool
+		expected    subnetDetails
+	}{
+		{
+			name: "valid subnet ID",
+			id:   "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci",
+			expected: subnetDetails{
+				ID:             "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci",
+				SubscriptionID: "11111111-1111-1111-1111-111111111111",
+				ResourceGroup:  "network",
+				VirtualNetwork: "vnet",
+				Name:           "aci",
+			},
+		},
+		{
+			name: "valid subnet ID with different casing",
+			id:   "/subscriptions/11111111-1111-1111-1111-111111111111/resourcegroups/my.network/providers/microsoft.network/virtualnetworks/my-vnet/subnets/aci_subnet",
+			expected: subnetDetails{
+				ID:             "/subscriptions/11111111-1111-1111-1111-111111111111/resourcegroups/my.network/providers/microsoft.network/virtualnetworks/my-vnet/subnets/aci_subnet",
+				SubscriptionID: "11111111-1111-1111-1111-111111111111",
+				ResourceGroup:  "my.network",
+				VirtualNetwork: "my-vnet",
+				Name:           "aci_subnet",
+			},
+		},
+		{
+			name:        "invalid virtual network ID",
+			id:          "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet",
+			expectError: true,
+		},
+		{
+			name:        "invalid resource type",
+			id:          "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Storage/storageAccounts/account/subnets/aci",
+			expectError: true,
+		},
+		{
+			name:        "invalid subscription ID",
+			id:          "/subscriptions/11111111-1111-1111-1111-11111111111x/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci",
+			expectError: true,
+		},
+		{
+			name:        "invalid subnet ID with trailing slash",
+			id:          "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci/",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			subnet, err := parseSubnetID(tc.id)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, subnet)
+		})
+	}
+}
+
+func TestImageWithDigest(t *testing.T) {
+	const digest = "sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb"
+	const otherDigest = "sha256:a9137fc4cb1d3c79533a45bbaa437d6f45e501a61b9c882a1ca4960fafe0ae3c"
+	testcases := []struct {
+		name        string
+		image       string
+		digest      string
+		expected    string
+		expectError string
+	}{
+		{name: "docker hub image", image: "nginx", expected: "nginx:latest"},
+		{name: "docker hub image with tag", image: "simongdavies/helloworld-aci-cnab:1.0", expected: "simongdavies/helloworld-aci-cnab:1.0"},
+		{name: "docker hub image with digest", image: "simongdavies/helloworld-aci-cnab", digest: digest, expected: "simongdavies/helloworld-aci-cnab@" + digest},
+		{name: "fully qualified docker hub image", image: "docker.io/library/nginx:1.25", expected: "nginx:1.25"},
+		{name: "registry image with tag", image: "myregistry.azurecr.io/app:1.0", expected: "myregistry.azurecr.io/app:1.0"},
+		{name: "tag is dropped when there is a digest", image: "myregistry.azurecr.io/app:1.0", digest: digest, expected: "myregistry.azurecr.io/app@" + digest},
+		{name: "image with tag and digest", image: "myregistry.azurecr.io/app:1.0@" + digest, expected: "myregistry.azurecr.io/app@" + digest},
+		{name: "image with tag and the same digest", image: "myregistry.azurecr.io/app:1.0@" + digest, digest: digest, expected: "myregistry.azurecr.io/app@" + digest},
+		{name: "registry with port", image: "myreg.local:5000/app", expected: "myreg.local:5000/app:latest"},
+		{name: "registry with port and tag", image: "myreg.local:5000/app:1.0", expected: "myreg.local:5000/app:1.0"},
+		{name: "registry with port, tag and digest", image: "myreg.local:5000/team/app:1.0", digest: digest, expected: "myreg.local:5000/team/app@" + digest},
+		{name: "registry with port and digest in image", image: "myreg.local:5000/team/app@" + digest, expected: "myreg.local:5000/team/app@" + digest},
+		{name: "no image", image: " ", expectError: "Invocation image does not have an image reference"},
+		{name: "uppercase repository", image: "myregistry.azurecr.io/App:1.0", expectError: "Invocation image reference myregistry.azurecr.io/App:1.0 is not valid: invalid reference format: repository name must be lowercase"},
+		{name: "invalid tag", image: "myregistry.azurecr.io/app:1.0:2.0", expectError: "Invocation image reference myregistry.azurecr.io/app:1.0:2.0 is not valid: invalid reference format"},
+		{name: "invalid digest", image: "myregistry.azurecr.io/app", digest: "sha256:1234", expectError: "Invocation image digest sha256:1234 is not valid: invalid reference format"},
+		{name: "digests do not match", image: "myregistry.azurecr.io/app@" + digest, digest: otherDigest, expectError: "Invocation image reference myregistry.azurecr.io/app@" + digest + " does not match the invocation image digest " + otherDigest},
+		{name: "localhost registry", image: "localhost:5000/app:1.0", expectError: "Invocation image localhost:5000/app:1.0 is in a registry on the local machine which ACI cannot pull from"},
+		{name: "loopback registry", image: "127.0.0.1:5000/app", digest: digest, expectError: "Invocation image 127.0.0.1:5000/app is in a registry on the local machine which ACI cannot pull from"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			image, err := imageWithDigest(bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: tc.image, Digest: tc.digest}})
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, image)
+		})
+	}
+}
+
 func TestValidateMSIScope(t *testing.T) {
 	testcases := []struct {
 		name        string
@@ -496,3 +685,472 @@ func getOutputs(results cnabdriver.OperationResult) (outputs []string) {
 	}
 	return outputs
 }
+
+const (
+	fakeSubscriptionID = "11111111-1111-1111-1111-111111111111"
+	fakeLocation       = "westeurope"
+	fakeObjectID       = "33333333-3333-3333-3333-333333333333"
+)
+
+// newFakeDriver creates a driver that uses an in-memory backend and file share instead of Azure
+func newFakeDriver(t *testing.T, settings map[string]string) (*aciDriver, *fake.Backend, *fake.FileShare) {
+	operationRecordDir, err := ioutil.TempDir("", "operations")
+	assert.NoError(t, err, "Error creating operation record directory")
+	t.Cleanup(func() { os.RemoveAll(operationRecordDir) })
+	d := &aciDriver{
+		userAgent:          "azure-cnab-driver-test-version",
+		version:            "test-version",
+		pollInterval:       time.Millisecond,
+		operationRecordDir: operationRecordDir,
+	}
+	config := make(map[string]string)
+	for env := range d.Config() {
+		config[env] = ""
+	}
+	config["CNAB_AZURE_SUBSCRIPTION_ID"] = fakeSubscriptionID
+	config["CNAB_AZURE_LOCATION"] = fakeLocation
+	for k, v := range settings {
+		config[k] = v
+	}
+	err = d.processConfiguration(config)
+	assert.NoErrorf(t, err, "Expected no error when configuring driver. Got: %v", err)
+
+	backend := fake.NewBackend(fakeSubscriptionID, fakeLocation)
+	share := fake.NewFileShare()
+	d.login = func(clientID string, clientSecret string, tenantID string, applicationID string) (az.LoginInfo, error) {
+		return az.LoginInfo{LoginType: az.ServicePrincipal, ObjectID: fakeObjectID}, nil
+	}
+	d.newBackend = func(authorizer autorest.Authorizer, userAgent string) az.Backend {
+		return backend
+	}
+	d.newFileShare = func(accountName string, accountKey string, shareName string) (fileShare, error) {
+		return share, nil
+	}
+	return d, backend, share
+}
+
+func newFakeOperation() *cnabdriver.Operation {
+	return &cnabdriver.Operation{
+		Action:       "install",
+		Installation: "test",
+		Image: bundle.InvocationImage{
+			BaseImage: bundle.BaseImage{
+				Image:     "simongdavies/helloworld-aci-cnab",
+				ImageType: "docker",
+				Digest:    "sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb",
+			},
+		},
+		Bundle: &bundle.Bundle{
+			Name: "helloworld",
+		},
+		Revision: "01DDY0MT808KX0GGZ6SMXN4TW",
+		Environment: map[string]string{
+			"ENV1": "value1",
+		},
+	}
+}
+
+func delegatedSubnet(id string, serviceName string) network.Subnet {
+	return network.Subnet{
+		ID: to.StringPtr(id),
+		SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+			Delegations: &[]network.Delegation{
+				{
+					Name: to.StringPtr("delegation"),
+					ServiceDelegationPropertiesFormat: &network.ServiceDelegationPropertiesFormat{
+						ServiceName: to.StringPtr(serviceName),
+					},
+				},
+			},
+		},
+	}
+}
+
+func getContainer(t *testing.T, cg containerinstance.ContainerGroup) containerinstance.Container {
+	if assert.NotNil(t, cg.ContainerGroupProperties) && assert.NotNil(t, cg.Containers) && assert.Len(t, *cg.Containers, 1) {
+		return (*cg.Containers)[0]
+	}
+	return containerinstance.Container{}
+}
+
+func TestRunWithFakeBackend(t *testing.T) {
+	userMSIResourceID := "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/identities/providers/Microsoft.ManagedIdentity/userAssignedIdentities/test"
+	running := fake.ContainerStep{State: "Running", Logs: []string{"Installing"}}
+	subnetID := "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci"
+	var created []containerinstance.ContainerGroup
+	testcases := []struct {
+		name        string
+		settings    map[string]string
+		setup       func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation)
+		expectError string
+		check       func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult)
+	}{
+		{
+			name: "runs the invocation image and deletes the resources it created",
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					return fake.ContainerRun{running, {State: "Succeeded", Logs: []string{"Done"}}}
+				}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.DeletedContainerGroups)
+				assert.Equal(t, []string{d.aciRG}, b.DeletedResourceGroups)
+				assert.Empty(t, b.ResourceGroups)
+				assert.Empty(t, b.StoppedContainerGroups)
+			},
+		},
+		{
+			name:     "an existing resource group is used and not deleted",
+			settings: map[string]string{"CNAB_AZURE_RESOURCE_GROUP": "existing", "CNAB_AZURE_LOCATION": ""},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.ResourceGroups["existing"] = resources.Group{Location: to.StringPtr(fakeLocation)}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Equal(t, fakeLocation, d.aciLocation)
+				assert.Equal(t, []string{fake.Key("existing", d.aciName)}, b.DeletedContainerGroups)
+				assert.Empty(t, b.DeletedResourceGroups)
+				assert.Contains(t, b.ResourceGroups, "existing")
+			},
+		},
+		{
+			name:     "resources are kept when CNAB_AZURE_DELETE_RESOURCES is false",
+			settings: map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Empty(t, b.DeletedContainerGroups)
+				assert.Empty(t, b.DeletedResourceGroups)
+				if cg, ok := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]; assert.True(t, ok) {
+					container := getContainer(t, cg)
+					assert.Equal(t, "simongdavies/helloworld-aci-cnab@sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb", *container.Image)
+					assert.Contains(t, *container.EnvironmentVariables, containerinstance.EnvironmentVariable{Name: to.StringPtr("ENV1"), SecureValue: to.StringPtr("value1")})
+					assert.Empty(t, to.StringSlice(container.Command))
+				}
+			},
+		},
+		{
+			name:     "files are passed to the container in a secret volume",
+			settings: map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				op.Files = map[string]string{"/cnab/app/image-map.json": "{}"}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+				container := getContainer(t, cg)
+				if assert.NotNil(t, cg.Volumes) && assert.Len(t, *cg.Volumes, 1) {
+					volume := (*cg.Volumes)[0]
+					assert.Equal(t, fileMountName, *volume.Name)
+					assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("/cnab/app/image-map.json")), *volume.Secret["path0"])
+					assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("{}")), *volume.Secret["value0"])
+				}
+				if assert.NotNil(t, container.Command) {
+					assert.Equal(t, "/bin/bash", (*container.Command)[0])
+					assert.Contains(t, (*container.Command)[3], "/cnab/app/run")
+				}
+			},
+		},
+		{
+			name: "outputs are read from the state file share and then deleted",
+			settings: map[string]string{
+				"CNAB_AZURE_STATE_FILESHARE":            "share",
+				"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+				"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "key",
+			},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{}}
+				op.Bundle.Outputs = map[string]bundle.Output{
+					"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"},
+				}
+				op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					share.WriteFile("helloworld/test/outputs/output1", "OUTPUT_1")
+					return nil
+				}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Equal(t, map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"}, result.Outputs)
+				assert.Empty(t, share.Files())
+			},
+		},
+		{
+			name:     "a role is assigned to the system MSI before the invocation image runs",
+			settings: map[string]string{"CNAB_AZURE_MSI_TYPE": "system"},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				if assert.Len(t, b.RoleAssignments, 1) {
+					properties := b.RoleAssignments[0].Properties
+					assert.Equal(t, fmt.Sprintf("/subscriptions/%s/resourcegroups/%s", fakeSubscriptionID, d.aciRG), *properties.Scope)
+					assert.Equal(t, *b.RoleDefinitions[0].ID, *properties.RoleDefinitionID)
+					assert.NotEmpty(t, *properties.PrincipalID)
+				}
+			},
+		},
+		{
+			name:     "the user MSI is assigned to the container group",
+			settings: map[string]string{"CNAB_AZURE_MSI_TYPE": "user", "CNAB_AZURE_USER_MSI_RESOURCE_ID": userMSIResourceID, "CNAB_AZURE_DELETE_RESOURCES": "false"},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.UserAssignedIdentities[userMSIResourceID] = msi.Identity{ID: to.StringPtr(userMSIResourceID)}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+				if assert.NotNil(t, cg.Identity) {
+					assert.Equal(t, containerinstance.ResourceIdentityTypeUserAssigned, cg.Identity.Type)
+					assert.Contains(t, cg.Identity.UserAssignedIdentities, userMSIResourceID)
+				}
+			},
+		},
+		{
+			name:     "the container group is attached to a delegated subnet",
+			settings: map[string]string{"CNAB_AZURE_SUBNET_ID": subnetID, "CNAB_AZURE_DNS_NAME_SERVERS": "10.0.0.4,10.0.0.5", "CNAB_AZURE_DNS_SEARCH_DOMAINS": "contoso.com,corp.contoso.com", "CNAB_AZURE_MSI_TYPE": "system"},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Subnets[subnetID] = delegatedSubnet(subnetID, "Microsoft.ContainerInstance/containerGroups")
+				created = nil
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					created = append(created, cg)
+					return nil
+				}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				// The container group created for the system MSI and the container group that runs the invocation image should both be attached to the subnet
+				if assert.Len(t, created, 2) {
+					for _, cg := range created {
+						assert.Equal(t, &[]containerinstance.ContainerGroupSubnetID{{ID: to.StringPtr(subnetID)}}, cg.SubnetIds)
+						if assert.NotNil(t, cg.DNSConfig) {
+							assert.Equal(t, []string{"10.0.0.4", "10.0.0.5"}, to.StringSlice(cg.DNSConfig.NameServers))
+							assert.Equal(t, "contoso.com corp.contoso.com", to.String(cg.DNSConfig.SearchDomains))
+						}
+					}
+				}
+			},
+		},
+		{
+			name:     "the resource group and container groups are tagged",
+			settings: map[string]string{"CNAB_AZURE_TAGS": "costcenter=1234,owner=team a", "CNAB_AZURE_MSI_TYPE": "system", "CNAB_AZURE_DELETE_RESOURCES": "false"},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				op.Bundle.Version = "0.1.0"
+				created = nil
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					created = append(created, cg)
+					return nil
+				}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				rg, ok := b.ResourceGroups[d.aciRG]
+				if !assert.True(t, ok, "Expected resource group %s to be created", d.aciRG) {
+					return
+				}
+				tags := to.StringMap(rg.Tags)
+				assert.Equal(t, "1234", tags["costcenter"])
+				assert.Equal(t, "team a", tags["owner"])
+				assert.Equal(t, "helloworld", tags["cnab-bundle-name"])
+				assert.Equal(t, "0.1.0", tags["cnab-bundle-version"])
+				assert.Equal(t, "test", tags["cnab-installation"])
+				assert.Equal(t, "install", tags["cnab-action"])
+				assert.Equal(t, "test-version", tags["cnab-driver-version"])
+				assert.Equal(t, fakeObjectID, tags["cnab-created-by"])
+				_, err := time.Parse(time.RFC3339, tags["cnab-created-at"])
+				assert.NoErrorf(t, err, "Expected cnab-created-at to be a timestamp. Got: %v", err)
+				// The container group created for the system MSI and the container group that runs the invocation image should have the same tags as the resource group
+				if assert.Len(t, created, 2) {
+					for _, cg := range created {
+						assert.Equal(t, tags, to.StringMap(cg.Tags))
+					}
+				}
+			},
+		},
+		{
+			name:     "a subnet that is not delegated to ACI is reported",
+			settings: map[string]string{"CNAB_AZURE_SUBNET_ID": subnetID},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Subnets[subnetID] = delegatedSubnet(subnetID, "Microsoft.Web/serverFarms")
+			},
+			expectError: fmt.Sprintf("running invocation instance using ACI failed: Subnet %s is not delegated to Microsoft.ContainerInstance/containerGroups", subnetID),
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Empty(t, b.ContainerGroups)
+				assert.Empty(t, b.ResourceGroups)
+			},
+		},
+		{
+			name:        "a subnet that does not exist is reported",
+			settings:    map[string]string{"CNAB_AZURE_SUBNET_ID": subnetID},
+			expectError: fmt.Sprintf("running invocation instance using ACI failed: Subnet %s not found", subnetID),
+		},
+		{
+			name:        "an unknown subscription is reported",
+			settings:    map[string]string{"CNAB_AZURE_SUBSCRIPTION_ID": "22222222-2222-2222-2222-222222222222"},
+			expectError: "cannot set Azure subscription: Subscription ID: 22222222-2222-2222-2222-222222222222 not found",
+		},
+		{
+			name:        "a location without ACI is reported",
+			settings:    map[string]string{"CNAB_AZURE_LOCATION": "nowhere"},
+			expectError: "running invocation instance using ACI failed: ACI driver location is invalid: nowhere",
+		},
+		{
+			name: "a container that fails to start is reported and cleaned up",
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					return fake.ContainerRun{{
+						State:        "Failed",
+						Logs:         []string{"exec format error"},
+						DetailStatus: "Error",
+						Events: []containerinstance.Event{
+							{Type: to.StringPtr("Normal"), Name: to.StringPtr("Pulling"), Message: to.StringPtr("pulling image \"image\"")},
+							{Type: to.StringPtr("Warning"), Name: to.StringPtr("Failed"), Message: to.StringPtr("Failed to pull image \"image\"")},
+						},
+					}}
+				}
+			},
+			expectError: "running invocation instance using ACI failed: Unexpected Container Status:Failed detail status:Error events:Failed: Failed to pull image \"image\"",
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Len(t, b.DeletedContainerGroups, 1)
+				assert.Len(t, b.DeletedResourceGroups, 1)
+			},
+		},
+		{
+			name:     "a detached operation returns once the container group is created",
+			settings: map[string]string{"CNAB_AZURE_DETACH": "true"},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					return fake.ContainerRun{running}
+				}
+			},
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Contains(t, b.ContainerGroups, fake.Key(d.aciRG, d.aciName))
+				assert.Contains(t, b.ResourceGroups, d.aciRG)
+				assert.Empty(t, b.DeletedContainerGroups)
+				assert.Empty(t, b.DeletedResourceGroups)
+				assert.Empty(t, result.Outputs)
+				if assert.NotNil(t, d.operationRecord) {
+					assert.Len(t, d.operationRecord.ID, operationRecordIDLength)
+				}
+			},
+		},
+		{
+			name: "a container that fails while running is reported",
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					return fake.ContainerRun{running, running, {State: "Failed", Logs: []string{"error"}, ExitCode: to.Int32Ptr(3), DetailStatus: "Error"}}
+				}
+			},
+			expectError: "running invocation instance using ACI failed: Unexpected Container Status:Failed exit code:3 detail status:Error",
+		},
+		{
+			name:     "the container group is stopped when the operation times out",
+			settings: map[string]string{"CNAB_AZURE_TIMEOUT": "50ms"},
+			setup: func(b *fake.Backend, share *fake.FileShare, op *cnabdriver.Operation) {
+				b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+					return fake.ContainerRun{running}
+				}
+			},
+			expectError: "running invocation instance using ACI failed: operation timed out after 50ms",
+			check: func(t *testing.T, d *aciDriver, b *fake.Backend, share *fake.FileShare, result cnabdriver.OperationResult) {
+				assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.StoppedContainerGroups)
+				assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.DeletedContainerGroups)
+				assert.Len(t, b.DeletedResourceGroups, 1)
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, share := newFakeDriver(t, tc.settings)
+			op := newFakeOperation()
+			if tc.setup != nil {
+				tc.setup(b, share, op)
+			}
+
+			result, err := d.Run(op)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+			} else {
+				assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+			}
+
+			if tc.check != nil {
+				tc.check(t, d, b, share, result)
+			}
+
+			// The operation record is only left behind if the operation is detached or the driver exits while the container group is running
+			records, err := ioutil.ReadDir(d.operationRecordDir)
+			assert.NoError(t, err)
+			if d.detach {
+				assert.Len(t, records, 1)
+			} else {
+				assert.Empty(t, records)
+			}
+		})
+	}
+}
+
+func TestRunWithFakeBackendContainerFailed(t *testing.T) {
+	d, b, _ := newFakeDriver(t, map[string]string{})
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{
+			{State: "Running"},
+			{
+				State:        "Failed",
+				ExitCode:     to.Int32Ptr(137),
+				DetailStatus: "OOMKilled",
+				Events: []containerinstance.Event{
+					{Type: to.StringPtr("Normal"), Name: to.StringPtr("Started"), Message: to.StringPtr("Started container"), Count: to.Int32Ptr(1)},
+					{Type: to.StringPtr("Warning"), Name: to.StringPtr("Killing"), Message: to.StringPtr("Killing container"), Count: to.Int32Ptr(1)},
+				},
+			},
+		}
+	}
+
+	_, err := d.Run(newFakeOperation())
+	var containerFailed *ContainerFailedError
+	if !assert.True(t, errors.As(err, &containerFailed), "Expected a ContainerFailedError. Got: %v", err) {
+		return
+	}
+	assert.Equal(t, "Failed", containerFailed.State)
+	assert.Equal(t, to.Int32Ptr(137), containerFailed.ExitCode)
+	assert.Equal(t, "OOMKilled", containerFailed.DetailStatus)
+	assert.Equal(t, []ContainerEvent{
+		{Type: "Normal", Name: "Started", Message: "Started container", Count: 1},
+		{Type: "Warning", Name: "Killing", Message: "Killing container", Count: 1},
+	}, containerFailed.Events)
+	assert.EqualError(t, containerFailed, "Unexpected Container Status:Failed exit code:137 detail status:OOMKilled events:Killing: Killing container")
+}
+
+func TestRunWithFakeBackendCancelled(t *testing.T) {
+	d, b, _ := newFakeDriver(t, map[string]string{})
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{State: "Running"}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := d.RunWithContext(ctx, newFakeOperation())
+	assert.True(t, errors.Is(err, context.Canceled), "Expected operation to be cancelled. Got: %v", err)
+	assert.False(t, errors.Is(err, ErrOperationTimedOut))
+	assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.StoppedContainerGroups)
+	assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.DeletedContainerGroups)
+	assert.Equal(t, []string{d.aciRG}, b.DeletedResourceGroups)
+}
+
+func TestRunWithFakeBackendTimedOut(t *testing.T) {
+	for _, deleteResources := range []bool{true, false} {
+		t.Run(fmt.Sprintf("CNAB_AZURE_DELETE_RESOURCES=%v", deleteResources), func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_TIMEOUT": "50ms", "CNAB_AZURE_DELETE_RESOURCES": strconv.FormatBool(deleteResources)})
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				return fake.ContainerRun{{State: "Running", Logs: []string{"Installing"}, StoppedLogs: []string{"Terminated"}}}
+			}
+
+			var err error
+			output := captureStdout(t, func() {
+				_, err = d.Run(newFakeOperation())
+			})
+			assert.True(t, errors.Is(err, ErrOperationTimedOut), "Expected operation to time out. Got: %v", err)
+			assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.StoppedContainerGroups)
+			assert.Contains(t, output, "Installing")
+			assert.Contains(t, output, "Terminated", "Expected the logs written as the container group stopped to be output")
+			if deleteResources {
+				assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.DeletedContainerGroups)
+				assert.Equal(t, []string{d.aciRG}, b.DeletedResourceGroups)
+			} else {
+				assert.Empty(t, b.DeletedContainerGroups)
+				assert.Empty(t, b.DeletedResourceGroups)
+				assert.Contains(t, b.ContainerGroups, fake.Key(d.aciRG, d.aciName))
+			}
+		})
+	}
+}
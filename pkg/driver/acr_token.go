@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
+)
+
+// exchangeACRTokenFromLogin exchanges the access token of the identity the driver logged in with for a refresh token for an Azure Container Registry,
+// this works for every login type so the invocation image can be pulled without a registry username and password
+func (d *aciDriver) exchangeACRTokenFromLogin(ctx context.Context, domain string) (string, error) {
+	accessToken, err := d.loginInfo.AccessToken()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get access token to exchange for registry %s: %v", domain, err)
+	}
+	return registry.NewClient(nil).ExchangeAADToken(ctx, domain, d.tenantID, accessToken)
+}
+
+// setACRCredentials sets the registry credentials to a refresh token for the Azure Container Registry the invocation image is pulled from if no
+// registry credentials are configured, if the exchange fails the image is pulled without credentials
+func (d *aciDriver) setACRCredentials(ctx context.Context, domain string) {
+	if len(d.imageRegistryPassword) > 0 || !d.acrTokenExchange || d.exchangeACRToken == nil || !registry.IsAzureContainerRegistry(domain) {
+		return
+	}
+
+	token, err := d.exchangeACRToken(ctx, domain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get credentials for Azure Container Registry %s, the invocation image will be pulled without credentials: %v\n", domain, err)
+		return
+	}
+	log.Debugf("Using Azure AD token exchange credentials for registry %s", domain)
+	d.imageRegistryUser = registry.ACRTokenUsername
+	d.imageRegistryPassword = token
+}
@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
+)
+
+func TestRunWithFakeBackendACRTokenExchange(t *testing.T) {
+	testcases := []struct {
+		name             string
+		settings         map[string]string
+		image            string
+		exchangeErr      error
+		expectedExchange bool
+		expectedUser     string
+		expectedPassword string
+	}{
+		{
+			name:             "acr image is pulled with exchanged token",
+			image:            "myregistry.azurecr.io/helloworld-aci-cnab",
+			expectedExchange: true,
+			expectedUser:     registry.ACRTokenUsername,
+			expectedPassword: "refresh-token",
+		},
+		{
+			name:             "configured credentials are used",
+			settings:         map[string]string{"CNAB_AZURE_REGISTRY_USERNAME": "user", "CNAB_AZURE_REGISTRY_PASSWORD": "password"},
+			image:            "myregistry.azurecr.io/helloworld-aci-cnab",
+			expectedUser:     "user",
+			expectedPassword: "password",
+		},
+		{
+			name:     "exchange is disabled",
+			settings: map[string]string{"CNAB_AZURE_REGISTRY_TOKEN_EXCHANGE": "false"},
+			image:    "myregistry.azurecr.io/helloworld-aci-cnab",
+		},
+		{
+			name:  "image is not in acr",
+			image: "simongdavies/helloworld-aci-cnab",
+		},
+		{
+			name:             "image is pulled without credentials if the exchange fails",
+			image:            "myregistry.azurecr.io/helloworld-aci-cnab",
+			exchangeErr:      errors.New("exchange failed"),
+			expectedExchange: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			d, b, _ := newFakeDriver(t, settings)
+			exchanged := false
+			d.exchangeACRToken = func(ctx context.Context, domain string) (string, error) {
+				exchanged = true
+				assert.Equal(t, "myregistry.azurecr.io", domain)
+				return "refresh-token", tc.exchangeErr
+			}
+			op := newFakeOperation()
+			op.Image.Image = tc.image
+
+			var err error
+			captureStdout(t, func() {
+				_, err = d.Run(op)
+			})
+			assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+			assert.Equal(t, tc.expectedExchange, exchanged)
+
+			cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+			if len(tc.expectedPassword) == 0 {
+				assert.Empty(t, *cg.ImageRegistryCredentials)
+				return
+			}
+			if assert.NotNil(t, cg.ImageRegistryCredentials) && assert.Len(t, *cg.ImageRegistryCredentials, 1) {
+				credentials := (*cg.ImageRegistryCredentials)[0]
+				assert.Equal(t, "myregistry.azurecr.io", to.String(credentials.Server))
+				assert.Equal(t, tc.expectedUser, to.String(credentials.Username))
+				assert.Equal(t, tc.expectedPassword, to.String(credentials.Password))
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/driver"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+)
+
+// operationRecordIDLength is the number of hex characters in an operation record ID
+const operationRecordIDLength = 12
+
+// OperationRecord is written when the container group for an operation is created and removed when the driver finishes with it,
+// a record that is left behind means that the operation was detached or the driver process exited while the container group was running
+type OperationRecord struct {
+	// ID identifies the record in the status and collect commands
+	ID                 string `json:"id"`
+	SubscriptionID     string `json:"subscriptionId"`
+	ResourceGroup      string `json:"resourceGroup"`
+	ContainerGroupName string `json:"containerGroupName"`
+	// CreatedResourceGroup is true if the resource group was created by the driver and is deleted along with the container group
+	CreatedResourceGroup bool `json:"createdResourceGroup"`
+	DeleteResources      bool `json:"deleteResources"`
+	// RetentionPolicy is empty in records written before the retention policy was added, DeleteResources is used for them
+	RetentionPolicy string `json:"retentionPolicy,omitempty"`
+	BundleName      string `json:"bundleName,omitempty"`
+	Installation    string `json:"installation"`
+	Action          string `json:"action"`
+	// Outputs are the outputs that apply to the action keyed by the path the invocation image writes them to
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// The storage account key for the state file share is not recorded, it is read from the configuration when the outputs are retrieved
+	StateFileShare          string `json:"stateFileShare,omitempty"`
+	StateStorageAccountName string `json:"stateStorageAccountName,omitempty"`
+	StatePath               string `json:"statePath,omitempty"`
+	DeleteOutputs           bool   `json:"deleteOutputs"`
+	// OutputsInLogs is true if the outputs are read from the container logs rather than the state file share
+	OutputsInLogs bool `json:"outputsInLogs,omitempty"`
+	// StateBlobContainer is set if the outputs are read from a blob container in the state storage account rather than the state file share
+	StateBlobContainer string `json:"stateBlobContainer,omitempty"`
+	// StagedFilesPath is the directory in the state file share that file inputs were staged in, it is deleted when the operation is collected
+	StagedFilesPath string `json:"stagedFilesPath,omitempty"`
+	// LinesOutput is the number of lines of the container logs that have been written
+	LinesOutput int       `json:"linesOutput"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// OperationAttacher resumes an operation that was detached or whose driver process exited before its container group completed
+type OperationAttacher interface {
+	// GetOperationRecord reads the record of an operation that was left behind by the driver
+	GetOperationRecord(resourceGroup string, name string) (*OperationRecord, error)
+	// GetOperationRecordByID reads the record of an operation using the ID printed when the operation was detached
+	GetOperationRecordByID(id string) (*OperationRecord, error)
+	// GetOperationState gets the state of the container group running the operation
+	GetOperationState(ctx context.Context, record *OperationRecord) (string, error)
+	// Attach writes the container logs from where the driver left off, waits for the container group to complete and returns the outputs,
+	// the resources are cleaned up as they would have been by the driver
+	Attach(ctx context.Context, record *OperationRecord) (driver.OperationResult, error)
+	// Collect is the same as Attach except that it fails without waiting if the container group has not completed
+	Collect(ctx context.Context, record *OperationRecord) (driver.OperationResult, error)
+}
+
+// NewOperationAttacher creates an OperationAttacher that uses the login and state configuration of the driver
+func NewOperationAttacher(version string) (OperationAttacher, error) {
+	d := &aciDriver{
+		pollInterval:       5 * time.Second,
+		operationRecordDir: defaultOperationRecordDir(),
+		newBackend:         az.NewBackend,
+		login:              az.LoginToAzure,
+		newFileShare:       newAzureFileShare,
+		newBlobContainer:   newAzureBlobContainer,
+	}
+	d.userAgent = fmt.Sprintf("%s-%s", userAgentPrefix, version)
+	d.version = version
+	config := make(map[string]string)
+	for env := range d.Config() {
+		config[env] = os.Getenv(env)
+	}
+	if err := d.processLoginConfiguration(config); err != nil {
+		return nil, err
+	}
+	if err := d.processStateConfiguration(config); err != nil {
+		return nil, err
+	}
+	d.streamLogs = !(len(config["CNAB_AZURE_STREAM_LOGS"]) > 0 && strings.ToLower(config["CNAB_AZURE_STREAM_LOGS"]) == "false")
+
+	return d, nil
+}
+
+// GetOperationRecord reads the record for the container group in the operation record directory
+func (d *aciDriver) GetOperationRecord(resourceGroup string, name string) (*OperationRecord, error) {
+	fileName := operationRecordFileName(d.operationRecordDir, resourceGroup, name)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No operation record found for container group %s in resource group %s, only operations started on this machine that did not complete can be attached to", name, resourceGroup)
+		}
+		return nil, fmt.Errorf("Failed to read operation record %s: %v", fileName, err)
+	}
+
+	var record OperationRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("Failed to parse operation record %s: %v", fileName, err)
+	}
+
+	return &record, nil
+}
+
+// GetOperationRecordByID searches the operation record directory for the record with the ID
+func (d *aciDriver) GetOperationRecordByID(id string) (*OperationRecord, error) {
+	record, err := d.findOperationRecord(func(record *OperationRecord) bool {
+		return len(record.ID) > 0 && record.ID == id
+	})
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("No operation record found with ID %s", id)
+	}
+
+	return record, nil
+}
+
+// findOperationRecord returns the first record in the operation record directory that matches, it returns nil if no record matches
+func (d *aciDriver) findOperationRecord(match func(record *OperationRecord) bool) (*OperationRecord, error) {
+	files, err := ioutil.ReadDir(d.operationRecordDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read operation record directory %s: %v", d.operationRecordDir, err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		fileName := filepath.Join(d.operationRecordDir, file.Name())
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			log.Debugf("Ignoring operation record %s: %v", fileName, err)
+			continue
+		}
+		var record OperationRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Debugf("Ignoring operation record %s: %v", fileName, err)
+			continue
+		}
+		if match(&record) {
+			return &record, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetOperationState logs in to Azure and gets the state of the container group in the record
+func (d *aciDriver) GetOperationState(ctx context.Context, record *OperationRecord) (string, error) {
+	d.subscriptionID = record.SubscriptionID
+	if err := d.connect(ctx); err != nil {
+		return "", err
+	}
+
+	status, err := d.getContainerGroupStatus(ctx, record.ResourceGroup, record.ContainerGroupName)
+	if err != nil {
+		if az.IsNotFound(err) {
+			return "", fmt.Errorf("Container Group %s in Resource Group %s was not found, it may have been deleted", record.ContainerGroupName, record.ResourceGroup)
+		}
+		return "", fmt.Errorf("Error getting container state :%v", err)
+	}
+
+	return status.State, nil
+}
+
+// Attach resumes the operation in the record, the record is removed once the driver has logged in to Azure
+func (d *aciDriver) Attach(ctx context.Context, record *OperationRecord) (driver.OperationResult, error) {
+	return d.resume(ctx, record, true)
+}
+
+// Collect resumes the operation in the record if its container group has completed, the record and resources are kept if it has not
+func (d *aciDriver) Collect(ctx context.Context, record *OperationRecord) (driver.OperationResult, error) {
+	return d.resume(ctx, record, false)
+}
+
+func (d *aciDriver) resume(ctx context.Context, record *OperationRecord, wait bool) (driver.OperationResult, error) {
+	operationResult := driver.OperationResult{
+		Outputs: map[string]string{},
+	}
+
+	d.operationRecord = record
+	d.subscriptionID = record.SubscriptionID
+	d.aciRG = record.ResourceGroup
+	d.aciName = record.ContainerGroupName
+	d.createRG = record.CreatedResourceGroup
+	d.deleteACIResources = record.DeleteResources
+	if len(record.RetentionPolicy) > 0 {
+		policy, err := parseRetentionPolicy(record.RetentionPolicy)
+		if err != nil {
+			return operationResult, err
+		}
+		d.setRetentionPolicy(policy)
+	}
+	d.deleteOutputs = record.DeleteOutputs
+	d.hasOutputs = len(record.Outputs) > 0
+	d.stagedFilesPath = record.StagedFilesPath
+	d.outputsInLogs = record.OutputsInLogs
+	d.outputsInBlob = d.hasOutputs && len(record.StateBlobContainer) > 0
+	if (d.hasOutputs && !d.outputsInLogs) || len(d.stagedFilesPath) > 0 {
+		if err := d.setStateFileShare(record); err != nil {
+			return operationResult, err
+		}
+	}
+
+	if err := d.connect(ctx); err != nil {
+		return operationResult, err
+	}
+
+	if !wait {
+		status, err := d.getContainerGroupStatus(ctx, d.aciRG, d.aciName)
+		if err != nil {
+			return operationResult, fmt.Errorf("Error getting container state :%v", err)
+		}
+		if !containerGroupCompleted(status.State) {
+			return operationResult, fmt.Errorf("Container Group %s is %s, run collect again once it has completed or use attach to wait for it", d.aciName, status.State)
+		}
+	}
+
+	op := record.operation()
+	if d.hasOutputs && d.deleteOutputs && !d.outputsInLogs {
+		defer d.deleteOutputsFromFileShare(op, &operationResult)
+	}
+	defer d.deleteStagedFiles()
+
+	if d.deleteACIResources {
+		if d.createRG {
+			defer d.deleteResourceGroup()
+		}
+		defer d.deleteContainerGroup()
+	}
+
+	defer d.removeOperationRecord()
+	fmt.Printf("Attaching to Container Group %s in Resource Group %s\n", d.aciName, d.aciRG)
+	if err := d.waitForContainerGroup(ctx, record.LinesOutput); err != nil {
+		d.retainFailedResources(err)
+		return operationResult, fmt.Errorf("running invocation instance using ACI failed: %w", err)
+	}
+
+	return d.getOutputs(op, &operationResult)
+}
+
+// containerGroupCompleted checks if a container group in the state will not run any further, container groups are created with a restart policy of never
+func containerGroupCompleted(state string) bool {
+	return state == "Succeeded" || state == "Failed" || state == "Stopped"
+}
+
+// setStateFileShare sets the file share or blob container that outputs are read from, the storage account key is taken from the CNAB_AZURE_STATE_* variables or from the Cloud Shell clouddrive
+func (d *aciDriver) setStateFileShare(record *OperationRecord) error {
+	hasStorageAccount := d.hasStateVolumeInfo || len(d.stateBlobContainer) > 0
+	if !hasStorageAccount || !strings.EqualFold(d.stateStorageAccountName, record.StateStorageAccountName) {
+		if !az.IsInCloudShell() {
+			return fmt.Errorf("Operation has outputs in storage account %s, set CNAB_AZURE_STATE_* variables for the storage account so that outputs can be retrieved", record.StateStorageAccountName)
+		}
+		log.Debug("Getting File share info from CloudShell")
+		fileshare, err := az.GetCloudDriveDetails(d.userAgent)
+		if err != nil {
+			return fmt.Errorf("Operation has outputs and failed to get clouddrive details, set CNAB_AZURE_STATE_* variables so that outputs can be retrieved: %v", err)
+		}
+		if !strings.EqualFold(fileshare.StorageAccountName, record.StateStorageAccountName) {
+			return fmt.Errorf("Operation has outputs in storage account %s and the clouddrive uses storage account %s, set CNAB_AZURE_STATE_* variables for the storage account so that outputs can be retrieved", record.StateStorageAccountName, fileshare.StorageAccountName)
+		}
+		d.stateStorageAccountKey = fileshare.StorageAccountKey
+	}
+
+	d.stateStorageAccountName = record.StateStorageAccountName
+	d.stateFileShare = record.StateFileShare
+	d.stateBlobContainer = record.StateBlobContainer
+	d.statePath = record.StatePath
+	return nil
+}
+
+// operation rebuilds enough of the operation from the record to retrieve and delete its outputs
+func (r *OperationRecord) operation() *driver.Operation {
+	outputs := make(map[string]bundle.Output)
+	for outputPath, name := range r.Outputs {
+		outputs[name] = bundle.Output{Path: outputPath}
+	}
+
+	return &driver.Operation{
+		Installation: r.Installation,
+		Action:       r.Action,
+		Outputs:      r.Outputs,
+		Bundle: &bundle.Bundle{
+			Name:    r.BundleName,
+			Outputs: outputs,
+		},
+	}
+}
+
+// writeOperationRecord records the container group created for the operation
+func (d *aciDriver) writeOperationRecord(op *driver.Operation) error {
+	stateBlobContainer := ""
+	if d.outputsInBlob {
+		stateBlobContainer = d.stateBlobContainer
+	}
+	record := OperationRecord{
+		ID:                      strings.Replace(uuid.New().String(), "-", "", -1)[:operationRecordIDLength],
+		SubscriptionID:          d.subscriptionID,
+		ResourceGroup:           d.aciRG,
+		ContainerGroupName:      d.aciName,
+		CreatedResourceGroup:    d.createRG,
+		DeleteResources:         d.deleteACIResources,
+		RetentionPolicy:         d.retention().String(),
+		Installation:            op.Installation,
+		Action:                  op.Action,
+		Outputs:                 make(map[string]string),
+		StateFileShare:          d.stateFileShare,
+		StateStorageAccountName: d.stateStorageAccountName,
+		StatePath:               d.statePath,
+		DeleteOutputs:           d.deleteOutputs,
+		StagedFilesPath:         d.stagedFilesPath,
+		OutputsInLogs:           d.outputsInLogs,
+		StateBlobContainer:      stateBlobContainer,
+		CreatedAt:               time.Now().UTC(),
+	}
+	if op.Bundle != nil {
+		record.BundleName = op.Bundle.Name
+		for outputPath, name := range op.Outputs {
+			if output := op.Bundle.Outputs[name]; output.AppliesTo(op.Action) {
+				record.Outputs[outputPath] = name
+			}
+		}
+	}
+
+	if err := record.write(d.operationRecordDir); err != nil {
+		return err
+	}
+
+	log.Debug("Wrote operation record for Container Group ", d.aciName)
+	d.operationRecord = &record
+	return nil
+}
+
+// saveOperationProgress records the number of lines of the container logs that have been written
+func (d *aciDriver) saveOperationProgress(linesOutput int) {
+	if d.operationRecord == nil {
+		return
+	}
+
+	d.operationRecord.LinesOutput = linesOutput
+	if err := d.operationRecord.write(d.operationRecordDir); err != nil {
+		log.Debugf("Failed to update operation record: %v", err)
+	}
+}
+
+// removeOperationRecord removes the record once the driver has finished with the container group
+func (d *aciDriver) removeOperationRecord() {
+	if d.operationRecord == nil {
+		return
+	}
+
+	fileName := operationRecordFileName(d.operationRecordDir, d.operationRecord.ResourceGroup, d.operationRecord.ContainerGroupName)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		log.Debugf("Failed to remove operation record %s: %v", fileName, err)
+	}
+
+	d.operationRecord = nil
+}
+
+// write replaces the record file so that a partially written record is never read
+func (r *OperationRecord) write(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Error creating operation record directory: %s error: %v", dir, err)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error creating operation record: %v", err)
+	}
+
+	fileName := operationRecordFileName(dir, r.ResourceGroup, r.ContainerGroupName)
+	tempFileName := fileName + ".tmp"
+	if err := ioutil.WriteFile(tempFileName, data, 0600); err != nil {
+		return fmt.Errorf("Error writing operation record: %s error: %v", tempFileName, err)
+	}
+
+	if err := os.Rename(tempFileName, fileName); err != nil {
+		return fmt.Errorf("Error writing operation record: %s error: %v", fileName, err)
+	}
+
+	return nil
+}
+
+// Resource group names are case insensitive and container group names cannot contain underscores
+func operationRecordFileName(dir string, resourceGroup string, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_%s.json", strings.ToLower(resourceGroup), strings.ToLower(name)))
+}
+
+func defaultOperationRecordDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".cnab-azure-driver", "operations")
+}
@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/bundle/definition"
+	cnabdriver "github.com/cnabio/cnab-go/driver"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestAttach(t *testing.T) {
+	stateSettings := map[string]string{
+		"CNAB_AZURE_STATE_FILESHARE":            "share",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "key",
+	}
+	testcases := []struct {
+		name             string
+		settings         map[string]string
+		attachSettings   map[string]string
+		run              fake.ContainerRun
+		expectError      string
+		expectedLogs     []string
+		unexpectedLogs   []string
+		expectedOutputs  map[string]string
+		expectedDeletion bool
+	}{
+		{
+			name: "resumes the logs, retrieves the outputs and cleans up",
+			run: fake.ContainerRun{
+				{State: "Running", Logs: []string{"written before the driver exited"}},
+				{State: "Running", Logs: []string{"written after the driver exited"}},
+				{State: "Succeeded", Logs: []string{"written after attaching"}},
+			},
+			expectedLogs:     []string{"written after the driver exited", "written after attaching"},
+			unexpectedLogs:   []string{"written before the driver exited"},
+			expectedOutputs:  map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"},
+			expectedDeletion: true,
+		},
+		{
+			name:     "keeps the resources if the operation was keeping them",
+			settings: map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"},
+			run: fake.ContainerRun{
+				{State: "Running", Logs: []string{"written before the driver exited"}},
+				{State: "Succeeded"},
+			},
+			expectedOutputs: map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"},
+		},
+		{
+			name: "reports a container that failed",
+			run: fake.ContainerRun{
+				{State: "Running", Logs: []string{"written before the driver exited"}},
+				{State: "Failed", Logs: []string{"error"}, ExitCode: to.Int32Ptr(1)},
+			},
+			expectError:      "running invocation instance using ACI failed: Unexpected Container Status:Failed exit code:1",
+			expectedLogs:     []string{"error"},
+			expectedDeletion: true,
+		},
+		{
+			name:           "fails if the state storage account is not configured",
+			attachSettings: map[string]string{"CNAB_AZURE_STATE_FILESHARE": "", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY": ""},
+			run:            fake.ContainerRun{{State: "Succeeded"}},
+			expectError:    "Operation has outputs in storage account account, set CNAB_AZURE_STATE_* variables for the storage account so that outputs can be retrieved",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]string{}
+			for k, v := range stateSettings {
+				settings[k] = v
+			}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			d, b, share := newFakeDriver(t, settings)
+			op := newFakeOperation()
+			op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{}}
+			op.Bundle.Outputs = map[string]bundle.Output{
+				"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"},
+			}
+			op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				share.WriteFile("helloworld/test/outputs/output1", "OUTPUT_1")
+				return tc.run
+			}
+			startOperation(t, d, b, op)
+
+			// Attach using a new driver as the driver that started the operation has exited
+			for k, v := range tc.attachSettings {
+				settings[k] = v
+			}
+			attacher, _, _ := newFakeDriver(t, settings)
+			attacher.operationRecordDir = d.operationRecordDir
+			attacher.newBackend = func(authorizer autorest.Authorizer, userAgent string) az.Backend {
+				return b
+			}
+			attacher.newFileShare = func(accountName string, accountKey string, shareName string) (fileShare, error) {
+				return share, nil
+			}
+
+			record, err := attacher.GetOperationRecord(d.aciRG, d.aciName)
+			if !assert.NoErrorf(t, err, "Expected no error getting operation record. Got: %v", err) {
+				return
+			}
+			assert.Equal(t, 1, record.LinesOutput)
+			assert.Equal(t, op.Outputs, record.Outputs)
+
+			var result cnabdriver.OperationResult
+			logs := captureStdout(t, func() {
+				result, err = attacher.Attach(context.Background(), record)
+			})
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+			} else {
+				assert.NoErrorf(t, err, "Expected no error attaching to operation. Got: %v", err)
+				assert.Equal(t, tc.expectedOutputs, result.Outputs)
+				assert.Empty(t, share.Files(), "Expected outputs to be deleted from the file share")
+			}
+			for _, line := range tc.expectedLogs {
+				assert.Contains(t, logs, line)
+			}
+			for _, line := range tc.unexpectedLogs {
+				assert.NotContains(t, logs, line)
+			}
+
+			if tc.expectedDeletion {
+				assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.DeletedContainerGroups)
+				assert.Equal(t, []string{d.aciRG}, b.DeletedResourceGroups)
+			} else {
+				assert.Empty(t, b.DeletedContainerGroups)
+				assert.Empty(t, b.DeletedResourceGroups)
+			}
+
+			_, err = attacher.GetOperationRecord(d.aciRG, d.aciName)
+			if attacher.backend == nil {
+				assert.NoError(t, err, "Expected the operation record to be kept if the driver did not log in")
+			} else {
+				assert.Error(t, err, "Expected the operation record to be removed")
+			}
+		})
+	}
+}
+
+func TestGetOperationRecordNotFound(t *testing.T) {
+	d, _, _ := newFakeDriver(t, map[string]string{})
+	_, err := d.GetOperationRecord("rg", "aci")
+	assert.EqualError(t, err, "No operation record found for container group aci in resource group rg, only operations started on this machine that did not complete can be attached to")
+}
+
+// startOperation creates the resources for an operation and writes its record as the driver does, leaving them as they would be if the driver exited after writing the first line of the logs
+func startOperation(t *testing.T, d *aciDriver, b *fake.Backend, op *cnabdriver.Operation) {
+	ctx := context.Background()
+	assert.NoError(t, d.connect(ctx))
+	assert.NoError(t, d.prepareOperation(op))
+	containerGroup, err := d.buildContainerGroup(op, "image", "docker.io", &identityDetails{MSIType: "none"}, nil)
+	assert.NoError(t, err)
+	_, err = b.CreateResourceGroup(ctx, d.subscriptionID, d.aciRG, resources.Group{Location: to.StringPtr(fakeLocation)})
+	assert.NoError(t, err)
+	_, err = b.CreateContainerGroup(ctx, d.subscriptionID, d.aciRG, d.aciName, containerGroup)
+	assert.NoError(t, err)
+	assert.NoError(t, d.writeOperationRecord(op))
+	d.saveOperationProgress(1)
+}
+
+func captureStdout(t *testing.T, f func()) string {
+	return captureOutput(t, &os.Stdout, f)
+}
+
+func captureStderr(t *testing.T, f func()) string {
+	return captureOutput(t, &os.Stderr, f)
+}
+
+func captureOutput(t *testing.T, file **os.File, f func()) string {
+	original := *file
+	defer func() { *file = original }()
+	r, w, err := os.Pipe()
+	assert.Nilf(t, err, "os.Pipe call failed: %v", err)
+	*file = w
+	f()
+	err = w.Close()
+	assert.Nilf(t, err, "Closing Writer failed: %v", err)
+	output, err := ioutil.ReadAll(r)
+	assert.Nilf(t, err, "Reading output failed: %v", err)
+	return string(output)
+}
+
+func TestCollectDetachedOperation(t *testing.T) {
+	settings := map[string]string{
+		"CNAB_AZURE_DETACH":                     "true",
+		"CNAB_AZURE_STATE_FILESHARE":            "share",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "key",
+	}
+	d, b, share := newFakeDriver(t, settings)
+	op := newFakeOperation()
+	op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{}}
+	op.Bundle.Outputs = map[string]bundle.Output{
+		"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"},
+	}
+	op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		share.WriteFile("helloworld/test/outputs/output1", "OUTPUT_1")
+		return fake.ContainerRun{
+			{State: "Running", Logs: []string{"Installing"}},
+			{State: "Running"},
+			{State: "Succeeded", Logs: []string{"Done"}},
+		}
+	}
+	result, err := d.Run(op)
+	if !assert.NoErrorf(t, err, "Expected no error running detached operation. Got: %v", err) {
+		return
+	}
+	assert.Empty(t, result.Outputs)
+	assert.Len(t, share.Files(), 1, "Expected outputs to be kept until the operation is collected")
+	id := d.operationRecord.ID
+
+	collector, _, _ := newFakeDriver(t, map[string]string{})
+	collector.operationRecordDir = d.operationRecordDir
+	collector.newBackend = func(authorizer autorest.Authorizer, userAgent string) az.Backend {
+		return b
+	}
+	collector.newFileShare = func(accountName string, accountKey string, shareName string) (fileShare, error) {
+		return share, nil
+	}
+	collector.hasStateVolumeInfo = true
+	collector.stateStorageAccountName = "account"
+
+	_, err = collector.GetOperationRecordByID("unknown")
+	assert.EqualError(t, err, "No operation record found with ID unknown")
+	record, err := collector.GetOperationRecordByID(id)
+	if !assert.NoErrorf(t, err, "Expected no error getting operation record. Got: %v", err) {
+		return
+	}
+	assert.Equal(t, d.aciName, record.ContainerGroupName)
+
+	state, err := collector.GetOperationState(context.Background(), record)
+	assert.NoErrorf(t, err, "Expected no error getting operation state. Got: %v", err)
+	assert.Equal(t, "Running", state)
+
+	// The operation cannot be collected until the container group has completed
+	_, err = collector.Collect(context.Background(), record)
+	assert.EqualError(t, err, fmt.Sprintf("Container Group %s is Running, run collect again once it has completed or use attach to wait for it", d.aciName))
+	assert.Empty(t, b.DeletedContainerGroups)
+	_, err = collector.GetOperationRecordByID(id)
+	assert.NoError(t, err, "Expected the operation record to be kept until the operation is collected")
+
+	logs := captureStdout(t, func() {
+		result, err = collector.Collect(context.Background(), record)
+	})
+	assert.NoErrorf(t, err, "Expected no error collecting operation. Got: %v", err)
+	assert.Equal(t, map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"}, result.Outputs)
+	assert.Contains(t, logs, "Installing")
+	assert.Contains(t, logs, "Done")
+	assert.Empty(t, share.Files())
+	assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.DeletedContainerGroups)
+	assert.Equal(t, []string{d.aciRG}, b.DeletedResourceGroups)
+	_, err = collector.GetOperationRecordByID(id)
+	assert.Error(t, err, "Expected the operation record to be removed")
+}
@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cnabio/cnab-go/bundle"
+	log "github.com/sirupsen/logrus"
+)
+
+// bundleExtensionKey is the name of the custom extension a bundle can use to declare settings for the ACI Driver
+const bundleExtensionKey = "io.cnab.azure-driver"
+
+// bundleExtension contains the settings that can be declared by a bundle in its custom section e.g.
+//
+//	"custom": {
+//		"io.cnab.azure-driver": {
+//			"cpu": 2,
+//			"memoryInGB": 4,
+//			"gpu": { "sku": "K80", "count": 1 },
+//			"command": ["/cnab/app/run", "--verbose"]
+//		}
+//	}
+type bundleExtension struct {
+	CPU        *float64      `json:"cpu,omitempty"`
+	MemoryInGB *float64      `json:"memoryInGB,omitempty"`
+	GPU        *gpuExtension `json:"gpu,omitempty"`
+	// Command replaces the entrypoint and cmd of the invocation image
+	Command []string `json:"command,omitempty"`
+}
+
+type gpuExtension struct {
+	SKU   string `json:"sku"`
+	Count int    `json:"count,omitempty"`
+}
+
+// getBundleExtension gets the ACI Driver extension from the custom section of the bundle, an empty extension is returned if the bundle does not declare one
+func getBundleExtension(b *bundle.Bundle) (*bundleExtension, error) {
+	ext := bundleExtension{}
+	if b == nil {
+		return &ext, nil
+	}
+
+	custom, ok := b.Custom[bundleExtensionKey]
+	if !ok {
+		return &ext, nil
+	}
+
+	// The custom section is deserialised as a generic map so round trip it through json to get the typed extension
+	data, err := json.Marshal(custom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialise extension: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &ext); err != nil {
+		return nil, fmt.Errorf("failed to parse extension: %v", err)
+	}
+
+	return &ext, nil
+}
+
+// applyBundleExtension overrides driver configuration with any values declared in the bundle extension
+func (d *aciDriver) applyBundleExtension(b *bundle.Bundle) error {
+	ext, err := getBundleExtension(b)
+	if err != nil {
+		return err
+	}
+
+	if ext.CPU != nil {
+		log.Debug("Bundle Extension CPU: ", *ext.CPU)
+		d.cpu = *ext.CPU
+	}
+
+	if ext.MemoryInGB != nil {
+		log.Debug("Bundle Extension Memory in GB: ", *ext.MemoryInGB)
+		d.memoryInGB = *ext.MemoryInGB
+	}
+
+	if ext.GPU != nil {
+		d.gpuSKU = strings.ToUpper(ext.GPU.SKU)
+		d.gpuCount = ext.GPU.Count
+		if d.gpuCount == 0 && len(d.gpuSKU) > 0 {
+			d.gpuCount = 1
+		}
+		log.Debugf("Bundle Extension GPU SKU: %s GPU Count: %d", d.gpuSKU, d.gpuCount)
+	}
+
+	if len(ext.Command) > 0 {
+		log.Debug("Bundle Extension Command: ", ext.Command)
+		d.runCommand = ext.Command
+	}
+
+	return validateResources(d.cpu, d.memoryInGB, d.gpuSKU, d.gpuCount)
+}
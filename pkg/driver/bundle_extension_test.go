@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyBundleExtension(t *testing.T) {
+	testcases := []struct {
+		name               string
+		bundle             *bundle.Bundle
+		expectError        bool
+		expectMessage      string
+		expectedCPU        float64
+		expectedMemoryInGB float64
+		expectedGPUSKU     string
+		expectedGPUCount   int
+	}{
+		{"No bundle", nil, false, "", defaultCPU, defaultMemoryInGB, "", 0},
+		{"No extension", &bundle.Bundle{}, false, "", defaultCPU, defaultMemoryInGB, "", 0},
+		{"Override CPU and memory", &bundle.Bundle{Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"cpu": 2.0, "memoryInGB": 8.0}}}, false, "", 2, 8, "", 0},
+		{"Override GPU with default count", &bundle.Bundle{Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"gpu": map[string]interface{}{"sku": "v100"}}}}, false, "", defaultCPU, defaultMemoryInGB, "V100", 1},
+		{"Override GPU with count", &bundle.Bundle{Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"gpu": map[string]interface{}{"sku": "P100", "count": 2}}}}, false, "", defaultCPU, defaultMemoryInGB, "P100", 2},
+		{"Invalid extension", &bundle.Bundle{Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"cpu": "lots"}}}, true, "failed to parse extension: json: cannot unmarshal string into Go struct field bundleExtension.cpu of type float64", 0, 0, "", 0},
+		{"Invalid CPU", &bundle.Bundle{Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"cpu": -1}}}, true, "invalid CPU value -1, CPU must be greater than 0", 0, 0, "", 0},
+		{"Invalid GPU", &bundle.Bundle{Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"gpu": map[string]interface{}{"count": 1}}}}, true, "a GPU SKU must be specified when requesting GPUs", 0, 0, "", 0},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &aciDriver{
+				cpu:        defaultCPU,
+				memoryInGB: defaultMemoryInGB,
+			}
+			err := d.applyBundleExtension(tc.bundle)
+			if tc.expectError {
+				assert.EqualError(t, err, tc.expectMessage)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedCPU, d.cpu)
+			assert.Equal(t, tc.expectedMemoryInGB, d.memoryInGB)
+			assert.Equal(t, tc.expectedGPUSKU, d.gpuSKU)
+			assert.Equal(t, tc.expectedGPUCount, d.gpuCount)
+		})
+	}
+}
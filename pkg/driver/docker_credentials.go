@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
+)
+
+// getDockerConfigCredentials gets the credentials for a registry from the Docker config.json in CNAB_AZURE_DOCKER_CONFIG, these are the credentials
+// saved by docker login either in the file or by a credential helper
+func (d *aciDriver) getDockerConfigCredentials(ctx context.Context, domain string) (registry.Credentials, bool, error) {
+	config, err := registry.LoadDockerConfig(d.dockerConfigDir)
+	if err != nil {
+		return registry.Credentials{}, false, err
+	}
+	return config.Credentials(ctx, domain)
+}
+
+// setRegistryCredentials resolves the credentials for the registry the invocation image is pulled from if none are configured, the Docker config is
+// used first so that a docker login or az acr login takes precedence over the exchange of the Azure AD token
+func (d *aciDriver) setRegistryCredentials(ctx context.Context, domain string) {
+	if len(d.imageRegistryPassword) > 0 {
+		return
+	}
+
+	if d.dockerCredentials != nil {
+		credentials, found, err := d.dockerCredentials(ctx, domain)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Failed to get credentials for registry %s from Docker config: %v\n", domain, err)
+		case found:
+			log.Debugf("Using credentials from Docker config for registry %s", domain)
+			d.imageRegistryUser = credentials.Username
+			d.imageRegistryPassword = credentials.Password
+			return
+		}
+	}
+
+	d.setACRCredentials(ctx, domain)
+}
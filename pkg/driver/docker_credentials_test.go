@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
+)
+
+func TestRunWithFakeBackendDockerConfigCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	auth := base64.StdEncoding.EncodeToString([]byte("dockeruser:dockerpassword"))
+	config := fmt.Sprintf(`{"auths":{"registry.example.com":{"auth":"%s"},"myregistry.azurecr.io":{"identitytoken":"identity-token"}}}`, auth)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+
+	testcases := []struct {
+		name             string
+		settings         map[string]string
+		image            string
+		expectedExchange bool
+		expectedUser     string
+		expectedPassword string
+	}{
+		{
+			name:             "credentials from docker config",
+			image:            "registry.example.com/helloworld-aci-cnab",
+			expectedUser:     "dockeruser",
+			expectedPassword: "dockerpassword",
+		},
+		{
+			name:             "acr identity token from docker config is used instead of the exchange",
+			image:            "myregistry.azurecr.io/helloworld-aci-cnab",
+			expectedUser:     registry.ACRTokenUsername,
+			expectedPassword: "identity-token",
+		},
+		{
+			name:             "configured credentials are used",
+			settings:         map[string]string{"CNAB_AZURE_REGISTRY_USERNAME": "user", "CNAB_AZURE_REGISTRY_PASSWORD": "password"},
+			image:            "registry.example.com/helloworld-aci-cnab",
+			expectedUser:     "user",
+			expectedPassword: "password",
+		},
+		{
+			name:  "registry not in docker config",
+			image: "other.example.com/helloworld-aci-cnab",
+		},
+		{
+			name:             "acr not in docker config uses the exchange",
+			image:            "otherregistry.azurecr.io/helloworld-aci-cnab",
+			expectedExchange: true,
+			expectedUser:     registry.ACRTokenUsername,
+			expectedPassword: "refresh-token",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false", "CNAB_AZURE_DOCKER_CONFIG": dir}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			d, b, _ := newFakeDriver(t, settings)
+			d.dockerCredentials = d.getDockerConfigCredentials
+			exchanged := false
+			d.exchangeACRToken = func(ctx context.Context, domain string) (string, error) {
+				exchanged = true
+				return "refresh-token", nil
+			}
+			op := newFakeOperation()
+			op.Image.Image = tc.image
+
+			captureStdout(t, func() {
+				_, err = d.Run(op)
+			})
+			assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+			assert.Equal(t, tc.expectedExchange, exchanged)
+
+			cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+			if len(tc.expectedPassword) == 0 {
+				assert.Empty(t, *cg.ImageRegistryCredentials)
+				return
+			}
+			if assert.Len(t, *cg.ImageRegistryCredentials, 1) {
+				credentials := (*cg.ImageRegistryCredentials)[0]
+				assert.Equal(t, tc.expectedUser, to.String(credentials.Username))
+				assert.Equal(t, tc.expectedPassword, to.String(credentials.Password))
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+)
+
+// DefaultExecCommand is the command executed in the invocation image container if no command is given
+const DefaultExecCommand = "/bin/sh"
+
+// defaultTerminalSize is used when the size of the terminal the command is executed from is not known
+var defaultTerminalSize = TerminalSize{Rows: 24, Cols: 80}
+
+// TerminalSize is the size of the terminal that a command executed in a container writes its output to
+type TerminalSize struct {
+	Rows int32
+	Cols int32
+}
+
+// ContainerExecutor runs commands in the invocation image container of a running operation, it is used to debug invocation images with CNAB_AZURE_DEBUG_CONTAINER
+type ContainerExecutor interface {
+	// Exec runs the command in the container group, sending stdin to the command and writing its output to stdout until the command exits.
+	// If resourceGroup is empty it is found from the record of an operation started on this machine.
+	Exec(ctx context.Context, resourceGroup string, name string, command string, terminal *TerminalSize, stdin io.Reader, stdout io.Writer) error
+}
+
+// NewContainerExecutor creates a ContainerExecutor that uses the login and subscription configuration of the driver
+func NewContainerExecutor(version string) (ContainerExecutor, error) {
+	d := &aciDriver{
+		operationRecordDir: defaultOperationRecordDir(),
+		newBackend:         az.NewBackend,
+		login:              az.LoginToAzure,
+	}
+	d.userAgent = fmt.Sprintf("%s-%s", userAgentPrefix, version)
+	d.version = version
+	config := make(map[string]string)
+	for env := range d.Config() {
+		config[env] = os.Getenv(env)
+	}
+	if err := d.processLoginConfiguration(config); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Exec runs the command in the invocation image container of the container group, ACI only supports executing a single command without arguments
+func (d *aciDriver) Exec(ctx context.Context, resourceGroup string, name string, command string, terminal *TerminalSize, stdin io.Reader, stdout io.Writer) error {
+	if len(resourceGroup) == 0 {
+		record, err := d.findOperationRecord(func(record *OperationRecord) bool {
+			return strings.EqualFold(record.ContainerGroupName, name)
+		})
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return fmt.Errorf("No operation record found for container group %s, set the resource group of the container group", name)
+		}
+		resourceGroup = record.ResourceGroup
+		d.subscriptionID = record.SubscriptionID
+	}
+	if terminal == nil {
+		terminal = &defaultTerminalSize
+	}
+
+	if err := d.connect(ctx); err != nil {
+		return err
+	}
+
+	status, err := d.getContainerGroupStatus(ctx, resourceGroup, name)
+	if err != nil {
+		if az.IsNotFound(err) {
+			return fmt.Errorf("Container Group %s in Resource Group %s was not found", name, resourceGroup)
+		}
+		return fmt.Errorf("Error getting container state :%v", err)
+	}
+	if status.State != "Running" {
+		return fmt.Errorf("Container Group %s is %s, commands can only be executed in a running container", name, status.State)
+	}
+
+	log.Debugf("Executing %s in Container Group %s in Resource Group %s", command, name, resourceGroup)
+	stream, err := d.backend.ExecuteCommand(ctx, d.subscriptionID, resourceGroup, name, name, command, terminal.Rows, terminal.Cols)
+	if err != nil {
+		return fmt.Errorf("Error executing command in container: %v", err)
+	}
+	defer stream.Close()
+
+	// There is no way to tell the container that the input has ended so the command runs until it exits
+	go func() {
+		if _, err := io.Copy(stream, stdin); err != nil {
+			log.Debugf("Error sending input to container: %v", err)
+		}
+	}()
+
+	output := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, stream)
+		output <- err
+	}()
+
+	select {
+	case err := <-output:
+		if err != nil {
+			return fmt.Errorf("Error reading output of command: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// execInstructions tells the user how to connect to a container started with CNAB_AZURE_DEBUG_CONTAINER
+func execInstructions(resourceGroup string, name string) string {
+	return fmt.Sprintf("Container Group %s is running in debug mode, run cnab-azure exec --name %s --resource-group %s -- %s to connect to it", name, name, resourceGroup, DefaultExecCommand)
+}
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestExec(t *testing.T) {
+	testcases := []struct {
+		name             string
+		resourceGroup    string
+		record           bool
+		terminal         *TerminalSize
+		run              fake.ContainerRun
+		expectError      string
+		expectedOutput   string
+		expectedTerminal TerminalSize
+	}{
+		{
+			name:             "runs the command in the container group of an operation started on this machine",
+			record:           true,
+			run:              fake.ContainerRun{{State: "Running"}},
+			expectedOutput:   "/bin/sh got ls\n",
+			expectedTerminal: defaultTerminalSize,
+		},
+		{
+			name:             "runs the command in the resource group that is set",
+			resourceGroup:    "rg",
+			terminal:         &TerminalSize{Rows: 50, Cols: 200},
+			run:              fake.ContainerRun{{State: "Running"}},
+			expectedOutput:   "/bin/sh got ls\n",
+			expectedTerminal: TerminalSize{Rows: 50, Cols: 200},
+		},
+		{
+			name:        "fails if there is no operation record for the container group",
+			run:         fake.ContainerRun{{State: "Running"}},
+			expectError: "No operation record found for container group %s, set the resource group of the container group",
+		},
+		{
+			name:        "fails if the container is not running",
+			record:      true,
+			run:         fake.ContainerRun{{State: "Succeeded"}},
+			expectError: "Container Group %s is Succeeded, commands can only be executed in a running container",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{})
+			op := newFakeOperation()
+			if len(tc.resourceGroup) > 0 {
+				d.aciRG = tc.resourceGroup
+			}
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				return tc.run
+			}
+			b.Exec = func(command string, stdin io.Reader, stdout io.Writer) {
+				line, _ := bufio.NewReader(stdin).ReadString('\n')
+				fmt.Fprintf(stdout, "%s got %s", command, line)
+			}
+			startOperation(t, d, b, op)
+			if !tc.record {
+				d.removeOperationRecord()
+			}
+
+			executor, _, _ := newFakeDriver(t, map[string]string{})
+			executor.operationRecordDir = d.operationRecordDir
+			executor.newBackend = d.newBackend
+			var output strings.Builder
+			err := executor.Exec(context.Background(), tc.resourceGroup, d.aciName, DefaultExecCommand, tc.terminal, strings.NewReader("ls\n"), &output)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, fmt.Sprintf(tc.expectError, d.aciName))
+				assert.Empty(t, b.ExecutedCommands)
+				return
+			}
+			assert.NoErrorf(t, err, "Expected no error executing command. Got: %v", err)
+			assert.Equal(t, tc.expectedOutput, output.String())
+			assert.Equal(t, []fake.ExecutedCommand{{
+				Key:           fake.Key(d.aciRG, d.aciName),
+				ContainerName: d.aciName,
+				Command:       DefaultExecCommand,
+				Rows:          tc.expectedTerminal.Rows,
+				Cols:          tc.expectedTerminal.Cols,
+			}}, b.ExecutedCommands)
+		})
+	}
+}
+
+func TestRunWithFakeBackendDebugContainer(t *testing.T) {
+	d, b, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_DEBUG_CONTAINER": "true"})
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{State: "Running"}, {State: "Succeeded"}}
+	}
+	var err error
+	output := captureStdout(t, func() {
+		_, err = d.Run(newFakeOperation())
+	})
+	assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+	assert.Contains(t, output, fmt.Sprintf("run cnab-azure exec --name %s --resource-group %s -- /bin/sh to connect to it", d.aciName, d.aciRG))
+}
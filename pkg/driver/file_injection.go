@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// fileInjectionAuto runs the script with bash and falls back to sh and then to an init container if the invocation image does not have the shell
+	fileInjectionAuto = "auto"
+	// fileInjectionBash runs the script with /bin/bash from the invocation image
+	fileInjectionBash = "bash"
+	// fileInjectionSh runs the script with /bin/sh from the invocation image
+	fileInjectionSh = "sh"
+	// fileInjectionInitContainer copies a shell and the tools used by the script onto an emptyDir volume from an init container
+	// so that the script can be run in invocation images that do not have a shell
+	fileInjectionInitContainer = "init-container"
+
+	// The busybox image is statically linked so that it can run in any invocation image, CNAB_AZURE_INIT_CONTAINER_IMAGE can be set to another image
+	// that has a statically linked busybox at /bin/busybox
+	defaultInitContainerImage = "busybox:1.36-musl"
+	initContainerName         = "cnab-azure-init"
+	toolsMountName            = "cnabazuretools"
+	toolsMountPoint           = "/cnab-azure"
+	toolsBinDir               = toolsMountPoint + "/bin"
+)
+
+// parseFileInjection parses the value of CNAB_AZURE_FILE_INJECTION
+func parseFileInjection(value string) (string, error) {
+	strategy := strings.ToLower(strings.TrimSpace(value))
+	switch strategy {
+	case "":
+		return fileInjectionAuto, nil
+	case fileInjectionAuto, fileInjectionBash, fileInjectionSh, fileInjectionInitContainer:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("value (%s) of CNAB_AZURE_FILE_INJECTION should be %s, %s, %s or %s", value, fileInjectionAuto, fileInjectionBash, fileInjectionSh, fileInjectionInitContainer)
+	}
+}
+
+// getFileInjection gets the strategy used to run the script in the current attempt to start the container group, auto starts with bash
+func (d *aciDriver) getFileInjection() string {
+	if d.fileInjection != fileInjectionAuto && len(d.fileInjection) > 0 {
+		return d.fileInjection
+	}
+	if len(d.fileInjectionFallback) > 0 {
+		return d.fileInjectionFallback
+	}
+	return fileInjectionBash
+}
+
+// scriptCommand gets the command that runs the script that sets up files and outputs using the file injection strategy,
+// the tools copied by the init container are added to the end of the PATH so that the tools in the invocation image are used first
+func (d *aciDriver) scriptCommand(script string) []string {
+	switch d.getFileInjection() {
+	case fileInjectionSh:
+		return []string{"/bin/sh", "-e", "-c", script}
+	case fileInjectionInitContainer:
+		return []string{toolsBinDir + "/sh", "-e", "-c", fmt.Sprintf("PATH=${PATH}:%s;%s", toolsBinDir, script)}
+	default:
+		return []string{"/bin/bash", "-e", "-c", script}
+	}
+}
+
+// getInitContainers gets the init container that copies busybox and links the tools that it provides onto an emptyDir volume mounted in the invocation image
+func (d *aciDriver) getInitContainers(volumes *[]containerinstance.Volume, mounts *[]containerinstance.VolumeMount) *[]containerinstance.InitContainerDefinition {
+	if d.getFileInjection() != fileInjectionInitContainer {
+		return nil
+	}
+
+	toolsMount := containerinstance.VolumeMount{
+		Name:      to.StringPtr(toolsMountName),
+		MountPath: to.StringPtr(toolsMountPoint),
+	}
+	*mounts = append(*mounts, toolsMount)
+	*volumes = append(*volumes, containerinstance.Volume{
+		Name:     to.StringPtr(toolsMountName),
+		EmptyDir: map[string]interface{}{},
+	})
+	// busybox links its tools to the path that it is run from, this is the same in both containers as the volume is mounted at the same path
+	install := fmt.Sprintf("mkdir -p %[1]s && cp /bin/busybox %[1]s/busybox && %[1]s/busybox --install -s %[1]s", toolsBinDir)
+	return &[]containerinstance.InitContainerDefinition{
+		{
+			Name: to.StringPtr(initContainerName),
+			InitContainerPropertiesDefinition: &containerinstance.InitContainerPropertiesDefinition{
+				Image:        to.StringPtr(d.initContainerImage),
+				Command:      &[]string{"/bin/sh", "-c", install},
+				VolumeMounts: &[]containerinstance.VolumeMount{toolsMount},
+			},
+		},
+	}
+}
+
+// nextFileInjection gets the strategy to retry with if the container group failed to start because the invocation image does not have the shell used to run the script,
+// a fallback is only used if the strategy is auto and the script is being run
+func (d *aciDriver) nextFileInjection(status *containerGroupStatus, command []string) (string, bool) {
+	shell := d.scriptCommand("")[0]
+	if d.fileInjection != fileInjectionAuto || len(command) == 0 || command[0] != shell || !shellNotFound(status, shell) {
+		return "", false
+	}
+
+	switch d.getFileInjection() {
+	case fileInjectionBash:
+		return fileInjectionSh, true
+	case fileInjectionSh:
+		return fileInjectionInitContainer, true
+	default:
+		return "", false
+	}
+}
+
+// shellNotFound checks the events of a container group that failed to start for the error the container runtime reports when the command does not exist
+func shellNotFound(status *containerGroupStatus, shell string) bool {
+	for _, event := range status.Events {
+		message := strings.ToLower(event.Message)
+		if strings.Contains(message, shell) && (strings.Contains(message, "no such file or directory") || strings.Contains(message, "not found")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestParseFileInjection(t *testing.T) {
+	for value, expected := range map[string]string{"": "auto", "Auto": "auto", "bash": "bash", "sh": "sh", "init-container": "init-container"} {
+		strategy, err := parseFileInjection(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, strategy)
+	}
+	_, err := parseFileInjection("zsh")
+	assert.EqualError(t, err, "value (zsh) of CNAB_AZURE_FILE_INJECTION should be auto, bash, sh or init-container")
+}
+
+// shellRun fails to start containers whose command is not one of the shells in the image
+func shellRun(shells ...string) func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+	return func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		command := to.StringSlice((*cg.Containers)[0].Command)
+		for _, shell := range shells {
+			if len(command) == 0 || command[0] == shell {
+				return fake.ContainerRun{{State: "Running"}, {State: "Succeeded"}}
+			}
+		}
+		message := fmt.Sprintf(`failed to create containerd task: OCI runtime create failed: exec: "%[1]s": stat %[1]s: no such file or directory: unknown`, command[0])
+		return fake.ContainerRun{{State: "Failed", ExitCode: to.Int32Ptr(128), Events: []containerinstance.Event{{Type: to.StringPtr("Warning"), Name: to.StringPtr("Failed"), Message: to.StringPtr(message)}}}}
+	}
+}
+
+// pendingRun starts each container group in the Pending state so that a failure to start is only reported once it has been polled again
+func pendingRun(run func(cg containerinstance.ContainerGroup) fake.ContainerRun) func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+	return func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return append(fake.ContainerRun{{State: "Pending"}}, run(cg)...)
+	}
+}
+
+func TestRunWithFakeBackendFileInjection(t *testing.T) {
+	testcases := []struct {
+		name             string
+		fileInjection    string
+		pending          bool
+		shells           []string
+		expectedShell    string
+		expectedAttempts int
+		expectError      bool
+	}{
+		{name: "auto uses bash if the image has bash", shells: []string{"/bin/bash", "/bin/sh"}, expectedShell: "/bin/bash", expectedAttempts: 1},
+		{name: "auto falls back to sh if the image does not have bash", shells: []string{"/bin/sh"}, expectedShell: "/bin/sh", expectedAttempts: 2},
+		{name: "auto falls back to an init container if the image does not have a shell", shells: []string{toolsBinDir + "/sh"}, expectedShell: toolsBinDir + "/sh", expectedAttempts: 3},
+		{name: "auto falls back when the container group is pending before it fails", pending: true, shells: []string{"/bin/sh"}, expectedShell: "/bin/sh", expectedAttempts: 2},
+		{name: "auto falls back to an init container when the container group is pending before it fails", pending: true, shells: []string{toolsBinDir + "/sh"}, expectedShell: toolsBinDir + "/sh", expectedAttempts: 3},
+		{name: "sh is used when it is set", fileInjection: "sh", shells: []string{"/bin/sh"}, expectedShell: "/bin/sh", expectedAttempts: 1},
+		{name: "bash does not fall back", fileInjection: "bash", shells: []string{"/bin/sh"}, expectedShell: "/bin/bash", expectedAttempts: 1, expectError: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false", "CNAB_AZURE_FILE_INJECTION": tc.fileInjection})
+			b.Run = shellRun(tc.shells...)
+			if tc.pending {
+				b.Run = pendingRun(b.Run)
+			}
+			op := newFakeOperation()
+			op.Files = map[string]string{"/cnab/app/image-map.json": "{}"}
+
+			var err error
+			captureStdout(t, func() {
+				_, err = d.Run(op)
+			})
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+			}
+			assert.Len(t, b.DeletedContainerGroups, tc.expectedAttempts-1, "Expected the container group to be deleted before each retry")
+
+			cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+			container := getContainer(t, cg)
+			command := to.StringSlice(container.Command)
+			if assert.Len(t, command, 4) {
+				assert.Equal(t, tc.expectedShell, command[0])
+			}
+			if tc.expectedShell != toolsBinDir+"/sh" {
+				assert.Nil(t, cg.InitContainers)
+				return
+			}
+
+			assert.Contains(t, command[3], "PATH=${PATH}:"+toolsBinDir+";")
+			if assert.NotNil(t, cg.InitContainers) && assert.Len(t, *cg.InitContainers, 1) {
+				init := (*cg.InitContainers)[0]
+				assert.Equal(t, defaultInitContainerImage, to.String(init.Image))
+				assert.Equal(t, []containerinstance.VolumeMount{{Name: to.StringPtr(toolsMountName), MountPath: to.StringPtr(toolsMountPoint)}}, *init.VolumeMounts)
+			}
+			assert.Contains(t, *container.VolumeMounts, containerinstance.VolumeMount{Name: to.StringPtr(toolsMountName), MountPath: to.StringPtr(toolsMountPoint)})
+			assert.Contains(t, *cg.Volumes, containerinstance.Volume{Name: to.StringPtr(toolsMountName), EmptyDir: map[string]interface{}{}})
+		})
+	}
+}
+
+func TestRunWithFakeBackendFileInjectionSystemMSI(t *testing.T) {
+	d, b, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false", "CNAB_AZURE_MSI_TYPE": "system"})
+	b.Run = shellRun("/bin/sh")
+	op := newFakeOperation()
+	op.Files = map[string]string{"/cnab/app/image-map.json": "{}"}
+
+	var err error
+	captureStdout(t, func() {
+		_, err = d.Run(op)
+	})
+	assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+	assert.Len(t, b.DeletedContainerGroups, 1)
+
+	// The role assignment of the identity deleted with the first container group is deleted, only the current identity has a role assignment
+	assert.Len(t, b.DeletedRoleAssignments, 1)
+	cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+	if assert.Len(t, b.RoleAssignments, 1) {
+		assert.Equal(t, to.String(cg.Identity.PrincipalID), to.String(b.RoleAssignments[0].Properties.PrincipalID))
+	}
+}
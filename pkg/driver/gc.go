@@ -0,0 +1,352 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+)
+
+// GarbageType is the type of a resource found by the garbage collector
+type GarbageType string
+
+const (
+	// GarbageResourceGroup is a resource group created by the driver
+	GarbageResourceGroup GarbageType = "ResourceGroup"
+	// GarbageContainerGroup is a container group created by the driver
+	GarbageContainerGroup GarbageType = "ContainerGroup"
+	// GarbageRoleAssignment is a role assignment for the system assigned identity of a container group created by the driver
+	GarbageRoleAssignment GarbageType = "RoleAssignment"
+)
+
+// GarbageAction is what the garbage collector did with a resource
+type GarbageAction string
+
+const (
+	// GarbageKept means the resource is newer than the threshold or its age is not known
+	GarbageKept GarbageAction = "kept"
+	// GarbageKeptRunning means the resource has expired but is kept as its container group, or a container group in it, has not completed
+	GarbageKeptRunning GarbageAction = "kept while running"
+	// GarbageKeptByPolicy means the resource has expired but is kept as it was created with the never retention policy
+	GarbageKeptByPolicy GarbageAction = "kept by retention policy"
+	// GarbageWouldDelete means the resource would have been deleted if this was not a dry run
+	GarbageWouldDelete GarbageAction = "would delete"
+	// GarbageDeleted means the resource was deleted
+	GarbageDeleted GarbageAction = "deleted"
+	// GarbageDeletedWithResourceGroup means the resource is in a resource group that was deleted
+	GarbageDeletedWithResourceGroup GarbageAction = "deleted with resource group"
+	// GarbageDeleteFailed means the resource could not be deleted
+	GarbageDeleteFailed GarbageAction = "delete failed"
+)
+
+// Garbage is a resource created by the driver that the garbage collector found
+type Garbage struct {
+	Type          GarbageType
+	ID            string
+	Name          string
+	ResourceGroup string
+	// State is the state of a container group or the provisioning state of a resource group
+	State string
+	// CreatedAt is zero if the time the resource was created is not known, role assignments have the creation time of their container group
+	CreatedAt time.Time
+	// RetainUntil is set if the resource was kept after a failure by a retention policy with a duration, it is deleted once this has passed whatever its age
+	RetainUntil time.Time
+	// RetainedAt is set if the resource was kept after a failure by a retention policy without a duration, its age is measured from this time
+	RetainedAt time.Time
+	// Policy is the retention policy the resource was created with, it is empty for resources created before the driver recorded the policy
+	Policy string
+	Action GarbageAction
+	// Error is set if the resource could not be deleted
+	Error error
+}
+
+// GarbageCollector finds and deletes Azure resources that were left behind when the driver could not clean up after an operation
+type GarbageCollector interface {
+	// CollectGarbage finds the resources created by the driver and deletes those created more than olderThan ago or whose retention has expired,
+	// if dryRun is true nothing is deleted. Resources of container groups that have not completed and resources created with the never retention
+	// policy are only deleted if force is true.
+	CollectGarbage(ctx context.Context, olderThan time.Duration, dryRun bool, force bool) ([]Garbage, error)
+}
+
+// NewGarbageCollector creates a GarbageCollector that uses the login and subscription configuration of the driver
+func NewGarbageCollector(version string) (GarbageCollector, error) {
+	d := &aciDriver{
+		newBackend: az.NewBackend,
+		login:      az.LoginToAzure,
+	}
+	d.userAgent = fmt.Sprintf("%s-%s", userAgentPrefix, version)
+	d.version = version
+	config := make(map[string]string)
+	for env := range d.Config() {
+		config[env] = os.Getenv(env)
+	}
+	if err := d.processLoginConfiguration(config); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// CollectGarbage finds the resource groups, container groups and system MSI role assignments created by the driver and deletes those that have expired,
+// a container group that is still running may belong to a detached operation or a driver that is waiting for it so it is kept along with its resources
+func (d *aciDriver) CollectGarbage(ctx context.Context, olderThan time.Duration, dryRun bool, force bool) ([]Garbage, error) {
+	if err := d.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expired := func(item *Garbage) bool {
+		if !item.RetainUntil.IsZero() {
+			return !now.Before(item.RetainUntil)
+		}
+		if !item.RetainedAt.IsZero() {
+			return now.Sub(item.RetainedAt) >= olderThan
+		}
+		return !item.CreatedAt.IsZero() && now.Sub(item.CreatedAt) >= olderThan
+	}
+
+	groups, err := d.backend.ListResourceGroups(ctx, d.subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list resource groups: %v", err)
+	}
+
+	var resourceGroups []Garbage
+	// Resource groups created by the driver keyed by lower case name
+	driverResourceGroups := make(map[string]*Garbage)
+	// kept are the actions of the resources that are kept whether or not they have expired keyed by ID
+	kept := make(map[string]GarbageAction)
+	// keptByPolicy checks the retention policy in the tags of a resource, resources created with the never policy are kept unless forced
+	keptByPolicy := func(item *Garbage, tags map[string]*string) bool {
+		policy, ok := retentionPolicyTag(tags)
+		if !ok {
+			return false
+		}
+		item.Policy = policy.String()
+		if !policy.deleteResources && !force {
+			kept[item.ID] = GarbageKeptByPolicy
+			return true
+		}
+		return false
+	}
+	for _, group := range groups {
+		name := to.String(group.Name)
+		if !isDriverResource(name, group.Tags) {
+			continue
+		}
+		item := Garbage{
+			Type:          GarbageResourceGroup,
+			ID:            to.String(group.ID),
+			Name:          name,
+			ResourceGroup: name,
+			CreatedAt:     createdAt(group.Tags),
+			RetainUntil:   retainUntil(group.Tags),
+			RetainedAt:    retainedAt(group.Tags),
+			Action:        GarbageKept,
+		}
+		if group.Properties != nil {
+			item.State = to.String(group.Properties.ProvisioningState)
+		}
+		keptByPolicy(&item, group.Tags)
+		resourceGroups = append(resourceGroups, item)
+	}
+	sort.Slice(resourceGroups, func(i, j int) bool { return resourceGroups[i].Name < resourceGroups[j].Name })
+	for i := range resourceGroups {
+		driverResourceGroups[strings.ToLower(resourceGroups[i].Name)] = &resourceGroups[i]
+	}
+
+	list, err := d.backend.ListContainerGroups(ctx, d.subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list container groups: %v", err)
+	}
+
+	var containerGroups []Garbage
+	var roleAssignments []Garbage
+	for _, containerGroup := range list {
+		resource, err := azure.ParseResourceID(to.String(containerGroup.ID))
+		if err != nil {
+			log.Debugf("Ignoring container group %s: %v", to.String(containerGroup.ID), err)
+			continue
+		}
+		resourceGroup := driverResourceGroups[strings.ToLower(resource.ResourceGroup)]
+		if resourceGroup == nil && !isDriverResource(resource.ResourceName, containerGroup.Tags) {
+			continue
+		}
+
+		item := Garbage{
+			Type:          GarbageContainerGroup,
+			ID:            to.String(containerGroup.ID),
+			Name:          resource.ResourceName,
+			ResourceGroup: resource.ResourceGroup,
+			State:         d.getGarbageContainerGroupState(ctx, resource.ResourceGroup, resource.ResourceName, containerGroup),
+			CreatedAt:     createdAt(containerGroup.Tags),
+			RetainUntil:   retainUntil(containerGroup.Tags),
+			RetainedAt:    retainedAt(containerGroup.Tags),
+			Action:        GarbageKept,
+		}
+		// Container groups created before the driver added tags have the age of the resource group they are in
+		if item.CreatedAt.IsZero() && resourceGroup != nil {
+			item.CreatedAt = resourceGroup.CreatedAt
+		}
+		// Container groups without a policy in a resource group kept by its policy are kept with it
+		protected := keptByPolicy(&item, containerGroup.Tags) || (len(item.Policy) == 0 && resourceGroup != nil && kept[resourceGroup.ID] == GarbageKeptByPolicy)
+		if protected {
+			kept[item.ID] = GarbageKeptByPolicy
+		}
+		running := !force && !containerGroupCompleted(item.State)
+		if running {
+			kept[item.ID] = GarbageKeptRunning
+			if resourceGroup != nil {
+				kept[resourceGroup.ID] = GarbageKeptRunning
+			}
+		}
+		containerGroups = append(containerGroups, item)
+
+		// The role assignments for a system assigned identity can only be found while the container group exists
+		identity := containerGroup.Identity
+		if identity == nil || identity.PrincipalID == nil || (identity.Type != containerinstance.ResourceIdentityTypeSystemAssigned && identity.Type != containerinstance.ResourceIdentityTypeSystemAssignedUserAssigned) {
+			continue
+		}
+		assignments, err := d.backend.ListRoleAssignmentsForPrincipal(ctx, d.subscriptionID, *identity.PrincipalID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list role assignments for container group %s: %v", item.Name, err)
+		}
+		for _, assignment := range assignments {
+			roleAssignment := Garbage{
+				Type:          GarbageRoleAssignment,
+				ID:            to.String(assignment.ID),
+				Name:          to.String(assignment.Name),
+				ResourceGroup: item.ResourceGroup,
+				CreatedAt:     item.CreatedAt,
+				RetainUntil:   item.RetainUntil,
+				RetainedAt:    item.RetainedAt,
+				Policy:        item.Policy,
+				Action:        GarbageKept,
+			}
+			if action, ok := kept[item.ID]; ok {
+				kept[roleAssignment.ID] = action
+			}
+			if assignment.Properties != nil {
+				roleAssignment.State = fmt.Sprintf("assigned at %s", to.String(assignment.Properties.Scope))
+			}
+			roleAssignments = append(roleAssignments, roleAssignment)
+		}
+	}
+	sort.Slice(containerGroups, func(i, j int) bool { return containerGroups[i].ID < containerGroups[j].ID })
+	sort.Slice(roleAssignments, func(i, j int) bool { return roleAssignments[i].ID < roleAssignments[j].ID })
+
+	// Role assignments are deleted first as they cannot be found once the container group has been deleted,
+	// container groups in resource groups that are going to be deleted are deleted along with the resource group
+	failed := 0
+	deletable := func(item *Garbage) bool {
+		if !expired(item) {
+			return false
+		}
+		if action, ok := kept[item.ID]; ok {
+			item.Action = action
+			return false
+		}
+		return true
+	}
+	collect := func(item *Garbage, deleteResource func() error) {
+		if !deletable(item) {
+			return
+		}
+		if dryRun {
+			item.Action = GarbageWouldDelete
+			return
+		}
+		log.Debugf("Deleting %s %s", item.Type, item.ID)
+		if err := deleteResource(); err != nil {
+			item.Action = GarbageDeleteFailed
+			item.Error = err
+			failed++
+			return
+		}
+		item.Action = GarbageDeleted
+	}
+
+	for i := range roleAssignments {
+		item := &roleAssignments[i]
+		collect(item, func() error {
+			return d.backend.DeleteRoleAssignment(ctx, d.subscriptionID, item.ID)
+		})
+	}
+
+	for i := range containerGroups {
+		item := &containerGroups[i]
+		if resourceGroup := driverResourceGroups[strings.ToLower(item.ResourceGroup)]; resourceGroup != nil && deletable(resourceGroup) {
+			continue
+		}
+		collect(item, func() error {
+			return d.backend.DeleteContainerGroup(ctx, d.subscriptionID, item.ResourceGroup, item.Name)
+		})
+	}
+
+	for i := range resourceGroups {
+		item := &resourceGroups[i]
+		collect(item, func() error {
+			return d.backend.DeleteResourceGroup(ctx, d.subscriptionID, item.Name)
+		})
+	}
+
+	for i := range containerGroups {
+		item := &containerGroups[i]
+		resourceGroup := driverResourceGroups[strings.ToLower(item.ResourceGroup)]
+		if resourceGroup == nil {
+			continue
+		}
+		switch resourceGroup.Action {
+		case GarbageDeleted:
+			item.Action = GarbageDeletedWithResourceGroup
+		case GarbageWouldDelete:
+			item.Action = GarbageWouldDelete
+		}
+	}
+
+	garbage := append(append(resourceGroups, containerGroups...), roleAssignments...)
+	if failed > 0 {
+		return garbage, fmt.Errorf("Failed to delete %d resources", failed)
+	}
+
+	return garbage, nil
+}
+
+// getGarbageContainerGroupState gets the state of a container group, container groups are listed without their instance view so it is read separately
+func (d *aciDriver) getGarbageContainerGroupState(ctx context.Context, resourceGroupName string, containerGroupName string, containerGroup containerinstance.ContainerGroup) string {
+	state := ""
+	if containerGroup.ContainerGroupProperties != nil {
+		state = to.String(containerGroup.ProvisioningState)
+	}
+
+	current, err := d.backend.GetContainerGroup(ctx, d.subscriptionID, resourceGroupName, containerGroupName)
+	if err != nil {
+		log.Debugf("Failed to get state of container group %s: %v", containerGroupName, err)
+		return state
+	}
+	if current.ContainerGroupProperties != nil && current.InstanceView != nil && current.InstanceView.State != nil {
+		return *current.InstanceView.State
+	}
+	return state
+}
+
+// isDriverResource checks if a resource was created by the driver, resources created before the driver added tags are identified by the generated name
+func isDriverResource(name string, tags map[string]*string) bool {
+	if _, ok := tags[tagDriverVersion]; ok {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(name), generatedNamePrefix)
+}
+
+// createdAt gets the time a resource was created from its tags
+func createdAt(tags map[string]*string) time.Time {
+	return timeTag(tags, tagCreatedAt)
+}
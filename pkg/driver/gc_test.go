@@ -0,0 +1,212 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	testcases := []struct {
+		name        string
+		dryRun      bool
+		force       bool
+		errors      map[string]error
+		expectError string
+		expected    map[string]GarbageAction
+		check       func(t *testing.T, b *fake.Backend)
+	}{
+		{
+			name:   "lists the resources that would be deleted",
+			dryRun: true,
+			expected: map[string]GarbageAction{
+				"cnab-azure-old":                           GarbageWouldDelete,
+				"cnab-azure-old/cnab-azure-old-cg":         GarbageWouldDelete,
+				"cnab-azure-new":                           GarbageKept,
+				"cnab-azure-new/cnab-azure-new-cg":         GarbageKept,
+				"cnab-azure-untagged":                      GarbageKept,
+				"existing/deploy":                          GarbageWouldDelete,
+				"role assignment/cnab-azure-old":           GarbageWouldDelete,
+				"cnab-azure-running":                       GarbageKeptRunning,
+				"cnab-azure-running/cnab-azure-running-cg": GarbageKeptRunning,
+				"role assignment/cnab-azure-running":       GarbageKeptRunning,
+			},
+			check: func(t *testing.T, b *fake.Backend) {
+				assert.Empty(t, b.DeletedResourceGroups)
+				assert.Empty(t, b.DeletedContainerGroups)
+				assert.Empty(t, b.DeletedRoleAssignments)
+			},
+		},
+		{
+			name: "deletes resources older than the threshold",
+			expected: map[string]GarbageAction{
+				"cnab-azure-old":                           GarbageDeleted,
+				"cnab-azure-old/cnab-azure-old-cg":         GarbageDeletedWithResourceGroup,
+				"cnab-azure-new":                           GarbageKept,
+				"cnab-azure-new/cnab-azure-new-cg":         GarbageKept,
+				"cnab-azure-untagged":                      GarbageKept,
+				"existing/deploy":                          GarbageDeleted,
+				"role assignment/cnab-azure-old":           GarbageDeleted,
+				"cnab-azure-running":                       GarbageKeptRunning,
+				"cnab-azure-running/cnab-azure-running-cg": GarbageKeptRunning,
+				"role assignment/cnab-azure-running":       GarbageKeptRunning,
+			},
+			check: func(t *testing.T, b *fake.Backend) {
+				assert.Equal(t, []string{"cnab-azure-old"}, b.DeletedResourceGroups)
+				assert.Equal(t, []string{fake.Key("existing", "deploy")}, b.DeletedContainerGroups)
+				assert.Len(t, b.DeletedRoleAssignments, 1)
+				assert.Contains(t, b.ContainerGroups, fake.Key("cnab-azure-running", "cnab-azure-running-cg"), "Expected running container group to be kept")
+				assert.Empty(t, b.StoppedContainerGroups)
+				assert.Contains(t, b.ResourceGroups, "cnab-azure-new")
+				assert.Contains(t, b.ResourceGroups, "cnab-azure-untagged")
+				assert.Contains(t, b.ContainerGroups, fake.Key("existing", "other"))
+			},
+		},
+		{
+			name:        "reports resources that could not be deleted",
+			errors:      map[string]error{"DeleteResourceGroup": errors.New("resource group is locked")},
+			expectError: "Failed to delete 1 resources",
+			expected: map[string]GarbageAction{
+				"cnab-azure-old":                           GarbageDeleteFailed,
+				"cnab-azure-old/cnab-azure-old-cg":         GarbageKept,
+				"cnab-azure-new":                           GarbageKept,
+				"cnab-azure-new/cnab-azure-new-cg":         GarbageKept,
+				"cnab-azure-untagged":                      GarbageKept,
+				"existing/deploy":                          GarbageDeleted,
+				"role assignment/cnab-azure-old":           GarbageDeleted,
+				"cnab-azure-running":                       GarbageKeptRunning,
+				"cnab-azure-running/cnab-azure-running-cg": GarbageKeptRunning,
+				"role assignment/cnab-azure-running":       GarbageKeptRunning,
+			},
+		},
+		{
+			name:  "deletes the resources of running container groups when forced",
+			force: true,
+			expected: map[string]GarbageAction{
+				"cnab-azure-old":                           GarbageDeleted,
+				"cnab-azure-old/cnab-azure-old-cg":         GarbageDeletedWithResourceGroup,
+				"cnab-azure-new":                           GarbageKept,
+				"cnab-azure-new/cnab-azure-new-cg":         GarbageKept,
+				"cnab-azure-untagged":                      GarbageKept,
+				"existing/deploy":                          GarbageDeleted,
+				"role assignment/cnab-azure-old":           GarbageDeleted,
+				"cnab-azure-running":                       GarbageDeleted,
+				"cnab-azure-running/cnab-azure-running-cg": GarbageDeletedWithResourceGroup,
+				"role assignment/cnab-azure-running":       GarbageDeleted,
+			},
+			check: func(t *testing.T, b *fake.Backend) {
+				assert.ElementsMatch(t, []string{"cnab-azure-old", "cnab-azure-running"}, b.DeletedResourceGroups)
+				assert.Len(t, b.DeletedRoleAssignments, 2)
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{})
+			now := time.Now()
+			createGarbage(t, b, now)
+			for k, v := range tc.errors {
+				b.Errors[k] = v
+			}
+
+			garbage, err := d.CollectGarbage(context.Background(), 24*time.Hour, tc.dryRun, tc.force)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+			} else {
+				assert.NoErrorf(t, err, "Expected no error collecting garbage. Got: %v", err)
+			}
+
+			actions := map[string]GarbageAction{}
+			for _, item := range garbage {
+				switch item.Type {
+				case GarbageResourceGroup:
+					actions[item.Name] = item.Action
+				case GarbageContainerGroup:
+					actions[item.ResourceGroup+"/"+item.Name] = item.Action
+				case GarbageRoleAssignment:
+					actions["role assignment/"+item.ResourceGroup] = item.Action
+					assert.Equal(t, fmt.Sprintf("assigned at /subscriptions/%s", fakeSubscriptionID), item.State)
+				}
+				if item.Action == GarbageDeleteFailed {
+					assert.EqualError(t, item.Error, "resource group is locked")
+				}
+			}
+			assert.Equal(t, tc.expected, actions)
+			if tc.check != nil {
+				tc.check(t, b)
+			}
+		})
+	}
+}
+
+// createGarbage creates resources as they would be left behind by the driver along with resources that were not created by the driver
+func createGarbage(t *testing.T, b *fake.Backend, now time.Time) {
+	ctx := context.Background()
+	tags := func(createdAt time.Time) map[string]*string {
+		return map[string]*string{
+			tagDriverVersion: to.StringPtr("test-version"),
+			tagCreatedAt:     to.StringPtr(createdAt.UTC().Format(time.RFC3339)),
+			"owner":          to.StringPtr("team"),
+		}
+	}
+	createContainerGroup := func(resourceGroupName string, name string, tags map[string]*string, identity *containerinstance.ContainerGroupIdentity) containerinstance.ContainerGroup {
+		containerGroup, err := b.CreateContainerGroup(ctx, fakeSubscriptionID, resourceGroupName, name, containerinstance.ContainerGroup{
+			Tags:                     tags,
+			Identity:                 identity,
+			ContainerGroupProperties: &containerinstance.ContainerGroupProperties{},
+		})
+		assert.NoError(t, err)
+		return containerGroup
+	}
+
+	groups := map[string]map[string]*string{
+		"cnab-azure-old":      tags(now.Add(-48 * time.Hour)),
+		"cnab-azure-running":  tags(now.Add(-48 * time.Hour)),
+		"cnab-azure-new":      tags(now.Add(-time.Hour)),
+		"cnab-azure-untagged": nil,
+		"existing":            {"owner": to.StringPtr("team")},
+	}
+	for name, tags := range groups {
+		_, err := b.CreateResourceGroup(ctx, fakeSubscriptionID, name, resources.Group{Location: to.StringPtr(fakeLocation), Tags: tags})
+		assert.NoError(t, err)
+	}
+
+	// A container group with a system MSI that was given a role at the subscription scope
+	old := createContainerGroup("cnab-azure-old", "cnab-azure-old-cg", nil, &containerinstance.ContainerGroupIdentity{Type: containerinstance.ResourceIdentityTypeSystemAssigned})
+	_, err := b.CreateRoleAssignment(ctx, fakeSubscriptionID, "/subscriptions/"+fakeSubscriptionID, "22222222-2222-2222-2222-222222222222", authorization.RoleAssignmentCreateParameters{
+		Properties: &authorization.RoleAssignmentProperties{PrincipalID: old.Identity.PrincipalID},
+	})
+	assert.NoError(t, err)
+	// A role assignment for another principal should not be found
+	_, err = b.CreateRoleAssignment(ctx, fakeSubscriptionID, "/subscriptions/"+fakeSubscriptionID, "33333333-3333-3333-3333-333333333333", authorization.RoleAssignmentCreateParameters{
+		Properties: &authorization.RoleAssignmentProperties{PrincipalID: to.StringPtr("44444444-4444-4444-4444-444444444444")},
+	})
+	assert.NoError(t, err)
+
+	// A container group for a detached operation that is still running
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{State: "Running"}}
+	}
+	running := createContainerGroup("cnab-azure-running", "cnab-azure-running-cg", tags(now.Add(-48*time.Hour)), &containerinstance.ContainerGroupIdentity{Type: containerinstance.ResourceIdentityTypeSystemAssigned})
+	b.Run = nil
+	_, err = b.CreateRoleAssignment(ctx, fakeSubscriptionID, "/subscriptions/"+fakeSubscriptionID, "55555555-5555-5555-5555-555555555555", authorization.RoleAssignmentCreateParameters{
+		Properties: &authorization.RoleAssignmentProperties{PrincipalID: running.Identity.PrincipalID},
+	})
+	assert.NoError(t, err)
+
+	createContainerGroup("cnab-azure-new", "cnab-azure-new-cg", tags(now.Add(-time.Hour)), nil)
+	// Container groups in an existing resource group are only collected if they are tagged by the driver
+	createContainerGroup("existing", "deploy", tags(now.Add(-48*time.Hour)), nil)
+	createContainerGroup("existing", "other", map[string]*string{"owner": to.StringPtr("team")}, nil)
+}
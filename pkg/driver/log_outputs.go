@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// outputTransportAuto reads outputs from the state file share if one is configured or available in Cloud Shell, from the state blob container if
+	// one is configured and from the container logs otherwise
+	outputTransportAuto = "auto"
+	// outputTransportFileShare reads outputs from the state file share that the invocation image writes them to
+	outputTransportFileShare = "fileshare"
+	// outputTransportLogs reads outputs from the container logs, the script writes each output file base64 encoded between markers once the bundle has run
+	outputTransportLogs = "logs"
+
+	outputBeginMarker = "##cnab-azure-output-begin:"
+	outputEndMarker   = "##cnab-azure-output-end:"
+)
+
+// parseOutputTransport parses the value of CNAB_AZURE_OUTPUT_TRANSPORT
+func parseOutputTransport(value string) (string, error) {
+	transport := strings.ToLower(strings.TrimSpace(value))
+	switch transport {
+	case "":
+		return outputTransportAuto, nil
+	case outputTransportAuto, outputTransportFileShare, outputTransportBlob, outputTransportLogs:
+		return transport, nil
+	default:
+		return "", fmt.Errorf("value (%s) of CNAB_AZURE_OUTPUT_TRANSPORT should be %s, %s, %s or %s", value, outputTransportAuto, outputTransportFileShare, outputTransportBlob, outputTransportLogs)
+	}
+}
+
+// writeOutputsCommand gets the commands that write the output files to stdout after the bundle has run, the exit code of the bundle is kept
+// so that the outputs are written whether or not it succeeds
+func writeOutputsCommand(runCommand string) string {
+	outputDir := cnabOutputMountPoint + cnabOutputDirName
+	return fmt.Sprintf(`%[1]s && rc=0 || rc=$?;for f in %[2]s/*;do if [ -f "${f}" ];then echo "%[3]s${f##*/}";base64 "${f}";echo "%[4]s${f##*/}";fi;done;exit ${rc}`,
+		runCommand, outputDir, outputBeginMarker, outputEndMarker)
+}
+
+// outputFrames collects the outputs written to the container logs, the lines between the markers are not written to stdout
+type outputFrames struct {
+	// current is the name of the output being read, it is empty outside of a frame
+	current string
+	encoded strings.Builder
+	// outputs are the base64 encoded outputs that have been read keyed by the output name
+	outputs map[string]string
+}
+
+// read checks if the line is part of an output, if it is the line is collected and true is returned
+func (f *outputFrames) read(line string) bool {
+	if len(f.current) == 0 {
+		if !strings.HasPrefix(line, outputBeginMarker) {
+			return false
+		}
+		f.current = strings.TrimPrefix(line, outputBeginMarker)
+		f.encoded.Reset()
+		return true
+	}
+
+	if line == outputEndMarker+f.current {
+		if f.outputs == nil {
+			f.outputs = map[string]string{}
+		}
+		f.outputs[f.current] = f.encoded.String()
+		f.current = ""
+		return true
+	}
+	f.encoded.WriteString(strings.TrimSpace(line))
+	return true
+}
+
+// decodeLogOutput decodes an output read from the container logs
+func decodeLogOutput(name string, encoded string) (string, error) {
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding output %s from container logs: %v", name, err)
+	}
+	return string(content), nil
+}
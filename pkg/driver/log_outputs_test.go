@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/bundle/definition"
+	cnabdriver "github.com/cnabio/cnab-go/driver"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestParseOutputTransport(t *testing.T) {
+	for value, expected := range map[string]string{"": "auto", "AUTO": "auto", "fileshare": "fileshare", "Blob": "blob", "logs": "logs"} {
+		transport, err := parseOutputTransport(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, transport)
+	}
+	_, err := parseOutputTransport("sidecar")
+	assert.EqualError(t, err, "value (sidecar) of CNAB_AZURE_OUTPUT_TRANSPORT should be auto, fileshare, blob or logs")
+}
+
+func TestContainerLogsOutputFrames(t *testing.T) {
+	logs := newContainerLogs(0)
+	output := captureStdout(t, func() {
+		err := logs.writeLines([]string{
+			"Installing",
+			outputBeginMarker + "output1",
+			"T1VU",
+			"UFVUXzE=",
+			outputEndMarker + "output1",
+			"##cnab-azure-output-end:other",
+			"Done",
+		})
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, "Installing\n##cnab-azure-output-end:other\nDone\n", output, "Expected only the lines of the output frame not to be written")
+	assert.Equal(t, 7, logs.linesOutput(), "Expected the lines of the output frame to be counted as written")
+	assert.Equal(t, map[string]string{"output1": "T1VUUFVUXzE="}, logs.outputs())
+
+	content, err := decodeLogOutput("output1", logs.outputs()["output1"])
+	assert.NoError(t, err)
+	assert.Equal(t, "OUTPUT_1", content)
+	_, err = decodeLogOutput("output1", "!!")
+	assert.EqualError(t, err, "Error decoding output output1 from container logs: illegal base64 data at input byte 0")
+}
+
+func TestRunWithFakeBackendOutputsInLogs(t *testing.T) {
+	d, b, share := newFakeDriver(t, map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"})
+	op := newFakeOperation()
+	op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{}, "output2": &definition.Schema{}}
+	op.Bundle.Outputs = map[string]bundle.Output{
+		"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"},
+		"output2": {Definition: "output2", Path: "/cnab/app/outputs/output2"},
+	}
+	op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1", "/cnab/app/outputs/output2": "output2"}
+	var command []string
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		command = to.StringSlice((*cg.Containers)[0].Command)
+		return fake.ContainerRun{
+			{State: "Running", Logs: []string{"Installing"}},
+			{State: "Succeeded", Logs: []string{
+				outputBeginMarker + "output1",
+				base64.StdEncoding.EncodeToString([]byte("OUTPUT_1")),
+				outputEndMarker + "output1",
+				"Done",
+			}},
+		}
+	}
+
+	var result cnabdriver.OperationResult
+	var err error
+	output := captureStdout(t, func() {
+		result, err = d.Run(op)
+	})
+	assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+	assert.Equal(t, map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"}, result.Outputs)
+	assert.Contains(t, output, "Done")
+	assert.NotContains(t, output, outputBeginMarker)
+	assert.Empty(t, share.Files())
+	if assert.Len(t, command, 4) {
+		assert.Equal(t, "mkdir -p /cnab/app/outputs;"+writeOutputsCommand("/cnab/app/run"), command[3])
+	}
+	for _, volume := range *b.ContainerGroups[fake.Key(d.aciRG, d.aciName)].Volumes {
+		assert.Nil(t, volume.AzureFile, "Expected no state volume to be mounted")
+	}
+}
+
+func TestAttachOutputsInLogs(t *testing.T) {
+	d, b, _ := newFakeDriver(t, map[string]string{})
+	op := newFakeOperation()
+	op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{}, "output2": &definition.Schema{}}
+	op.Bundle.Outputs = map[string]bundle.Output{
+		"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"},
+		"output2": {Definition: "output2", Path: "/cnab/app/outputs/output2"},
+	}
+	op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1", "/cnab/app/outputs/output2": "output2"}
+	// The driver exits after output2 has been written and while output1 is being written
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{
+			{State: "Running", Logs: []string{
+				"Installing",
+				outputBeginMarker + "output2",
+				base64.StdEncoding.EncodeToString([]byte("OUTPUT_2")),
+				outputEndMarker + "output2",
+				outputBeginMarker + "output1",
+				"T1VU",
+			}},
+			{State: "Succeeded", Logs: []string{"UFVUXzE=", outputEndMarker + "output1", "Done"}},
+		}
+	}
+	startOperation(t, d, b, op)
+	d.saveOperationProgress(6)
+
+	attacher, _, _ := newFakeDriver(t, map[string]string{})
+	attacher.operationRecordDir = d.operationRecordDir
+	attacher.newBackend = func(authorizer autorest.Authorizer, userAgent string) az.Backend {
+		return b
+	}
+	record, err := attacher.GetOperationRecord(d.aciRG, d.aciName)
+	if !assert.NoErrorf(t, err, "Expected no error getting operation record. Got: %v", err) {
+		return
+	}
+	assert.True(t, record.OutputsInLogs)
+
+	var result cnabdriver.OperationResult
+	output := captureStdout(t, func() {
+		result, err = attacher.Attach(context.Background(), record)
+	})
+	assert.NoErrorf(t, err, "Expected no error attaching to operation. Got: %v", err)
+	assert.Equal(t, map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1", "/cnab/app/outputs/output2": "OUTPUT_2"}, result.Outputs)
+	assert.Contains(t, output, "Done")
+	assert.NotContains(t, output, "Installing", "Expected the lines written before the driver exited not to be written again")
+	assert.NotContains(t, output, outputBeginMarker)
+}
@@ -0,0 +1,220 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRecentLogLines is the number of lines that have been written that are kept to find where the container logs continue from
+const maxRecentLogLines = 100
+
+// containerLogs writes the logs of the invocation image to stdout, lines are only written once whether they are read from the attach stream or from the container logs
+type containerLogs struct {
+	mu sync.Mutex
+	// written is the number of lines that have been written
+	written int
+	// recent are the last lines that have been written
+	recent []string
+	// frames are the outputs written to the logs by the script, they are counted as written but not written to stdout
+	frames outputFrames
+	// replayOutputs is true if the lines that were written before an operation was resumed should be read for outputs, they are read from the
+	// first logs that are updated
+	replayOutputs bool
+}
+
+// newContainerLogs creates a containerLogs for a container whose first linesOutput lines have already been written
+func newContainerLogs(linesOutput int) *containerLogs {
+	return &containerLogs{written: linesOutput}
+}
+
+// linesOutput gets the number of lines that have been written
+func (l *containerLogs) linesOutput() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written
+}
+
+// outputs gets the base64 encoded outputs that were read from the logs keyed by the output name
+func (l *containerLogs) outputs() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.frames.outputs
+}
+
+// writeLines writes lines read from the attach stream
+func (l *containerLogs) writeLines(lines []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// The lines before the stream attached are not known so the outputs cannot be replayed from them
+	l.replayOutputs = false
+	return l.write(lines)
+}
+
+// update writes the lines of the container logs that have not already been written, unless complete is true a last line without a newline is
+// left until the next update as the container may still be writing it
+func (l *containerLogs) update(content string, complete bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := strings.Split(content, "\n")
+	if complete && len(lines[len(lines)-1]) > 0 {
+		lines = append(lines, "")
+	}
+	lines = lines[:len(lines)-1]
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	written := l.overlap(lines)
+	if l.replayOutputs {
+		// The output frames that were written before the operation was resumed are read without writing the lines again
+		for _, line := range lines[:written] {
+			l.frames.read(line)
+		}
+		l.replayOutputs = false
+	}
+	return l.write(lines[written:])
+}
+
+// overlap finds the number of lines at the start of the container logs that have already been written. ACI only returns the end of the logs once they
+// are large and lines can be missed while the attach stream connects, so the logs are matched with the recent lines that have been written. The position
+// where the most of the recent lines match is used, preferring the position closest to the number of lines written. If none of them match all of the lines are new.
+func (l *containerLogs) overlap(lines []string) int {
+	if len(l.recent) == 0 {
+		// The lines that were written are not known when resuming an operation
+		if l.written < len(lines) {
+			return l.written
+		}
+		return len(lines)
+	}
+
+	// matching counts the recent lines that match the logs going back from end
+	matching := func(end int) int {
+		count := 0
+		for count < end && count < len(l.recent) && lines[end-count-1] == l.recent[len(l.recent)-count-1] {
+			count++
+		}
+		return count
+	}
+
+	if l.written > 0 && l.written <= len(lines) && matching(l.written) == len(l.recent) {
+		return l.written
+	}
+
+	distance := func(end int) int {
+		if end > l.written {
+			return end - l.written
+		}
+		return l.written - end
+	}
+	overlap, most := 0, 0
+	for end := len(lines); end > 0; end-- {
+		count := matching(end)
+		if count > most || (count == most && count > 0 && distance(end) < distance(overlap)) {
+			overlap, most = end, count
+		}
+	}
+
+	return overlap
+}
+
+func (l *containerLogs) write(lines []string) error {
+	for _, line := range lines {
+		if !l.frames.read(line) {
+			if _, err := fmt.Println(line); err != nil {
+				return fmt.Errorf("Error writing container logs :%v", err)
+			}
+		}
+		l.written++
+		l.recent = append(l.recent, line)
+	}
+	if len(l.recent) > maxRecentLogLines {
+		l.recent = append([]string(nil), l.recent[len(l.recent)-maxRecentLogLines:]...)
+	}
+
+	return nil
+}
+
+// logStream copies the lines read from the attach stream of the invocation image container to the container logs
+type logStream struct {
+	stream    io.ReadCloser
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// attachLogStream attaches to the invocation image container and writes its output until the stream ends, the output written
+// before the stream connects is not included so the container logs should be written first
+func (d *aciDriver) attachLogStream(ctx context.Context, logs *containerLogs) (*logStream, error) {
+	log.Debug("Attaching to Invocation Image output")
+	stream, err := d.backend.AttachContainer(ctx, d.subscriptionID, d.aciRG, d.aciName, d.aciName)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &logStream{
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		reader := bufio.NewReader(stream)
+		for {
+			// A last line without a newline is written from the container logs once the container has terminated
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err != io.EOF {
+					s.err = err
+				}
+				return
+			}
+			if err := logs.writeLines([]string{strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")}); err != nil {
+				s.err = err
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// open checks if the stream is still writing output
+func (s *logStream) open() bool {
+	if s == nil {
+		return false
+	}
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// close closes the stream and waits for the lines that have been read to be written
+func (s *logStream) close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		if err := s.stream.Close(); err != nil {
+			log.Debugf("Error closing container output stream: %v", err)
+		}
+	})
+	<-s.done
+}
+
+// writeContainerLogs gets the logs of the invocation image container and writes the lines that have not already been written
+func (d *aciDriver) writeContainerLogs(ctx context.Context, logs *containerLogs, complete bool) error {
+	log.Debug("Getting Logs from Invocation Image")
+	content, err := d.backend.GetContainerLogs(ctx, d.subscriptionID, d.aciRG, d.aciName, d.aciName)
+	if err != nil {
+		return fmt.Errorf("Error getting container logs :%v", err)
+	}
+
+	return logs.update(content, complete)
+}
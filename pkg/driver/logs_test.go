@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestContainerLogsUpdate(t *testing.T) {
+	testcases := []struct {
+		name        string
+		linesOutput int
+		written     []string
+		content     string
+		complete    bool
+		expected    string
+	}{
+		{
+			name:     "writes all the lines of new logs",
+			content:  "one\ntwo\n",
+			expected: "one\ntwo\n",
+		},
+		{
+			name:     "writes the lines after those already written",
+			written:  []string{"one", "two"},
+			content:  "one\ntwo\nthree\n",
+			expected: "three\n",
+		},
+		{
+			name:     "leaves a line without a newline until the container has terminated",
+			written:  []string{"one"},
+			content:  "one\ntwo\nthr",
+			expected: "two\n",
+		},
+		{
+			name:     "writes a line without a newline once the container has terminated",
+			written:  []string{"one"},
+			content:  "one\ntwo",
+			complete: true,
+			expected: "two\n",
+		},
+		{
+			name:     "does not write lines again when the start of the logs has been truncated",
+			written:  []string{"one", "two", "three"},
+			content:  "two\nthree\nfour\n",
+			expected: "four\n",
+		},
+		{
+			name:     "skips lines that were missed when they are no longer the last lines written",
+			written:  []string{"one", "three"},
+			content:  "one\ntwo\nthree\nfour\n",
+			expected: "four\n",
+		},
+		{
+			name:     "matches repeated lines at the number of lines written",
+			written:  []string{"installing", "installing"},
+			content:  "installing\ninstalling\ninstalling\ndone\n",
+			expected: "installing\ndone\n",
+		},
+		{
+			name:     "writes all of the logs if none of the lines written are in them",
+			written:  []string{"one", "two"},
+			content:  "five\nsix\n",
+			expected: "five\nsix\n",
+		},
+		{
+			name:        "uses the number of lines written when resuming an operation",
+			linesOutput: 2,
+			content:     "one\ntwo\nthree\n",
+			expected:    "three\n",
+		},
+		{
+			name:     "removes carriage returns",
+			written:  []string{"one"},
+			content:  "one\r\ntwo\r\n",
+			expected: "two\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := newContainerLogs(tc.linesOutput)
+			captureStdout(t, func() {
+				assert.NoError(t, logs.writeLines(tc.written))
+			})
+
+			var err error
+			output := captureStdout(t, func() {
+				err = logs.update(tc.content, tc.complete)
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, output)
+			assert.Equal(t, tc.linesOutput+len(tc.written)+strings.Count(tc.expected, "\n"), logs.linesOutput())
+		})
+	}
+}
+
+func TestRunWithFakeBackendLogs(t *testing.T) {
+	logLines := func(from int, to int) []string {
+		var lines []string
+		for i := from; i <= to; i++ {
+			lines = append(lines, "log line "+string(rune('a'+i)))
+		}
+		return lines
+	}
+	run := fake.ContainerRun{
+		{State: "Running", Logs: logLines(0, 1)},
+		{State: "Running", Logs: logLines(2, 3)},
+		{State: "Running", Logs: logLines(4, 5)},
+		{State: "Succeeded", Logs: logLines(6, 7)},
+	}
+	testcases := []struct {
+		name     string
+		settings map[string]string
+		setup    func(b *fake.Backend)
+		run      fake.ContainerRun
+		attached bool
+	}{
+		{
+			name:     "streams the logs",
+			run:      run,
+			attached: true,
+		},
+		{
+			name:     "polls the logs if streaming is disabled",
+			settings: map[string]string{"CNAB_AZURE_STREAM_LOGS": "false"},
+			setup: func(b *fake.Backend) {
+				b.Errors["AttachContainer"] = errors.New("streaming should not be used")
+			},
+			run: run,
+		},
+		{
+			name: "polls the logs if attaching to the container fails",
+			setup: func(b *fake.Backend) {
+				b.Errors["AttachContainer"] = errors.New("attach failed")
+			},
+			run: run,
+		},
+		{
+			name: "polls the logs if the stream ends before the container terminates",
+			run: fake.ContainerRun{
+				run[0],
+				run[1],
+				{State: "Running", Logs: logLines(4, 5), StreamEnded: true},
+				run[3],
+			},
+			attached: true,
+		},
+		{
+			name: "writes the lines that were not streamed once the container terminates",
+			run: fake.ContainerRun{
+				run[0],
+				run[1],
+				run[2],
+				{State: "Succeeded", Logs: logLines(6, 7), StreamEnded: true},
+			},
+			attached: true,
+		},
+		{
+			name:     "polls truncated logs without writing lines again",
+			settings: map[string]string{"CNAB_AZURE_STREAM_LOGS": "false"},
+			setup: func(b *fake.Backend) {
+				b.LogTailLines = 4
+			},
+			run: run,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, tc.settings)
+			if tc.setup != nil {
+				tc.setup(b)
+			}
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				return tc.run
+			}
+
+			var err error
+			output := captureStdout(t, func() {
+				_, err = d.Run(newFakeOperation())
+			})
+			assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+
+			var written []string
+			for _, line := range strings.Split(output, "\n") {
+				if line = strings.ReplaceAll(line, "\033[1C\033[1D", ""); strings.HasPrefix(line, "log line") {
+					written = append(written, line)
+				}
+			}
+			assert.Equal(t, logLines(0, 7), written)
+			if tc.attached {
+				assert.Equal(t, []string{fake.Key(d.aciRG, d.aciName)}, b.AttachedContainerGroups)
+			} else {
+				assert.Empty(t, b.AttachedContainerGroups)
+			}
+		})
+	}
+}
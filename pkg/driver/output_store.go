@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+)
+
+const (
+	// outputTransportBlob reads outputs from the state blob container, the script uploads each output file with curl once the bundle has run
+	outputTransportBlob = "blob"
+	// defaultUploadSASDuration is how long the SAS token used to upload outputs is valid for if there is no timeout
+	defaultUploadSASDuration = 24 * time.Hour
+	outputsURLEnvVarName     = "CNAB_AZURE_OUTPUTS_URL"
+	outputsSASEnvVarName     = "CNAB_AZURE_OUTPUTS_SAS"
+	// curlNotFoundExitCode is the exit code of the script if the invocation image does not have curl to upload outputs with
+	curlNotFoundExitCode = 127
+	curlNotFoundMessage  = "curl is required in the invocation image to upload outputs to the blob container, the bundle has not been run"
+)
+
+// blobContainer is used to read and delete outputs uploaded to the state blob container by the invocation image
+type blobContainer interface {
+	UploadBlob(blobName string, content []byte) error
+	DownloadBlob(blobName string) (string, error)
+	BlobExists(blobName string) (bool, error)
+	DeleteBlob(blobName string) (bool, error)
+	ListBlobs(prefix string) ([]string, error)
+	URL() string
+	GetUploadSASToken(expiry time.Time) (string, error)
+}
+
+func newAzureBlobContainer(accountName string, accountKey string, containerName string) (blobContainer, error) {
+	return az.NewBlobContainer(accountName, accountKey, containerName)
+}
+
+// outputStore is the state backend that outputs are read from and deleted from once they have been retrieved
+type outputStore interface {
+	Exists(fileName string) (bool, error)
+	Read(fileName string) (string, error)
+	Delete(fileName string) (bool, error)
+	String() string
+}
+
+type fileShareOutputStore struct {
+	share fileShare
+}
+
+func (s fileShareOutputStore) Exists(fileName string) (bool, error) {
+	return s.share.CheckIfFileExists(fileName)
+}
+
+func (s fileShareOutputStore) Read(fileName string) (string, error) {
+	return s.share.ReadFileFromShare(fileName)
+}
+
+func (s fileShareOutputStore) Delete(fileName string) (bool, error) {
+	return s.share.DeleteFileFromShare(fileName)
+}
+
+func (s fileShareOutputStore) String() string {
+	return "AzureFileShare"
+}
+
+type blobOutputStore struct {
+	container blobContainer
+}
+
+func (s blobOutputStore) Exists(fileName string) (bool, error) {
+	return s.container.BlobExists(fileName)
+}
+
+func (s blobOutputStore) Read(fileName string) (string, error) {
+	return s.container.DownloadBlob(fileName)
+}
+
+func (s blobOutputStore) Delete(fileName string) (bool, error) {
+	return s.container.DeleteBlob(fileName)
+}
+
+func (s blobOutputStore) String() string {
+	return "Azure Blob Container"
+}
+
+// newOutputStore gets the store that the invocation image writes outputs to
+func (d *aciDriver) newOutputStore() (outputStore, error) {
+	if d.outputsInBlob {
+		container, err := d.newBlobContainer(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateBlobContainer)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating Azure Blob Container structure: %v", err)
+		}
+		return blobOutputStore{container: container}, nil
+	}
+
+	afs, err := d.newFileShare(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateFileShare)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating AzureFileShare structure: %v", err)
+	}
+	return fileShareOutputStore{share: afs}, nil
+}
+
+// prepareBlobOutputs gets the URL and SAS token that the script uses to upload outputs to the state blob container, the token only allows
+// blobs to be written and expires after the timeout of the operation
+func (d *aciDriver) prepareBlobOutputs() error {
+	container, err := d.newBlobContainer(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateBlobContainer)
+	if err != nil {
+		return fmt.Errorf("Error creating Azure Blob Container structure to upload outputs: %v", err)
+	}
+
+	duration := defaultUploadSASDuration
+	if d.timeout > 0 {
+		duration = d.timeout + time.Hour
+	}
+	d.outputsSASToken, err = container.GetUploadSASToken(time.Now().Add(duration))
+	if err != nil {
+		return err
+	}
+	d.outputsContainerURL = container.URL()
+	return nil
+}
+
+// outputsURL is the URL that the script uploads output files under
+func (d *aciDriver) outputsURL() string {
+	return d.outputsContainerURL + "/" + path.Join(d.statePath, cnabOutputDirName)
+}
+
+// uploadOutputsCommand gets the commands that upload the output files to the state blob container after the bundle has run, the exit code of the
+// bundle is kept unless an upload fails. The bundle is not run if the invocation image does not have curl as its outputs could not be uploaded.
+func uploadOutputsCommand(runCommand string) string {
+	outputDir := cnabOutputMountPoint + cnabOutputDirName
+	return fmt.Sprintf(`command -v curl >/dev/null 2>&1 || { echo "%[5]s" >&2;exit %[6]d; };%[1]s && rc=0 || rc=$?;for f in %[2]s/*;do if [ -f "${f}" ];then curl -sSf -X PUT -H "x-ms-blob-type: BlockBlob" -T "${f}" "${%[3]s}/${f##*/}?${%[4]s}" || rc=$?;fi;done;exit ${rc}`,
+		runCommand, outputDir, outputsURLEnvVarName, outputsSASEnvVarName, curlNotFoundMessage, curlNotFoundExitCode)
+}
@@ -0,0 +1,221 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/bundle/definition"
+	cnabdriver "github.com/cnabio/cnab-go/driver"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/test"
+)
+
+var blobSettings = map[string]string{
+	"CNAB_AZURE_STATE_BLOB_CONTAINER":       "outputs",
+	"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+	"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "key",
+}
+
+func TestProcessStateConfigurationBlobContainer(t *testing.T) {
+	testcases := []struct {
+		name                  string
+		settings              map[string]string
+		expectError           string
+		expectStateVolumeInfo bool
+	}{
+		{name: "blob container without a file share", settings: blobSettings},
+		{name: "blob container with a file share", settings: map[string]string{"CNAB_AZURE_STATE_BLOB_CONTAINER": "outputs", "CNAB_AZURE_STATE_FILESHARE": "share", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY": "key"}, expectStateVolumeInfo: true},
+		{name: "blob container needs the storage account key", settings: map[string]string{"CNAB_AZURE_STATE_BLOB_CONTAINER": "outputs", "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account"}, expectError: "All of CNAB_AZURE_STATE_BLOB_CONTAINER,CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME,CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY must be set when one is set. CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY is not set"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &aciDriver{}
+			config := make(map[string]string)
+			for env := range d.Config() {
+				config[env] = ""
+			}
+			for k, v := range tc.settings {
+				config[k] = v
+			}
+			err := d.processStateConfiguration(config)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "outputs", d.stateBlobContainer)
+			assert.Equal(t, "account", d.stateStorageAccountName)
+			assert.Equal(t, "key", d.stateStorageAccountKey)
+			assert.Equal(t, tc.expectStateVolumeInfo, d.hasStateVolumeInfo)
+			assert.Equal(t, tc.expectStateVolumeInfo, d.mountStateVolume)
+		})
+	}
+}
+
+func newBlobOutputsOperation() *cnabdriver.Operation {
+	op := newFakeOperation()
+	op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{}}
+	op.Bundle.Outputs = map[string]bundle.Output{
+		"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"},
+	}
+	op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+	return op
+}
+
+func TestRunWithFakeBackendOutputsInBlob(t *testing.T) {
+	settings := map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false", "CNAB_AZURE_TIMEOUT": "1h"}
+	for k, v := range blobSettings {
+		settings[k] = v
+	}
+	d, b, share := newFakeDriver(t, settings)
+	container := fake.NewBlobContainer("outputs")
+	d.newBlobContainer = func(accountName string, accountKey string, containerName string) (blobContainer, error) {
+		return container, nil
+	}
+	op := newBlobOutputsOperation()
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		// Simulates the upload of the output by the script
+		container.UploadBlob("helloworld/test/outputs/output1", []byte("OUTPUT_1"))
+		return fake.ContainerRun{{State: "Running"}, {State: "Succeeded", Logs: []string{"Done"}}}
+	}
+
+	var result cnabdriver.OperationResult
+	var err error
+	start := time.Now()
+	captureStdout(t, func() {
+		result, err = d.Run(op)
+	})
+	assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+	assert.Equal(t, map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"}, result.Outputs)
+	assert.Empty(t, container.Blobs(), "Expected outputs to be deleted from the blob container")
+	assert.Empty(t, share.Files())
+
+	cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+	c := getContainer(t, cg)
+	command := to.StringSlice(c.Command)
+	if assert.Len(t, command, 4) {
+		assert.Equal(t, "mkdir -p /cnab/app/outputs;"+uploadOutputsCommand("/cnab/app/run"), command[3])
+	}
+	for _, volume := range *cg.Volumes {
+		assert.Nil(t, volume.AzureFile, "Expected no state volume to be mounted")
+	}
+	env := map[string]containerinstance.EnvironmentVariable{}
+	for _, ev := range *c.EnvironmentVariables {
+		env[to.String(ev.Name)] = ev
+	}
+	assert.NotContains(t, env, "STATE_PATH")
+	assert.Equal(t, "https://fake.blob.core.windows.net/outputs/helloworld/test/outputs", to.String(env[outputsURLEnvVarName].Value))
+	assert.Nil(t, env[outputsSASEnvVarName].Value, "Expected the SAS token to be a secure value")
+	expiry, err := time.Parse(time.RFC3339, strings.TrimPrefix(strings.Split(to.String(env[outputsSASEnvVarName].SecureValue), "&")[0], "se="))
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, start.Add(2*time.Hour), expiry, time.Minute, "Expected the SAS token to expire an hour after the timeout")
+	}
+}
+
+func TestUploadOutputsCommandRequiresCurl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bin")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	run := func() (string, int) {
+		cmd := exec.Command("/bin/sh", "-c", uploadOutputsCommand("echo ran"))
+		cmd.Env = []string{"PATH=" + dir}
+		output, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return string(output), exitErr.ExitCode()
+		}
+		assert.NoError(t, err)
+		return string(output), 0
+	}
+
+	output, code := run()
+	assert.Equal(t, curlNotFoundMessage+"\n", output, "Expected the bundle not to be run if the image does not have curl")
+	assert.Equal(t, curlNotFoundExitCode, code)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "curl"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+	output, code = run()
+	assert.Equal(t, "ran\n", output)
+	assert.Equal(t, 0, code)
+}
+
+func TestRunWithFakeBackendOutputsInBlobErrors(t *testing.T) {
+	d, _, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_OUTPUT_TRANSPORT": "blob"})
+	_, err := d.Run(newBlobOutputsOperation())
+	assert.EqualError(t, err, "Bundle has outputs and CNAB_AZURE_OUTPUT_TRANSPORT is blob, set CNAB_AZURE_STATE_BLOB_CONTAINER and CNAB_AZURE_STATE_STORAGE_ACCOUNT_* variables so that outputs can be uploaded")
+
+	d, b, _ := newFakeDriver(t, blobSettings)
+	d.newBlobContainer = func(accountName string, accountKey string, containerName string) (blobContainer, error) {
+		return nil, fmt.Errorf("Azure Blob Container %s does not exist in Storage Account %s", containerName, accountName)
+	}
+	captureStdout(t, func() {
+		_, err = d.Run(newBlobOutputsOperation())
+	})
+	assert.EqualError(t, err, "running invocation instance using ACI failed: Error creating Azure Blob Container structure to upload outputs: Azure Blob Container outputs does not exist in Storage Account account")
+	assert.Empty(t, b.ContainerGroups)
+}
+
+func TestCollectOutputsInBlob(t *testing.T) {
+	settings := map[string]string{"CNAB_AZURE_DETACH": "true"}
+	for k, v := range blobSettings {
+		settings[k] = v
+	}
+	d, b, _ := newFakeDriver(t, settings)
+	container := fake.NewBlobContainer("outputs")
+	newBlobContainer := func(accountName string, accountKey string, containerName string) (blobContainer, error) {
+		return container, nil
+	}
+	d.newBlobContainer = newBlobContainer
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		container.UploadBlob("helloworld/test/outputs/output1", []byte("OUTPUT_1"))
+		return fake.ContainerRun{{State: "Succeeded"}}
+	}
+	var err error
+	captureStdout(t, func() {
+		_, err = d.Run(newBlobOutputsOperation())
+	})
+	assert.NoErrorf(t, err, "Expected no error running detached operation. Got: %v", err)
+	assert.Equal(t, "outputs", d.operationRecord.StateBlobContainer)
+
+	// The collector is created in the same way as cnab-azure collect, only the calls to Azure are replaced
+	defer test.UnSetDriverEnvironmentVars(t)
+	for k, v := range blobSettings {
+		os.Setenv(k, v)
+	}
+	attacher, err := NewOperationAttacher("test-version")
+	if !assert.NoErrorf(t, err, "Expected no error creating operation attacher. Got: %v", err) {
+		return
+	}
+	collector := attacher.(*aciDriver)
+	assert.Equal(t, reflect.ValueOf(newAzureBlobContainer).Pointer(), reflect.ValueOf(collector.newBlobContainer).Pointer(), "Expected the attacher to create Azure Blob Containers")
+	collector.operationRecordDir = d.operationRecordDir
+	collector.login = d.login
+	collector.newBackend = func(authorizer autorest.Authorizer, userAgent string) az.Backend {
+		return b
+	}
+	collector.newBlobContainer = newBlobContainer
+	record, err := collector.GetOperationRecordByID(d.operationRecord.ID)
+	if !assert.NoErrorf(t, err, "Expected no error getting operation record. Got: %v", err) {
+		return
+	}
+	var result cnabdriver.OperationResult
+	captureStdout(t, func() {
+		result, err = collector.Collect(context.Background(), record)
+	})
+	assert.NoErrorf(t, err, "Expected no error collecting operation. Got: %v", err)
+	assert.Equal(t, map[string]string{"/cnab/app/outputs/output1": "OUTPUT_1"}, result.Outputs)
+	assert.Empty(t, container.Blobs())
+}
@@ -0,0 +1,167 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/cnabio/cnab-go/driver"
+	log "github.com/sirupsen/logrus"
+)
+
+// redactedValue replaces secret values in a Plan
+const redactedValue = "REDACTED"
+
+// Plan describes the Azure resources that the ACI driver would create to run an operation, values that would not be known until Azure is called are left empty
+type Plan struct {
+	// SubscriptionID is empty if the default subscription for the account would be used
+	SubscriptionID      string `json:"subscriptionId,omitempty"`
+	ResourceGroup       string `json:"resourceGroup"`
+	CreateResourceGroup bool   `json:"createResourceGroup"`
+	DeleteResources     bool   `json:"deleteResources"`
+	RetentionPolicy     string `json:"retentionPolicy"`
+	// Location is empty if the location of an existing Resource Group would be used
+	Location           string `json:"location,omitempty"`
+	ContainerGroupName string `json:"containerGroupName"`
+	SystemMSIRole      string `json:"systemMSIRole,omitempty"`
+	SystemMSIScope     string `json:"systemMSIScope,omitempty"`
+	// ContainerGroup is the container group that would be created with secure environment variables, registry passwords, storage account keys and file contents redacted
+	ContainerGroup containerinstance.ContainerGroup `json:"containerGroup"`
+}
+
+// Plan builds the container group that would be created to run the operation without logging in to or calling Azure
+func (d *aciDriver) Plan(op *driver.Operation) (*Plan, error) {
+	if err := d.prepareOperation(op); err != nil {
+		return nil, err
+	}
+
+	return d.plan(op)
+}
+
+func (d *aciDriver) plan(op *driver.Operation) (*Plan, error) {
+	image, domain, err := d.getImage(op)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := Plan{
+		SubscriptionID:      d.subscriptionID,
+		ResourceGroup:       d.aciRG,
+		CreateResourceGroup: d.createRG,
+		DeleteResources:     d.deleteACIResources,
+		RetentionPolicy:     d.retention().String(),
+		Location:            d.aciLocation,
+		ContainerGroupName:  d.aciName,
+	}
+
+	// The User MSI is not looked up in a plan so the configured resource ID is used as is
+	identity := &identityDetails{MSIType: "none"}
+	switch d.msiType {
+	case "system":
+		plan.SystemMSIRole = d.systemMSIRole
+		plan.SystemMSIScope = d.systemMSIScope
+		if len(plan.SystemMSIScope) == 0 {
+			subscriptionID := d.subscriptionID
+			if len(subscriptionID) == 0 {
+				subscriptionID = "<default subscription>"
+			}
+			plan.SystemMSIScope = fmt.Sprintf("/subscriptions/%s/resourcegroups/%s", subscriptionID, d.aciRG)
+		}
+		identity = systemAssignedIdentity(plan.SystemMSIScope, plan.SystemMSIRole)
+	case "user":
+		identity = userAssignedIdentity(d.userMSIResourceID)
+	}
+
+	containerGroup, err := d.buildContainerGroup(op, image, domain, identity, d.getTags(op, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.aciLocation) == 0 {
+		containerGroup.Location = nil
+	}
+
+	plan.ContainerGroup, err = redactContainerGroup(containerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Created plan for Container Group: ", d.aciName)
+	return &plan, nil
+}
+
+// Write writes the plan as indented JSON
+func (p *Plan) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(p); err != nil {
+		return fmt.Errorf("Failed to write plan: %v", err)
+	}
+	return nil
+}
+
+// redactContainerGroup returns a copy of the container group with any secret values replaced
+func redactContainerGroup(containerGroup containerinstance.ContainerGroup) (containerinstance.ContainerGroup, error) {
+	var redacted containerinstance.ContainerGroup
+	data, err := json.Marshal(containerGroup)
+	if err != nil {
+		return redacted, fmt.Errorf("Failed to copy Container Group: %v", err)
+	}
+	if err := json.Unmarshal(data, &redacted); err != nil {
+		return redacted, fmt.Errorf("Failed to copy Container Group: %v", err)
+	}
+
+	properties := redacted.ContainerGroupProperties
+	if properties == nil {
+		return redacted, nil
+	}
+
+	if properties.Containers != nil {
+		for _, container := range *properties.Containers {
+			if container.ContainerProperties == nil || container.EnvironmentVariables == nil {
+				continue
+			}
+			for i, ev := range *container.EnvironmentVariables {
+				if ev.SecureValue != nil {
+					(*container.EnvironmentVariables)[i].SecureValue = redact(*ev.SecureValue)
+				}
+			}
+		}
+	}
+
+	if properties.ImageRegistryCredentials != nil {
+		for i, credential := range *properties.ImageRegistryCredentials {
+			if credential.Password != nil {
+				(*properties.ImageRegistryCredentials)[i].Password = redact(*credential.Password)
+			}
+		}
+	}
+
+	if properties.Volumes != nil {
+		for _, volume := range *properties.Volumes {
+			if volume.AzureFile != nil && volume.AzureFile.StorageAccountKey != nil {
+				volume.AzureFile.StorageAccountKey = redact(*volume.AzureFile.StorageAccountKey)
+			}
+			// File paths are kept so that reviewers can see which files are created, the file contents may be secret
+			for k, v := range volume.Secret {
+				if strings.HasPrefix(k, "value") && v != nil {
+					volume.Secret[k] = redact(*v)
+				}
+			}
+		}
+	}
+
+	return redacted, nil
+}
+
+func redact(value string) *string {
+	if len(value) == 0 {
+		return &value
+	}
+	redacted := redactedValue
+	return &redacted
+}
@@ -0,0 +1,243 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/bundle/definition"
+	cnabdriver "github.com/cnabio/cnab-go/driver"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+)
+
+func TestPlan(t *testing.T) {
+	userMSIResourceID := "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/identities/providers/Microsoft.ManagedIdentity/userAssignedIdentities/test"
+	subnetID := "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci"
+	stateSettings := map[string]string{
+		"CNAB_AZURE_STATE_FILESHARE":            "share",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+		"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "accountkey",
+	}
+	testcases := []struct {
+		name        string
+		settings    map[string]string
+		setup       func(op *cnabdriver.Operation)
+		expectError string
+		check       func(t *testing.T, plan *Plan)
+	}{
+		{
+			name: "redacts secure environment variables",
+			check: func(t *testing.T, plan *Plan) {
+				assert.True(t, plan.CreateResourceGroup)
+				assert.True(t, plan.DeleteResources)
+				assert.Equal(t, fakeLocation, plan.Location)
+				assert.Equal(t, fakeLocation, to.String(plan.ContainerGroup.Location))
+				assert.Nil(t, plan.ContainerGroup.Identity)
+				container := getContainer(t, plan.ContainerGroup)
+				assert.Equal(t, "simongdavies/helloworld-aci-cnab@sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb", to.String(container.Image))
+				assert.Empty(t, to.StringSlice(container.Command))
+				assert.Equal(t, redactedValue, getSecureValue(container, "ENV1"))
+				tags := to.StringMap(plan.ContainerGroup.Tags)
+				assert.Equal(t, "install", tags["cnab-action"])
+				// The logged in identity is not known in a plan
+				assert.NotContains(t, tags, "cnab-created-by")
+			},
+		},
+		{
+			name:     "uses the location of an existing resource group",
+			settings: map[string]string{"CNAB_AZURE_RESOURCE_GROUP": "existing", "CNAB_AZURE_LOCATION": "", "CNAB_AZURE_SUBSCRIPTION_ID": fakeSubscriptionID},
+			check: func(t *testing.T, plan *Plan) {
+				assert.False(t, plan.CreateResourceGroup)
+				assert.Equal(t, "existing", plan.ResourceGroup)
+				assert.Equal(t, fakeSubscriptionID, plan.SubscriptionID)
+				assert.Empty(t, plan.Location)
+				assert.Nil(t, plan.ContainerGroup.Location)
+			},
+		},
+		{
+			name: "keeps file paths and redacts file contents",
+			setup: func(op *cnabdriver.Operation) {
+				op.Files = map[string]string{"/cnab/app/secret.txt": "secret"}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				volumes := *plan.ContainerGroup.Volumes
+				if assert.Len(t, volumes, 1) {
+					assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("/cnab/app/secret.txt")), to.String(volumes[0].Secret["path0"]))
+					assert.Equal(t, redactedValue, to.String(volumes[0].Secret["value0"]))
+				}
+				container := getContainer(t, plan.ContainerGroup)
+				command := to.StringSlice(container.Command)
+				if assert.Len(t, command, 4) {
+					assert.True(t, strings.HasSuffix(command[3], "/cnab/app/run"), "Expected the script to run /cnab/app/run. Got: %s", command[3])
+				}
+			},
+		},
+		{
+			name:     "redacts the state storage account key",
+			settings: stateSettings,
+			setup: func(op *cnabdriver.Operation) {
+				op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+				op.Bundle.Outputs = map[string]bundle.Output{"output1": {Definition: "output1", Path: "/cnab/app/outputs/output1"}}
+				op.Bundle.Definitions = definition.Definitions{"output1": &definition.Schema{Type: "string"}}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				volumes := *plan.ContainerGroup.Volumes
+				if assert.Len(t, volumes, 1) && assert.NotNil(t, volumes[0].AzureFile) {
+					assert.Equal(t, "account", to.String(volumes[0].AzureFile.StorageAccountName))
+					assert.Equal(t, redactedValue, to.String(volumes[0].AzureFile.StorageAccountKey))
+				}
+				container := getContainer(t, plan.ContainerGroup)
+				assert.Equal(t, "/cnab/state/helloworld/test", getValue(container, "STATE_PATH"))
+			},
+		},
+		{
+			name:     "redacts the registry password",
+			settings: map[string]string{"CNAB_AZURE_REGISTRY_USERNAME": "user", "CNAB_AZURE_REGISTRY_PASSWORD": "registrypassword"},
+			check: func(t *testing.T, plan *Plan) {
+				credentials := *plan.ContainerGroup.ImageRegistryCredentials
+				if assert.Len(t, credentials, 1) {
+					assert.Equal(t, "user", to.String(credentials[0].Username))
+					assert.Equal(t, "docker.io", to.String(credentials[0].Server))
+					assert.Equal(t, redactedValue, to.String(credentials[0].Password))
+				}
+			},
+		},
+		{
+			name:     "includes the system MSI role and scope",
+			settings: map[string]string{"CNAB_AZURE_MSI_TYPE": "system", "CNAB_AZURE_SUBSCRIPTION_ID": ""},
+			check: func(t *testing.T, plan *Plan) {
+				assert.Equal(t, "Contributor", plan.SystemMSIRole)
+				assert.Equal(t, "/subscriptions/<default subscription>/resourcegroups/"+plan.ResourceGroup, plan.SystemMSIScope)
+				if assert.NotNil(t, plan.ContainerGroup.Identity) {
+					assert.Equal(t, containerinstance.ResourceIdentityTypeSystemAssigned, plan.ContainerGroup.Identity.Type)
+				}
+			},
+		},
+		{
+			name:     "uses the user MSI resource ID without looking it up",
+			settings: map[string]string{"CNAB_AZURE_MSI_TYPE": "user", "CNAB_AZURE_USER_MSI_RESOURCE_ID": userMSIResourceID},
+			check: func(t *testing.T, plan *Plan) {
+				if assert.NotNil(t, plan.ContainerGroup.Identity) {
+					assert.Equal(t, containerinstance.ResourceIdentityTypeUserAssigned, plan.ContainerGroup.Identity.Type)
+					assert.Contains(t, plan.ContainerGroup.Identity.UserAssignedIdentities, userMSIResourceID)
+				}
+			},
+		},
+		{
+			name:     "includes the subnet without looking it up",
+			settings: map[string]string{"CNAB_AZURE_SUBNET_ID": subnetID, "CNAB_AZURE_DNS_NAME_SERVERS": "10.0.0.4"},
+			check: func(t *testing.T, plan *Plan) {
+				assert.Equal(t, &[]containerinstance.ContainerGroupSubnetID{{ID: to.StringPtr(subnetID)}}, plan.ContainerGroup.SubnetIds)
+				if assert.NotNil(t, plan.ContainerGroup.DNSConfig) {
+					assert.Equal(t, []string{"10.0.0.4"}, to.StringSlice(plan.ContainerGroup.DNSConfig.NameServers))
+				}
+			},
+		},
+		{
+			name: "reads outputs from the container logs if there is no state volume",
+			setup: func(op *cnabdriver.Operation) {
+				op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				assert.Nil(t, plan.ContainerGroup.Volumes, "Expected no state volume to be mounted")
+				container := getContainer(t, plan.ContainerGroup)
+				command := to.StringSlice(container.Command)
+				if assert.Len(t, command, 4) {
+					assert.True(t, strings.HasPrefix(command[3], "mkdir -p /cnab/app/outputs;/cnab/app/run && rc=0 || rc=$?;"), "Expected the script to write the outputs to the logs. Got: %s", command[3])
+				}
+			},
+		},
+		{
+			name:     "fails if outputs are read from the state volume and there is no state volume",
+			settings: map[string]string{"CNAB_AZURE_OUTPUT_TRANSPORT": "fileshare"},
+			setup: func(op *cnabdriver.Operation) {
+				op.Outputs = map[string]string{"/cnab/app/outputs/output1": "output1"}
+			},
+			expectError: "Bundle has outputs no volume mounted for state",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]string{"CNAB_AZURE_LOCATION": fakeLocation}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			d, backend, _ := newFakeDriver(t, settings)
+			d.login = func(clientID string, clientSecret string, tenantID string, applicationID string) (az.LoginInfo, error) {
+				return az.LoginInfo{}, errors.New("login should not be called when creating a plan")
+			}
+			op := newFakeOperation()
+			if tc.setup != nil {
+				tc.setup(op)
+			}
+
+			plan, err := d.Plan(op)
+			if len(tc.expectError) > 0 {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.expectError)
+				}
+				return
+			}
+
+			if !assert.NoErrorf(t, err, "Expected no error creating plan. Got: %v", err) {
+				return
+			}
+			assert.Equal(t, d.aciName, plan.ContainerGroupName)
+			assert.Empty(t, backend.ContainerGroups)
+			assert.Empty(t, backend.RoleAssignments)
+			tc.check(t, plan)
+
+			var buffer bytes.Buffer
+			err = plan.Write(&buffer)
+			assert.NoErrorf(t, err, "Expected no error writing plan. Got: %v", err)
+			assert.NotContains(t, buffer.String(), "value1")
+			assert.NotContains(t, buffer.String(), "registrypassword")
+			assert.NotContains(t, buffer.String(), "accountkey")
+			var written map[string]interface{}
+			assert.NoError(t, json.Unmarshal(buffer.Bytes(), &written))
+		})
+	}
+}
+
+func TestRunWithDryRun(t *testing.T) {
+	d, backend, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_LOCATION": fakeLocation, "CNAB_AZURE_DRY_RUN": "true"})
+	loggedIn := false
+	d.login = func(clientID string, clientSecret string, tenantID string, applicationID string) (az.LoginInfo, error) {
+		loggedIn = true
+		return az.LoginInfo{}, nil
+	}
+
+	result, err := d.Run(newFakeOperation())
+	assert.NoErrorf(t, err, "Expected no error running dry run. Got: %v", err)
+	assert.Empty(t, result.Outputs)
+	assert.False(t, loggedIn, "Expected dry run not to login to Azure")
+	assert.Empty(t, backend.ResourceGroups)
+	assert.Empty(t, backend.ContainerGroups)
+}
+
+func getValue(container containerinstance.Container, name string) string {
+	for _, ev := range *container.EnvironmentVariables {
+		if to.String(ev.Name) == name {
+			return to.String(ev.Value)
+		}
+	}
+	return ""
+}
+
+func getSecureValue(container containerinstance.Container, name string) string {
+	for _, ev := range *container.EnvironmentVariables {
+		if to.String(ev.Name) == name {
+			return to.String(ev.SecureValue)
+		}
+	}
+	return ""
+}
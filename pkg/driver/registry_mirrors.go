@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// defaultBootstrapImage is the image of the container group that is created to set up a system assigned identity before the invocation image is run
+const defaultBootstrapImage = "alpine:latest"
+
+// registryMirror replaces the registry, and optionally a path in it, that images are pulled from with a mirror
+type registryMirror struct {
+	// source is a registry domain optionally followed by a path, images whose normalized name is in the source are pulled from the mirror
+	source string
+	mirror string
+}
+
+// registryMirrors are ordered with the most specific source first so that a rule for docker.io/library is used before a rule for docker.io
+type registryMirrors []registryMirror
+
+// parseRegistryMirrors parses the value of CNAB_AZURE_REGISTRY_MIRRORS, a comma separated list of source=mirror rules
+func parseRegistryMirrors(value string) (registryMirrors, error) {
+	var mirrors registryMirrors
+	for _, rule := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(rule)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("value (%s) of CNAB_AZURE_REGISTRY_MIRRORS should be a comma separated list of registry=mirror rules", value)
+		}
+		source, err := normalizeMirrorPath(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("registry %s in CNAB_AZURE_REGISTRY_MIRRORS is not valid: %v", strings.TrimSpace(parts[0]), err)
+		}
+		mirror, err := normalizeMirrorPath(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s in CNAB_AZURE_REGISTRY_MIRRORS is not valid: %v", strings.TrimSpace(parts[1]), err)
+		}
+		mirrors = append(mirrors, registryMirror{source: source, mirror: mirror})
+	}
+
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		return len(mirrors[i].source) > len(mirrors[j].source)
+	})
+	return mirrors, nil
+}
+
+// normalizeMirrorPath checks that a registry domain and path can be the start of an image name, the Docker Hub aliases are replaced with docker.io
+// so that they match normalized image names
+func normalizeMirrorPath(value string) (string, error) {
+	value = strings.Trim(strings.TrimSpace(value), "/")
+	if len(value) == 0 {
+		return "", fmt.Errorf("registry is empty")
+	}
+	parts := strings.SplitN(value, "/", 2)
+	parts[0] = strings.ToLower(parts[0])
+	switch parts[0] {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		parts[0] = "docker.io"
+	}
+	value = strings.Join(parts, "/")
+
+	// The domain is only recognised as a registry if the name has a path after it
+	named, err := reference.ParseNormalizedNamed(value + "/image")
+	if err != nil {
+		return "", err
+	}
+	if reference.Domain(named) != parts[0] {
+		return "", fmt.Errorf("%s is not a registry domain", parts[0])
+	}
+	return value, nil
+}
+
+// apply gets the reference to pull an image with, the tag and digest of the image are kept
+func (m registryMirrors) apply(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse image reference: %s error: %v", image, err)
+	}
+
+	name := named.Name()
+	for _, rule := range m {
+		if name != rule.source && !strings.HasPrefix(name, rule.source+"/") {
+			continue
+		}
+		// The tag and digest follow the name in the string form of the reference
+		mirrored := rule.mirror + strings.TrimPrefix(named.String(), rule.source)
+		mirroredNamed, err := reference.ParseNormalizedNamed(mirrored)
+		if err != nil {
+			return "", fmt.Errorf("Image %s cannot be pulled from mirror %s: %v", image, rule.mirror, err)
+		}
+		return reference.FamiliarString(mirroredNamed), nil
+	}
+	return image, nil
+}
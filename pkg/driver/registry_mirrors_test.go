@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	mirrors, err := parseRegistryMirrors("")
+	assert.NoError(t, err)
+	assert.Empty(t, mirrors)
+
+	mirrors, err = parseRegistryMirrors(" index.docker.io = MyMirror.azurecr.io/dockerhub/ ,docker.io/library=mymirror.azurecr.io/library,,ghcr.io=mymirror.azurecr.io/ghcr")
+	assert.NoError(t, err)
+	assert.Equal(t, registryMirrors{
+		{source: "docker.io/library", mirror: "mymirror.azurecr.io/library"},
+		{source: "docker.io", mirror: "mymirror.azurecr.io/dockerhub"},
+		{source: "ghcr.io", mirror: "mymirror.azurecr.io/ghcr"},
+	}, mirrors, "Expected the most specific rules first")
+
+	testcases := []struct {
+		value       string
+		expectError string
+	}{
+		{value: "docker.io", expectError: "value (docker.io) of CNAB_AZURE_REGISTRY_MIRRORS should be a comma separated list of registry=mirror rules"},
+		{value: "=mymirror.azurecr.io", expectError: "registry  in CNAB_AZURE_REGISTRY_MIRRORS is not valid: registry is empty"},
+		{value: "docker.io=", expectError: "mirror  in CNAB_AZURE_REGISTRY_MIRRORS is not valid: registry is empty"},
+		{value: "docker.io=mirror", expectError: "mirror mirror in CNAB_AZURE_REGISTRY_MIRRORS is not valid: mirror is not a registry domain"},
+		{value: "docker.io=mymirror.azurecr.io/Hub", expectError: "mirror mymirror.azurecr.io/Hub in CNAB_AZURE_REGISTRY_MIRRORS is not valid: invalid reference format: repository name must be lowercase"},
+		{value: "docker.io=my_mirror.azurecr.io", expectError: "mirror my_mirror.azurecr.io in CNAB_AZURE_REGISTRY_MIRRORS is not valid: my_mirror.azurecr.io is not a registry domain"},
+	}
+	for _, tc := range testcases {
+		_, err := parseRegistryMirrors(tc.value)
+		assert.EqualError(t, err, tc.expectError)
+	}
+}
+
+func TestRegistryMirrorsApply(t *testing.T) {
+	const digest = "sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb"
+	mirrors, err := parseRegistryMirrors("docker.io=mymirror.azurecr.io/dockerhub,docker.io/library/busybox=tools.azurecr.io/busybox,myreg.local:5000=mymirror.azurecr.io")
+	if !assert.NoError(t, err) {
+		return
+	}
+	testcases := []struct {
+		image    string
+		expected string
+	}{
+		{image: "alpine:latest", expected: "mymirror.azurecr.io/dockerhub/library/alpine:latest"},
+		{image: "simongdavies/helloworld-aci-cnab@" + digest, expected: "mymirror.azurecr.io/dockerhub/simongdavies/helloworld-aci-cnab@" + digest},
+		{image: "docker.io/library/nginx:1.25", expected: "mymirror.azurecr.io/dockerhub/library/nginx:1.25"},
+		{image: "busybox:1.36-musl", expected: "tools.azurecr.io/busybox:1.36-musl"},
+		{image: "busybox-extras:1.0", expected: "mymirror.azurecr.io/dockerhub/library/busybox-extras:1.0"},
+		{image: "myreg.local:5000/team/app:1.0@" + digest, expected: "mymirror.azurecr.io/team/app:1.0@" + digest},
+		{image: "myreg.local/team/app:1.0", expected: "myreg.local/team/app:1.0"},
+		{image: "myregistry.azurecr.io/app:1.0", expected: "myregistry.azurecr.io/app:1.0"},
+	}
+	for _, tc := range testcases {
+		image, err := mirrors.apply(tc.image)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, image, "Unexpected mirrored image for %s", tc.image)
+	}
+}
+
+func TestRunWithFakeBackendRegistryMirrors(t *testing.T) {
+	testcases := []struct {
+		name                   string
+		settings               map[string]string
+		expectedBootstrapImage string
+		expectedInitImage      string
+	}{
+		{
+			name:                   "mirrors are applied to the default images",
+			expectedBootstrapImage: "mymirror.azurecr.io/dockerhub/library/alpine:latest",
+			expectedInitImage:      "mymirror.azurecr.io/dockerhub/library/busybox:1.36-musl",
+		},
+		{
+			name:                   "images can be set",
+			settings:               map[string]string{"CNAB_AZURE_BOOTSTRAP_IMAGE": "private.azurecr.io/alpine:3.18", "CNAB_AZURE_INIT_CONTAINER_IMAGE": "busybox:1.35-musl"},
+			expectedBootstrapImage: "private.azurecr.io/alpine:3.18",
+			expectedInitImage:      "mymirror.azurecr.io/dockerhub/library/busybox:1.35-musl",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]string{
+				"CNAB_AZURE_REGISTRY_MIRRORS":  "docker.io=mymirror.azurecr.io/dockerhub",
+				"CNAB_AZURE_REGISTRY_USERNAME": "user",
+				"CNAB_AZURE_REGISTRY_PASSWORD": "password",
+				"CNAB_AZURE_MSI_TYPE":          "system",
+				"CNAB_AZURE_FILE_INJECTION":    "init-container",
+			}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			d, b, _ := newFakeDriver(t, settings)
+			var created []containerinstance.ContainerGroup
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				created = append(created, cg)
+				return nil
+			}
+			op := newFakeOperation()
+			op.Files = map[string]string{"/cnab/app/image-map.json": "{}"}
+
+			var err error
+			captureStdout(t, func() {
+				_, err = d.Run(op)
+			})
+			assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+			if !assert.Len(t, created, 2) {
+				return
+			}
+
+			credentials := []containerinstance.ImageRegistryCredential{{Username: to.StringPtr("user"), Password: to.StringPtr("password"), Server: to.StringPtr("mymirror.azurecr.io")}}
+			bootstrap := created[0]
+			assert.Equal(t, tc.expectedBootstrapImage, to.String(getContainer(t, bootstrap).Image))
+			assert.Equal(t, credentials, *bootstrap.ImageRegistryCredentials)
+
+			cg := created[1]
+			assert.Equal(t, "mymirror.azurecr.io/dockerhub/simongdavies/helloworld-aci-cnab@sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb", to.String(getContainer(t, cg).Image))
+			assert.Equal(t, credentials, *cg.ImageRegistryCredentials)
+			if assert.NotNil(t, cg.InitContainers) && assert.Len(t, *cg.InitContainers, 1) {
+				assert.Equal(t, tc.expectedInitImage, to.String((*cg.InitContainers)[0].Image))
+			}
+		})
+	}
+}
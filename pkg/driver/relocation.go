@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/driver"
+	"github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+)
+
+// relocationMappingPath is where the CNAB spec places the relocation mapping in the invocation image, tools that relocate bundles pass it as a file input
+const relocationMappingPath = "/cnab/app/relocation-mapping.json"
+
+// relocationMapping maps the original references of the images in a bundle to the references they were relocated to
+type relocationMapping map[string]string
+
+// parseRelocationMapping parses a relocation mapping, source identifies where it came from in errors
+func parseRelocationMapping(data []byte, source string) (relocationMapping, error) {
+	var mapping relocationMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("Error parsing relocation mapping %s: %v", source, err)
+	}
+	for original, relocated := range mapping {
+		if _, err := reference.ParseNormalizedNamed(relocated); err != nil {
+			return nil, fmt.Errorf("Error parsing relocation mapping %s: image %s is relocated to an invalid reference %s: %v", source, original, relocated, err)
+		}
+	}
+	return mapping, nil
+}
+
+// readRelocationMapping reads the relocation mapping file set in CNAB_AZURE_RELOCATION_MAPPING
+func readRelocationMapping(fileName string) (relocationMapping, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading relocation mapping: %v", err)
+	}
+	return parseRelocationMapping(data, fileName)
+}
+
+// relocate gets the relocated reference of an image, the original references in the mapping are compared in their normalized form so that
+// docker.io/library/nginx:1.0 matches nginx:1.0
+func (m relocationMapping) relocate(img bundle.InvocationImage) (string, bool) {
+	candidates := []string{img.Image}
+	if len(img.Digest) > 0 {
+		candidates = append(candidates, img.Image+"@"+img.Digest)
+	}
+	for _, candidate := range candidates {
+		if relocated, ok := m[candidate]; ok {
+			return relocated, true
+		}
+	}
+
+	for _, candidate := range candidates {
+		named, err := reference.ParseNormalizedNamed(candidate)
+		if err != nil {
+			continue
+		}
+		for original, relocated := range m {
+			if originalNamed, err := reference.ParseNormalizedNamed(original); err == nil && originalNamed.String() == named.String() {
+				return relocated, true
+			}
+		}
+	}
+	return "", false
+}
+
+// relocateImage rewrites the invocation image using the relocation mapping passed with the operation and the one set in CNAB_AZURE_RELOCATION_MAPPING,
+// the configured mapping takes precedence
+func (d *aciDriver) relocateImage(op *driver.Operation) (bundle.InvocationImage, error) {
+	img := op.Image
+	mappings := []relocationMapping{d.relocationMapping}
+	if data, ok := op.Files[relocationMappingPath]; ok {
+		mapping, err := parseRelocationMapping([]byte(data), relocationMappingPath)
+		if err != nil {
+			return img, err
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	for _, mapping := range mappings {
+		if relocated, ok := mapping.relocate(img); ok {
+			log.Debugf("Invocation image %s is relocated to %s", img.Image, relocated)
+			img.Image = relocated
+			return img, nil
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestRelocationMappingRelocate(t *testing.T) {
+	const digest = "sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb"
+	mapping := relocationMapping{
+		"simongdavies/helloworld-aci-cnab":          "myacr.azurecr.io/helloworld-aci-cnab",
+		"docker.io/library/nginx:1.25":              "myacr.azurecr.io/library/nginx:1.25",
+		"myreg.local:5000/app@" + digest:            "myacr.azurecr.io/app@" + digest,
+		"registry.example.com/team/tool:2.0":        "myacr.azurecr.io/team/tool:2.0",
+		"registry.example.com/team/tool:2.0-ignore": "myacr.azurecr.io/ignore",
+	}
+	testcases := []struct {
+		name     string
+		image    bundle.InvocationImage
+		expected string
+	}{
+		{name: "exact match", image: bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: "simongdavies/helloworld-aci-cnab", Digest: digest}}, expected: "myacr.azurecr.io/helloworld-aci-cnab"},
+		{name: "normalized match", image: bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: "nginx:1.25"}}, expected: "myacr.azurecr.io/library/nginx:1.25"},
+		{name: "match with digest", image: bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: "myreg.local:5000/app", Digest: digest}}, expected: "myacr.azurecr.io/app@" + digest},
+		{name: "registry with path", image: bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: "registry.example.com/team/tool:2.0"}}, expected: "myacr.azurecr.io/team/tool:2.0"},
+		{name: "different tag", image: bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: "registry.example.com/team/tool:3.0"}}},
+		{name: "not in mapping", image: bundle.InvocationImage{BaseImage: bundle.BaseImage{Image: "other/image"}}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			relocated, ok := mapping.relocate(tc.image)
+			assert.Equal(t, len(tc.expected) > 0, ok)
+			assert.Equal(t, tc.expected, relocated)
+		})
+	}
+}
+
+func TestParseRelocationMapping(t *testing.T) {
+	_, err := parseRelocationMapping([]byte("[]"), "mapping.json")
+	assert.EqualError(t, err, "Error parsing relocation mapping mapping.json: json: cannot unmarshal array into Go value of type driver.relocationMapping")
+	_, err = parseRelocationMapping([]byte(`{"app:1.0": "myacr.azurecr.io/App:1.0"}`), "mapping.json")
+	assert.EqualError(t, err, "Error parsing relocation mapping mapping.json: image app:1.0 is relocated to an invalid reference myacr.azurecr.io/App:1.0: invalid reference format: repository name must be lowercase")
+	_, err = readRelocationMapping(filepath.Join("testdata", "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestRunWithFakeBackendRelocation(t *testing.T) {
+	const digest = "sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb"
+	dir, err := ioutil.TempDir("", "relocation")
+	assert.NoError(t, err, "Error creating relocation mapping directory")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	mappingFile := filepath.Join(dir, "relocation-mapping.json")
+	err = ioutil.WriteFile(mappingFile, []byte(`{"simongdavies/helloworld-aci-cnab": "configured.azurecr.io/helloworld-aci-cnab"}`), 0600)
+	assert.NoError(t, err)
+
+	testcases := []struct {
+		name           string
+		settings       map[string]string
+		files          map[string]string
+		expectedImage  string
+		expectedServer string
+	}{
+		{
+			name:           "image is not relocated without a mapping",
+			expectedImage:  "simongdavies/helloworld-aci-cnab@" + digest,
+			expectedServer: "docker.io",
+		},
+		{
+			name:           "mapping from the operation",
+			files:          map[string]string{relocationMappingPath: `{"docker.io/simongdavies/helloworld-aci-cnab": "airgap.azurecr.io/cnab/helloworld-aci-cnab:v1"}`},
+			expectedImage:  "airgap.azurecr.io/cnab/helloworld-aci-cnab@" + digest,
+			expectedServer: "airgap.azurecr.io",
+		},
+		{
+			name:           "mapping from CNAB_AZURE_RELOCATION_MAPPING takes precedence",
+			settings:       map[string]string{"CNAB_AZURE_RELOCATION_MAPPING": mappingFile},
+			files:          map[string]string{relocationMappingPath: `{"docker.io/simongdavies/helloworld-aci-cnab": "airgap.azurecr.io/cnab/helloworld-aci-cnab:v1"}`},
+			expectedImage:  "configured.azurecr.io/helloworld-aci-cnab@" + digest,
+			expectedServer: "configured.azurecr.io",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]string{
+				"CNAB_AZURE_DELETE_RESOURCES":  "false",
+				"CNAB_AZURE_REGISTRY_USERNAME": "user",
+				"CNAB_AZURE_REGISTRY_PASSWORD": "password",
+			}
+			for k, v := range tc.settings {
+				settings[k] = v
+			}
+			d, b, _ := newFakeDriver(t, settings)
+			op := newFakeOperation()
+			op.Files = tc.files
+
+			var err error
+			captureStdout(t, func() {
+				_, err = d.Run(op)
+			})
+			assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+
+			cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+			assert.Equal(t, tc.expectedImage, to.String(getContainer(t, cg).Image))
+			if assert.Len(t, *cg.ImageRegistryCredentials, 1) {
+				assert.Equal(t, tc.expectedServer, to.String((*cg.ImageRegistryCredentials)[0].Server))
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// retentionAlways deletes the resources created by the driver when the operation completes
+	retentionAlways = "always"
+	// retentionNever keeps the resources created by the driver, this is the same as setting CNAB_AZURE_DELETE_RESOURCES to false
+	retentionNever = "never"
+	// retentionOnSuccess deletes the resources created by the driver if the operation succeeds and keeps them if it fails,
+	// on-success:<duration> keeps them for the duration after which they are deleted by cnab-azure gc
+	retentionOnSuccess = "on-success"
+)
+
+// retentionPolicy controls which of the resources created by the driver are deleted when the operation completes
+type retentionPolicy struct {
+	deleteResources bool
+	keepOnFailure   bool
+	// ttl is how long resources are kept after a failure, if it is zero they are kept until they are old enough to be deleted by cnab-azure gc
+	ttl time.Duration
+}
+
+// parseRetentionPolicy parses the value of CNAB_AZURE_RETENTION_POLICY
+func parseRetentionPolicy(value string) (retentionPolicy, error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(value)), ":", 2)
+	var policy retentionPolicy
+	switch parts[0] {
+	case retentionAlways:
+		policy.deleteResources = true
+	case retentionNever:
+	case retentionOnSuccess:
+		policy.deleteResources = true
+		policy.keepOnFailure = true
+	default:
+		return policy, fmt.Errorf("value (%s) of CNAB_AZURE_RETENTION_POLICY should be %s, %s, %s or %s:<duration>", value, retentionAlways, retentionNever, retentionOnSuccess, retentionOnSuccess)
+	}
+
+	if len(parts) == 2 {
+		if !policy.keepOnFailure {
+			return policy, fmt.Errorf("value (%s) of CNAB_AZURE_RETENTION_POLICY is invalid, a duration can only be set for the %s policy", value, retentionOnSuccess)
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return policy, fmt.Errorf("value (%s) of CNAB_AZURE_RETENTION_POLICY has an invalid duration: %v", value, err)
+		}
+		if ttl <= 0 {
+			return policy, fmt.Errorf("value (%s) of CNAB_AZURE_RETENTION_POLICY should have a positive duration", value)
+		}
+		policy.ttl = ttl
+	}
+
+	return policy, nil
+}
+
+// String formats the policy in the same way as CNAB_AZURE_RETENTION_POLICY
+func (p retentionPolicy) String() string {
+	switch {
+	case !p.deleteResources:
+		return retentionNever
+	case p.keepOnFailure && p.ttl > 0:
+		return fmt.Sprintf("%s:%s", retentionOnSuccess, p.ttl)
+	case p.keepOnFailure:
+		return retentionOnSuccess
+	default:
+		return retentionAlways
+	}
+}
+
+// retention gets the retention policy that the driver is using
+func (d *aciDriver) retention() retentionPolicy {
+	return retentionPolicy{
+		deleteResources: d.deleteACIResources,
+		keepOnFailure:   d.keepOnFailure,
+		ttl:             d.retentionTTL,
+	}
+}
+
+func (d *aciDriver) setRetentionPolicy(policy retentionPolicy) {
+	d.deleteACIResources = policy.deleteResources
+	d.keepOnFailure = policy.keepOnFailure
+	d.retentionTTL = policy.ttl
+}
+
+// retainFailedResources keeps the container group and the resource group created by the driver if the operation failed with opErr and the
+// retention policy keeps failures. The time they were kept and the time they can be deleted are added to their tags for cnab-azure gc.
+func (d *aciDriver) retainFailedResources(opErr error) {
+	if opErr == nil || !d.deleteACIResources || !d.keepOnFailure {
+		return
+	}
+
+	d.retained = true
+	now := time.Now().UTC()
+	retentionTags := map[string]string{tagRetainedAt: now.Format(time.RFC3339)}
+	until := "until they are deleted by cnab-azure gc"
+	if d.retentionTTL > 0 {
+		retainUntil := now.Add(d.retentionTTL).Format(time.RFC3339)
+		retentionTags[tagRetainUntil] = retainUntil
+		until = fmt.Sprintf("until %s after which they are deleted by cnab-azure gc", retainUntil)
+	}
+
+	// The operation context may have been cancelled so use a new context
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := d.tagContainerGroup(ctx, retentionTags); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add retention tags to container group %s error: %v\n", d.aciName, err)
+	}
+	if d.createRG {
+		if err := d.tagResourceGroup(ctx, retentionTags); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add retention tags to resource group %s error: %v\n", d.aciRG, err)
+		}
+	}
+
+	fmt.Printf("Operation failed, keeping Container Group %s in Resource Group %s %s\n", d.aciName, d.aciRG, until)
+}
+
+func (d *aciDriver) tagContainerGroup(ctx context.Context, retentionTags map[string]string) error {
+	containerGroup, err := d.backend.GetContainerGroup(ctx, d.subscriptionID, d.aciRG, d.aciName)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.backend.UpdateContainerGroupTags(ctx, d.subscriptionID, d.aciRG, d.aciName, mergeTags(containerGroup.Tags, retentionTags))
+	return err
+}
+
+func (d *aciDriver) tagResourceGroup(ctx context.Context, retentionTags map[string]string) error {
+	group, err := d.backend.GetResourceGroup(ctx, d.subscriptionID, d.aciRG)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.backend.UpdateResourceGroupTags(ctx, d.subscriptionID, d.aciRG, mergeTags(group.Tags, retentionTags))
+	return err
+}
+
+// mergeTags adds tags to the existing tags of a resource, the tags of a resource are replaced when they are updated
+func mergeTags(existing map[string]*string, tags map[string]string) map[string]*string {
+	merged := make(map[string]*string, len(existing)+len(tags))
+	for name, value := range existing {
+		merged[name] = value
+	}
+	for name, value := range tags {
+		merged[name] = to.StringPtr(value)
+	}
+	return merged
+}
+
+// retainUntil gets the time that a resource kept after a failure can be deleted from its tags
+func retainUntil(tags map[string]*string) time.Time {
+	return timeTag(tags, tagRetainUntil)
+}
+
+// retainedAt gets the time that a resource was kept after a failure from its tags
+func retainedAt(tags map[string]*string) time.Time {
+	return timeTag(tags, tagRetainedAt)
+}
+
+// retentionPolicyTag gets the retention policy that a resource was created with from its tags, resources created before the driver added the tag
+// do not have a policy
+func retentionPolicyTag(tags map[string]*string) (retentionPolicy, bool) {
+	value, ok := tags[tagRetentionPolicy]
+	if !ok || value == nil {
+		return retentionPolicy{}, false
+	}
+	policy, err := parseRetentionPolicy(*value)
+	if err != nil {
+		log.Debugf("Ignoring invalid %s tag %s: %v", tagRetentionPolicy, *value, err)
+		return retentionPolicy{}, false
+	}
+	return policy, true
+}
+
+// timeTag gets a time that is stored in a tag in RFC3339 format, the time is zero if the tag is not set or is invalid
+func timeTag(tags map[string]*string, name string) time.Time {
+	value, ok := tags[name]
+	if !ok || value == nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		log.Debugf("Ignoring invalid %s tag %s: %v", name, *value, err)
+		return time.Time{}
+	}
+	return t
+}
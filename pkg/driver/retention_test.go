@@ -0,0 +1,219 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	testcases := []struct {
+		value       string
+		expected    retentionPolicy
+		expectError string
+	}{
+		{value: "always", expected: retentionPolicy{deleteResources: true}},
+		{value: "never", expected: retentionPolicy{}},
+		{value: "On-Success", expected: retentionPolicy{deleteResources: true, keepOnFailure: true}},
+		{value: "on-success:24h", expected: retentionPolicy{deleteResources: true, keepOnFailure: true, ttl: 24 * time.Hour}},
+		{value: "sometimes", expectError: "value (sometimes) of CNAB_AZURE_RETENTION_POLICY should be always, never, on-success or on-success:<duration>"},
+		{value: "never:1h", expectError: "value (never:1h) of CNAB_AZURE_RETENTION_POLICY is invalid, a duration can only be set for the on-success policy"},
+		{value: "on-success:1 day", expectError: `value (on-success:1 day) of CNAB_AZURE_RETENTION_POLICY has an invalid duration: time: unknown unit " day" in duration "1 day"`},
+		{value: "on-success:0s", expectError: "value (on-success:0s) of CNAB_AZURE_RETENTION_POLICY should have a positive duration"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.value, func(t *testing.T) {
+			policy, err := parseRetentionPolicy(tc.value)
+			if len(tc.expectError) > 0 {
+				assert.EqualError(t, err, tc.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, policy)
+			formatted, err := parseRetentionPolicy(policy.String())
+			assert.NoError(t, err)
+			assert.Equal(t, policy, formatted, "Expected the formatted policy to be parsed as the same policy")
+		})
+	}
+}
+
+func TestRetentionPolicyConfiguration(t *testing.T) {
+	d, _, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"})
+	assert.Equal(t, "never", d.retention().String())
+
+	d, _, _ = newFakeDriver(t, map[string]string{"CNAB_AZURE_RETENTION_POLICY": "on-success:2h"})
+	assert.Equal(t, "on-success:2h0m0s", d.retention().String())
+
+	config := map[string]string{
+		"CNAB_AZURE_LOCATION":         fakeLocation,
+		"CNAB_AZURE_DELETE_RESOURCES": "true",
+		"CNAB_AZURE_RETENTION_POLICY": "on-success",
+	}
+	assert.EqualError(t, d.processConfiguration(config), "CNAB_AZURE_DELETE_RESOURCES should not be set when CNAB_AZURE_RETENTION_POLICY is set")
+}
+
+func TestRunWithFakeBackendRetentionPolicy(t *testing.T) {
+	failed := fake.ContainerRun{{State: "Running"}, {State: "Failed", ExitCode: to.Int32Ptr(1)}}
+	succeeded := fake.ContainerRun{{State: "Running"}, {State: "Succeeded"}}
+	testcases := []struct {
+		name              string
+		policy            string
+		run               fake.ContainerRun
+		expectDeleted     bool
+		expectRetainUntil bool
+	}{
+		{name: "always deletes a failed operation", policy: "always", run: failed, expectDeleted: true},
+		{name: "on-success deletes a successful operation", policy: "on-success:1h", run: succeeded, expectDeleted: true},
+		{name: "on-success keeps a failed operation", policy: "on-success", run: failed},
+		{name: "on-success with a duration keeps a failed operation until it expires", policy: "on-success:1h", run: failed, expectRetainUntil: true},
+		{name: "never keeps a successful operation", policy: "never", run: succeeded},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_RETENTION_POLICY": tc.policy})
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				return tc.run
+			}
+			start := time.Now().UTC().Truncate(time.Second)
+			captureStdout(t, func() {
+				_, _ = d.Run(newFakeOperation())
+			})
+
+			key := fake.Key(d.aciRG, d.aciName)
+			if tc.expectDeleted {
+				assert.Equal(t, []string{key}, b.DeletedContainerGroups)
+				assert.Equal(t, []string{d.aciRG}, b.DeletedResourceGroups)
+				return
+			}
+			assert.Empty(t, b.DeletedContainerGroups)
+			assert.Empty(t, b.DeletedResourceGroups)
+
+			containerGroup := b.ContainerGroups[key]
+			resourceGroup := b.ResourceGroups[d.aciRG]
+			for _, tags := range []map[string]*string{containerGroup.Tags, resourceGroup.Tags} {
+				assert.Equal(t, d.retention().String(), to.String(tags[tagRetentionPolicy]))
+				if tc.policy == "never" {
+					assert.NotContains(t, tags, tagRetainedAt, "Expected resources kept by the never policy not to be tagged as retained")
+					continue
+				}
+				assert.Contains(t, tags, tagRetainedAt)
+				if tc.expectRetainUntil {
+					assert.False(t, retainUntil(tags).Before(start.Add(time.Hour)), "Expected the resource to be retained for the duration of the policy")
+				} else {
+					assert.NotContains(t, tags, tagRetainUntil)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectGarbageRetainedResources(t *testing.T) {
+	d, b, _ := newFakeDriver(t, map[string]string{})
+	ctx := context.Background()
+	now := time.Now()
+	create := func(name string, createdAt time.Time, retainUntil time.Time) {
+		tags := map[string]*string{
+			tagDriverVersion: to.StringPtr("test-version"),
+			tagCreatedAt:     to.StringPtr(createdAt.UTC().Format(time.RFC3339)),
+			tagRetainUntil:   to.StringPtr(retainUntil.UTC().Format(time.RFC3339)),
+		}
+		_, err := b.CreateResourceGroup(ctx, fakeSubscriptionID, name, resources.Group{Location: to.StringPtr(fakeLocation), Tags: tags})
+		assert.NoError(t, err)
+	}
+	create("cnab-azure-expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	create("cnab-azure-retained", now.Add(-48*time.Hour), now.Add(time.Hour))
+
+	garbage, err := d.CollectGarbage(ctx, 24*time.Hour, false, false)
+	assert.NoErrorf(t, err, "Expected no error collecting garbage. Got: %v", err)
+	actions := map[string]GarbageAction{}
+	for _, item := range garbage {
+		actions[item.Name] = item.Action
+	}
+	assert.Equal(t, map[string]GarbageAction{"cnab-azure-expired": GarbageDeleted, "cnab-azure-retained": GarbageKept}, actions)
+}
+
+func TestCollectGarbageRetentionPolicy(t *testing.T) {
+	testcases := []struct {
+		name     string
+		force    bool
+		expected map[string]GarbageAction
+	}{
+		{
+			name: "keeps resources by their retention policy",
+			expected: map[string]GarbageAction{
+				"cnab-azure-never":              GarbageKeptByPolicy,
+				"cnab-azure-never-cg":           GarbageKeptByPolicy,
+				"cnab-azure-failed-recently":    GarbageKept,
+				"cnab-azure-failed-recently-cg": GarbageKept,
+				"cnab-azure-failed-long-ago":    GarbageDeleted,
+				"cnab-azure-failed-long-ago-cg": GarbageDeletedWithResourceGroup,
+				"cnab-azure-orphaned":           GarbageDeleted,
+				"cnab-azure-orphaned-cg":        GarbageDeletedWithResourceGroup,
+				"cnab-azure-always":             GarbageDeleted,
+				"cnab-azure-always-cg":          GarbageDeletedWithResourceGroup,
+			},
+		},
+		{
+			name:  "deletes resources kept by the never policy when forced",
+			force: true,
+			expected: map[string]GarbageAction{
+				"cnab-azure-never":              GarbageDeleted,
+				"cnab-azure-never-cg":           GarbageDeletedWithResourceGroup,
+				"cnab-azure-failed-recently":    GarbageKept,
+				"cnab-azure-failed-recently-cg": GarbageKept,
+				"cnab-azure-failed-long-ago":    GarbageDeleted,
+				"cnab-azure-failed-long-ago-cg": GarbageDeletedWithResourceGroup,
+				"cnab-azure-orphaned":           GarbageDeleted,
+				"cnab-azure-orphaned-cg":        GarbageDeletedWithResourceGroup,
+				"cnab-azure-always":             GarbageDeleted,
+				"cnab-azure-always-cg":          GarbageDeletedWithResourceGroup,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{})
+			ctx := context.Background()
+			now := time.Now()
+			// create creates a resource group and container group as they are left by an operation with the retention policy, a resource kept after
+			// a failure by a policy without a duration has the time it was kept
+			create := func(name string, policy string, retainedAt time.Time) {
+				tags := map[string]*string{
+					tagDriverVersion:   to.StringPtr("test-version"),
+					tagCreatedAt:       to.StringPtr(now.Add(-72 * time.Hour).UTC().Format(time.RFC3339)),
+					tagRetentionPolicy: to.StringPtr(policy),
+				}
+				if !retainedAt.IsZero() {
+					tags[tagRetainedAt] = to.StringPtr(retainedAt.UTC().Format(time.RFC3339))
+				}
+				_, err := b.CreateResourceGroup(ctx, fakeSubscriptionID, name, resources.Group{Location: to.StringPtr(fakeLocation), Tags: tags})
+				assert.NoError(t, err)
+				_, err = b.CreateContainerGroup(ctx, fakeSubscriptionID, name, name+"-cg", containerinstance.ContainerGroup{Tags: tags, ContainerGroupProperties: &containerinstance.ContainerGroupProperties{}})
+				assert.NoError(t, err)
+			}
+			create("cnab-azure-never", "never", time.Time{})
+			create("cnab-azure-failed-recently", "on-success", now.Add(-time.Hour))
+			create("cnab-azure-failed-long-ago", "on-success", now.Add(-48*time.Hour))
+			create("cnab-azure-orphaned", "on-success", time.Time{})
+			create("cnab-azure-always", "always", time.Time{})
+
+			garbage, err := d.CollectGarbage(ctx, 24*time.Hour, false, tc.force)
+			assert.NoErrorf(t, err, "Expected no error collecting garbage. Got: %v", err)
+			actions := map[string]GarbageAction{}
+			for _, item := range garbage {
+				actions[item.Name] = item.Action
+			}
+			assert.Equal(t, tc.expected, actions)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
+)
+
+// defaultRunCommand is the CNAB run tool, it is run if the image does not set an entrypoint or cmd and the bundle does not declare a command
+const defaultRunCommand = "/cnab/app/run"
+
+// shellSafe matches words that do not need to be quoted in a shell script
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// getImageConfigFromRegistry reads the configuration of the invocation image from its registry using the registry credentials of the driver
+func (d *aciDriver) getImageConfigFromRegistry(ctx context.Context, image string, domain string) (*registry.ImageConfig, error) {
+	client := registry.NewClient(nil)
+	if len(d.imageRegistryPassword) > 0 {
+		client.SetCredentials(domain, registry.Credentials{Username: d.imageRegistryUser, Password: d.imageRegistryPassword})
+	}
+
+	return client.GetImageConfig(ctx, image)
+}
+
+// resolveImageCommand gets the entrypoint and cmd of the invocation image so that the script the driver runs before the bundle can chain to them,
+// a command declared in the bundle extension is used instead. If the image configuration cannot be read the CNAB run tool is used.
+func (d *aciDriver) resolveImageCommand(ctx context.Context, image string, domain string) {
+	d.imageCommand = nil
+	if len(d.runCommand) > 0 || d.getImageConfig == nil {
+		return
+	}
+
+	config, err := d.getImageConfig(ctx, image, domain)
+	if err != nil {
+		log.Debugf("Failed to get configuration of image %s, %s will be run: %v", image, defaultRunCommand, err)
+		return
+	}
+
+	d.imageCommand = config.Command()
+	log.Debugf("Image Command: %v", d.imageCommand)
+}
+
+// getRunCommand gets the command that runs the bundle in the invocation image
+func (d *aciDriver) getRunCommand() []string {
+	if len(d.runCommand) > 0 {
+		return d.runCommand
+	}
+	if len(d.imageCommand) > 0 {
+		return d.imageCommand
+	}
+	return []string{defaultRunCommand}
+}
+
+// shellCommand formats a command so that it can be run from a shell script
+func shellCommand(command []string) string {
+	quoted := make([]string, len(command))
+	for i, word := range command {
+		if shellSafe.MatchString(word) {
+			quoted[i] = word
+		} else {
+			quoted[i] = "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
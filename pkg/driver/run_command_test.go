@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+	"github.com/deislabs/cnab-azure-driver/pkg/registry"
+)
+
+func TestShellCommand(t *testing.T) {
+	assert.Equal(t, "/cnab/app/run", shellCommand([]string{"/cnab/app/run"}))
+	assert.Equal(t, "/docker-entrypoint.sh --mode=run", shellCommand([]string{"/docker-entrypoint.sh", "--mode=run"}))
+	assert.Equal(t, `/bin/sh -c 'echo "it'\''s $HOME"'`, shellCommand([]string{"/bin/sh", "-c", `echo "it's $HOME"`}))
+	assert.Equal(t, "run ''", shellCommand([]string{"run", ""}))
+}
+
+func TestRunWithFakeBackendRunCommand(t *testing.T) {
+	testcases := []struct {
+		name            string
+		imageConfig     *registry.ImageConfig
+		imageErr        error
+		bundleCommand   []string
+		files           bool
+		expectedCommand []string
+		expectedImage   string
+	}{
+		{
+			name:            "runs the entrypoint and cmd of the image after the script",
+			imageConfig:     &registry.ImageConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"run", "--all"}},
+			files:           true,
+			expectedCommand: []string{"/bin/bash", "-e", "-c", "/entrypoint.sh run --all"},
+			expectedImage:   "simongdavies/helloworld-aci-cnab@sha256:ba27c336615454378b0c1d85ef048583b1fd607b1a96defc90988292e9fb1edb",
+		},
+		{
+			name:            "runs /cnab/app/run if the image does not set a command",
+			imageConfig:     &registry.ImageConfig{},
+			files:           true,
+			expectedCommand: []string{"/bin/bash", "-e", "-c", "/cnab/app/run"},
+		},
+		{
+			name:            "runs /cnab/app/run if the image configuration cannot be read",
+			imageErr:        errors.New("unexpected status from registry: 404 Not Found"),
+			files:           true,
+			expectedCommand: []string{"/bin/bash", "-e", "-c", "/cnab/app/run"},
+		},
+		{
+			name:            "runs the command in the bundle extension after the script",
+			imageConfig:     &registry.ImageConfig{Entrypoint: []string{"/entrypoint.sh"}},
+			bundleCommand:   []string{"/cnab/app/run", "--log level"},
+			files:           true,
+			expectedCommand: []string{"/bin/bash", "-e", "-c", "/cnab/app/run '--log level'"},
+		},
+		{
+			name:            "runs the command in the bundle extension without a script",
+			bundleCommand:   []string{"/cnab/app/run", "--verbose"},
+			expectedCommand: []string{"/cnab/app/run", "--verbose"},
+		},
+		{
+			name: "runs the image without a command when there is no script",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, b, _ := newFakeDriver(t, map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"})
+			b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+				return fake.ContainerRun{{State: "Running"}, {State: "Succeeded"}}
+			}
+			var images []string
+			d.getImageConfig = func(ctx context.Context, image string, domain string) (*registry.ImageConfig, error) {
+				images = append(images, image)
+				return tc.imageConfig, tc.imageErr
+			}
+			op := newFakeOperation()
+			if tc.files {
+				op.Files = map[string]string{"/cnab/app/image-map.json": "{}"}
+			}
+			if len(tc.bundleCommand) > 0 {
+				op.Bundle = &bundle.Bundle{
+					Name:   "helloworld",
+					Custom: map[string]interface{}{bundleExtensionKey: map[string]interface{}{"command": tc.bundleCommand}},
+				}
+			}
+
+			var err error
+			captureStdout(t, func() {
+				_, err = d.Run(op)
+			})
+			assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+
+			container := getContainer(t, b.ContainerGroups[fake.Key(d.aciRG, d.aciName)])
+			command := to.StringSlice(container.Command)
+			if tc.files {
+				if assert.Len(t, command, 4) {
+					assert.Equal(t, tc.expectedCommand[:3], command[:3])
+					assert.True(t, strings.HasSuffix(command[3], ";"+tc.expectedCommand[3]), "Expected the script to run %s. Got: %s", tc.expectedCommand[3], command[3])
+				}
+			} else {
+				assert.Equal(t, tc.expectedCommand, command)
+			}
+			if len(tc.expectedImage) > 0 {
+				assert.Equal(t, []string{tc.expectedImage}, images)
+			}
+			if len(tc.bundleCommand) > 0 || !tc.files {
+				assert.Empty(t, images, "Expected the registry not to be called when the image command is not needed")
+			}
+		})
+	}
+}
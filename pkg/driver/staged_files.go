@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/cnabio/cnab-go/driver"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxSecretVolumeSize is the largest size of the encoded file inputs that are passed in a secret volume, ACI rejects
+	// container groups whose secret volumes are too large so larger file inputs are staged on the state file share
+	maxSecretVolumeSize = 64 * 1024
+	// Staged files are written to a directory for each operation under stagedFilesDirName in the state file share
+	stagedFilesDirName   = ".cnab-azure-files"
+	stagedFilesMountName = "bundlefileshare"
+)
+
+// secretVolumeSize gets the size of the secret volume that would hold the file inputs, the secret values are base64 encoded
+func secretVolumeSize(files map[string]string) int {
+	size := 0
+	for k, v := range files {
+		size += base64.StdEncoding.EncodedLen(len(k)) + base64.StdEncoding.EncodedLen(len(v))
+	}
+	return size
+}
+
+// prepareFiles decides whether the file inputs are staged on the state file share, a state file share is needed if they are too large for a secret volume
+func (d *aciDriver) prepareFiles(op *driver.Operation) {
+	d.stagedFilesPath = ""
+	if size := secretVolumeSize(op.Files); size > maxSecretVolumeSize {
+		log.Debugf("File inputs are %d bytes encoded which is larger than a secret volume, staging them on the state file share", size)
+		d.stagedFilesPath = path.Join(stagedFilesDirName, d.aciName)
+	}
+}
+
+// stageFiles writes the file inputs to the state file share as pairs of files in the same way as the secret volume, path{n} contains the file target file path and
+// value{n} contains the file content
+func (d *aciDriver) stageFiles(op *driver.Operation) error {
+	afs, err := d.newFileShare(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateFileShare)
+	if err != nil {
+		return fmt.Errorf("Error creating AzureFileShare structure to stage files: %v", err)
+	}
+
+	fmt.Printf("Staging %d files on Azure FileShare %s\n", len(op.Files), d.stateFileShare)
+	i := 0
+	for k, v := range op.Files {
+		log.Debug("Staging File Input: ", k)
+		if err := afs.WriteFileToShare(path.Join(d.stagedFilesPath, fmt.Sprintf("path%d", i)), []byte(k), true); err != nil {
+			return fmt.Errorf("Error staging file %s on AzureFileShare: %v", k, err)
+		}
+		if err := afs.WriteFileToShare(path.Join(d.stagedFilesPath, fmt.Sprintf("value%d", i)), []byte(v), true); err != nil {
+			return fmt.Errorf("Error staging file %s on AzureFileShare: %v", k, err)
+		}
+		i++
+	}
+
+	return nil
+}
+
+// deleteStagedFiles deletes the staged file inputs from the state file share once the operation has completed
+func (d *aciDriver) deleteStagedFiles() {
+	if len(d.stagedFilesPath) == 0 {
+		return
+	}
+	log.Debug("Deleting staged files ", d.stagedFilesPath)
+	afs, err := d.newFileShare(d.stateStorageAccountName, d.stateStorageAccountKey, d.stateFileShare)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating AzureFileShare object to delete staged files: %v\n", err)
+		return
+	}
+	if _, err := afs.DeleteDirectoryFromShare(d.stagedFilesPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error deleting staged files %s from fileshare:%v\n", d.stagedFilesPath, err)
+	}
+}
+
+// getStagedFilesVolume gets the volume that mounts the state file share read-only so that the script can copy the staged files into place
+func (d *aciDriver) getStagedFilesVolume() (containerinstance.Volume, containerinstance.VolumeMount) {
+	volume := containerinstance.Volume{
+		Name: to.StringPtr(stagedFilesMountName),
+		AzureFile: &containerinstance.AzureFileVolume{
+			ReadOnly:           to.BoolPtr(true),
+			StorageAccountKey:  to.StringPtr(d.stateStorageAccountKey),
+			StorageAccountName: to.StringPtr(d.stateStorageAccountName),
+			ShareName:          to.StringPtr(d.stateFileShare),
+		},
+	}
+	mount := containerinstance.VolumeMount{
+		Name:      to.StringPtr(stagedFilesMountName),
+		MountPath: to.StringPtr(fileMountPoint),
+		ReadOnly:  to.BoolPtr(true),
+	}
+	return volume, mount
+}
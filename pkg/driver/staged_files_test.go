@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+var stateSettings = map[string]string{
+	"CNAB_AZURE_STATE_FILESHARE":            "share",
+	"CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME": "account",
+	"CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY":  "key",
+}
+
+func TestSecretVolumeSize(t *testing.T) {
+	assert.Equal(t, 0, secretVolumeSize(nil))
+	assert.Equal(t, 8+4, secretVolumeSize(map[string]string{"/a/b": "{}"}))
+}
+
+func TestRunWithFakeBackendStagedFiles(t *testing.T) {
+	settings := map[string]string{"CNAB_AZURE_DELETE_RESOURCES": "false"}
+	for k, v := range stateSettings {
+		settings[k] = v
+	}
+	d, b, share := newFakeDriver(t, settings)
+	large := strings.Repeat("x", maxSecretVolumeSize)
+	op := newFakeOperation()
+	op.Files = map[string]string{"/cnab/app/large.json": large}
+	var staged map[string]string
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		staged = share.Files()
+		return fake.ContainerRun{{State: "Running"}, {State: "Succeeded"}}
+	}
+
+	var err error
+	captureStdout(t, func() {
+		_, err = d.Run(op)
+	})
+	assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+
+	stagedPath := path.Join(stagedFilesDirName, d.aciName)
+	assert.Equal(t, map[string]string{
+		stagedPath + "/path0":  "/cnab/app/large.json",
+		stagedPath + "/value0": large,
+	}, staged, "Expected the files to be staged on the share before the container group was created")
+	assert.Empty(t, share.Files(), "Expected the staged files to be deleted once the operation completed")
+
+	cg := b.ContainerGroups[fake.Key(d.aciRG, d.aciName)]
+	container := getContainer(t, cg)
+	for _, volume := range *cg.Volumes {
+		assert.Nil(t, volume.Secret, "Expected the files not to be passed in a secret volume")
+	}
+	assert.Contains(t, *cg.Volumes, containerinstance.Volume{
+		Name: to.StringPtr(stagedFilesMountName),
+		AzureFile: &containerinstance.AzureFileVolume{
+			ReadOnly:           to.BoolPtr(true),
+			StorageAccountKey:  to.StringPtr("key"),
+			StorageAccountName: to.StringPtr("account"),
+			ShareName:          to.StringPtr("share"),
+		},
+	})
+	assert.Contains(t, *container.VolumeMounts, containerinstance.VolumeMount{Name: to.StringPtr(stagedFilesMountName), MountPath: to.StringPtr(fileMountPoint), ReadOnly: to.BoolPtr(true)})
+	command := to.StringSlice(container.Command)
+	if assert.Len(t, command, 4) {
+		assert.True(t, strings.HasPrefix(command[3], fmt.Sprintf("cd %s/%s;", fileMountPoint, stagedPath)), "Expected the script to copy the staged files. Got: %s", command[3])
+	}
+}
+
+func TestRunWithFakeBackendStagedFilesErrors(t *testing.T) {
+	op := newFakeOperation()
+	op.Files = map[string]string{"/cnab/app/large.json": strings.Repeat("x", maxSecretVolumeSize)}
+
+	d, _, _ := newFakeDriver(t, map[string]string{})
+	_, err := d.Run(op)
+	assert.EqualError(t, err, fmt.Sprintf("File inputs are %d bytes encoded which is more than the %d bytes that can be passed in a secret volume, set CNAB_AZURE_STATE_* variables so that they can be staged on the state file share", secretVolumeSize(op.Files), maxSecretVolumeSize))
+
+	d, b, _ := newFakeDriver(t, stateSettings)
+	d.newFileShare = func(accountName string, accountKey string, shareName string) (fileShare, error) {
+		return nil, fmt.Errorf("Azure Share %s does not exist in Storage Account %s", shareName, accountName)
+	}
+	captureStdout(t, func() {
+		_, err = d.Run(op)
+	})
+	assert.EqualError(t, err, "running invocation instance using ACI failed: Error creating AzureFileShare structure to stage files: Azure Share share does not exist in Storage Account account")
+	assert.Empty(t, b.ContainerGroups)
+}
+
+// undeletableFileShare is a file share whose directories cannot be deleted
+type undeletableFileShare struct {
+	*fake.FileShare
+}
+
+func (f undeletableFileShare) DeleteDirectoryFromShare(dirName string) (bool, error) {
+	return false, fmt.Errorf("directory %s is locked", dirName)
+}
+
+func TestRunWithFakeBackendStagedFilesDeleteError(t *testing.T) {
+	d, _, share := newFakeDriver(t, stateSettings)
+	d.newFileShare = func(accountName string, accountKey string, shareName string) (fileShare, error) {
+		return undeletableFileShare{share}, nil
+	}
+	op := newFakeOperation()
+	op.Files = map[string]string{"/cnab/app/large.json": strings.Repeat("x", maxSecretVolumeSize)}
+
+	var err error
+	var stdout string
+	stderr := captureStderr(t, func() {
+		stdout = captureStdout(t, func() {
+			_, err = d.Run(op)
+		})
+	})
+	assert.NoErrorf(t, err, "Expected no error running operation. Got: %v", err)
+	stagedPath := path.Join(stagedFilesDirName, d.aciName)
+	assert.Contains(t, stderr, fmt.Sprintf("Error deleting staged files %s from fileshare:directory %s is locked", stagedPath, stagedPath))
+	assert.NotContains(t, stdout, "Error deleting staged files")
+}
+
+func TestCollectDeletesStagedFiles(t *testing.T) {
+	settings := map[string]string{"CNAB_AZURE_DETACH": "true"}
+	for k, v := range stateSettings {
+		settings[k] = v
+	}
+	d, b, share := newFakeDriver(t, settings)
+	op := newFakeOperation()
+	op.Files = map[string]string{"/cnab/app/large.json": strings.Repeat("x", maxSecretVolumeSize)}
+	b.Run = func(cg containerinstance.ContainerGroup) fake.ContainerRun {
+		return fake.ContainerRun{{State: "Succeeded"}}
+	}
+	var err error
+	captureStdout(t, func() {
+		_, err = d.Run(op)
+	})
+	assert.NoErrorf(t, err, "Expected no error running detached operation. Got: %v", err)
+	assert.Len(t, share.Files(), 2, "Expected the staged files to be kept until the operation is collected")
+	assert.Equal(t, path.Join(stagedFilesDirName, d.aciName), d.operationRecord.StagedFilesPath)
+
+	collector, _, _ := newFakeDriver(t, stateSettings)
+	collector.operationRecordDir = d.operationRecordDir
+	collector.newBackend = func(authorizer autorest.Authorizer, userAgent string) az.Backend {
+		return b
+	}
+	collector.newFileShare = func(accountName string, accountKey string, shareName string) (fileShare, error) {
+		return share, nil
+	}
+	record, err := collector.GetOperationRecordByID(d.operationRecord.ID)
+	if !assert.NoErrorf(t, err, "Expected no error getting operation record. Got: %v", err) {
+		return
+	}
+	captureStdout(t, func() {
+		_, err = collector.Collect(context.Background(), record)
+	})
+	assert.NoErrorf(t, err, "Expected no error collecting operation. Got: %v", err)
+	assert.Empty(t, share.Files())
+}
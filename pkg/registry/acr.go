@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ACRTokenUsername is the username used with an Azure Container Registry refresh token obtained by exchanging an Azure AD token
+const ACRTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// acrDomainSuffixes are the domains of Azure Container Registries in the public and sovereign clouds
+var acrDomainSuffixes = []string{".azurecr.io", ".azurecr.cn", ".azurecr.us"}
+
+// IsAzureContainerRegistry checks if the registry with the domain is an Azure Container Registry
+func IsAzureContainerRegistry(domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, suffix := range acrDomainSuffixes {
+		if strings.HasSuffix(domain, suffix) && len(domain) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExchangeAADToken exchanges an Azure AD access token for a refresh token that can be used as the password to pull images from an
+// Azure Container Registry, the tenant is optional
+func (c *Client) ExchangeAADToken(ctx context.Context, domain string, tenantID string, accessToken string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", domain)
+	if len(tenantID) > 0 {
+		form.Set("tenant", tenantID)
+	}
+	form.Set("access_token", accessToken)
+
+	uri := fmt.Sprintf("https://%s/oauth2/exchange", registryHost(domain))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	log.Debugf("Exchanging Azure AD token for refresh token for registry %s", domain)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to exchange Azure AD token for registry %s: %v", domain, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to exchange Azure AD token for registry %s: unexpected status from registry: %s", domain, resp.Status)
+	}
+
+	var response struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&response); err != nil {
+		return "", fmt.Errorf("Failed to parse token exchange response from registry %s: %v", domain, err)
+	}
+	if len(response.RefreshToken) == 0 {
+		return "", errors.New("registry " + domain + " did not return a refresh token")
+	}
+	return response.RefreshToken, nil
+}
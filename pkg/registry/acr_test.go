@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAzureContainerRegistry(t *testing.T) {
+	for domain, expected := range map[string]bool{
+		"myregistry.azurecr.io": true,
+		"MyRegistry.AzureCR.io": true,
+		"myregistry.azurecr.cn": true,
+		"myregistry.azurecr.us": true,
+		"azurecr.io":            false,
+		".azurecr.io":           false,
+		"docker.io":             false,
+		"azurecr.io.example":    false,
+		"localhost:5000":        false,
+	} {
+		assert.Equal(t, expected, IsAzureContainerRegistry(domain), domain)
+	}
+}
+
+func TestExchangeAADToken(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/oauth2/exchange", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "access_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "tenant", r.PostForm.Get("tenant"))
+		if r.PostForm.Get("access_token") != "aad-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"refresh_token":"refresh-%s"}`, r.PostForm.Get("service"))
+	}))
+	t.Cleanup(server.Close)
+	domain := strings.TrimPrefix(server.URL, "https://")
+	client := NewClient(server.Client())
+
+	token, err := client.ExchangeAADToken(context.Background(), domain, "tenant", "aad-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh-"+domain, token)
+
+	_, err = client.ExchangeAADToken(context.Background(), domain, "tenant", "other-token")
+	assert.EqualError(t, err, fmt.Sprintf("Failed to exchange Azure AD token for registry %s: unexpected status from registry: 401 Unauthorized", domain))
+}
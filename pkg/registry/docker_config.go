@@ -0,0 +1,169 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dockerConfigFileName = "config.json"
+	// dockerHubServerURL is the server that Docker Hub credentials are stored for by docker login
+	dockerHubServerURL = "https://index.docker.io/v1/"
+	// credentialHelperPrefix is the prefix of the executables that implement the docker-credential protocol
+	credentialHelperPrefix = "docker-credential-"
+	// identityTokenUsername is the username returned by credential helpers for identity tokens
+	identityTokenUsername = "<token>"
+)
+
+// DockerConfig holds the registry credentials from a Docker config.json file that docker login writes to
+type DockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// DefaultDockerConfigDir gets the directory that the Docker CLI reads config.json from, this is DOCKER_CONFIG if it is set or ~/.docker
+func DefaultDockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); len(dir) > 0 {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// LoadDockerConfig reads config.json from the directory, if the file does not exist an empty configuration is returned
+func LoadDockerConfig(dir string) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	fileName := filepath.Join(dir, dockerConfigFileName)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("Error reading Docker config %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Error parsing Docker config %s: %v", fileName, err)
+	}
+	return config, nil
+}
+
+// Credentials gets the credentials for the registry with the domain, a credential helper configured for the registry or the credential store is
+// used in the same way as the Docker CLI, if the helper does not have credentials for the registry the auths entries are used
+func (c *DockerConfig) Credentials(ctx context.Context, domain string) (Credentials, bool, error) {
+	host := dockerConfigHost(domain)
+	helper, ok := c.CredHelpers[host]
+	if !ok && host == dockerConfigHost(dockerHubServerURL) {
+		helper, ok = c.CredHelpers[dockerHubServerURL]
+	}
+	if !ok {
+		helper = c.CredsStore
+	}
+	if len(helper) > 0 {
+		credentials, found, err := getHelperCredentials(ctx, helper, host)
+		if err != nil || found {
+			return credentials, found, err
+		}
+	}
+
+	for server, auth := range c.Auths {
+		if dockerConfigHost(server) != host {
+			continue
+		}
+		return auth.credentials(server, domain)
+	}
+	return Credentials{}, false, nil
+}
+
+func (a dockerAuth) credentials(server string, domain string) (Credentials, bool, error) {
+	credentials := Credentials{Username: a.Username, Password: a.Password}
+	if len(a.Auth) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return Credentials{}, false, fmt.Errorf("Error decoding Docker config auth for %s: %v", server, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return Credentials{}, false, fmt.Errorf("Docker config auth for %s should be username:password", server)
+		}
+		credentials = Credentials{Username: parts[0], Password: parts[1]}
+	}
+	if len(a.IdentityToken) > 0 {
+		return identityTokenCredentials(domain, a.IdentityToken)
+	}
+	return credentials, len(credentials.Password) > 0, nil
+}
+
+// identityTokenCredentials gets the credentials to use for an identity token, only ACR accepts identity tokens as passwords
+func identityTokenCredentials(domain string, token string) (Credentials, bool, error) {
+	if !IsAzureContainerRegistry(domain) {
+		log.Debugf("Ignoring identity token in Docker config for registry %s, identity tokens are only supported for Azure Container Registry", domain)
+		return Credentials{}, false, nil
+	}
+	return Credentials{Username: ACRTokenUsername, Password: token}, true, nil
+}
+
+// getHelperCredentials runs docker-credential-<helper> get with the server on stdin, the helper writes the credentials as JSON to stdout
+func getHelperCredentials(ctx context.Context, helper string, host string) (Credentials, bool, error) {
+	server := host
+	if host == dockerConfigHost(dockerHubServerURL) {
+		server = dockerHubServerURL
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.Debugf("Getting credentials for registry %s from %s%s", server, credentialHelperPrefix, helper)
+	if err := cmd.Run(); err != nil {
+		// Helpers write credentials not found to stdout when they do not have credentials for the server
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, fmt.Errorf("Error getting credentials for %s from %s%s: %v %s", server, credentialHelperPrefix, helper, err, strings.TrimSpace(stderr.String()+stdout.String()))
+	}
+
+	var response struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return Credentials{}, false, fmt.Errorf("Error parsing credentials for %s from %s%s: %v", server, credentialHelperPrefix, helper, err)
+	}
+	if response.Username == identityTokenUsername {
+		return identityTokenCredentials(host, response.Secret)
+	}
+	return Credentials{Username: response.Username, Password: response.Secret}, len(response.Secret) > 0, nil
+}
+
+// dockerConfigHost gets the registry host that a server in the Docker config is for, servers can be stored as URLs and Docker Hub has several names
+func dockerConfigHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host = strings.ToLower(strings.SplitN(host, "/", 2)[0])
+	switch host {
+	case dockerHubDomain, dockerHubRegistry, "registry.hub.docker.com":
+		return "index.docker.io"
+	}
+	return host
+}
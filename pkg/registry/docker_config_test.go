@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCredentialHelper writes a docker-credential-test helper to a directory at the start of PATH, the helper has credentials for
+// helper.example.com and an identity token for myregistry.azurecr.io
+func writeCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helper")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	script := `#!/bin/sh
+read server
+case "${server}" in
+  helper.example.com) echo '{"ServerURL":"helper.example.com","Username":"helperuser","Secret":"helperpassword"}' ;;
+  myregistry.azurecr.io) echo '{"ServerURL":"myregistry.azurecr.io","Username":"<token>","Secret":"refresh-token"}' ;;
+  broken.example.com) echo 'helper failed' >&2; exit 2 ;;
+  *) echo 'credentials not found in native keychain'; exit 1 ;;
+esac
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+func TestLoadDockerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config, err := LoadDockerConfig(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, config.Auths, "Expected an empty configuration if there is no config.json")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths":{"example.com":{}},"credsStore":"test"}`), 0600))
+	config, err = LoadDockerConfig(dir)
+	assert.NoError(t, err)
+	assert.Contains(t, config.Auths, "example.com")
+	assert.Equal(t, "test", config.CredsStore)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{`), 0600))
+	_, err = LoadDockerConfig(dir)
+	assert.Error(t, err)
+}
+
+func TestDockerConfigCredentials(t *testing.T) {
+	writeCredentialHelper(t)
+	auth := func(user string, password string) dockerAuth {
+		return dockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(user + ":" + password))}
+	}
+	testcases := []struct {
+		name          string
+		config        DockerConfig
+		domain        string
+		expected      Credentials
+		expectedFound bool
+		expectedError bool
+	}{
+		{
+			name:          "auth entry",
+			config:        DockerConfig{Auths: map[string]dockerAuth{"registry.example.com": auth("user", "password")}},
+			domain:        "registry.example.com",
+			expected:      Credentials{Username: "user", Password: "password"},
+			expectedFound: true,
+		},
+		{
+			name:          "auth entry stored as url",
+			config:        DockerConfig{Auths: map[string]dockerAuth{"https://registry.example.com/v2/": {Username: "user", Password: "password"}}},
+			domain:        "registry.example.com",
+			expected:      Credentials{Username: "user", Password: "password"},
+			expectedFound: true,
+		},
+		{
+			name:          "docker hub",
+			config:        DockerConfig{Auths: map[string]dockerAuth{dockerHubServerURL: auth("hubuser", "hubpassword")}},
+			domain:        "docker.io",
+			expected:      Credentials{Username: "hubuser", Password: "hubpassword"},
+			expectedFound: true,
+		},
+		{
+			name:   "no entry for registry",
+			config: DockerConfig{Auths: map[string]dockerAuth{"registry.example.com": auth("user", "password")}},
+			domain: "other.example.com",
+		},
+		{
+			name:          "identity token for acr",
+			config:        DockerConfig{Auths: map[string]dockerAuth{"myregistry.azurecr.io": {IdentityToken: "identity-token"}}},
+			domain:        "myregistry.azurecr.io",
+			expected:      Credentials{Username: ACRTokenUsername, Password: "identity-token"},
+			expectedFound: true,
+		},
+		{
+			name:   "identity token for other registry",
+			config: DockerConfig{Auths: map[string]dockerAuth{"registry.example.com": {IdentityToken: "identity-token"}}},
+			domain: "registry.example.com",
+		},
+		{
+			name:          "invalid auth",
+			config:        DockerConfig{Auths: map[string]dockerAuth{"registry.example.com": {Auth: "!!"}}},
+			domain:        "registry.example.com",
+			expectedError: true,
+		},
+		{
+			name:          "credential helper for registry",
+			config:        DockerConfig{CredHelpers: map[string]string{"helper.example.com": "test"}},
+			domain:        "helper.example.com",
+			expected:      Credentials{Username: "helperuser", Password: "helperpassword"},
+			expectedFound: true,
+		},
+		{
+			name:          "credential store identity token for acr",
+			config:        DockerConfig{CredsStore: "test"},
+			domain:        "myregistry.azurecr.io",
+			expected:      Credentials{Username: ACRTokenUsername, Password: "refresh-token"},
+			expectedFound: true,
+		},
+		{
+			name:          "credential store without credentials uses auths",
+			config:        DockerConfig{CredsStore: "test", Auths: map[string]dockerAuth{"registry.example.com": auth("user", "password")}},
+			domain:        "registry.example.com",
+			expected:      Credentials{Username: "user", Password: "password"},
+			expectedFound: true,
+		},
+		{
+			name:          "credential helper fails",
+			config:        DockerConfig{CredsStore: "test"},
+			domain:        "broken.example.com",
+			expectedError: true,
+		},
+		{
+			name:          "credential helper not installed",
+			config:        DockerConfig{CredsStore: "missing"},
+			domain:        "registry.example.com",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			credentials, found, err := tc.config.Credentials(context.Background(), tc.domain)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedFound, found)
+			assert.Equal(t, tc.expected, credentials)
+		})
+	}
+}
@@ -0,0 +1,365 @@
+// Package registry reads image metadata from container registries using the Docker Registry HTTP API V2
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	// dockerHubDomain is the domain of Docker Hub images, the registry API is served from dockerHubRegistry
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// maxResponseSize limits the size of the manifests and image configurations that are read
+	maxResponseSize = 4 * 1024 * 1024
+)
+
+// ImageConfig is the configuration of an image that determines what runs when a container is started from it
+type ImageConfig struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	WorkingDir string   `json:"WorkingDir"`
+}
+
+// Command gets the command that a container started from the image runs, the command is empty if the image does not set an entrypoint or cmd
+func (c *ImageConfig) Command() []string {
+	return append(append([]string{}, c.Entrypoint...), c.Cmd...)
+}
+
+// Credentials are used to authenticate to a registry
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Client reads images from registries, anonymous access is used for registries without credentials
+type Client struct {
+	httpClient  *http.Client
+	mu          sync.Mutex
+	credentials map[string]Credentials
+	// tokens are the bearer tokens obtained for each registry and repository
+	tokens map[string]string
+}
+
+// NewClient creates a Client that uses HTTPS
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		httpClient:  httpClient,
+		credentials: map[string]Credentials{},
+		tokens:      map[string]string{},
+	}
+}
+
+// SetCredentials sets the credentials used for the registry with the domain, e.g. myregistry.azurecr.io or docker.io
+func (c *Client) SetCredentials(domain string, credentials Credentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credentials[registryHost(domain)] = credentials
+}
+
+func (c *Client) getCredentials(host string) (Credentials, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	credentials, ok := c.credentials[host]
+	return credentials, ok
+}
+
+// GetImageConfig gets the configuration of an image, if the image is a multi-platform image the configuration of the linux/amd64 image is returned
+func (c *Client) GetImageConfig(ctx context.Context, image string) (*ImageConfig, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse image reference: %s error: %v", image, err)
+	}
+	named = reference.TagNameOnly(named)
+	repo := repository{
+		host: registryHost(reference.Domain(named)),
+		path: reference.Path(named),
+	}
+
+	ref := ""
+	if digested, ok := named.(reference.Digested); ok {
+		ref = digested.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+
+	m, err := c.getManifest(ctx, repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) > 0 {
+		descriptor, err := selectPlatform(m.Manifests)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get manifest of image %s: %v", image, err)
+		}
+		if m, err = c.getManifest(ctx, repo, descriptor.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Config.Digest) == 0 {
+		return nil, fmt.Errorf("Manifest of image %s does not have a configuration", image)
+	}
+
+	var config struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := c.getJSON(ctx, repo, "blobs/"+m.Config.Digest, "", &config); err != nil {
+		return nil, fmt.Errorf("Failed to get configuration of image %s: %v", image, err)
+	}
+
+	return &config.Config, nil
+}
+
+type repository struct {
+	host string
+	path string
+}
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// manifest holds the fields used from image manifests and from manifest lists and indexes
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+func (c *Client) getManifest(ctx context.Context, repo repository, ref string) (*manifest, error) {
+	accept := strings.Join([]string{mediaTypeDockerManifestList, mediaTypeOCIIndex, mediaTypeDockerManifest, mediaTypeOCIManifest}, ", ")
+	var m manifest
+	if err := c.getJSON(ctx, repo, "manifests/"+ref, accept, &m); err != nil {
+		return nil, fmt.Errorf("Failed to get manifest %s of %s/%s: %v", ref, repo.host, repo.path, err)
+	}
+	return &m, nil
+}
+
+// selectPlatform selects the linux/amd64 image from a manifest list as ACI runs Linux containers on amd64
+func selectPlatform(manifests []descriptor) (descriptor, error) {
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+			return m, nil
+		}
+	}
+	return descriptor{}, errors.New("no linux/amd64 image found")
+}
+
+func (c *Client) getJSON(ctx context.Context, repo repository, path string, accept string, v interface{}) error {
+	resp, err := c.get(ctx, repo, path, accept)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// get sends a request to the registry, if the registry responds with an authentication challenge the request is authenticated and retried
+func (c *Client) get(ctx context.Context, repo repository, path string, accept string) (*http.Response, error) {
+	uri := fmt.Sprintf("https://%s/v2/%s/%s", repo.host, repo.path, path)
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		if len(authorization) > 0 {
+			req.Header.Set("Authorization", authorization)
+		}
+		return c.httpClient.Do(req)
+	}
+
+	tokenKey := repo.host + "/" + repo.path
+	c.mu.Lock()
+	token := c.tokens[tokenKey]
+	c.mu.Unlock()
+	authorization := ""
+	if len(token) > 0 {
+		authorization = "Bearer " + token
+	}
+
+	resp, err := send(authorization)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err = c.authorize(ctx, repo, challenge)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(authorization, "Bearer ") {
+			c.mu.Lock()
+			c.tokens[tokenKey] = strings.TrimPrefix(authorization, "Bearer ")
+			c.mu.Unlock()
+		}
+		if resp, err = send(authorization); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status from registry: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// authorize gets the Authorization header for a request that was challenged by the registry
+func (c *Client) authorize(ctx context.Context, repo repository, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	credentials, hasCredentials := c.getCredentials(repo.host)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredentials {
+			return "", fmt.Errorf("registry %s requires credentials", repo.host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := c.getToken(ctx, params, repo, credentials, hasCredentials)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get token for registry %s: %v", repo.host, err)
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("registry %s returned an unsupported authentication challenge: %q", repo.host, challenge)
+	}
+}
+
+// getToken gets a bearer token for pulling from the repository from the token server in the challenge
+func (c *Client) getToken(ctx context.Context, params map[string]string, repo repository, credentials Credentials, hasCredentials bool) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", errors.New("authentication challenge does not have a realm")
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid realm %s: %v", realm, err)
+	}
+
+	query := tokenURL.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	scope, ok := params["scope"]
+	if !ok {
+		scope = fmt.Sprintf("repository:%s:pull", repo.path)
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredentials {
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+
+	log.Debugf("Getting token for %s from %s", scope, tokenURL.Host)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from token server: %s", resp.Status)
+	}
+
+	// Token servers return the token in either token or access_token
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %v", err)
+	}
+	if len(response.Token) > 0 {
+		return response.Token, nil
+	}
+	if len(response.AccessToken) > 0 {
+		return response.AccessToken, nil
+	}
+	return "", errors.New("token server did not return a token")
+}
+
+// parseChallenge parses a WWW-Authenticate header such as Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for len(rest) > 0 {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[name] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return parts[0], params
+}
+
+// registryHost gets the host that serves the registry API for an image domain
+func registryHost(domain string) string {
+	if domain == dockerHubDomain || domain == "index.docker.io" {
+		return dockerHubRegistry
+	}
+	return domain
+}
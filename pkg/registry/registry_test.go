@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUsername = "user"
+	testPassword = "password"
+	testToken    = "token"
+)
+
+// newTestRegistry starts a registry that serves a multi-platform image with the tag v1 from the repository test/bundle,
+// requests must be authenticated with a bearer token obtained from its token endpoint using basic auth
+func newTestRegistry(t *testing.T) (*httptest.Server, *[]string) {
+	var requests []string
+	config := `{"architecture":"amd64","os":"linux","config":{"Entrypoint":["/entrypoint.sh"],"Cmd":["run"],"WorkingDir":"/cnab/app"}}`
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != testUsername || password != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "repository:test/bundle:pull", r.URL.Query().Get("scope"))
+		assert.Equal(t, "test-registry", r.URL.Query().Get("service"))
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": testToken})
+	})
+	mux.HandleFunc("/v2/test/bundle/", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:test/bundle:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/v2/test/bundle/") {
+		case "manifests/v1":
+			assert.Contains(t, r.Header.Get("Accept"), mediaTypeOCIIndex)
+			fmt.Fprintf(w, `{"mediaType":"%s","manifests":[{"digest":"sha256:arm","platform":{"architecture":"arm64","os":"linux"}},{"digest":"sha256:amd","platform":{"architecture":"amd64","os":"linux"}}]}`, mediaTypeOCIIndex)
+		case "manifests/sha256:amd":
+			fmt.Fprintf(w, `{"mediaType":"%s","config":{"digest":"sha256:config"}}`, mediaTypeOCIManifest)
+		case "blobs/sha256:config":
+			fmt.Fprint(w, config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server = httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestGetImageConfig(t *testing.T) {
+	server, requests := newTestRegistry(t)
+	domain := strings.TrimPrefix(server.URL, "https://")
+	client := NewClient(server.Client())
+	client.SetCredentials(domain, Credentials{Username: testUsername, Password: testPassword})
+
+	config, err := client.GetImageConfig(context.Background(), domain+"/test/bundle:v1")
+	assert.NoErrorf(t, err, "Expected no error getting image config. Got: %v", err)
+	assert.Equal(t, &ImageConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"run"}, WorkingDir: "/cnab/app"}, config)
+	assert.Equal(t, []string{"/entrypoint.sh", "run"}, config.Command())
+	assert.Equal(t, []string{
+		"/v2/test/bundle/manifests/v1",
+		"/v2/test/bundle/manifests/v1",
+		"/v2/test/bundle/manifests/sha256:amd",
+		"/v2/test/bundle/blobs/sha256:config",
+	}, *requests, "Expected the token to be reused after the first challenge")
+}
+
+func TestGetImageConfigErrors(t *testing.T) {
+	server, _ := newTestRegistry(t)
+	domain := strings.TrimPrefix(server.URL, "https://")
+
+	client := NewClient(server.Client())
+	_, err := client.GetImageConfig(context.Background(), domain+"/test/bundle:v1")
+	assert.EqualError(t, err, fmt.Sprintf("Failed to get manifest v1 of %s/test/bundle: Failed to get token for registry %s: unexpected status from token server: 401 Unauthorized", domain, domain))
+
+	client.SetCredentials(domain, Credentials{Username: testUsername, Password: testPassword})
+	_, err = client.GetImageConfig(context.Background(), domain+"/test/bundle:v2")
+	assert.EqualError(t, err, fmt.Sprintf("Failed to get manifest v2 of %s/test/bundle: unexpected status from registry: 404 Not Found", domain))
+
+	_, err = client.GetImageConfig(context.Background(), "Invalid:Image")
+	assert.Error(t, err)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/alpine:pull",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, params)
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "registry-1.docker.io", registryHost("docker.io"))
+	assert.Equal(t, "myregistry.azurecr.io", registryHost("myregistry.azurecr.io"))
+}
@@ -0,0 +1,152 @@
+package fakeazure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// serveFiles implements the subset of the Azure Files REST API used by azure.FileShare, the first path segment is the share name
+func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	name := ""
+	if len(parts) == 2 {
+		name = strings.Trim(parts[1], "/")
+	}
+
+	query := r.URL.Query()
+	switch {
+	case query.Get("restype") == "share":
+		if r.Method != http.MethodHead && r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case query.Get("restype") == "directory":
+		s.serveDirectory(w, r, name)
+	case query.Get("comp") == "range" && r.Method == http.MethodPut:
+		s.writeRange(w, r, name)
+	default:
+		s.serveFile(w, r, name)
+	}
+}
+
+func (s *Server) directoryExists(name string) bool {
+	if len(name) == 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	created := s.directories[name]
+	s.mu.Unlock()
+	if created {
+		return true
+	}
+
+	for fileName := range s.Share.Files() {
+		if strings.HasPrefix(fileName, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveDirectory(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !s.directoryExists(name) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		if s.directoryExists(name) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.mu.Lock()
+		s.directories[name] = true
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	exists, _ := s.Share.CheckIfFileExists(name)
+	switch r.Method {
+	case http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		content, _ := s.Share.ReadFileFromShare(name)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		content, _ := s.Share.ReadFileFromShare(name)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(content))
+	case http.MethodPut:
+		size, err := strconv.Atoi(r.Header.Get("x-ms-content-length"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid x-ms-content-length: %v", err), http.StatusBadRequest)
+			return
+		}
+		s.Share.WriteFile(name, string(make([]byte, size)))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = s.Share.DeleteFileFromShare(name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) writeRange(w http.ResponseWriter, r *http.Request, name string) {
+	content, err := s.Share.ReadFileFromShare(name)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fileRange := r.Header.Get("x-ms-range")
+	if len(fileRange) == 0 {
+		fileRange = r.Header.Get("Range")
+	}
+
+	var start, end int
+	if _, err := fmt.Sscanf(fileRange, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(content) {
+		http.Error(w, fmt.Sprintf("invalid range: %s", fileRange), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	data := []byte(content)
+	if r.Header.Get("x-ms-write") == "clear" {
+		for i := start; i <= end; i++ {
+			data[i] = 0
+		}
+	} else {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(body) != end-start+1 {
+			http.Error(w, "body does not match range", http.StatusBadRequest)
+			return
+		}
+		copy(data[start:], body)
+	}
+
+	s.Share.WriteFile(name, string(data))
+	w.WriteHeader(http.StatusCreated)
+}
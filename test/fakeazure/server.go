@@ -0,0 +1,743 @@
+// Package fakeazure provides a local HTTP server that stands in for the Azure Resource Manager, Azure Active Directory and Azure Files endpoints used by the driver
+// so that operations can be run end to end without an Azure subscription. ARM requests are served from a fake.Backend and Azure Files requests from a fake.FileShare.
+package fakeazure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	"github.com/Azure/azure-sdk-for-go/services/containerinstance/mgmt/2021-10-01/containerinstance"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	az "github.com/deislabs/cnab-azure-driver/pkg/azure"
+	"github.com/deislabs/cnab-azure-driver/pkg/azure/fake"
+)
+
+// StorageEndpointSuffix is the storage endpoint suffix the driver should use so that Azure Files requests can be redirected to the server
+const StorageEndpointSuffix = "storage.fakeazure.test"
+
+// Server is a fake Azure server
+type Server struct {
+	*httptest.Server
+	// Backend holds the state of the fake ARM resources
+	Backend *fake.Backend
+	// Share holds the files in the fake Azure File Share, all share names resolve to it
+	Share *fake.FileShare
+
+	mu          sync.Mutex
+	directories map[string]bool
+	streams     map[string]*containerStream
+}
+
+// containerStream is a stream attached to a container or an executed command waiting for the driver to connect to its websocket
+type containerStream struct {
+	password string
+	stream   io.ReadCloser
+	// exec streams are authenticated by the first message and send the messages they receive to the command
+	exec bool
+}
+
+// NewServer starts a fake Azure server
+func NewServer(backend *fake.Backend, share *fake.FileShare) *Server {
+	s := &Server{
+		Backend:     backend,
+		Share:       share,
+		directories: map[string]bool{},
+		streams:     map[string]*containerStream{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Environment returns the environment variables that point the driver at the server
+func (s *Server) Environment() map[string]string {
+	return map[string]string{
+		"CNAB_AZURE_ARM_ENDPOINT":            s.URL + "/",
+		"CNAB_AZURE_AAD_ENDPOINT":            s.URL + "/",
+		"CNAB_AZURE_STORAGE_ENDPOINT_SUFFIX": StorageEndpointSuffix,
+	}
+}
+
+// RedirectStorageRequests sends Azure Files requests made using http.DefaultTransport to the server, the storage client always uses
+// https and an account specific host name so the requests cannot be pointed at the server using the endpoint suffix alone.
+// The returned function restores http.DefaultTransport.
+func (s *Server) RedirectStorageRequests() func() {
+	original := http.DefaultTransport
+	http.DefaultTransport = &redirectTransport{
+		host: strings.TrimPrefix(s.URL, "http://"),
+		next: original,
+	}
+	return func() {
+		http.DefaultTransport = original
+	}
+}
+
+type redirectTransport struct {
+	host string
+	next http.RoundTripper
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Hostname(), "."+StorageEndpointSuffix) {
+		return t.next.RoundTrip(req)
+	}
+
+	redirect := req.Clone(req.Context())
+	redirect.Host = req.URL.Host
+	redirect.URL.Scheme = "http"
+	redirect.URL.Host = t.host
+	return t.next.RoundTrip(redirect)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Host, ".file."+StorageEndpointSuffix) {
+		s.serveFiles(w, r)
+		return
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if len(segment) > 0 {
+			segments = append(segments, segment)
+		}
+	}
+
+	lower := make([]string, len(segments))
+	for i, segment := range segments {
+		lower[i] = strings.ToLower(segment)
+	}
+
+	switch {
+	case len(lower) == 2 && lower[0] == "streams" && r.Method == http.MethodGet:
+		s.serveContainerStream(w, r, segments[1])
+	case len(lower) == 3 && lower[1] == "oauth2" && lower[2] == "token" && r.Method == http.MethodPost:
+		s.token(w, r)
+	case len(lower) == 1 && lower[0] == "subscriptions" && r.Method == http.MethodGet:
+		s.listSubscriptions(w, r)
+	case len(lower) == 2 && lower[0] == "subscriptions" && r.Method == http.MethodGet:
+		s.getSubscription(w, r, segments[1])
+	case indexOf(lower, "microsoft.authorization") > 0:
+		s.serveAuthorization(w, r, segments, lower)
+	case len(lower) == 3 && lower[0] == "subscriptions" && lower[2] == "resourcegroups" && r.Method == http.MethodGet:
+		s.listResourceGroups(w, r, segments[1])
+	case len(lower) == 4 && lower[0] == "subscriptions" && lower[2] == "resourcegroups":
+		s.serveResourceGroup(w, r, segments[1], segments[3])
+	case len(lower) == 4 && lower[0] == "subscriptions" && lower[2] == "providers" && r.Method == http.MethodGet:
+		s.getProvider(w, r, segments[1], segments[3])
+	case len(lower) == 7 && lower[0] == "subscriptions" && lower[3] == "microsoft.containerinstance" && lower[4] == "locations" && lower[6] == "capabilities" && r.Method == http.MethodGet:
+		s.listCapabilities(w, r, segments[1], segments[5])
+	case len(lower) == 5 && lower[0] == "subscriptions" && lower[3] == "microsoft.containerinstance" && lower[4] == "containergroups" && r.Method == http.MethodGet:
+		s.listContainerGroups(w, r, segments[1])
+	case len(lower) >= 8 && lower[0] == "subscriptions" && lower[5] == "microsoft.containerinstance" && lower[6] == "containergroups":
+		s.serveContainerGroup(w, r, segments, lower)
+	case len(lower) == 8 && lower[0] == "subscriptions" && lower[5] == "microsoft.managedidentity" && lower[6] == "userassignedidentities" && r.Method == http.MethodGet:
+		s.getUserAssignedIdentity(w, r, segments[1], segments[3], segments[7])
+	case len(lower) == 10 && lower[0] == "subscriptions" && lower[5] == "microsoft.network" && lower[6] == "virtualnetworks" && lower[8] == "subnets" && r.Method == http.MethodGet:
+		s.getSubnet(w, r, segments[1], segments[3], segments[7], segments[9])
+	default:
+		writeJSON(w, http.StatusNotFound, armError("NotFound", fmt.Sprintf("%s %s is not supported by the fake server", r.Method, r.URL.Path)))
+	}
+}
+
+func indexOf(segments []string, value string) int {
+	for i, segment := range segments {
+		if segment == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, armError("BadRequest", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "fake-access-token",
+		"expires_in":   "3600",
+		"expires_on":   strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+		"not_before":   strconv.FormatInt(now.Unix(), 10),
+		"resource":     r.FormValue("resource"),
+		"token_type":   "Bearer",
+	})
+}
+
+func subscriptionJSON(subscriptionID string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             "/subscriptions/" + subscriptionID,
+		"subscriptionId": subscriptionID,
+		"displayName":    subscriptionID,
+		"state":          "Enabled",
+	}
+}
+
+func (s *Server) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	result, err := s.Backend.ListSubscriptions(r.Context())
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	value := []interface{}{}
+	for _, subscription := range result {
+		value = append(value, subscriptionJSON(*subscription.SubscriptionID))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": value})
+}
+
+func (s *Server) getSubscription(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	subscription, err := s.Backend.GetSubscription(r.Context(), subscriptionID)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subscriptionJSON(*subscription.SubscriptionID))
+}
+
+func resourceGroupJSON(subscriptionID string, name string, group resources.Group) map[string]interface{} {
+	result := map[string]interface{}{
+		"id":   fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionID, name),
+		"name": name,
+		"properties": map[string]interface{}{
+			"provisioningState": "Succeeded",
+		},
+	}
+	if group.Location != nil {
+		result["location"] = *group.Location
+	}
+	if group.Tags != nil {
+		result["tags"] = group.Tags
+	}
+	return result
+}
+
+func (s *Server) listResourceGroups(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	groups, err := s.Backend.ListResourceGroups(r.Context(), subscriptionID)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	value := []interface{}{}
+	for _, group := range groups {
+		value = append(value, resourceGroupJSON(subscriptionID, *group.Name, group))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": value})
+}
+
+func (s *Server) serveResourceGroup(w http.ResponseWriter, r *http.Request, subscriptionID string, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		group, err := s.Backend.GetResourceGroup(r.Context(), subscriptionID, name)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resourceGroupJSON(subscriptionID, name, group))
+	case http.MethodPut:
+		var group resources.Group
+		if !readJSON(w, r, &group) {
+			return
+		}
+		group, err := s.Backend.CreateResourceGroup(r.Context(), subscriptionID, name, group)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, resourceGroupJSON(subscriptionID, name, group))
+	case http.MethodPatch:
+		var patch resources.GroupPatchable
+		if !readJSON(w, r, &patch) {
+			return
+		}
+		group, err := s.Backend.UpdateResourceGroupTags(r.Context(), subscriptionID, name, patch.Tags)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resourceGroupJSON(subscriptionID, name, group))
+	case http.MethodDelete:
+		if err := s.Backend.DeleteResourceGroup(r.Context(), subscriptionID, name); err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) getProvider(w http.ResponseWriter, r *http.Request, subscriptionID string, namespace string) {
+	provider, err := s.Backend.GetProvider(r.Context(), subscriptionID, namespace)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	resourceTypes := []interface{}{}
+	if provider.ResourceTypes != nil {
+		for _, t := range *provider.ResourceTypes {
+			resourceTypes = append(resourceTypes, map[string]interface{}{
+				"resourceType": t.ResourceType,
+				"locations":    t.Locations,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":                fmt.Sprintf("/subscriptions/%s/providers/%s", subscriptionID, namespace),
+		"namespace":         namespace,
+		"registrationState": "Registered",
+		"resourceTypes":     resourceTypes,
+	})
+}
+
+func (s *Server) listCapabilities(w http.ResponseWriter, r *http.Request, subscriptionID string, location string) {
+	capabilities, err := s.Backend.ListContainerInstanceCapabilities(r.Context(), subscriptionID, location)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	value := []interface{}{}
+	for _, c := range capabilities {
+		item := map[string]interface{}{
+			"resourceType": c.ResourceType,
+			"osType":       c.OsType,
+			"location":     c.Location,
+			"gpu":          c.Gpu,
+		}
+		if c.Capabilities != nil {
+			item["capabilities"] = map[string]interface{}{
+				"maxCpu":        c.Capabilities.MaxCPU,
+				"maxMemoryInGB": c.Capabilities.MaxMemoryInGB,
+				"maxGpuCount":   c.Capabilities.MaxGpuCount,
+			}
+		}
+		value = append(value, item)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": value})
+}
+
+// containerGroupJSON serialises a container group including the read only properties that the SDK models leave out when marshalling
+func containerGroupJSON(containerGroup containerinstance.ContainerGroup) (map[string]interface{}, error) {
+	data, err := json.Marshal(containerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	result["id"] = containerGroup.ID
+	result["name"] = containerGroup.Name
+	result["type"] = "Microsoft.ContainerInstance/containerGroups"
+	if containerGroup.Identity != nil && containerGroup.Identity.PrincipalID != nil {
+		if identity, ok := result["identity"].(map[string]interface{}); ok {
+			identity["principalId"] = containerGroup.Identity.PrincipalID
+		}
+	}
+
+	if properties, ok := result["properties"].(map[string]interface{}); ok {
+		properties["provisioningState"] = "Succeeded"
+		if containerGroup.ContainerGroupProperties != nil && containerGroup.InstanceView != nil {
+			instanceView := map[string]interface{}{
+				"state": containerGroup.InstanceView.State,
+			}
+			if containerGroup.InstanceView.Events != nil {
+				instanceView["events"] = eventsJSON(*containerGroup.InstanceView.Events)
+			}
+			properties["instanceView"] = instanceView
+		}
+		containers, _ := properties["containers"].([]interface{})
+		if containerGroup.ContainerGroupProperties != nil && containerGroup.Containers != nil && len(containers) == len(*containerGroup.Containers) {
+			for i, container := range *containerGroup.Containers {
+				containerProperties, ok := containers[i].(map[string]interface{})["properties"].(map[string]interface{})
+				if !ok || container.ContainerProperties == nil || container.InstanceView == nil {
+					continue
+				}
+				instanceView := map[string]interface{}{}
+				if container.InstanceView.CurrentState != nil {
+					instanceView["currentState"] = containerStateJSON(*container.InstanceView.CurrentState)
+				}
+				if container.InstanceView.Events != nil {
+					instanceView["events"] = eventsJSON(*container.InstanceView.Events)
+				}
+				containerProperties["instanceView"] = instanceView
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// containerStateJSON and eventJSON have the fields of the SDK models without the marshallers that leave out read only properties
+type containerStateJSON containerinstance.ContainerState
+
+type eventJSON containerinstance.Event
+
+func eventsJSON(events []containerinstance.Event) []eventJSON {
+	result := make([]eventJSON, len(events))
+	for i, event := range events {
+		result[i] = eventJSON(event)
+	}
+	return result
+}
+
+func (s *Server) listContainerGroups(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	containerGroups, err := s.Backend.ListContainerGroups(r.Context(), subscriptionID)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	value := []interface{}{}
+	for _, containerGroup := range containerGroups {
+		item, err := containerGroupJSON(containerGroup)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, armError("InternalServerError", err.Error()))
+			return
+		}
+		value = append(value, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": value})
+}
+
+func (s *Server) serveContainerGroup(w http.ResponseWriter, r *http.Request, segments []string, lower []string) {
+	subscriptionID, resourceGroupName, name := segments[1], segments[3], segments[7]
+	switch {
+	case len(lower) == 8 && r.Method == http.MethodGet:
+		containerGroup, err := s.Backend.GetContainerGroup(r.Context(), subscriptionID, resourceGroupName, name)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeContainerGroup(w, http.StatusOK, containerGroup)
+	case len(lower) == 8 && r.Method == http.MethodPut:
+		var containerGroup containerinstance.ContainerGroup
+		if !readJSON(w, r, &containerGroup) {
+			return
+		}
+		containerGroup, err := s.Backend.CreateContainerGroup(r.Context(), subscriptionID, resourceGroupName, name, containerGroup)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeContainerGroup(w, http.StatusCreated, containerGroup)
+	case len(lower) == 8 && r.Method == http.MethodPatch:
+		var resource containerinstance.Resource
+		if !readJSON(w, r, &resource) {
+			return
+		}
+		containerGroup, err := s.Backend.UpdateContainerGroupTags(r.Context(), subscriptionID, resourceGroupName, name, resource.Tags)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeContainerGroup(w, http.StatusOK, containerGroup)
+	case len(lower) == 8 && r.Method == http.MethodDelete:
+		if err := s.Backend.DeleteContainerGroup(r.Context(), subscriptionID, resourceGroupName, name); err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(lower) == 9 && lower[8] == "stop" && r.Method == http.MethodPost:
+		if err := s.Backend.StopContainerGroup(r.Context(), subscriptionID, resourceGroupName, name); err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(lower) == 11 && lower[8] == "containers" && lower[10] == "logs" && r.Method == http.MethodGet:
+		logs, err := s.Backend.GetContainerLogs(r.Context(), subscriptionID, resourceGroupName, name, segments[9])
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"content": logs})
+	case len(lower) == 11 && lower[8] == "containers" && lower[10] == "attach" && r.Method == http.MethodPost:
+		stream, err := s.Backend.AttachContainer(r.Context(), subscriptionID, resourceGroupName, name, segments[9])
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.addContainerStream(stream, false))
+	case len(lower) == 11 && lower[8] == "containers" && lower[10] == "exec" && r.Method == http.MethodPost:
+		var request containerinstance.ContainerExecRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+		var rows, cols int32
+		if request.TerminalSize != nil {
+			rows, cols = to.Int32(request.TerminalSize.Rows), to.Int32(request.TerminalSize.Cols)
+		}
+		stream, err := s.Backend.ExecuteCommand(r.Context(), subscriptionID, resourceGroupName, name, segments[9], to.String(request.Command), rows, cols)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.addContainerStream(stream, true))
+	default:
+		writeJSON(w, http.StatusNotFound, armError("NotFound", fmt.Sprintf("%s %s is not supported by the fake server", r.Method, r.URL.Path)))
+	}
+}
+
+// addContainerStream registers a stream to be served over a websocket and returns the response that tells the driver how to connect to it
+func (s *Server) addContainerStream(stream io.ReadCloser, exec bool) map[string]interface{} {
+	id, password := uuid.New().String(), uuid.New().String()
+	s.mu.Lock()
+	s.streams[id] = &containerStream{password: password, stream: stream, exec: exec}
+	s.mu.Unlock()
+	return map[string]interface{}{
+		"webSocketUri": "ws" + strings.TrimPrefix(s.URL, "http") + "/streams/" + id,
+		"password":     password,
+	}
+}
+
+// serveContainerStream sends the output of an attached container or an executed command over a websocket in the same way as ACI
+func (s *Server) serveContainerStream(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	stream, ok := s.streams[id]
+	delete(s.streams, id)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	defer stream.stream.Close()
+	if !stream.exec && r.Header.Get("Authorization") != stream.password {
+		http.Error(w, "invalid password", http.StatusUnauthorized)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if stream.exec {
+		if _, password, err := conn.ReadMessage(); err != nil || string(password) != stream.password {
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid password"), time.Now().Add(time.Second))
+			return
+		}
+	}
+
+	// Reading from the connection handles the close message sent when the driver closes the stream, messages sent to an exec stream are the input of the command
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				stream.stream.Close()
+				return
+			}
+			if writer, ok := stream.stream.(io.Writer); ok && stream.exec {
+				if _, err := writer.Write(message); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := stream.stream.Read(buffer)
+		if n > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, buffer[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+func writeContainerGroup(w http.ResponseWriter, statusCode int, containerGroup containerinstance.ContainerGroup) {
+	result, err := containerGroupJSON(containerGroup)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, armError("InternalServerError", err.Error()))
+		return
+	}
+	writeJSON(w, statusCode, result)
+}
+
+func (s *Server) serveAuthorization(w http.ResponseWriter, r *http.Request, segments []string, lower []string) {
+	i := indexOf(lower, "microsoft.authorization")
+	scope := "/" + strings.Join(segments[:i-1], "/")
+	subscriptionID := ""
+	if len(segments) > 1 && lower[0] == "subscriptions" {
+		subscriptionID = segments[1]
+	}
+
+	switch {
+	case len(lower) == i+2 && lower[i+1] == "roledefinitions" && r.Method == http.MethodGet:
+		roleDefinitions, err := s.Backend.ListRoleDefinitions(r.Context(), subscriptionID, scope)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		value := []interface{}{}
+		for _, roleDefinition := range roleDefinitions {
+			item := map[string]interface{}{
+				"id":   roleDefinition.ID,
+				"name": roleDefinition.Name,
+				"type": "Microsoft.Authorization/roleDefinitions",
+			}
+			if roleDefinition.RoleDefinitionProperties != nil {
+				item["properties"] = map[string]interface{}{
+					"roleName": roleDefinition.RoleName,
+				}
+			}
+			value = append(value, item)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": value})
+	case len(lower) == i+3 && lower[i+1] == "roleassignments" && r.Method == http.MethodPut:
+		var parameters authorization.RoleAssignmentCreateParameters
+		if !readJSON(w, r, &parameters) {
+			return
+		}
+		roleAssignment, err := s.Backend.CreateRoleAssignment(r.Context(), subscriptionID, scope, segments[i+2], parameters)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, roleAssignmentJSON(roleAssignment))
+	case len(lower) == i+2 && lower[i+1] == "roleassignments" && r.Method == http.MethodGet:
+		// Only the principalId filter used by the driver is supported
+		var principalID string
+		if _, err := fmt.Sscanf(r.URL.Query().Get("$filter"), "principalId eq '%36s'", &principalID); err != nil {
+			writeJSON(w, http.StatusBadRequest, armError("BadRequest", fmt.Sprintf("unsupported filter %s", r.URL.Query().Get("$filter"))))
+			return
+		}
+		roleAssignments, err := s.Backend.ListRoleAssignmentsForPrincipal(r.Context(), subscriptionID, principalID)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		value := []interface{}{}
+		for _, roleAssignment := range roleAssignments {
+			value = append(value, roleAssignmentJSON(roleAssignment))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": value})
+	case len(lower) == i+3 && lower[i+1] == "roleassignments" && r.Method == http.MethodDelete:
+		// The SDK adds a leading / to the role assignment ID when building the path
+		if err := s.Backend.DeleteRoleAssignment(r.Context(), subscriptionID, "/"+strings.Join(segments, "/")); err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeJSON(w, http.StatusNotFound, armError("NotFound", fmt.Sprintf("%s %s is not supported by the fake server", r.Method, r.URL.Path)))
+	}
+}
+
+func roleAssignmentJSON(roleAssignment authorization.RoleAssignment) map[string]interface{} {
+	result := map[string]interface{}{
+		"id":   roleAssignment.ID,
+		"name": roleAssignment.Name,
+		"type": "Microsoft.Authorization/roleAssignments",
+	}
+	if roleAssignment.Properties != nil {
+		result["properties"] = map[string]interface{}{
+			"scope":            roleAssignment.Properties.Scope,
+			"roleDefinitionId": roleAssignment.Properties.RoleDefinitionID,
+			"principalId":      roleAssignment.Properties.PrincipalID,
+		}
+	}
+	return result
+}
+
+func (s *Server) getUserAssignedIdentity(w http.ResponseWriter, r *http.Request, subscriptionID string, resourceGroupName string, name string) {
+	identity, err := s.Backend.GetUserAssignedIdentity(r.Context(), subscriptionID, resourceGroupName, name)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	result := map[string]interface{}{
+		"id":   identity.ID,
+		"name": name,
+		"type": "Microsoft.ManagedIdentity/userAssignedIdentities",
+	}
+	if identity.UserAssignedIdentityProperties != nil {
+		result["properties"] = map[string]interface{}{
+			"principalId": identity.PrincipalID,
+			"clientId":    identity.ClientID,
+			"tenantId":    identity.TenantID,
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getSubnet(w http.ResponseWriter, r *http.Request, subscriptionID string, resourceGroupName string, virtualNetworkName string, name string) {
+	subnet, err := s.Backend.GetSubnet(r.Context(), subscriptionID, resourceGroupName, virtualNetworkName, name)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	if subnet.ID == nil {
+		subnet.ID = &r.URL.Path
+	}
+	if subnet.Name == nil {
+		subnet.Name = &name
+	}
+	writeJSON(w, http.StatusOK, subnet)
+}
+
+func armError(code string, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	}
+}
+
+func writeBackendError(w http.ResponseWriter, err error) {
+	if az.IsNotFound(err) {
+		writeJSON(w, http.StatusNotFound, armError("ResourceNotFound", err.Error()))
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, armError("BadRequest", err.Error()))
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, armError("InvalidRequestContent", err.Error()))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -27,10 +27,12 @@ func GetFieldValue(t *testing.T, i interface{}, field string) interface{} {
 		switch f.Kind() {
 		case reflect.String:
 			return f.String()
-		case reflect.Int:
+		case reflect.Int, reflect.Int64:
 			return f.Int()
 		case reflect.Bool:
 			return f.Bool()
+		case reflect.Float64:
+			return f.Float()
 		default:
 			t.Errorf("field %s has unexpected type %s ", field, f.Kind())
 			return nil